@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/auth"
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/commitlog"
+	"github.com/pyr33x/goqtt/internal/discovery"
+	"github.com/pyr33x/goqtt/internal/lastvalue"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/transport"
+)
+
+// Server exposes broker introspection and management over HTTP
+type Server struct {
+	addr   string
+	server *transport.TCPServer
+	broker *broker.Broker
+	db     *sql.DB
+	auth   *auth.Store
+	disc   *discovery.Registry // nil when discovery is disabled
+	values *lastvalue.Cache    // nil when the last-value cache is disabled
+	log    *commitlog.Log      // nil when the commit log is disabled
+	http   *http.Server
+	stopCh chan struct{} // Closed on Stop to end open streams
+	logger *logger.Logger
+}
+
+// New creates a new admin API server bound to addr
+func New(addr string, srv *transport.TCPServer, db *sql.DB) *Server {
+	s := &Server{
+		addr:   addr,
+		server: srv,
+		broker: srv.Broker(),
+		db:     db,
+		auth:   auth.NewStore(db),
+		stopCh: make(chan struct{}),
+		logger: logger.NewMQTTLogger("admin"),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics", s.handleTopics)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /settings", s.handleGetSettings)
+	mux.HandleFunc("PATCH /settings", s.authenticated(s.handlePatchSettings))
+	mux.HandleFunc("GET /clients", s.authenticated(s.handleListClients))
+	mux.HandleFunc("GET /subscriptions", s.authenticated(s.handleListSubscriptions))
+	mux.HandleFunc("DELETE /sessions/{id}", s.authenticated(s.handleExpireSession))
+	mux.HandleFunc("DELETE /sessions/{id}/inflight", s.authenticated(s.handleDropInflight))
+	mux.HandleFunc("DELETE /sessions/{id}/queue", s.authenticated(s.handleClearQueue))
+	mux.HandleFunc("GET /stream", s.handleStream)
+	mux.HandleFunc("GET /discovery", s.authenticated(s.handleDiscovery))
+	mux.HandleFunc("GET /values", s.handleListValues)
+	mux.HandleFunc("GET /values/{topic...}", s.handleGetValue)
+	mux.HandleFunc("GET /replay", s.authenticated(s.handleReplay))
+
+	s.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Start begins serving the admin API
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.LogError(err, "admin server error")
+		}
+	}()
+	return nil
+}
+
+// Stop shuts down the admin API, ending open streams and waiting for
+// in-flight requests
+func (s *Server) Stop(ctx context.Context) error {
+	close(s.stopCh)
+	return s.http.Shutdown(ctx)
+}
+
+// authenticated wraps a handler that lists clients or changes broker state
+// so it requires the same credentials as the streaming endpoints
+func (s *Server) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.authenticate(w, r); !ok {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleTopics renders the live topic tree
+func (s *Server) handleTopics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.broker.TopicTree())
+}
+
+// writeError responds with a JSON error body
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Failed to encode admin response", logger.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,23 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pyr33x/goqtt/internal/discovery"
+)
+
+// SetDiscovery enables the discovered entities view
+func (s *Server) SetDiscovery(reg *discovery.Registry) {
+	s.disc = reg
+}
+
+// handleDiscovery lists the Home Assistant entities announced under the
+// discovery prefix
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if s.disc == nil {
+		writeError(w, http.StatusNotFound, errors.New("discovery is not enabled"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.disc.Entities())
+}
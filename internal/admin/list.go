@@ -0,0 +1,247 @@
+package admin
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is the envelope returned by listing endpoints
+type page[T any] struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Items  []T `json:"items"`
+}
+
+// listParams holds the pagination and sorting options shared by listing endpoints
+type listParams struct {
+	offset int
+	limit  int
+	sort   string
+	desc   bool
+}
+
+// parseListParams reads offset, limit, sort and order from the query string
+func parseListParams(q url.Values, sortKeys ...string) (listParams, error) {
+	p := listParams{limit: defaultPageLimit, sort: sortKeys[0]}
+
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("offset must be a non-negative integer")
+		}
+		p.offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		p.limit = n
+	}
+	if v := q.Get("sort"); v != "" {
+		if !slices.Contains(sortKeys, v) {
+			return p, fmt.Errorf("sort must be one of %s", strings.Join(sortKeys, ", "))
+		}
+		p.sort = v
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		p.desc = true
+	default:
+		return p, fmt.Errorf("order must be asc or desc")
+	}
+
+	return p, nil
+}
+
+// paginate sorts items with cmpFn (honoring the requested order) and slices out the requested page
+func paginate[T any](items []T, p listParams, cmpFn func(a, b T) int) page[T] {
+	slices.SortStableFunc(items, func(a, b T) int {
+		if p.desc {
+			return cmpFn(b, a)
+		}
+		return cmpFn(a, b)
+	})
+
+	total := len(items)
+	start := min(p.offset, total)
+	end := min(start+p.limit, total)
+
+	return page[T]{
+		Total:  total,
+		Offset: p.offset,
+		Limit:  p.limit,
+		Items:  items[start:end],
+	}
+}
+
+// clientInfo describes a session in the /clients listing
+type clientInfo struct {
+	ClientID      string    `json:"client_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	CleanSession  bool      `json:"clean_session"`
+	KeepAlive     uint16    `json:"keep_alive"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Inflight      int       `json:"inflight"`
+	Subscriptions int       `json:"subscriptions"`
+}
+
+// handleListClients lists sessions, filtered by ?prefix, ?ip, ?connected_after,
+// ?connected_before (RFC 3339) and ?min_inflight
+func (s *Server) handleListClients(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params, err := parseListParams(q, "client_id", "connected_at", "inflight")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	prefix := q.Get("prefix")
+	ip := q.Get("ip")
+	after, err := parseTimeParam(q, "connected_after")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	before, err := parseTimeParam(q, "connected_before")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	minInflight := 0
+	if v := q.Get("min_inflight"); v != "" {
+		if minInflight, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("min_inflight must be an integer"))
+			return
+		}
+	}
+
+	subscriptionCounts := make(map[string]int)
+	for _, sub := range s.broker.GetAllSubscriptions() {
+		subscriptionCounts[sub.ClientID]++
+	}
+
+	clients := make([]clientInfo, 0)
+	for _, session := range s.broker.Sessions() {
+		if !strings.HasPrefix(session.ClientID, prefix) {
+			continue
+		}
+
+		remoteAddr := ""
+		if session.Conn != nil {
+			remoteAddr = session.Conn.RemoteAddr().String()
+		}
+		if ip != "" && hostOf(remoteAddr) != ip {
+			continue
+		}
+
+		connectedAt := time.Unix(session.ConnectionTimestamp, 0).UTC()
+		if !after.IsZero() && connectedAt.Before(after) {
+			continue
+		}
+		if !before.IsZero() && connectedAt.After(before) {
+			continue
+		}
+
+		inflight := s.broker.GetInflightCount(session.ClientID)
+		if inflight < minInflight {
+			continue
+		}
+
+		clients = append(clients, clientInfo{
+			ClientID:      session.ClientID,
+			RemoteAddr:    remoteAddr,
+			CleanSession:  session.CleanSession,
+			KeepAlive:     session.KeepAlive,
+			ConnectedAt:   connectedAt,
+			Inflight:      inflight,
+			Subscriptions: subscriptionCounts[session.ClientID],
+		})
+	}
+
+	writeJSON(w, http.StatusOK, paginate(clients, params, func(a, b clientInfo) int {
+		switch params.sort {
+		case "connected_at":
+			return cmp.Or(a.ConnectedAt.Compare(b.ConnectedAt), cmp.Compare(a.ClientID, b.ClientID))
+		case "inflight":
+			return cmp.Or(cmp.Compare(a.Inflight, b.Inflight), cmp.Compare(a.ClientID, b.ClientID))
+		default:
+			return cmp.Compare(a.ClientID, b.ClientID)
+		}
+	}))
+}
+
+// subscriptionInfo describes an entry in the /subscriptions listing
+type subscriptionInfo struct {
+	ClientID    string `json:"client_id"`
+	TopicFilter string `json:"topic_filter"`
+	QoS         int    `json:"qos"`
+}
+
+// handleListSubscriptions lists subscriptions, filtered by ?prefix (client ID) and ?topic_prefix
+func (s *Server) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params, err := parseListParams(q, "client_id", "topic_filter")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	prefix := q.Get("prefix")
+	topicPrefix := q.Get("topic_prefix")
+
+	subscriptions := make([]subscriptionInfo, 0)
+	for _, sub := range s.broker.GetAllSubscriptions() {
+		if !strings.HasPrefix(sub.ClientID, prefix) || !strings.HasPrefix(sub.TopicFilter, topicPrefix) {
+			continue
+		}
+		subscriptions = append(subscriptions, subscriptionInfo{
+			ClientID:    sub.ClientID,
+			TopicFilter: sub.TopicFilter,
+			QoS:         int(sub.QoS),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, paginate(subscriptions, params, func(a, b subscriptionInfo) int {
+		if params.sort == "topic_filter" {
+			return cmp.Or(cmp.Compare(a.TopicFilter, b.TopicFilter), cmp.Compare(a.ClientID, b.ClientID))
+		}
+		return cmp.Or(cmp.Compare(a.ClientID, b.ClientID), cmp.Compare(a.TopicFilter, b.TopicFilter))
+	}))
+}
+
+// parseTimeParam parses an optional RFC 3339 timestamp from the query string
+func parseTimeParam(q url.Values, key string) (time.Time, error) {
+	v := q.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", key)
+	}
+	return t, nil
+}
+
+// hostOf strips the port from a remote address
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
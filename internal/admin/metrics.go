@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/lastvalue"
+)
+
+// Metrics is a snapshot of broker counters and resource usage
+type Metrics struct {
+	Connections int                  `json:"connections"`
+	Disconnects map[string]uint64    `json:"disconnects"` // Closed connections by reason
+	Retained    broker.RetainedStats `json:"retained"`
+	QoS         broker.QoSStats      `json:"qos"`
+	Offline     broker.OfflineStats  `json:"offline"`
+	Inflight    broker.InflightStats `json:"inflight"`
+	Load        broker.LoadStats     `json:"load"`
+	Rate        broker.RateStats     `json:"rate"`
+	LastValue   *lastvalue.Stats     `json:"last_value,omitempty"` // Set when the last-value cache is enabled
+}
+
+// handleMetrics reports current broker metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := Metrics{
+		Connections: s.server.CurrentConnections(),
+		Disconnects: s.server.DisconnectStats(),
+		Retained:    s.broker.RetainedStats(),
+		QoS:         s.broker.QoSStats(),
+		Offline:     s.broker.OfflineStats(),
+		Inflight:    s.broker.InflightStats(),
+		Load:        s.broker.LoadStats(),
+		Rate:        s.broker.RateStats(),
+	}
+	if s.values != nil {
+		stats := s.values.Stats()
+		metrics.LastValue = &stats
+	}
+	writeJSON(w, http.StatusOK, metrics)
+}
@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/commitlog"
+)
+
+// logRecordView is the JSON form of a logged message
+type logRecordView struct {
+	Offset uint64    `json:"offset"`
+	Time   time.Time `json:"time"`
+	streamEvent
+}
+
+// logPage is one page of a replay. Next is the offset to ask for to carry
+// on from where the page ends.
+type logPage struct {
+	First   uint64          `json:"first"` // Oldest offset still kept
+	Next    uint64          `json:"next"`
+	Records []logRecordView `json:"records"`
+}
+
+// SetCommitLog enables the replay endpoint
+func (s *Server) SetCommitLog(log *commitlog.Log) {
+	s.log = log
+}
+
+// handleReplay returns logged messages on topics matching the filter query
+// parameter, oldest first, from the offset or since (RFC 3339) parameter on,
+// so a consumer can catch up after an outage. The filter must be one MQTT
+// clients may subscribe to.
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if s.log == nil {
+		writeError(w, http.StatusNotFound, errors.New("commit log is not enabled"))
+		return
+	}
+
+	q := r.URL.Query()
+	filter := q.Get("filter")
+	if filter == "" {
+		writeError(w, http.StatusBadRequest, errors.New("filter query parameter is required"))
+		return
+	}
+	if !s.readable(w, filter) {
+		return
+	}
+	limit := defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxPageLimit))
+			return
+		}
+		limit = n
+	}
+
+	first, next := s.log.Offsets()
+	var offset uint64
+	switch {
+	case q.Has("offset") && q.Has("since"):
+		writeError(w, http.StatusBadRequest, errors.New("give either offset or since, not both"))
+		return
+	case q.Has("offset"):
+		n, err := strconv.ParseUint(q.Get("offset"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("offset must be a non-negative integer"))
+			return
+		}
+		offset = n
+	case q.Has("since"):
+		since, err := time.Parse(time.RFC3339Nano, q.Get("since"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("since must be an RFC 3339 timestamp"))
+			return
+		}
+		if offset, err = s.log.OffsetAt(since); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		offset = first
+	}
+
+	page := logPage{First: first, Next: max(offset, first), Records: []logRecordView{}}
+	err := s.log.Replay(filter, offset, func(rec commitlog.Record) bool {
+		if len(page.Records) == limit {
+			return false
+		}
+		page.Next = rec.Offset + 1
+		// A broad filter can match topics under a denied prefix
+		if s.broker.CheckSubscribe(rec.Topic) != nil {
+			return true
+		}
+		page.Records = append(page.Records, logRecordView{
+			Offset:      rec.Offset,
+			Time:        rec.Time,
+			streamEvent: newStreamEvent(broker.NewMessage(rec.Topic, rec.Payload, false)),
+		})
+		return true
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(page.Records) < limit {
+		// Nothing more matched up to the end of the log
+		page.Next = max(page.Next, next)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
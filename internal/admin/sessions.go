@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleExpireSession discards a client's session and all state attached to it
+func (s *Server) handleExpireSession(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	if !s.broker.ExpireSession(clientID) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %q not found", clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"client_id": clientID, "expired": true})
+}
+
+// handleDropInflight discards a client's in-flight QoS 1/2 messages
+func (s *Server) handleDropInflight(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	dropped, ok := s.broker.DropInflight(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %q not found", clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"client_id": clientID, "dropped": dropped})
+}
+
+// handleClearQueue discards the messages queued for a disconnected client
+func (s *Server) handleClearQueue(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	discarded, ok := s.broker.ClearOfflineQueue(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %q not found", clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"client_id": clientID, "discarded": discarded})
+}
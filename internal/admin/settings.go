@@ -0,0 +1,260 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/transport"
+)
+
+// Settings holds the limits that can be tuned at runtime.
+// Nil fields are left unchanged when applying an update. The offline queue
+// and in-flight window can be resized but not turned on or off, and are
+// omitted while they are disabled in the config.
+type Settings struct {
+	MaxConnections    *int     `json:"max_connections,omitempty"`
+	LogLevel          *string  `json:"log_level,omitempty"`
+	OfflineQueue      *int     `json:"offline_queue,omitempty"`
+	MaxInflight       *int     `json:"max_inflight,omitempty"`
+	InflightQueue     *int     `json:"inflight_queue,omitempty"`
+	RateLimitMessages *float64 `json:"rate_limit_messages,omitempty"`
+	RateLimitBytes    *int64   `json:"rate_limit_bytes,omitempty"`
+}
+
+// currentSettings reads the live values from the running server
+func currentSettings(srv *transport.TCPServer) Settings {
+	b := srv.Broker()
+	maxConns := srv.MaxConnections()
+	level := logger.GetLevel().String()
+	rate := b.ClientRate()
+	s := Settings{
+		MaxConnections:    &maxConns,
+		LogLevel:          &level,
+		RateLimitMessages: &rate.Messages,
+		RateLimitBytes:    &rate.Bytes,
+	}
+	if offline := b.OfflineStats(); offline.Limit > 0 {
+		s.OfflineQueue = &offline.Limit
+	}
+	if inflight := b.InflightStats(); inflight.Limit > 0 {
+		s.MaxInflight = &inflight.Limit
+		s.InflightQueue = &inflight.Queue
+	}
+	return s
+}
+
+// validate checks an update against the running server before any of it
+// is applied
+func (s Settings) validate(srv *transport.TCPServer) error {
+	b := srv.Broker()
+	if s.MaxConnections != nil && *s.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	if s.LogLevel != nil {
+		if _, err := logger.ParseLevel(*s.LogLevel); err != nil {
+			return err
+		}
+	}
+	if s.OfflineQueue != nil {
+		if b.OfflineStats().Limit == 0 {
+			return fmt.Errorf("offline_queue can't be changed: the offline queue is disabled in the config")
+		}
+		if *s.OfflineQueue <= 0 {
+			return fmt.Errorf("offline_queue must be positive")
+		}
+	}
+	if s.MaxInflight != nil || s.InflightQueue != nil {
+		if b.InflightStats().Limit == 0 {
+			return fmt.Errorf("max_inflight and inflight_queue can't be changed: the in-flight window is disabled in the config")
+		}
+		if s.MaxInflight != nil && *s.MaxInflight <= 0 {
+			return fmt.Errorf("max_inflight must be positive")
+		}
+		if s.InflightQueue != nil && *s.InflightQueue < 0 {
+			return fmt.Errorf("inflight_queue must not be negative")
+		}
+	}
+	if (s.RateLimitMessages != nil && *s.RateLimitMessages < 0) || (s.RateLimitBytes != nil && *s.RateLimitBytes < 0) {
+		return fmt.Errorf("rate_limit_messages and rate_limit_bytes must not be negative")
+	}
+	return nil
+}
+
+// apply pushes the non-nil fields into the running server. It only fails
+// for settings validate would have refused.
+func (s Settings) apply(srv *transport.TCPServer) error {
+	b := srv.Broker()
+	if s.MaxConnections != nil {
+		srv.SetMaxConnections(*s.MaxConnections)
+	}
+	if s.LogLevel != nil {
+		level, _ := logger.ParseLevel(*s.LogLevel)
+		logger.SetLevel(level)
+	}
+	if s.OfflineQueue != nil {
+		if err := b.SetOfflineQueue(*s.OfflineQueue); err != nil {
+			return err
+		}
+	}
+	if s.MaxInflight != nil || s.InflightQueue != nil {
+		inflight := b.InflightStats()
+		limit, queue := inflight.Limit, inflight.Queue
+		if s.MaxInflight != nil {
+			limit = *s.MaxInflight
+		}
+		if s.InflightQueue != nil {
+			queue = *s.InflightQueue
+		}
+		if err := b.SetInflightWindow(limit, queue); err != nil {
+			return err
+		}
+	}
+	if s.RateLimitMessages != nil || s.RateLimitBytes != nil {
+		rate := b.ClientRate()
+		if s.RateLimitMessages != nil {
+			rate.Messages = *s.RateLimitMessages
+		}
+		if s.RateLimitBytes != nil {
+			rate.Bytes = *s.RateLimitBytes
+		}
+		if err := b.SetClientRate(rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persist stores the non-nil fields so they survive a restart
+func (s Settings) persist(db *sql.DB) error {
+	values := make(map[string]string)
+	if s.MaxConnections != nil {
+		values["max_connections"] = strconv.Itoa(*s.MaxConnections)
+	}
+	if s.LogLevel != nil {
+		values["log_level"] = *s.LogLevel
+	}
+	if s.OfflineQueue != nil {
+		values["offline_queue"] = strconv.Itoa(*s.OfflineQueue)
+	}
+	if s.MaxInflight != nil {
+		values["max_inflight"] = strconv.Itoa(*s.MaxInflight)
+	}
+	if s.InflightQueue != nil {
+		values["inflight_queue"] = strconv.Itoa(*s.InflightQueue)
+	}
+	if s.RateLimitMessages != nil {
+		values["rate_limit_messages"] = strconv.FormatFloat(*s.RateLimitMessages, 'g', -1, 64)
+	}
+	if s.RateLimitBytes != nil {
+		values["rate_limit_bytes"] = strconv.FormatInt(*s.RateLimitBytes, 10)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		if _, err := tx.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadPersistedSettings applies settings saved through the admin API on top of the config file values
+func LoadPersistedSettings(db *sql.DB, srv *transport.TCPServer) error {
+	rows, err := db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var s Settings
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		switch key {
+		case "max_connections", "offline_queue", "max_inflight", "inflight_queue":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid persisted %s %q: %w", key, value, err)
+			}
+			switch key {
+			case "max_connections":
+				s.MaxConnections = &n
+			case "offline_queue":
+				s.OfflineQueue = &n
+			case "max_inflight":
+				s.MaxInflight = &n
+			case "inflight_queue":
+				s.InflightQueue = &n
+			}
+		case "rate_limit_messages":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid persisted %s %q: %w", key, value, err)
+			}
+			s.RateLimitMessages = &n
+		case "rate_limit_bytes":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid persisted %s %q: %w", key, value, err)
+			}
+			s.RateLimitBytes = &n
+		case "log_level":
+			s.LogLevel = &value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := s.validate(srv); err != nil {
+		return err
+	}
+	return s.apply(srv)
+}
+
+// handleGetSettings returns the current runtime settings
+func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentSettings(s.server))
+}
+
+// handlePatchSettings applies a partial settings update, persisting it when ?persist=true
+func (s *Server) handlePatchSettings(w http.ResponseWriter, r *http.Request) {
+	var update Settings
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid settings body: %w", err))
+		return
+	}
+	if err := update.validate(s.server); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := update.apply(s.server); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	current := currentSettings(s.server)
+	s.logger.Info("Runtime settings updated",
+		logger.Int("max_connections", *current.MaxConnections),
+		logger.String("log_level", *current.LogLevel))
+
+	if r.URL.Query().Get("persist") == "true" {
+		if err := update.persist(s.db); err != nil {
+			s.logger.LogError(err, "Failed to persist runtime settings")
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, current)
+}
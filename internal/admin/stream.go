@@ -0,0 +1,153 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// streamBuffer is how many messages a stream holds for a slow HTTP client
+// before dropping new ones
+const streamBuffer = 256
+
+// streamKeepAlive is how often an idle stream sends a comment so proxies
+// keep the connection open
+const streamKeepAlive = 15 * time.Second
+
+// streamEvent is the JSON data of one message event
+type streamEvent struct {
+	Topic         string `json:"topic"`
+	Retain        bool   `json:"retain"`
+	Size          int    `json:"size"`
+	Payload       string `json:"payload,omitempty"`        // Set when the payload is valid UTF-8
+	PayloadBase64 []byte `json:"payload_base64,omitempty"` // Set for binary payloads
+	Spilled       bool   `json:"spilled,omitempty"`        // Payload kept on disk and left out of the event
+}
+
+func newStreamEvent(msg *broker.Message) streamEvent {
+	event := streamEvent{Topic: msg.Topic, Retain: msg.Retain, Size: msg.Size()}
+	switch {
+	case msg.Spilled():
+		event.Spilled = true
+	case utf8.Valid(msg.Payload):
+		event.Payload = string(msg.Payload)
+	default:
+		event.PayloadBase64 = msg.Payload
+	}
+	return event
+}
+
+// authenticate checks the request's basic auth credentials against the
+// MQTT user store, responding with 401 when they're missing or wrong
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (username string, ok bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok || s.auth.Authenticate(username, password) != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goqtt"`)
+		writeError(w, http.StatusUnauthorized, errors.New("valid credentials are required"))
+		return "", false
+	}
+	return username, true
+}
+
+// readable reports whether an MQTT client could subscribe to filter, so the
+// API shows no messages a subscription would not. Otherwise it responds with
+// 400 for an invalid filter or 403 for one the broker refuses.
+func (s *Server) readable(w http.ResponseWriter, filter string) bool {
+	err := s.broker.CheckSubscribe(filter)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, er.ErrWildcardsNotAvailable), errors.Is(err, er.ErrFilterDenied):
+		writeError(w, http.StatusForbidden, fmt.Errorf("filter %q: %w", filter, err))
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid filter %q: %w", filter, err))
+	}
+	return false
+}
+
+// handleStream streams messages matching the filter query parameter as
+// Server-Sent Events. Callers authenticate with HTTP basic auth against the
+// MQTT user store, and the filter must be one MQTT clients may subscribe to.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		writeError(w, http.StatusBadRequest, errors.New("filter query parameter is required"))
+		return
+	}
+	if !s.readable(w, filter) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	messages := make(chan *broker.Message, streamBuffer)
+	var dropped atomic.Uint64
+	cancel, err := s.broker.Tap(filter, func(msg *broker.Message) {
+		select {
+		case messages <- msg:
+		default:
+			dropped.Add(1)
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid filter %q: %w", filter, err))
+		return
+	}
+	defer cancel()
+
+	s.logger.Info("Stream opened", logger.String("username", username), logger.String("topic_filter", filter))
+	defer func() {
+		s.logger.Info("Stream closed", logger.String("username", username),
+			logger.String("topic_filter", filter), logger.Int("dropped", int(dropped.Load())))
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case msg := <-messages:
+			// Encode ends the data line with the newline SSE expects
+			if _, err := fmt.Fprint(w, "event: message\ndata: "); err != nil {
+				return
+			}
+			if err := enc.Encode(newStreamEvent(msg)); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, "\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
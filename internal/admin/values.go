@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/lastvalue"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// valueView is the JSON form of a cached last value
+type valueView struct {
+	streamEvent
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetLastValues enables the last-value cache endpoints
+func (s *Server) SetLastValues(cache *lastvalue.Cache) {
+	s.values = cache
+}
+
+// handleListValues returns the latest message on every cached topic
+// matching the filter query parameter, which defaults to #. Topics MQTT
+// clients may not subscribe to are left out.
+func (s *Server) handleListValues(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+	if s.values == nil {
+		writeError(w, http.StatusNotFound, errors.New("last-value cache is not enabled"))
+		return
+	}
+
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	if !s.readable(w, filter) {
+		return
+	}
+
+	entries := s.values.Query(filter)
+	views := make([]valueView, 0, len(entries))
+	for _, entry := range entries {
+		// A filter can match topics under a denied prefix, such as # does
+		if s.broker.CheckSubscribe(entry.Message.Topic) != nil {
+			continue
+		}
+		views = append(views, newValueView(entry))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleGetValue returns the latest message on one topic, if MQTT clients
+// may subscribe to it
+func (s *Server) handleGetValue(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+	if s.values == nil {
+		writeError(w, http.StatusNotFound, errors.New("last-value cache is not enabled"))
+		return
+	}
+
+	topic := r.PathValue("topic")
+	if err := utils.ValidateTopicName(topic); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid topic %q: %w", topic, err))
+		return
+	}
+	if !s.readable(w, topic) {
+		return
+	}
+	entry, ok := s.values.Get(topic)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no value cached for %q", topic))
+		return
+	}
+	writeJSON(w, http.StatusOK, newValueView(entry))
+}
+
+func newValueView(entry lastvalue.Entry) valueView {
+	return valueView{streamEvent: newStreamEvent(entry.Message), UpdatedAt: entry.UpdatedAt}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/x509"
 	"database/sql"
 	"errors"
 
@@ -39,3 +40,18 @@ func (s *Store) Authenticate(username, password string) error {
 
 	return nil
 }
+
+// AuthenticateCertificate authenticates a client by a certificate the TLS
+// listener has already verified against its client CA, and returns the
+// username it stands for: the certificate's subject common name. A
+// username sent in CONNECT must match it.
+func (s *Store) AuthenticateCertificate(cert *x509.Certificate, username string) (string, error) {
+	identity := cert.Subject.CommonName
+	if identity == "" || (username != "" && username != identity) {
+		return "", &er.Err{
+			Context: "Auth, Certificate",
+			Message: er.ErrCertificateMismatch,
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,343 @@
+// Package bridge connects goqtt to an upstream MQTT broker as a client,
+// forwarding messages between them according to topic mappings, so goqtt
+// can run as an edge broker feeding a central one.
+package bridge
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// Defaults used for zero Options fields
+const (
+	DefaultKeepAlive         = 60 * time.Second
+	DefaultReconnectDelay    = time.Second
+	DefaultMaxReconnectDelay = time.Minute
+	DefaultQueue             = 1000
+)
+
+// dialTimeout bounds connecting to the upstream and waiting for its CONNACK
+const dialTimeout = 10 * time.Second
+
+// maxInflight caps outbound QoS 1/2 messages awaiting acknowledgement
+const maxInflight = 32
+
+// Direction is which way a topic mapping forwards messages
+type Direction int
+
+const (
+	// In forwards messages from the upstream broker to local subscribers
+	In Direction = iota
+	// Out forwards local messages to the upstream broker
+	Out
+	// Both forwards messages either way
+	Both
+)
+
+// Topic maps topics between the brokers. Filter is matched under
+// LocalPrefix locally and under RemotePrefix upstream, and a forwarded
+// message has one prefix swapped for the other.
+type Topic struct {
+	Filter       string
+	Direction    Direction
+	QoS          packet.QoSLevel // Subscribed upstream at for In, published upstream at for Out
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+func (t Topic) in() bool  { return t.Direction == In || t.Direction == Both }
+func (t Topic) out() bool { return t.Direction == Out || t.Direction == Both }
+
+// Options configures a Bridge
+type Options struct {
+	Name              string // Identifies the bridge in logs and as the local publisher
+	Address           string // host:port of the upstream broker
+	ClientID          string // Empty uses goqtt-bridge-<Name>
+	Username          string // Sent, with Password, when not empty
+	Password          string
+	TLS               *tls.Config // nil connects over plain TCP
+	CleanSession      bool
+	KeepAlive         time.Duration
+	ReconnectDelay    time.Duration // First delay before reconnecting; doubled after each failed attempt
+	MaxReconnectDelay time.Duration
+	Queue             int    // Outbound messages buffered while the upstream is unreachable; the newest are dropped beyond it
+	SpoolDir          string // Directory of the on-disk spool
+	SpoolBytes        int64  // Spools outbound messages on disk up to this size instead of queueing them in memory; 0 disables
+	SpoolPolicy       string // DropOldest or DropNewest once the spool is full; empty is DropOldest
+	Compression       string // "deflate" compresses outbound payloads once the upstream advertises it; empty never does
+	CompressMin       int    // Smaller payloads are sent uncompressed
+	Preset            string // Managed broker whose requirements to follow, such as PresetAWSIoT; empty is none
+	BrokerID          string // Added to the route of forwarded messages; empty forwards routes as they are
+	MaxHops           int    // Messages that crossed more bridges are not forwarded; 0 uses DefaultMaxHops
+	Topics            []Topic
+}
+
+// Bridge keeps a client connection to an upstream broker, reconnecting
+// whenever it is lost
+type Bridge struct {
+	opts    Options
+	preset  *preset // nil without Options.Preset
+	broker  *broker.Broker
+	origin  string // Origin of messages the bridge publishes locally
+	out     chan outbound
+	spool   *spool // Replaces out when Options.SpoolBytes is set
+	cancels []func()
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64 // Outbound messages dropped on a full queue
+	logger  *logger.Logger
+
+	// Outbound QoS 1/2 state, resent when the connection is re-established
+	mu      sync.Mutex
+	pending map[uint16]*pendingOut
+	nextID  uint16
+
+	// Inbound QoS 2 messages awaiting PUBREL; only touched by the reader
+	received map[uint16]*broker.Message
+
+	// Set from the upstream's FeaturesTopic; unset until it is received
+	deflate  atomic.Bool
+	routed   atomic.Bool
+	upstream atomic.Pointer[string] // Broker ID
+	// Compression state, only touched by the session goroutine
+	zw   *flate.Writer
+	zbuf bytes.Buffer
+}
+
+// outbound is a local message waiting to be forwarded
+type outbound struct {
+	topic string
+	msg   *broker.Message
+	qos   packet.QoSLevel
+	pos   *spoolPos // Where the message is spooled, if it is
+}
+
+// pendingOut is an outbound message awaiting PUBACK, PUBREC or PUBCOMP
+type pendingOut struct {
+	frame    []byte // PUBLISH frame, without DUP
+	released bool   // PUBREC received; PUBREL sent, waiting for PUBCOMP
+	pos      *spoolPos
+}
+
+// New creates a bridge between b and the upstream broker in opts
+func New(b *broker.Broker, opts Options) *Bridge {
+	if opts.ClientID == "" {
+		opts.ClientID = "goqtt-bridge-" + opts.Name
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+	if opts.MaxReconnectDelay < opts.ReconnectDelay {
+		opts.MaxReconnectDelay = max(DefaultMaxReconnectDelay, opts.ReconnectDelay)
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultQueue
+	}
+	if opts.MaxHops <= 0 {
+		opts.MaxHops = DefaultMaxHops
+	}
+	p := applyPreset(&opts)
+	return &Bridge{
+		opts:     opts,
+		preset:   p,
+		broker:   b,
+		origin:   "$bridge/" + opts.Name,
+		out:      make(chan outbound, opts.Queue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		pending:  make(map[uint16]*pendingOut),
+		received: make(map[uint16]*broker.Message),
+		logger:   logger.NewMQTTLogger("bridge"),
+	}
+}
+
+// Start follows the outbound topics on the local broker and connects to the
+// upstream in the background. A spooled bridge first resumes sending what
+// it had not sent before the last Stop.
+func (br *Bridge) Start() error {
+	if br.opts.SpoolBytes > 0 {
+		s, err := openSpool(br.opts.SpoolDir, br.opts.SpoolBytes, br.opts.SpoolPolicy, br.opts.Name)
+		if err != nil {
+			return err
+		}
+		br.spool = s
+	}
+	for _, topic := range br.opts.Topics {
+		if !topic.out() {
+			continue
+		}
+		cancel, err := br.broker.Tap(topic.LocalPrefix+topic.Filter, func(msg *broker.Message) {
+			br.forward(topic, msg)
+		})
+		if err != nil {
+			br.untap()
+			if br.spool != nil {
+				_ = br.spool.close(br.spool.position())
+			}
+			return err
+		}
+		br.cancels = append(br.cancels, cancel)
+	}
+	go br.run()
+	return nil
+}
+
+// Stop disconnects from the upstream and stops forwarding. Messages still
+// queued are dropped, unless they are spooled, which keeps them for the
+// next Start.
+func (br *Bridge) Stop() {
+	br.once.Do(func() {
+		br.untap()
+		close(br.stop)
+		<-br.done
+		if br.spool != nil {
+			if err := br.spool.close(br.checkpoint()); err != nil {
+				br.logger.LogError(err, "Failed to close bridge spool", logger.String("bridge", br.opts.Name))
+			}
+		}
+	})
+	<-br.done
+}
+
+func (br *Bridge) untap() {
+	for _, cancel := range br.cancels {
+		cancel()
+	}
+	br.cancels = nil
+}
+
+// forward queues a local message for the upstream. It runs on the
+// delivering goroutine, so a full queue drops the message instead of
+// blocking the publisher.
+func (br *Bridge) forward(topic Topic, msg *broker.Message) {
+	if msg.Origin == br.origin {
+		return // Came from the upstream; sending it back would loop
+	}
+	remote := br.remoteTopic(topic, msg.Topic)
+	if br.spool != nil {
+		queued, err := br.spool.append(remote, msg, topic.QoS)
+		if err != nil {
+			br.logger.LogError(err, "Failed to spool outbound message",
+				logger.String("bridge", br.opts.Name),
+				logger.String("topic", msg.Topic))
+		}
+		if queued || err != nil {
+			return
+		}
+	} else {
+		select {
+		case br.out <- outbound{topic: remote, msg: msg, qos: topic.QoS}:
+			return
+		default:
+		}
+	}
+	if br.dropped.Add(1) == 1 {
+		br.logger.Warn("Bridge queue full, dropping outbound messages",
+			logger.String("bridge", br.opts.Name))
+	}
+}
+
+// features reports whether the bridge reads the upstream's FeaturesTopic.
+// Preset brokers are never goqtt, so they are not asked.
+func (br *Bridge) features() bool {
+	return br.preset == nil && (br.opts.Compression == "deflate" || br.opts.BrokerID != "")
+}
+
+// route returns the route msg carries upstream, or false if sending it
+// would loop back to the upstream or cross more than MaxHops bridges
+func (br *Bridge) route(msg *broker.Message) ([]string, bool) {
+	route := msg.Route
+	if br.opts.BrokerID != "" {
+		route = append(slices.Clip(route), br.opts.BrokerID)
+	}
+	if len(route) > br.opts.MaxHops {
+		return nil, false
+	}
+	if id := br.upstream.Load(); id != nil && slices.Contains(route, *id) {
+		return nil, false
+	}
+	return route, true
+}
+
+// checkpoint returns the spool position sending would resume from: the
+// oldest message still awaiting acknowledgement, or the next one to read
+func (br *Bridge) checkpoint() spoolPos {
+	pos := br.spool.position()
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for _, p := range br.pending {
+		if p.pos != nil && p.pos.before(pos) {
+			pos = *p.pos
+		}
+	}
+	return pos
+}
+
+// publish routes a message received from the upstream to local subscribers
+func (br *Bridge) publish(remote string, payload []byte, qos packet.QoSLevel, retain bool) {
+	local, ok := br.localTopic(remote)
+	if !ok {
+		br.logger.Warn("Dropping upstream message matching no inbound topic",
+			logger.String("bridge", br.opts.Name),
+			logger.String("topic", remote))
+		return
+	}
+	msg := broker.NewMessage(local, payload, retain)
+	msg.Origin = br.origin
+	if id := br.upstream.Load(); id != nil {
+		msg.Route = []string{*id}
+	}
+	if err := br.broker.PublishMessage(br.origin, msg, qos); err != nil {
+		br.logger.LogError(err, "Failed to publish upstream message",
+			logger.String("bridge", br.opts.Name),
+			logger.String("topic", local))
+	}
+}
+
+// run connects to the upstream until Stop, waiting longer after each
+// failed attempt
+func (br *Bridge) run() {
+	defer close(br.done)
+
+	delay := br.opts.ReconnectDelay
+	for {
+		connected, err := br.session()
+		select {
+		case <-br.stop:
+			return
+		default:
+		}
+		message := "Bridge connection failed, retrying"
+		if connected {
+			delay = br.opts.ReconnectDelay
+			message = "Bridge disconnected, reconnecting"
+		}
+		br.logger.Warn(message,
+			logger.String("bridge", br.opts.Name),
+			logger.String("address", br.opts.Address),
+			logger.String("error", err.Error()),
+			logger.String("retry_in", delay.String()))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-br.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay = min(delay*2, br.opts.MaxReconnectDelay)
+	}
+}
@@ -0,0 +1,556 @@
+package bridge
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// conn is one connection to the upstream broker
+type conn struct {
+	net.Conn
+	br     *Bridge
+	reader *bufio.Reader
+	wmu    sync.Mutex
+	acked  chan struct{} // Signalled when an outbound message completes
+}
+
+// session connects to the upstream and forwards messages until the
+// connection fails or the bridge stops. It reports whether the upstream
+// accepted the connection.
+func (br *Bridge) session() (bool, error) {
+	c, err := br.dial()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	br.logger.Info("Bridge connected",
+		logger.String("bridge", br.opts.Name),
+		logger.String("address", br.opts.Address))
+	if dropped := br.dropped.Swap(0); dropped > 0 {
+		br.logger.Warn("Bridge dropped outbound messages on a full queue",
+			logger.String("bridge", br.opts.Name),
+			logger.Int("dropped", int(dropped)))
+	}
+
+	if br.opts.CleanSession {
+		clear(br.received) // The upstream discarded them and won't send PUBREL
+	}
+	// Until this upstream advertises them
+	br.deflate.Store(false)
+	br.routed.Store(false)
+	br.upstream.Store(nil)
+
+	if err := c.subscribe(); err != nil {
+		return true, err
+	}
+	if err := c.resend(); err != nil {
+		return true, err
+	}
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- c.readLoop() }()
+
+	var ready chan struct{}
+	if br.spool != nil {
+		defer br.commit()
+		ready = br.spool.ready
+		if err := c.drain(); err != nil {
+			return true, err
+		}
+	}
+
+	ping := time.NewTicker(br.opts.KeepAlive / 2)
+	defer ping.Stop()
+	for {
+		// Stop taking new messages while the in-flight window is full
+		out := br.out
+		if br.spool != nil || br.inflight() >= maxInflight {
+			out = nil
+		}
+		select {
+		case <-br.stop:
+			_ = c.write([]byte{byte(packet.DISCONNECT), 0})
+			return true, nil
+		case err := <-readErr:
+			return true, err
+		case <-c.acked:
+			if err := c.drain(); err != nil {
+				return true, err
+			}
+		case <-ready:
+			if err := c.drain(); err != nil {
+				return true, err
+			}
+		case <-ping.C:
+			if err := c.write([]byte{byte(packet.PINGREQ), 0}); err != nil {
+				return true, err
+			}
+			br.commit()
+		case next := <-out:
+			if err := c.publish(next); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// drainBatch bounds how many spooled messages drain sends before going back
+// to the session loop, so a backlog of QoS 0 messages does not hold up pings
+// or Stop
+const drainBatch = 256
+
+// drain sends spooled messages while the in-flight window has room
+func (c *conn) drain() error {
+	if c.br.spool == nil {
+		return nil
+	}
+	for range drainBatch {
+		if c.br.inflight() >= maxInflight {
+			return nil // Resumed by the next acknowledgement
+		}
+		next, pos, ok := c.br.spool.next()
+		if !ok {
+			return nil
+		}
+		next.pos = &pos
+		if err := c.publish(next); err != nil {
+			return err
+		}
+	}
+	// Come back for the rest
+	select {
+	case c.br.spool.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// commit saves the spool position sending resumes from after a restart
+func (br *Bridge) commit() {
+	if err := br.spool.commit(br.checkpoint()); err != nil {
+		br.logger.LogError(err, "Failed to commit bridge spool position", logger.String("bridge", br.opts.Name))
+	}
+}
+
+// dial opens the connection and completes the CONNECT handshake
+func (br *Bridge) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	var err error
+	if br.opts.TLS != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", br.opts.Address, br.opts.TLS)
+	} else {
+		nc, err = dialer.Dial("tcp", br.opts.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{
+		Conn:   nc,
+		br:     br,
+		reader: bufio.NewReader(nc),
+		acked:  make(chan struct{}, 1),
+	}
+	_ = c.SetDeadline(time.Now().Add(dialTimeout))
+	if err := c.write(br.connectFrame()); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	raw, err := c.readPacket()
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("waiting for CONNACK: %w", err)
+	}
+	if packet.PacketType(raw[0]&0xF0) != packet.CONNACK || len(raw) != 4 {
+		_ = c.Close()
+		return nil, &er.Err{Context: "Bridge, Connect", Message: er.ErrBridgeProtocol}
+	}
+	if code := raw[3]; code != packet.ConnectionAccepted {
+		_ = c.Close()
+		return nil, &er.Err{
+			Context: "Bridge, Connect",
+			Message: fmt.Errorf("%w: return code %#x", er.ErrBridgeRefused, code),
+		}
+	}
+	_ = c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// subscribe subscribes to the inbound topics upstream
+func (c *conn) subscribe() error {
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, c.br.packetID())
+	filters := c.br.filters()
+	for filter, qos := range filters {
+		body = appendString(body, filter)
+		body = append(body, byte(qos))
+	}
+	if c.br.features() {
+		body = appendString(body, FeaturesTopic)
+		body = append(body, byte(packet.QoSAtMostOnce))
+		filters[FeaturesTopic] = packet.QoSAtMostOnce
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return c.write(appendFrame(nil, byte(packet.SUBSCRIBE)|0x02, body))
+}
+
+// resend retransmits the outbound messages left unacknowledged by the
+// previous connection, in packet ID order
+func (c *conn) resend() error {
+	c.br.mu.Lock()
+	ids := make([]uint16, 0, len(c.br.pending))
+	for id := range c.br.pending {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	frames := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		p := c.br.pending[id]
+		if p.released {
+			frames = append(frames, (&packet.PubrelPacket{PacketID: id}).Encode())
+			continue
+		}
+		frame := slices.Clone(p.frame)
+		frame[0] |= 0x08 // DUP
+		frames = append(frames, frame)
+	}
+	c.br.mu.Unlock()
+
+	for _, frame := range frames {
+		if err := c.write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish sends a queued local message upstream
+func (c *conn) publish(next outbound) error {
+	payload := next.msg.Payload
+	if next.msg.Spilled() {
+		var err error
+		if payload, err = io.ReadAll(next.msg.PayloadReader()); err != nil {
+			c.br.logger.LogError(err, "Failed to read spilled message",
+				logger.String("bridge", c.br.opts.Name),
+				logger.String("topic", next.msg.Topic))
+			return nil
+		}
+	}
+
+	route, ok := c.br.route(next.msg)
+	if !ok {
+		c.br.logger.Debug("Not forwarding message that would loop",
+			logger.String("bridge", c.br.opts.Name),
+			logger.String("topic", next.msg.Topic))
+		return nil
+	}
+	topic := next.topic
+	if wrapped, ok := c.br.envelope(route, payload); ok {
+		topic, payload = EnvelopePrefix+topic, wrapped
+	}
+
+	pp := &packet.PublishPacket{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     next.qos,
+		Retain:  next.msg.Retain && (c.br.preset == nil || c.br.preset.retain),
+	}
+	if next.qos > packet.QoSAtMostOnce {
+		id := c.br.packetID()
+		pp.PacketID = &id
+		frame := pp.Encode()
+		c.br.mu.Lock()
+		c.br.pending[id] = &pendingOut{frame: frame, pos: next.pos}
+		c.br.mu.Unlock()
+		return c.write(frame)
+	}
+	return c.write(pp.Encode())
+}
+
+// readLoop handles packets from the upstream until the connection fails.
+// Silence longer than the keep alive means the upstream is gone.
+func (c *conn) readLoop() error {
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(c.br.opts.KeepAlive * 3 / 2))
+		raw, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if err := c.handle(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes one packet from the upstream
+func (c *conn) handle(raw []byte) error {
+	switch packet.PacketType(raw[0] & 0xF0) {
+	case packet.PUBLISH:
+		var pp packet.PublishPacket
+		if err := pp.Parse(raw); err != nil {
+			return err
+		}
+		return c.receive(&pp)
+
+	case packet.PUBACK:
+		var ack packet.PubackPacket
+		if err := ack.Parse(raw); err != nil {
+			return err
+		}
+		c.complete(ack.PacketID)
+
+	case packet.PUBREC:
+		var rec packet.PubrecPacket
+		if err := rec.Parse(raw); err != nil {
+			return err
+		}
+		c.br.mu.Lock()
+		if p, ok := c.br.pending[rec.PacketID]; ok {
+			p.released = true
+			p.frame = nil
+		}
+		c.br.mu.Unlock()
+		return c.write((&packet.PubrelPacket{PacketID: rec.PacketID}).Encode())
+
+	case packet.PUBREL:
+		var rel packet.PubrelPacket
+		if err := rel.Parse(raw); err != nil {
+			return err
+		}
+		if msg, ok := c.br.received[rel.PacketID]; ok {
+			delete(c.br.received, rel.PacketID)
+			c.br.publish(msg.Topic, msg.Payload, packet.QoSExactlyOnce, msg.Retain)
+		}
+		return c.write((&packet.PubcompPacket{PacketID: rel.PacketID}).Encode())
+
+	case packet.PUBCOMP:
+		var comp packet.PubcompPacket
+		if err := comp.Parse(raw); err != nil {
+			return err
+		}
+		c.complete(comp.PacketID)
+
+	case packet.SUBACK:
+		var ack packet.SubackPacket
+		if err := ack.Parse(raw); err != nil {
+			return err
+		}
+		if slices.Contains(ack.ReturnCodes, packet.SubackFailure) {
+			c.br.logger.Warn("Upstream refused a bridge subscription", logger.String("bridge", c.br.opts.Name))
+		}
+
+	case packet.PINGRESP:
+		// The read deadline has already moved on
+
+	default:
+		return &er.Err{
+			Context: "Bridge, " + packet.PacketType(raw[0]&0xF0).String(),
+			Message: er.ErrBridgeProtocol,
+		}
+	}
+	return nil
+}
+
+// receive handles a PUBLISH from the upstream. QoS 2 messages are held
+// until their PUBREL, so a resent PUBLISH is not published twice.
+func (c *conn) receive(pp *packet.PublishPacket) error {
+	if pp.Topic == FeaturesTopic && c.br.features() {
+		features := string(pp.Payload)
+		deflate := c.br.opts.Compression == "deflate" && hasFeature(features, "deflate")
+		if !c.br.deflate.Swap(deflate) && deflate {
+			c.br.logger.Info("Upstream accepts compressed messages", logger.String("bridge", c.br.opts.Name))
+		}
+		c.br.routed.Store(hasFeature(features, "route"))
+		if id, ok := featureValue(features, "id"); ok {
+			c.br.upstream.Store(&id)
+		} else {
+			c.br.upstream.Store(nil)
+		}
+		return nil // Subscribed at QoS 0
+	}
+
+	payload := slices.Clone(pp.Payload) // Parse aliases the read buffer
+	switch pp.QoS {
+	case packet.QoSAtMostOnce:
+		c.br.publish(pp.Topic, payload, pp.QoS, pp.Retain)
+	case packet.QoSAtLeastOnce:
+		c.br.publish(pp.Topic, payload, pp.QoS, pp.Retain)
+		return c.write((&packet.PubackPacket{PacketID: *pp.PacketID}).Encode())
+	case packet.QoSExactlyOnce:
+		if _, ok := c.br.received[*pp.PacketID]; !ok {
+			c.br.received[*pp.PacketID] = broker.NewMessage(pp.Topic, payload, pp.Retain)
+		}
+		return c.write((&packet.PubrecPacket{PacketID: *pp.PacketID}).Encode())
+	}
+	return nil
+}
+
+// envelope returns payload in an envelope carrying route, and deflated if
+// that makes it smaller, as far as the upstream accepts either. The result
+// is valid until the next call; false means the payload goes as it is.
+func (br *Bridge) envelope(route []string, payload []byte) ([]byte, bool) {
+	routed := len(route) > 0 && br.routed.Load()
+	deflate := br.deflate.Load() && len(payload) >= br.opts.CompressMin
+	if !routed && !deflate {
+		return nil, false
+	}
+
+	var flags byte
+	br.zbuf.Reset()
+	br.zbuf.WriteByte(0)
+	if routed {
+		flags |= flagRoute
+		br.zbuf.Write(appendRoute(nil, route))
+	}
+	header := br.zbuf.Len()
+	if deflate {
+		if br.zw == nil {
+			br.zw, _ = flate.NewWriter(&br.zbuf, flate.DefaultCompression)
+		} else {
+			br.zw.Reset(&br.zbuf)
+		}
+		_, _ = br.zw.Write(payload)
+		_ = br.zw.Close()
+		if br.zbuf.Len()-header < len(payload) {
+			flags |= flagDeflate
+		} else {
+			br.zbuf.Truncate(header)
+			deflate = false
+		}
+	}
+	if !deflate {
+		if !routed {
+			return nil, false
+		}
+		br.zbuf.Write(payload)
+	}
+	br.zbuf.Bytes()[0] = flags
+	return br.zbuf.Bytes(), true
+}
+
+// complete forgets an acknowledged outbound message and wakes the writer
+func (c *conn) complete(id uint16) {
+	c.br.mu.Lock()
+	delete(c.br.pending, id)
+	c.br.mu.Unlock()
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
+}
+
+func (c *conn) write(frame []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := c.Write(frame)
+	return err
+}
+
+// readPacket reads one whole packet, fixed header included
+func (c *conn) readPacket() ([]byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	raw := []byte{header}
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, b)
+		if b&0x80 == 0 {
+			break
+		}
+		if len(raw) == 5 {
+			return nil, &er.Err{Context: "Bridge", Message: er.ErrRemainingLengthExceeded}
+		}
+	}
+	length, _, err := utils.ParseRemainingLength(raw[1:])
+	if err != nil {
+		return nil, err
+	}
+	raw = slices.Grow(raw, length)[:len(raw)+length]
+	if _, err := io.ReadFull(c.reader, raw[len(raw)-length:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+// inflight returns the number of outbound messages awaiting acknowledgement
+func (br *Bridge) inflight() int {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	return len(br.pending)
+}
+
+// packetID returns the next packet ID not in flight, skipping 0
+func (br *Bridge) packetID() uint16 {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for {
+		br.nextID++
+		if br.nextID == 0 {
+			continue
+		}
+		if _, used := br.pending[br.nextID]; !used {
+			return br.nextID
+		}
+	}
+}
+
+// connectFrame encodes the bridge's CONNECT
+func (br *Bridge) connectFrame() []byte {
+	var flags byte
+	if br.opts.CleanSession {
+		flags |= 0x02
+	}
+	if br.opts.Username != "" {
+		flags |= 0x80 | 0x40
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4, flags) // Protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(min(br.opts.KeepAlive/time.Second, 0xFFFF)))
+	body = appendString(body, br.opts.ClientID)
+	if br.opts.Username != "" {
+		body = appendString(body, br.opts.Username)
+		body = appendString(body, br.opts.Password)
+	}
+	return appendFrame(nil, byte(packet.CONNECT), body)
+}
+
+func appendFrame(dst []byte, header byte, body []byte) []byte {
+	dst = append(dst, header)
+	dst = utils.AppendRemainingLength(dst, len(body))
+	return append(dst, body...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,182 @@
+package bridge
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Messages between goqtt brokers can travel in an envelope: the bridge
+// publishes them to EnvelopePrefix+topic with a payload of
+//
+//	flags (1) | route | body
+//
+// where body is the original payload, deflated when flagDeflate is set. When
+// flagRoute is set, route lists the IDs of the brokers the message has been
+// bridged from, oldest first, as
+//
+//	count (1) | (length (1) | broker ID) * count
+//
+// The receiving broker unwraps them in Ingest before routing, so its
+// subscribers only see the original topic and payload. Publishing to $ topics needs the
+// bridge's user in the upstream's server.system_publishers.
+const EnvelopePrefix = "$bridge/v1/"
+
+// FeaturesTopic holds, retained, the envelope features a broker accepts,
+// separated by spaces, followed by id=<broker ID> when it has one. Bridges
+// subscribe to it upstream and only use the features listed, so an upstream
+// without Ingest gets plain messages.
+const FeaturesTopic = "$SYS/broker/bridge/features"
+
+// Features are the envelope features Ingest accepts
+const Features = "deflate route"
+
+// Envelope flags
+const (
+	flagDeflate = 0x01
+	flagRoute   = 0x02
+)
+
+// DefaultMaxHops is the number of bridges a message may cross when MaxHops
+// is not set
+const DefaultMaxHops = 8
+
+// MaxBrokerID is the longest broker ID a route can carry
+const MaxBrokerID = 255
+
+// maxInflated bounds an unwrapped payload to the largest MQTT packet. Tests
+// lower it.
+var maxInflated = 268435455
+
+// Advertise publishes the retained FeaturesTopic message, with brokerID if
+// not empty, when enabled, and clears one left by an earlier run otherwise.
+// Call it once the broker has started and before bridges connect.
+func Advertise(b *broker.Broker, enabled bool, brokerID string) error {
+	var payload []byte
+	if enabled {
+		payload = []byte(Features)
+		if brokerID != "" {
+			payload = fmt.Appendf(payload, " id=%s", brokerID)
+		}
+	}
+	return b.PublishMessage("", broker.NewMessage(FeaturesTopic, payload, true), packet.QoSAtMostOnce)
+}
+
+// Ingest returns a broker.Interceptor unwrapping enveloped messages sent by
+// goqtt bridges. A message whose route already passed through brokerID, or
+// crossed more than maxHops bridges, is dropped, which breaks loops between
+// bridged brokers. Register it before any interceptor that looks at topics.
+func Ingest(brokerID string, maxHops int) broker.Interceptor {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	return func(clientID string, msg *broker.Message) error {
+		return ingest(brokerID, maxHops, msg)
+	}
+}
+
+func ingest(brokerID string, maxHops int, msg *broker.Message) error {
+	topic, ok := strings.CutPrefix(msg.Topic, EnvelopePrefix)
+	if !ok {
+		return nil
+	}
+	if topic == "" {
+		return invalidEnvelope(msg.Topic, "empty topic")
+	}
+	if msg.Spilled() {
+		return invalidEnvelope(msg.Topic, "payload too large")
+	}
+	if len(msg.Payload) == 0 {
+		return invalidEnvelope(msg.Topic, "missing flags")
+	}
+
+	flags, body := msg.Payload[0], msg.Payload[1:]
+	if flags&^(flagDeflate|flagRoute) != 0 {
+		return invalidEnvelope(msg.Topic, fmt.Sprintf("unknown flags %#x", flags))
+	}
+	var route []string
+	if flags&flagRoute != 0 {
+		var err error
+		if route, body, err = parseRoute(body); err != nil {
+			return invalidEnvelope(msg.Topic, err.Error())
+		}
+		if len(route) > maxHops || brokerID != "" && slices.Contains(route, brokerID) {
+			return er.ErrMessageDropped
+		}
+	}
+	if flags&flagDeflate != 0 {
+		inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(body)), int64(maxInflated)+1))
+		if err != nil {
+			return invalidEnvelope(msg.Topic, err.Error())
+		}
+		if len(inflated) > maxInflated {
+			return invalidEnvelope(msg.Topic, "inflated payload too large")
+		}
+		body = inflated
+	}
+	msg.Topic, msg.Payload, msg.Route = topic, body, route
+	return nil
+}
+
+// appendRoute appends route in its envelope encoding
+func appendRoute(b []byte, route []string) []byte {
+	b = append(b, byte(len(route)))
+	for _, id := range route {
+		b = append(b, byte(len(id)))
+		b = append(b, id...)
+	}
+	return b
+}
+
+// parseRoute reads a route from the start of b and returns it with the
+// bytes after it
+func parseRoute(b []byte) ([]string, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("missing route")
+	}
+	route := make([]string, b[0])
+	b = b[1:]
+	for i := range route {
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, nil, errors.New("truncated route")
+		}
+		route[i], b = string(b[1:1+b[0]]), b[1+b[0]:]
+	}
+	return route, b, nil
+}
+
+func invalidEnvelope(topic, reason string) error {
+	return &er.Err{
+		Context: "Bridge, " + topic,
+		Message: fmt.Errorf("%w: %s", er.ErrInvalidEnvelope, reason),
+	}
+}
+
+// featureValue returns the value of the key=value entry for key in the
+// space-separated features list
+func featureValue(features, key string) (string, bool) {
+	for f := range strings.FieldsSeq(features) {
+		if value, ok := strings.CutPrefix(f, key+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// hasFeature reports whether the space-separated features list has feature
+func hasFeature(features, feature string) bool {
+	for f := range strings.FieldsSeq(features) {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+func TestRouteCodec(t *testing.T) {
+	for _, route := range [][]string{{}, {"a"}, {"edge-1", "core"}, {"", "x"}} {
+		raw := appendRoute(nil, route)
+		got, rest, err := parseRoute(append(raw, "body"...))
+		if err != nil {
+			t.Fatalf("%q: %v", route, err)
+		}
+		if !reflect.DeepEqual(got, route) || string(rest) != "body" {
+			t.Fatalf("%q: got %q and %q", route, got, rest)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"missing ID", []byte{2, 1, 'a'}},
+		{"missing ID length", []byte{1}},
+		{"ID past the end", []byte{1, 5, 'a', 'b'}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := parseRoute(tc.raw); err == nil {
+				t.Fatal("parsed an invalid route")
+			}
+		})
+	}
+}
+
+// deflate compresses payload as bridges do
+func deflate(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIngest(t *testing.T) {
+	defer func(limit int) { maxInflated = limit }(maxInflated)
+	maxInflated = 1024
+
+	routed := func(flags byte, route []string, body []byte) []byte {
+		return append(appendRoute([]byte{flags | flagRoute}, route), body...)
+	}
+	cases := []struct {
+		name      string
+		topic     string
+		payload   []byte
+		want      error // nil, er.ErrMessageDropped or er.ErrInvalidEnvelope
+		wantTopic string
+		wantBody  string
+		wantRoute []string
+	}{
+		{"not enveloped", "a/b", []byte("x"), nil, "a/b", "x", nil},
+		{"plain", EnvelopePrefix + "a/b", []byte("\x00x"), nil, "a/b", "x", nil},
+		{"deflated", EnvelopePrefix + "a", append([]byte{flagDeflate}, deflate(t, []byte("hello"))...), nil, "a", "hello", nil},
+		{"routed", EnvelopePrefix + "a", routed(0, []string{"edge"}, []byte("x")), nil, "a", "x", []string{"edge"}},
+		{"routed and deflated", EnvelopePrefix + "a", routed(flagDeflate, []string{"edge"}, deflate(t, []byte("hi"))), nil, "a", "hi", []string{"edge"}},
+		{"at the hop limit", EnvelopePrefix + "a", routed(0, []string{"1", "2"}, nil), nil, "a", "", []string{"1", "2"}},
+		{"inflated to the bound", EnvelopePrefix + "a", append([]byte{flagDeflate}, deflate(t, make([]byte, 1024))...), nil, "a", string(make([]byte, 1024)), nil},
+
+		{"loop", EnvelopePrefix + "a", routed(0, []string{"edge", "self"}, []byte("x")), er.ErrMessageDropped, "", "", nil},
+		{"over the hop limit", EnvelopePrefix + "a", routed(0, []string{"1", "2", "3"}, []byte("x")), er.ErrMessageDropped, "", "", nil},
+
+		{"empty topic", EnvelopePrefix, []byte{0}, er.ErrInvalidEnvelope, "", "", nil},
+		{"missing flags", EnvelopePrefix + "a", nil, er.ErrInvalidEnvelope, "", "", nil},
+		{"unknown flags", EnvelopePrefix + "a", []byte{0x04, 'x'}, er.ErrInvalidEnvelope, "", "", nil},
+		{"missing route", EnvelopePrefix + "a", []byte{flagRoute}, er.ErrInvalidEnvelope, "", "", nil},
+		{"truncated route", EnvelopePrefix + "a", []byte{flagRoute, 2, 4, 'e', 'd', 'g', 'e'}, er.ErrInvalidEnvelope, "", "", nil},
+		{"invalid deflate stream", EnvelopePrefix + "a", []byte{flagDeflate, 0xff, 0xff}, er.ErrInvalidEnvelope, "", "", nil},
+		{"inflated past the bound", EnvelopePrefix + "a", append([]byte{flagDeflate}, deflate(t, make([]byte, 1025))...), er.ErrInvalidEnvelope, "", "", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := broker.NewMessage(tc.topic, tc.payload, false)
+			err := ingest("self", 2, msg)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			if err != nil {
+				return
+			}
+			if msg.Topic != tc.wantTopic || string(msg.Payload) != tc.wantBody || !reflect.DeepEqual(msg.Route, tc.wantRoute) {
+				t.Fatalf("got %q %q %q", msg.Topic, msg.Payload, msg.Route)
+			}
+		})
+	}
+}
+
+// Without a broker ID only the hop limit breaks loops, which defaults to
+// DefaultMaxHops
+func TestIngestDefaults(t *testing.T) {
+	intercept := Ingest("", 0)
+	route := make([]string, DefaultMaxHops)
+	for i := range route {
+		route[i] = "self"
+	}
+	msg := broker.NewMessage(EnvelopePrefix+"a", appendRoute([]byte{flagRoute}, route), false)
+	if err := intercept("c", msg); err != nil {
+		t.Fatalf("%d hops: %v", len(route), err)
+	}
+
+	route = append(route, "self")
+	msg = broker.NewMessage(EnvelopePrefix+"a", appendRoute([]byte{flagRoute}, route), false)
+	if err := intercept("c", msg); !errors.Is(err, er.ErrMessageDropped) {
+		t.Fatalf("%d hops: err = %v", len(route), err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	features := "deflate route id=edge-1"
+	if !hasFeature(features, "route") || hasFeature(features, "rout") || hasFeature(features, "id") {
+		t.Fatal("hasFeature matched the wrong entries")
+	}
+	if id, ok := featureValue(features, "id"); !ok || id != "edge-1" {
+		t.Fatalf("id = %q, %v", id, ok)
+	}
+	if _, ok := featureValue("deflate", "id"); ok {
+		t.Fatal("found an id in a list without one")
+	}
+}
@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// Presets adapt a bridge to a managed cloud broker, which only accepts TLS
+const (
+	PresetAWSIoT      = "aws-iot"       // AWS IoT Core, authenticating with a client certificate
+	PresetAzureIoTHub = "azure-iot-hub" // Azure IoT Hub, connecting as the device named by ClientID
+	PresetHiveMQCloud = "hivemq-cloud"  // HiveMQ Cloud, authenticating with a username and password
+)
+
+// azureAPIVersion is the IoT Hub API version sent in the username
+const azureAPIVersion = "2021-04-12"
+
+// preset is what a managed broker supports
+type preset struct {
+	maxQoS       packet.QoSLevel
+	maxKeepAlive time.Duration // 0 is unlimited
+	retain       bool          // Whether retained publishes are accepted
+	alpn443      string        // ALPN protocol required to speak MQTT on port 443
+}
+
+var presets = map[string]preset{
+	PresetAWSIoT:      {maxQoS: packet.QoSAtLeastOnce, maxKeepAlive: 1200 * time.Second, retain: true, alpn443: "x-amzn-mqtt-ca"},
+	PresetAzureIoTHub: {maxQoS: packet.QoSAtLeastOnce, maxKeepAlive: 1767 * time.Second},
+	PresetHiveMQCloud: {maxQoS: packet.QoSExactlyOnce, retain: true},
+}
+
+// applyPreset adjusts opts, after defaults, to the broker opts.Preset names.
+// SNI needs no setting: tls.Dial sends the address host unless
+// TLS.ServerName overrides it.
+func applyPreset(opts *Options) *preset {
+	p, ok := presets[opts.Preset]
+	if !ok {
+		return nil
+	}
+
+	if opts.TLS == nil {
+		opts.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	host, port, _ := net.SplitHostPort(opts.Address)
+	if port == "443" && p.alpn443 != "" && len(opts.TLS.NextProtos) == 0 {
+		opts.TLS = opts.TLS.Clone()
+		opts.TLS.NextProtos = []string{p.alpn443}
+	}
+	if p.maxKeepAlive > 0 {
+		opts.KeepAlive = min(opts.KeepAlive, p.maxKeepAlive)
+	}
+	opts.Topics = slices.Clone(opts.Topics)
+	for i := range opts.Topics {
+		opts.Topics[i].QoS = min(opts.Topics[i].QoS, p.maxQoS)
+	}
+	if opts.Preset == PresetAzureIoTHub && opts.Username == "" {
+		opts.Username = host + "/" + opts.ClientID + "/?api-version=" + azureAPIVersion
+	}
+	return &p
+}
+
+// IoT Hub only takes device-to-cloud messages on the events topic and sends
+// cloud-to-device ones on the devicebound topic. Topics travel in a "topic"
+// property of the property bag following either.
+func (br *Bridge) azureEvents() string {
+	return "devices/" + br.opts.ClientID + "/messages/events/"
+}
+
+func (br *Bridge) azureDevicebound() string {
+	return "devices/" + br.opts.ClientID + "/messages/devicebound/"
+}
+
+// remoteTopic maps a local topic matching topic to the topic it is
+// published to upstream
+func (br *Bridge) remoteTopic(topic Topic, local string) string {
+	remote := topic.RemotePrefix + strings.TrimPrefix(local, topic.LocalPrefix)
+	if br.opts.Preset == PresetAzureIoTHub {
+		// Spaces as %20, since not every reader of property bags takes + as a space
+		return br.azureEvents() + "topic=" + strings.ReplaceAll(url.QueryEscape(remote), "+", "%20")
+	}
+	return remote
+}
+
+// localTopic maps a topic received from the upstream to the local topic it
+// is published to, using the first inbound mapping matching it
+func (br *Bridge) localTopic(remote string) (string, bool) {
+	if br.opts.Preset == PresetAzureIoTHub {
+		props, ok := strings.CutPrefix(remote, br.azureDevicebound())
+		if !ok {
+			return "", false
+		}
+		values, err := url.ParseQuery(props)
+		if remote = values.Get("topic"); err != nil || remote == "" {
+			return "", false
+		}
+	}
+	for _, topic := range br.opts.Topics {
+		if topic.in() && broker.TopicMatches(topic.RemotePrefix+topic.Filter, remote) {
+			return topic.LocalPrefix + strings.TrimPrefix(remote, topic.RemotePrefix), true
+		}
+	}
+	return "", false
+}
+
+// filters returns the upstream topic filters of the inbound mappings and
+// their QoS
+func (br *Bridge) filters() map[string]packet.QoSLevel {
+	filters := make(map[string]packet.QoSLevel)
+	for _, topic := range br.opts.Topics {
+		if !topic.in() {
+			continue
+		}
+		filter := topic.RemotePrefix + topic.Filter
+		if br.opts.Preset == PresetAzureIoTHub {
+			filter = br.azureDevicebound() + "#" // The only topic a device may subscribe to
+		}
+		filters[filter] = max(filters[filter], topic.QoS)
+	}
+	return filters
+}
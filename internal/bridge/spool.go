@@ -0,0 +1,501 @@
+package bridge
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Policies for a spool at its byte budget
+const (
+	DropOldest = "drop-oldest" // Remove the oldest segment, sent or not, to make room
+	DropNewest = "drop-newest" // Refuse messages until the upstream catches up
+)
+
+// A spool record is laid out as
+//
+//	flags (1) | topic length (2) | route length (2) | payload length (4) |
+//	topic | route | payload | crc32 (4)
+//
+// with the QoS in bits 0-1 of the flags and retain in bit 2, the route in
+// its envelope encoding or empty, and the CRC covering everything before it
+const (
+	spoolHeaderSize = 9
+	spoolCRCSize    = 4
+	spoolRetain     = 0x04
+)
+
+// spoolExt names segment files, which are called <sequence number>.spool.
+// The cursor file holds the position sending resumes from after a restart.
+const (
+	spoolExt    = ".spool"
+	spoolCursor = "cursor"
+)
+
+// Segment size bounds; segments are an eighth of the budget in between, so
+// drop-oldest removes a small part of the spool at a time
+const (
+	minSpoolSegment = 64 << 10
+	maxSpoolSegment = 64 << 20
+)
+
+// spoolPos is the position of a record in the spool
+type spoolPos struct {
+	seq uint64 // Segment
+	off int64  // Byte offset in the segment
+}
+
+func (p spoolPos) before(q spoolPos) bool {
+	return p.seq < q.seq || p.seq == q.seq && p.off < q.off
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// spool stores a bridge's outbound messages on disk until they are sent,
+// so they survive the upstream being unreachable and the broker restarting.
+// Records are read back in the order they were appended. Sending resumes
+// after a restart from the last committed position, the oldest record not
+// yet acknowledged, so a crash resends rather than loses messages.
+type spool struct {
+	dir          string
+	maxBytes     int64
+	dropOldest   bool
+	segmentBytes int64
+	bridge       string // Name, for logs
+	logger       *logger.Logger
+
+	mu        sync.Mutex
+	segments  []*spoolSegment // Oldest first; the last one is appended to
+	size      int64           // Bytes in every segment
+	active    *os.File
+	reader    *os.File // Open on the segment being read
+	readerSeq uint64
+	read      spoolPos // Next record to read
+	ready     chan struct{}
+}
+
+// openSpool opens the spool in dir, creating it if needed. A record left
+// half written by a crash is cut off the end of the last segment.
+func openSpool(dir string, maxBytes int64, policy, bridge string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create bridge spool directory: %w", err)
+	}
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		dropOldest:   policy != DropNewest,
+		segmentBytes: min(max(maxBytes/8, minSpoolSegment), maxSpoolSegment),
+		bridge:       bridge,
+		logger:       logger.NewMQTTLogger("bridge"),
+		ready:        make(chan struct{}, 1),
+	}
+
+	segments, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := s.loadCursor()
+	if err != nil {
+		return nil, err
+	}
+	// Segments before the cursor were sent in full
+	for len(segments) > 0 && segments[0].seq < cursor.seq {
+		if err := os.Remove(segments[0].path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove sent bridge spool segment: %w", err)
+		}
+		segments = segments[1:]
+	}
+	s.segments = segments
+
+	if len(segments) == 0 {
+		if err := s.createSegment(cursor.seq); err != nil {
+			return nil, err
+		}
+	} else if err := s.recover(segments[len(segments)-1]); err != nil {
+		return nil, err
+	}
+	for _, seg := range s.segments {
+		s.size += seg.size
+	}
+
+	s.read = spoolPos{seq: s.segments[0].seq}
+	if s.segments[0].seq == cursor.seq && cursor.off <= s.segments[0].size {
+		s.read = cursor
+	}
+	return s, nil
+}
+
+// append writes a message to the end of the spool. It reports false if the
+// message was dropped because the spool is at its budget.
+func (s *spool) append(topic string, msg *broker.Message, qos packet.QoSLevel) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return false, os.ErrClosed
+	}
+	var route []byte
+	if len(msg.Route) > 0 {
+		route = appendRoute(nil, msg.Route)
+	}
+	recordSize := int64(spoolHeaderSize + len(topic) + len(route) + msg.Size() + spoolCRCSize)
+	if s.size+recordSize > s.maxBytes {
+		if !s.dropOldest {
+			return false, nil
+		}
+		var freed int64
+		for s.size+recordSize > s.maxBytes && len(s.segments) > 1 {
+			freed += s.segments[0].size
+			s.removeOldest()
+		}
+		if freed > 0 {
+			s.logger.Warn("Bridge spool full, dropped its oldest messages",
+				logger.String("bridge", s.bridge),
+				logger.Int("bytes", int(freed)))
+		}
+		if s.size+recordSize > s.maxBytes {
+			return false, nil
+		}
+	}
+
+	active := s.segments[len(s.segments)-1]
+	if active.size > 0 && active.size+recordSize > s.segmentBytes {
+		if err := s.roll(); err != nil {
+			return false, err
+		}
+		active = s.segments[len(s.segments)-1]
+	}
+	if err := s.write(topic, route, msg, qos); err != nil {
+		// Cut off whatever part of the record made it to disk
+		_ = s.active.Truncate(active.size)
+		return false, fmt.Errorf("failed to append to bridge spool: %w", err)
+	}
+	active.size += recordSize
+	s.size += recordSize
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+func (s *spool) write(topic string, route []byte, msg *broker.Message, qos packet.QoSLevel) error {
+	flags := byte(qos)
+	if msg.Retain {
+		flags |= spoolRetain
+	}
+	header := make([]byte, spoolHeaderSize, spoolHeaderSize+len(topic)+len(route))
+	header[0] = flags
+	binary.BigEndian.PutUint16(header[1:], uint16(len(topic)))
+	binary.BigEndian.PutUint16(header[3:], uint16(len(route)))
+	binary.BigEndian.PutUint32(header[5:], uint32(msg.Size()))
+	header = append(header, topic...)
+	header = append(header, route...)
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(s.active)
+	out := io.MultiWriter(w, crc)
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	if n, err := io.Copy(out, msg.PayloadReader()); err != nil {
+		return err
+	} else if n != int64(msg.Size()) {
+		return io.ErrUnexpectedEOF
+	}
+	if err := binary.Write(w, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// next returns the oldest message not yet read and its position, or false
+// when every message has been read. A corrupt record skips the rest of its
+// segment.
+func (s *spool) next() (outbound, spoolPos, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		i := slices.IndexFunc(s.segments, func(seg *spoolSegment) bool { return seg.seq == s.read.seq })
+		if i < 0 {
+			return outbound{}, spoolPos{}, false // Closed
+		}
+		seg := s.segments[i]
+		if s.read.off >= seg.size {
+			if i == len(s.segments)-1 {
+				return outbound{}, spoolPos{}, false
+			}
+			s.read = spoolPos{seq: s.segments[i+1].seq}
+			continue
+		}
+
+		pos := s.read
+		next, size, err := s.readRecord(seg)
+		if err != nil {
+			s.logger.LogError(err, "Skipping the rest of a bridge spool segment",
+				logger.String("bridge", s.bridge),
+				logger.String("segment", seg.path))
+			s.read.off = seg.size
+			continue
+		}
+		s.read.off += size
+		return next, pos, true
+	}
+}
+
+// readRecord reads the record at the read position and returns it with its
+// size on disk
+func (s *spool) readRecord(seg *spoolSegment) (outbound, int64, error) {
+	if s.reader == nil || s.readerSeq != seg.seq {
+		if s.reader != nil {
+			_ = s.reader.Close()
+			s.reader = nil
+		}
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return outbound{}, 0, err
+		}
+		s.reader, s.readerSeq = file, seg.seq
+	}
+
+	r := io.NewSectionReader(s.reader, s.read.off, seg.size-s.read.off)
+	var header [spoolHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return outbound{}, 0, corruptSpool(err.Error())
+	}
+	topicLen := int(binary.BigEndian.Uint16(header[1:]))
+	routeLen := int(binary.BigEndian.Uint16(header[3:]))
+	payloadLen := int(binary.BigEndian.Uint32(header[5:]))
+	dataLen := topicLen + routeLen + payloadLen
+	body := make([]byte, dataLen+spoolCRCSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return outbound{}, 0, corruptSpool(err.Error())
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(body[:dataLen])
+	if crc.Sum32() != binary.BigEndian.Uint32(body[dataLen:]) {
+		return outbound{}, 0, corruptSpool("checksum mismatch")
+	}
+
+	flags := header[0]
+	topic := string(body[:topicLen])
+	msg := broker.NewMessage(topic, body[topicLen+routeLen:dataLen], flags&spoolRetain != 0)
+	if routeLen > 0 {
+		route, rest, err := parseRoute(body[topicLen : topicLen+routeLen])
+		if err != nil || len(rest) != 0 {
+			return outbound{}, 0, corruptSpool("invalid route")
+		}
+		msg.Route = route
+	}
+	return outbound{topic: topic, msg: msg, qos: packet.QoSLevel(flags & 0x03)}, int64(spoolHeaderSize + len(body)), nil
+}
+
+// position returns the position of the next record to read
+func (s *spool) position() spoolPos {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read
+}
+
+// commit records that every message before pos was sent and acknowledged,
+// so a restart resumes from pos, and removes the segments before it
+func (s *spool) commit(pos spoolPos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:], pos.seq)
+	binary.BigEndian.PutUint64(buf[8:], uint64(pos.off))
+	tmp := filepath.Join(s.dir, spoolCursor+".tmp")
+	if err := os.WriteFile(tmp, buf[:], 0o644); err != nil {
+		return fmt.Errorf("failed to write bridge spool cursor: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, spoolCursor)); err != nil {
+		return fmt.Errorf("failed to write bridge spool cursor: %w", err)
+	}
+
+	for len(s.segments) > 1 && s.segments[0].seq < pos.seq {
+		s.removeOldest()
+	}
+	return nil
+}
+
+// close commits pos and closes the spool's files
+func (s *spool) close(pos spoolPos) error {
+	err := s.commit(pos)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader != nil {
+		_ = s.reader.Close()
+		s.reader = nil
+	}
+	if s.active == nil {
+		return err
+	}
+	err = errors.Join(err, s.active.Sync(), s.active.Close())
+	s.active = nil
+	s.segments = nil
+	return err
+}
+
+// removeOldest deletes the oldest segment, moving the read position past it
+func (s *spool) removeOldest() {
+	oldest := s.segments[0]
+	if s.reader != nil && s.readerSeq == oldest.seq {
+		_ = s.reader.Close()
+		s.reader = nil
+	}
+	if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+		s.logger.LogError(err, "Failed to remove bridge spool segment", logger.String("segment", oldest.path))
+	}
+	s.size -= oldest.size
+	s.segments = s.segments[1:]
+	if s.read.seq <= oldest.seq {
+		s.read = spoolPos{seq: s.segments[0].seq}
+	}
+}
+
+// roll syncs and closes the active segment and starts the next one
+func (s *spool) roll() error {
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	return s.createSegment(s.segments[len(s.segments)-1].seq + 1)
+}
+
+func (s *spool) createSegment(seq uint64) error {
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create bridge spool segment: %w", err)
+	}
+	s.active = file
+	s.segments = append(s.segments, &spoolSegment{seq: seq, path: path})
+	return nil
+}
+
+// recover reopens the last segment for appending, cutting off a torn record
+func (s *spool) recover(last *spoolSegment) error {
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open bridge spool segment: %w", err)
+	}
+
+	r := bufio.NewReader(file)
+	var valid int64
+	for {
+		var header [spoolHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint16(header[1:])) + int64(binary.BigEndian.Uint16(header[3:])) +
+			int64(binary.BigEndian.Uint32(header[5:])) + spoolCRCSize
+		if n, err := io.CopyN(io.Discard, r, length); err != nil || n != length {
+			break
+		}
+		valid += spoolHeaderSize + length
+	}
+	if valid < last.size {
+		s.logger.Warn("Truncating torn record at the end of the bridge spool",
+			logger.String("bridge", s.bridge),
+			logger.String("segment", last.path),
+			logger.Int("bytes", int(last.size-valid)))
+		if err := file.Truncate(valid); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to truncate bridge spool segment: %w", err)
+		}
+		last.size = valid
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.active = file
+	return nil
+}
+
+// loadCursor reads the committed position, which is the start of the
+// spool before anything was committed
+func (s *spool) loadCursor() (spoolPos, error) {
+	buf, err := os.ReadFile(filepath.Join(s.dir, spoolCursor))
+	if os.IsNotExist(err) {
+		return spoolPos{}, nil
+	}
+	if err != nil {
+		return spoolPos{}, fmt.Errorf("failed to read bridge spool cursor: %w", err)
+	}
+	if len(buf) != 16 {
+		return spoolPos{}, corruptSpool("invalid cursor")
+	}
+	return spoolPos{
+		seq: binary.BigEndian.Uint64(buf[0:]),
+		off: int64(binary.BigEndian.Uint64(buf[8:])),
+	}, nil
+}
+
+// listSegments returns the segments in the spool directory, oldest first
+func (s *spool) listSegments() ([]*spoolSegment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridge spool segments: %w", err)
+	}
+
+	var segments []*spoolSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat bridge spool segment: %w", err)
+		}
+		segments = append(segments, &spoolSegment{
+			seq:  seq,
+			path: filepath.Join(s.dir, name),
+			size: info.Size(),
+		})
+	}
+	slices.SortFunc(segments, func(a, b *spoolSegment) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	return segments, nil
+}
+
+func corruptSpool(reason string) error {
+	return &er.Err{
+		Context: "Bridge spool",
+		Message: fmt.Errorf("%w: %s", er.ErrCorruptSpoolRecord, reason),
+	}
+}
@@ -0,0 +1,199 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// spoolPayload is large enough that a few records fill a minimum segment
+const spoolPayload = 20 << 10
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64, policy string) *spool {
+	t.Helper()
+	s, err := openSpool(dir, maxBytes, policy, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// appendN spools messages t/from to t/to-1, reporting how many were kept
+func appendN(t *testing.T, s *spool, from, to int) int {
+	t.Helper()
+	kept := 0
+	for i := from; i < to; i++ {
+		msg := broker.NewMessage(fmt.Sprintf("t/%d", i), make([]byte, spoolPayload), i%2 == 0)
+		ok, err := s.append(msg.Topic, msg, packet.QoSAtLeastOnce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			kept++
+		}
+	}
+	return kept
+}
+
+// drain reads every unread message and returns their topics
+func drain(s *spool) []string {
+	var topics []string
+	for {
+		out, _, ok := s.next()
+		if !ok {
+			return topics
+		}
+		topics = append(topics, out.topic)
+	}
+}
+
+func topicRange(from, to int) []string {
+	var topics []string
+	for i := from; i < to; i++ {
+		topics = append(topics, fmt.Sprintf("t/%d", i))
+	}
+	return topics
+}
+
+func sameTopics(t *testing.T, got, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("read %v, want %v", got, want)
+	}
+}
+
+func TestSpoolRecord(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1<<20, DropOldest)
+	defer s.close(s.position())
+
+	msg := broker.NewMessage("a/b", []byte("payload"), true)
+	msg.Route = []string{"edge", "core"}
+	if ok, err := s.append("a/b", msg, packet.QoSExactlyOnce); !ok || err != nil {
+		t.Fatalf("append = %v, %v", ok, err)
+	}
+	out, pos, ok := s.next()
+	if !ok {
+		t.Fatal("nothing to read")
+	}
+	if out.topic != "a/b" || string(out.msg.Payload) != "payload" || !out.msg.Retain ||
+		out.qos != packet.QoSExactlyOnce || fmt.Sprint(out.msg.Route) != "[edge core]" {
+		t.Fatalf("read %q %q retain=%v qos=%d route=%q", out.topic, out.msg.Payload, out.msg.Retain, out.qos, out.msg.Route)
+	}
+	if pos != (spoolPos{}) {
+		t.Fatalf("first record at %+v", pos)
+	}
+	if _, _, ok := s.next(); ok {
+		t.Fatal("read past the end")
+	}
+}
+
+// A record torn by a crash is cut off on open and later appends follow the
+// intact ones
+func TestSpoolRecoversTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<20, DropOldest)
+	appendN(t, s, 0, 3)
+	if err := s.close(s.position()); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := filepath.Join(dir, fmt.Sprintf("%020d%s", 0, spoolExt))
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intact := info.Size()
+	// The header of a fourth record and part of its topic
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 0, 3, 0, 0, 0, 0, 0, 7, 't', '/'}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	s = openTestSpool(t, dir, 1<<20, DropOldest)
+	defer s.close(s.position())
+	if info, _ := os.Stat(segment); info.Size() != intact {
+		t.Fatalf("segment is %d bytes after recovery, want %d", info.Size(), intact)
+	}
+	appendN(t, s, 3, 4)
+	sameTopics(t, drain(s), topicRange(0, 4))
+}
+
+// After a restart sending resumes from the committed cursor, across
+// segments, and segments sent in full are removed
+func TestSpoolResumesFromCursor(t *testing.T) {
+	dir := t.TempDir()
+	// 64 KiB segments of three records each
+	s := openTestSpool(t, dir, 512<<10, DropOldest)
+	appendN(t, s, 0, 10)
+	if len(s.segments) != 4 {
+		t.Fatalf("%d segments, want 4", len(s.segments))
+	}
+
+	// Acknowledged up to t/6; t/7 onwards were read but not acknowledged
+	var cursor spoolPos
+	for range 7 {
+		if _, _, ok := s.next(); !ok {
+			t.Fatal("spool ran out")
+		}
+		cursor = s.position()
+	}
+	drain(s)
+	if err := s.close(cursor); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSpool(t, dir, 512<<10, DropOldest)
+	defer s.close(s.position())
+	if s.segments[0].seq != cursor.seq {
+		t.Fatalf("oldest segment %d, want the cursor's %d", s.segments[0].seq, cursor.seq)
+	}
+	sameTopics(t, drain(s), topicRange(7, 10))
+}
+
+func TestSpoolBudget(t *testing.T) {
+	// Segments are the 64 KiB minimum, so three records fill one and the
+	// budget holds about twelve
+	const budget = 256 << 10
+	cases := []struct {
+		policy string
+		check  func(t *testing.T, kept int, read []string)
+	}{
+		{DropNewest, func(t *testing.T, kept int, read []string) {
+			if kept >= 20 {
+				t.Fatal("every message was kept")
+			}
+			// The oldest are kept and later ones refused
+			sameTopics(t, read, topicRange(0, kept))
+		}},
+		{DropOldest, func(t *testing.T, kept int, read []string) {
+			if kept != 20 {
+				t.Fatalf("kept %d of 20", kept)
+			}
+			// Whole segments of the oldest are dropped for the newest
+			if len(read) == 0 || len(read) == 20 || read[len(read)-1] != "t/19" {
+				t.Fatalf("read %v", read)
+			}
+			first := 20 - len(read)
+			sameTopics(t, read, topicRange(first, 20))
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			s := openTestSpool(t, t.TempDir(), budget, tc.policy)
+			defer s.close(s.position())
+			kept := appendN(t, s, 0, 20)
+			if s.size > budget {
+				t.Fatalf("spool is %d bytes, over its %d budget", s.size, budget)
+			}
+			tc.check(t, kept, drain(s))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// TLSOptions are the settings of a bridge connecting over TLS
+type TLSOptions struct {
+	CAFile             string // PEM CAs that sign the upstream's certificate; empty uses the system pool
+	CertFile           string // Client certificate, for upstreams that require one
+	KeyFile            string
+	ServerName         string   // Name verified in the upstream's certificate; empty uses the address host
+	InsecureSkipVerify bool     // Don't verify the upstream's certificate
+	ALPN               []string // Protocols offered in the handshake, for upstreams that route by them
+}
+
+// NewTLSConfig builds the client TLS config of a bridge
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		NextProtos:         opts.ALPN,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, &er.Err{
+				Context: "Bridge, TLS",
+				Message: fmt.Errorf("%w: %v", er.ErrInvalidTLSConfig, err),
+			}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &er.Err{
+				Context: "Bridge, TLS",
+				Message: fmt.Errorf("%w: no certificates in %s", er.ErrInvalidTLSConfig, opts.CAFile),
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, &er.Err{
+				Context: "Bridge, TLS",
+				Message: fmt.Errorf("%w: %v", er.ErrInvalidTLSConfig, err),
+			}
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
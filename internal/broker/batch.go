@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// BatchWriter is implemented by connections that can hold a frame briefly
+// and send it together with the frames that follow in one write
+type BatchWriter interface {
+	WriteBatched(frame []byte) error
+}
+
+// WithBatchTopics lets deliveries of messages published to topics matching
+// filters be held briefly by connections implementing BatchWriter, so a
+// burst of small messages reaches a subscriber in a few writes instead of
+// one write per message. Other messages are still written immediately, and
+// flush anything held before them.
+func WithBatchTopics(filters []string) Option {
+	return func(b *Broker) {
+		for _, filter := range filters {
+			if err := utils.ValidateTopicFilter(filter); err != nil {
+				b.logger.LogError(err, "Ignoring invalid batch topic filter", logger.String("topic_filter", filter))
+				continue
+			}
+			b.batchFilters = append(b.batchFilters, filter)
+		}
+	}
+}
+
+// isBatched reports whether topic matches a batch filter
+func (b *Broker) isBatched(topic string) bool {
+	for _, filter := range b.batchFilters {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
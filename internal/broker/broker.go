@@ -1,43 +1,105 @@
 package broker
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pyr33x/goqtt/internal/logger"
 	"github.com/pyr33x/goqtt/internal/packet"
 	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
 )
 
 type Broker struct {
-	session       atomic.Value
-	subscriptions *SubscriptionTree
-	retainedMsgs  map[string]*RetainedMessage
-	retainedMu    sync.RWMutex
-	rwmu          sync.RWMutex
-	packetIDSeq   uint32
-	qosManager    *QoSManager
-	logger        *logger.Logger
+	session           atomic.Value
+	sessionGen        atomic.Uint64 // Bumped whenever the session map changes
+	subscriptions     *SubscriptionTree
+	retained          *retainedStore
+	retainedPersister RetainedPersister     // Saves retained messages across restarts; nil keeps them in memory only
+	subPersister      SubscriptionPersister // Saves persistent sessions' subscriptions across restarts
+	qos2Persister     QoS2Persister         // Saves persistent sessions' unreleased inbound QoS 2 messages
+	rwmu              sync.RWMutex
+	qosManager        *QoSManager
+	presence          *PresenceOptions
+	dispatcher        *dispatcher
+	fanout            *fanout
+	limits            *loadMonitor
+	rates             *rateLimiter // Publish rate limits; nil is unlimited
+	willPolicy        WillPolicy
+	sysPublishers     map[string]struct{} // Users allowed to publish to $ topics
+	deniedFilters     []string            // Topic filters that may not be subscribed to
+	maxQoS            packet.QoSLevel
+	qosPolicy         QoSPolicy
+	capabilities      Capabilities
+	taps              atomic.Uint64 // Numbers in-process subscriptions made with Tap
+	interceptors      []Interceptor
+	replaySource      ReplaySource // Serves $replay subscriptions; nil treats them as ordinary filters
+	replayLimit       int          // Most messages sent for one $replay subscription
+	priorityFilters   []string     // Topics delivered ahead of others by the dispatcher
+	priorityBurst     int
+	batchFilters      []string // Topics whose deliveries may be held briefly and written together
+	offline           *offlineQueue
+	inflight          *inflightWindow // Caps unacknowledged QoS 1/2 deliveries per client; nil is unlimited
+	deliveryLocks     sync.Map        // Client ID -> *sync.Mutex ordering its deliveries
+	retainHandling    RetainHandling
+	dropSlow          bool          // Drop QoS 0 deliveries to stalled clients
+	slowDropped       atomic.Uint64 // QoS 0 deliveries dropped for stalled clients
+	stopCh            chan struct{}
+	stopOnce          sync.Once
+	logger            *logger.Logger
 }
 
-type RetainedMessage struct {
-	Topic   string
-	Payload []byte
-	QoS     packet.QoSLevel
-}
-
-func New() *Broker {
+func New(opts ...Option) *Broker {
 	b := &Broker{
 		subscriptions: NewSubscriptionTree(),
-		retainedMsgs:  make(map[string]*RetainedMessage),
+		retained:      newRetainedStore(),
 		qosManager:    NewQoSManager(),
+		willPolicy:    defaultWillPolicy,
+		maxQoS:        packet.QoSExactlyOnce,
+		capabilities:  defaultCapabilities,
+		stopCh:        make(chan struct{}),
 		logger:        logger.NewMQTTLogger("broker"),
 	}
 	b.session.Store(make(sessionMap)) // Initialize empty session map
+	b.qosManager.onRelease = b.routeReleased
+	b.qosManager.onExpire = b.expireQoS2
+	b.qosManager.onRetry = b.retryDelivery
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.dispatcher != nil {
+		if b.priorityBurst > 0 {
+			b.dispatcher.burst = b.priorityBurst
+		}
+		b.dispatcher.start()
+	}
+	go b.compactLoop()
 	return b
 }
 
+// compactInterval is how often the subscription tree is swept for empty nodes
+const compactInterval = 5 * time.Minute
+
+// compactLoop periodically compacts the subscription tree until Stop
+func (b *Broker) compactLoop() {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			if removed := b.subscriptions.Compact(); removed > 0 {
+				b.logger.Debug("Compacted subscription tree", logger.Int("removed_nodes", removed))
+			}
+		}
+	}
+}
+
 // HandleSubscribe processes a SUBSCRIBE packet and returns a SUBACK packet
 func (b *Broker) HandleSubscribe(session *Session, subscribePacket *packet.SubscribePacket) *packet.SubackPacket {
 	if subscribePacket == nil || session == nil {
@@ -47,7 +109,18 @@ func (b *Broker) HandleSubscribe(session *Session, subscribePacket *packet.Subsc
 
 	returnCodes := make([]byte, len(subscribePacket.Filters))
 
+	// A filter repeated within one packet is subscribed once, with the
+	// options of its last occurrence, so retained messages are not sent twice
+	last := make(map[string]int, len(subscribePacket.Filters))
+	for i, filter := range subscribePacket.Filters {
+		last[filter.Topic] = i
+	}
+
 	for i, filter := range subscribePacket.Filters {
+		if last[filter.Topic] != i {
+			continue
+		}
+
 		// Validate topic filter using comprehensive validation
 		if err := utils.ValidateTopicFilter(filter.Topic); err != nil {
 			b.logger.LogError(err, "Invalid topic filter",
@@ -56,17 +129,39 @@ func (b *Broker) HandleSubscribe(session *Session, subscribePacket *packet.Subsc
 			returnCodes[i] = packet.SubackFailure
 			continue
 		}
+		if !b.allowsFilter(filter.Topic) {
+			b.logger.Warn("Wildcard subscriptions are not available",
+				logger.ClientID(session.ClientID),
+				logger.String("topic_filter", filter.Topic))
+			returnCodes[i] = packet.SubackFailure
+			continue
+		}
+		if b.deniesFilter(filter.Topic) {
+			b.logger.Warn("Subscription to denied topic filter refused",
+				logger.ClientID(session.ClientID),
+				logger.String("topic_filter", filter.Topic))
+			returnCodes[i] = packet.SubackFailure
+			continue
+		}
+
+		// Grant the requested QoS level (or downgrade if needed)
+		grantedQoS := b.getGrantedQoS(filter.QoS)
 
-		// Create subscription handler
-		handler := func(topic string, payload []byte, qos packet.QoSLevel, retain bool) {
-			// Look up current session to ensure we use the latest connection
-			currentSession, _ := b.Get(session.ClientID)
-			if currentSession != nil {
-				b.deliverMessage(currentSession, topic, payload, qos, retain)
+		if start, logged, ok := b.replayFilter(filter.Topic); ok {
+			if err := b.replay(session, start, logged, grantedQoS); err != nil {
+				b.logger.LogError(err, "Failed to replay logged messages",
+					logger.ClientID(session.ClientID),
+					logger.String("topic_filter", filter.Topic))
+				returnCodes[i] = packet.SubackFailure
+				continue
 			}
+			returnCodes[i] = subackCode(grantedQoS)
+			continue
 		}
-		// Add subscription to the tree
-		err := b.subscriptions.Subscribe(session.ClientID, session, filter.Topic, filter.QoS, handler)
+
+		// Add subscription to the tree, replacing any existing one for the
+		// filter [MQTT-3.8.4-3]
+		replaced, err := b.subscriptions.Subscribe(session.ClientID, session, filter.Topic, grantedQoS, b.subscriptionHandler(session.ClientID))
 		if err != nil {
 			b.logger.LogError(err, "Failed to add subscription",
 				logger.ClientID(session.ClientID),
@@ -75,23 +170,26 @@ func (b *Broker) HandleSubscribe(session *Session, subscribePacket *packet.Subsc
 			continue
 		}
 
-		// Grant the requested QoS level (or downgrade if needed)
-		grantedQoS := b.getGrantedQoS(filter.QoS)
-		switch grantedQoS {
-		case packet.QoSAtMostOnce:
-			returnCodes[i] = packet.SubackMaxQoS0
-		case packet.QoSAtLeastOnce:
-			returnCodes[i] = packet.SubackMaxQoS1
-		case packet.QoSExactlyOnce:
-			returnCodes[i] = packet.SubackMaxQoS2
-		default:
-			returnCodes[i] = packet.SubackFailure
+		returnCodes[i] = subackCode(grantedQoS)
+
+		action := "subscribe"
+		if replaced {
+			action = "resubscribe"
+		}
+		b.logger.LogSubscription(session.ClientID, filter.Topic, int(grantedQoS), action)
+		if !session.CleanSession {
+			b.saveSubscription(session.ClientID, filter.Topic, grantedQoS)
 		}
 
-		b.logger.LogSubscription(session.ClientID, filter.Topic, int(grantedQoS), "subscribe")
+		// Send retained messages that match this subscription. By default
+		// that includes when it replaced an existing one.
+		if b.sendsRetained(replaced) {
+			b.sendRetainedMessages(session, filter.Topic, grantedQoS)
+		}
+	}
 
-		// Send retained messages that match this subscription
-		b.sendRetainedMessages(session, filter.Topic, grantedQoS)
+	for i, filter := range subscribePacket.Filters {
+		returnCodes[i] = returnCodes[last[filter.Topic]]
 	}
 
 	return &packet.SubackPacket{
@@ -100,6 +198,31 @@ func (b *Broker) HandleSubscribe(session *Session, subscribePacket *packet.Subsc
 	}
 }
 
+// subackCode is the SUBACK return code granting qos
+func subackCode(qos packet.QoSLevel) byte {
+	switch qos {
+	case packet.QoSAtMostOnce:
+		return packet.SubackMaxQoS0
+	case packet.QoSAtLeastOnce:
+		return packet.SubackMaxQoS1
+	case packet.QoSExactlyOnce:
+		return packet.SubackMaxQoS2
+	default:
+		return packet.SubackFailure
+	}
+}
+
+// subscriptionHandler delivers to whichever session is stored for clientID
+// when a message arrives, so it follows the client across reconnects
+func (b *Broker) subscriptionHandler(clientID string) func(*Message, packet.QoSLevel) {
+	return func(msg *Message, qos packet.QoSLevel) {
+		currentSession, _ := b.Get(clientID)
+		if currentSession != nil {
+			b.deliverMessage(currentSession, msg, qos)
+		}
+	}
+}
+
 // HandleUnsubscribe processes an UNSUBSCRIBE packet and returns an UNSUBACK packet
 func (b *Broker) HandleUnsubscribe(session *Session, unsubscribePacket *packet.UnsubscribePacket) *packet.UnsubackPacket {
 	if unsubscribePacket == nil || session == nil {
@@ -115,6 +238,9 @@ func (b *Broker) HandleUnsubscribe(session *Session, unsubscribePacket *packet.U
 				logger.String("topic_filter", topicFilter))
 		} else {
 			b.logger.LogSubscription(session.ClientID, topicFilter, 0, "unsubscribe")
+			if !session.CleanSession {
+				b.deleteSubscription(session.ClientID, topicFilter)
+			}
 		}
 	}
 
@@ -129,108 +255,229 @@ func (b *Broker) HandlePublish(clientID string, publishPacket *packet.PublishPac
 		return fmt.Errorf("invalid publish packet")
 	}
 
+	// Every subscriber and the retained store share one message, so the
+	// payload is never copied and the frame is encoded once per QoS
+	msg := NewMessage(publishPacket.Topic, publishPacket.Payload, publishPacket.Retain)
+	return b.PublishMessage(clientID, msg, publishPacket.QoS)
+}
+
+// PublishMessage routes an already built message, such as one whose payload
+// was spilled to disk, to the retained store and matching subscribers
+func (b *Broker) PublishMessage(clientID string, msg *Message, qos packet.QoSLevel) error {
 	// Validate topic name using comprehensive validation
-	if err := utils.ValidateTopicName(publishPacket.Topic); err != nil {
-		return fmt.Errorf("invalid topic name: %s, error: %v", publishPacket.Topic, err)
+	if err := utils.ValidateTopicName(msg.Topic); err != nil {
+		return fmt.Errorf("invalid topic name: %s, error: %v", msg.Topic, err)
 	}
 
+	if err := b.intercept(clientID, msg); err != nil {
+		if errors.Is(err, er.ErrMessageDropped) {
+			return nil
+		}
+		return err
+	}
+	qos = minQoS(qos, b.maxQoS)
+	msg.batched = b.isBatched(msg.Topic)
+
 	// Handle retained messages
-	if publishPacket.Retain {
-		b.handleRetainedMessage(publishPacket)
+	if msg.Retain {
+		b.handleRetainedMessage(msg, qos)
 	}
 
-	// Find matching subscriptions
-	matches := b.subscriptions.Match(publishPacket.Topic)
+	// Find matching subscriptions. Match returns a snapshot, so no tree
+	// state is held while handlers write to the network.
+	matches := b.subscriptions.Match(msg.Topic)
+
+	if b.dispatcher == nil && b.fanout != nil && len(matches) >= b.fanout.threshold {
+		b.fanout.deliver(matches, msg, qos)
+		b.logger.LogPublish(clientID, msg.Topic, int(qos), msg.Retain, msg.Size())
+		return nil
+	}
 
 	// Deliver message to each matching subscriber
+	high := b.dispatcher != nil && b.isPriority(msg.Topic)
 	for _, subscription := range matches {
-		if subscription.Handler != nil {
-			// Use the minimum QoS between published message and subscription
-			deliveryQoS := minQoS(publishPacket.QoS, subscription.QoS)
-			subscription.Handler(publishPacket.Topic, publishPacket.Payload, deliveryQoS, publishPacket.Retain)
+		if subscription.Handler == nil {
+			continue
+		}
+
+		// Use the minimum QoS between published message and subscription
+		job := delivery{
+			subscription: subscription,
+			msg:          msg,
+			qos:          minQoS(qos, subscription.QoS),
+			high:         high,
+		}
+		if b.dispatcher != nil {
+			b.dispatcher.dispatch(job)
+		} else {
+			subscription.Handler(job.msg, job.qos)
 		}
 	}
 
-	b.logger.LogPublish(clientID, publishPacket.Topic, int(publishPacket.QoS), publishPacket.Retain, len(publishPacket.Payload))
+	b.logger.LogPublish(clientID, msg.Topic, int(qos), msg.Retain, msg.Size())
 	return nil
 }
 
-// HandleClientDisconnect removes all subscriptions for a disconnecting client
+// HandleClientDisconnect detaches a disconnecting client from its session.
+// A clean session loses its subscriptions. A persistent one keeps them, its
+// unacknowledged QoS 1/2 deliveries for ResendInflight and the QoS 2
+// messages its client has not released yet, and with WithOfflineQueue
+// everything published to it from now on is queued until the client
+// reconnects.
 func (b *Broker) HandleClientDisconnect(clientID string) {
-	b.subscriptions.UnsubscribeAll(clientID)
-	b.qosManager.CleanupClient(clientID)
-	b.logger.LogClientConnection(clientID, "", "disconnect")
+	session, ok := b.Get(clientID)
+	b.forgetRate(clientID)
+	var deferred []queuedMessage
+	if b.inflight != nil {
+		deferred = b.inflight.takeDeferred(clientID)
+	}
+	if !ok || session.CleanSession {
+		b.subscriptions.UnsubscribeAll(clientID)
+		b.qosManager.CleanupClient(clientID)
+		b.logger.LogClientConnection(clientID, "", "disconnect")
+		return
+	}
+
+	b.detach(clientID)
+	b.qosManager.Suspend(clientID)
+	if b.offline != nil {
+		b.offline.open(clientID)
+		// Deferred deliveries were never sent, so they get new packet IDs
+		// after the unacknowledged ones are resent
+		if len(deferred) > 0 {
+			b.offline.requeue(clientID, deferred)
+		}
+	}
+	b.logger.LogClientConnection(clientID, "", "disconnect", logger.Bool("persistent", true))
 }
 
-// deliverMessage sends a message to a specific session with proper QoS flow handling
-func (b *Broker) deliverMessage(session *Session, topic string, payload []byte, qos packet.QoSLevel, retain bool) {
-	if session == nil || session.Conn == nil {
-		b.logger.Error("Cannot deliver message: invalid session or connection")
+// ResendInflight resumes the QoS 1/2 deliveries a client had not finished
+// acknowledging on its previous connection: PUBREL again for messages it
+// acknowledged with PUBREC, then each unacknowledged PUBLISH with its
+// original packet ID and DUP set [MQTT-4.4.0-1]. Call it once the new
+// connection is stored, before DrainOffline.
+func (b *Broker) ResendInflight(clientID string) {
+	mu := b.lockDelivery(clientID)
+	defer mu.Unlock()
+
+	session, ok := b.Get(clientID)
+	if !ok || session.Conn == nil {
 		return
 	}
+	publishes, released := b.qosManager.Resume(clientID)
+	for _, packetID := range released {
+		if _, err := session.Conn.Write(packet.NewPubRel(packetID).Encode()); err != nil {
+			b.logger.LogError(err, "Failed to resend PUBREL", logger.ClientID(clientID))
+			return
+		}
+	}
+	for _, msg := range publishes {
+		// QoS 1 and 2 frames are private copies, so setting DUP is safe
+		frame := msg.Message.Frame(msg.QoS, msg.PacketID)
+		frame[0] |= 0x08
+		if err := writeMessage(session.Conn, msg.Message, frame); err != nil {
+			b.logger.LogError(err, "Failed to resend message", logger.ClientID(clientID))
+			return
+		}
+	}
+	if len(publishes)+len(released) > 0 {
+		b.logger.LogClientConnection(clientID, "", "inflight_resent",
+			logger.Int("publishes", len(publishes)),
+			logger.Int("pubrels", len(released)))
+	}
+}
 
-	// Create PUBLISH packet for delivery
-	publishPacket := &packet.PublishPacket{
-		Topic:   topic,
-		Payload: payload,
-		QoS:     qos,
-		Retain:  retain,
+// deliverMessage sends a message to a specific session with proper QoS flow
+// handling, or queues it while the session's client is disconnected
+func (b *Broker) deliverMessage(session *Session, msg *Message, qos packet.QoSLevel) {
+	if session == nil {
+		b.logger.Error("Cannot deliver message: invalid session")
+		return
+	}
+	if b.offline != nil && b.offline.hold(session.ClientID, session.Conn != nil, msg, b.deliveryQoS(qos)) {
+		return
+	}
+	if session.Conn == nil {
+		return // Disconnected, and nothing is queued for it
 	}
+	b.send(session, msg, qos)
+}
 
+// send delivers a message to a connected session, unless its in-flight
+// window is full and the message is deferred
+func (b *Broker) send(session *Session, msg *Message, qos packet.QoSLevel) {
+	qos = b.deliveryQoS(qos)
+	mu := b.lockDelivery(session.ClientID)
+	if qos != packet.QoSAtMostOnce && b.inflight != nil && !b.admit(session.ClientID, msg, qos) {
+		mu.Unlock()
+		// Slots also free up when retries run out, which nothing else notices
+		b.releaseDeferred(session.ClientID)
+		return
+	}
+	b.transmit(session, msg, qos)
+	mu.Unlock()
+}
+
+// transmit writes a message to a connected session at qos
+func (b *Broker) transmit(session *Session, msg *Message, qos packet.QoSLevel) {
 	// Handle different QoS levels
 	switch qos {
 	case packet.QoSAtMostOnce:
-		// QoS 0: Fire and forget
-		b.sendPacket(session, publishPacket)
+		// QoS 0: Fire and forget, and the first thing dropped under memory pressure
+		if b.shedDelivery() {
+			return
+		}
+		frame := msg.Frame(qos, 0)
+		if handled, err := b.sendOrDrop(session.Conn, msg, frame); handled {
+			if err != nil {
+				b.logger.LogError(err, "Failed to deliver message to client", logger.ClientID(session.ClientID))
+			}
+			return
+		}
+		b.sendMessage(session, msg, frame)
 
 	case packet.QoSAtLeastOnce:
 		// QoS 1: Wait for PUBACK
-		packetID := b.generatePacketID()
-		publishPacket.PacketID = &packetID
-
-		// Store for retry/acknowledgment handling
+		// Store for retry/acknowledgment handling; this also assigns a
+		// packet ID that is not in flight for the client
 		pendingMsg := &PendingMessage{
-			PacketID: packetID,
 			ClientID: session.ClientID,
-			Topic:    topic,
-			Payload:  payload,
+			Message:  msg,
 			QoS:      qos,
-			Retain:   retain,
 			Session:  session,
 		}
-		b.qosManager.AddPendingQoS1(pendingMsg)
+		if !b.qosManager.AddPendingQoS1(pendingMsg) {
+			b.logger.Warn("Dropping message: no free packet IDs", logger.ClientID(session.ClientID))
+			return
+		}
 
-		b.sendPacket(session, publishPacket)
-		b.logger.LogQoSFlow(session.ClientID, packetID, int(qos), "PUBLISH_SENT")
+		b.sendMessage(session, msg, msg.Frame(qos, pendingMsg.PacketID))
+		b.logger.LogQoSFlow(session.ClientID, pendingMsg.PacketID, int(qos), "PUBLISH_SENT")
 
 	case packet.QoSExactlyOnce:
 		// QoS 2: PUBLISH -> PUBREC -> PUBREL -> PUBCOMP
-		packetID := b.generatePacketID()
-		publishPacket.PacketID = &packetID
-
-		// Store for retry/acknowledgment handling
+		// Store for retry/acknowledgment handling; this also assigns a
+		// packet ID that is not in flight for the client
 		pendingMsg := &PendingMessage{
-			PacketID: packetID,
 			ClientID: session.ClientID,
-			Topic:    topic,
-			Payload:  payload,
+			Message:  msg,
 			QoS:      qos,
-			Retain:   retain,
 			Session:  session,
 		}
-		b.qosManager.AddPendingQoS2(pendingMsg)
+		if !b.qosManager.AddPendingQoS2(pendingMsg) {
+			b.logger.Warn("Dropping message: no free packet IDs", logger.ClientID(session.ClientID))
+			return
+		}
 
-		b.sendPacket(session, publishPacket)
-		b.logger.LogQoSFlow(session.ClientID, packetID, int(qos), "PUBLISH_SENT")
+		b.sendMessage(session, msg, msg.Frame(qos, pendingMsg.PacketID))
+		b.logger.LogQoSFlow(session.ClientID, pendingMsg.PacketID, int(qos), "PUBLISH_SENT")
 	}
 }
 
-// sendPacket sends a packet to a session
-func (b *Broker) sendPacket(session *Session, publishPacket *packet.PublishPacket) {
-	data := publishPacket.Encode()
-	if data != nil {
-		_, err := session.Conn.Write(data)
-		if err != nil {
+// sendMessage writes an encoded message frame to a session
+func (b *Broker) sendMessage(session *Session, msg *Message, frame []byte) {
+	if frame != nil {
+		if err := writeMessage(session.Conn, msg, frame); err != nil {
 			b.logger.LogError(err, "Failed to deliver message to client",
 				logger.ClientID(session.ClientID))
 		}
@@ -238,57 +485,41 @@ func (b *Broker) sendPacket(session *Session, publishPacket *packet.PublishPacke
 }
 
 // handleRetainedMessage stores or removes retained messages
-func (b *Broker) handleRetainedMessage(publishPacket *packet.PublishPacket) {
-	b.retainedMu.Lock()
-	defer b.retainedMu.Unlock()
-
-	if len(publishPacket.Payload) == 0 {
+func (b *Broker) handleRetainedMessage(msg *Message, qos packet.QoSLevel) {
+	if msg.Size() == 0 {
 		// Empty payload removes retained message
-		delete(b.retainedMsgs, publishPacket.Topic)
-		b.logger.LogRetainedMessage(publishPacket.Topic, "removed", 0)
-	} else {
-		// Store retained message
-		b.retainedMsgs[publishPacket.Topic] = &RetainedMessage{
-			Topic:   publishPacket.Topic,
-			Payload: publishPacket.Payload,
-			QoS:     publishPacket.QoS,
-		}
-		b.logger.LogRetainedMessage(publishPacket.Topic, "stored", len(publishPacket.Payload))
+		b.retained.delete(msg.Topic)
+		b.persistRetained([]string{msg.Topic}, nil, 0)
+		b.logger.LogRetainedMessage(msg.Topic, "removed", 0)
+		return
 	}
+
+	evicted, ok := b.retained.store(msg, qos)
+	for _, topic := range evicted {
+		b.logger.LogRetainedMessage(topic, "evicted", 0)
+	}
+	if !ok {
+		b.logger.LogRetainedMessage(msg.Topic, "rejected", msg.Size(),
+			logger.String("reason", "retained limit reached"))
+		return
+	}
+	b.persistRetained(evicted, msg, qos)
+	b.logger.LogRetainedMessage(msg.Topic, "stored", msg.Size())
 }
 
 // sendRetainedMessages sends retained messages that match a topic filter to a subscriber
 func (b *Broker) sendRetainedMessages(session *Session, topicFilter string, maxQoS packet.QoSLevel) {
-	b.retainedMu.RLock()
-	defer b.retainedMu.RUnlock()
-
-	for topic, retainedMsg := range b.retainedMsgs {
-		if TopicMatches(topicFilter, topic) {
-			// Use minimum QoS between retained message and subscription
-			deliveryQoS := minQoS(retainedMsg.QoS, maxQoS)
-			b.deliverMessage(session, topic, retainedMsg.Payload, deliveryQoS, true)
-		}
+	// match returns a snapshot so the retained store is not locked during network writes
+	for _, retainedMsg := range b.retained.match(topicFilter) {
+		// Use minimum QoS between retained message and subscription
+		deliveryQoS := minQoS(retainedMsg.QoS, maxQoS)
+		b.deliverMessage(session, retainedMsg.Message, deliveryQoS)
 	}
 }
 
-// getGrantedQoS returns the QoS level granted by the broker (could implement downgrading logic)
+// getGrantedQoS returns the QoS level granted by the broker, capped at its maximum QoS
 func (b *Broker) getGrantedQoS(requestedQoS packet.QoSLevel) packet.QoSLevel {
-	// For now, grant the requested QoS level
-	// In a production implementation, you might want to downgrade based on server policy
-	if requestedQoS > packet.QoSExactlyOnce {
-		return packet.QoSExactlyOnce
-	}
-	return requestedQoS
-}
-
-// generatePacketID generates a unique packet ID for QoS 1 and 2 messages
-func (b *Broker) generatePacketID() uint16 {
-	// Simple atomic counter for packet IDs (1-65535, wrapping around)
-	id := atomic.AddUint32(&b.packetIDSeq, 1)
-	if id == 0 {
-		id = atomic.AddUint32(&b.packetIDSeq, 1) // Skip 0
-	}
-	return uint16(id)
+	return minQoS(requestedQoS, b.maxQoS)
 }
 
 // minQoS returns the minimum QoS level between two QoS levels
@@ -309,11 +540,30 @@ func (b *Broker) GetSubscriptionCount(clientID string) int {
 	return len(b.subscriptions.GetSubscriptions(clientID))
 }
 
+// GetAllSubscriptions returns every subscription held by the broker
+func (b *Broker) GetAllSubscriptions() []*Subscription {
+	return b.subscriptions.All()
+}
+
+// GetInflightCount returns the number of outbound QoS 1/2 messages awaiting acknowledgment for a client
+func (b *Broker) GetInflightCount(clientID string) int {
+	qos1, qos2 := b.qosManager.GetPendingMessageCount(clientID)
+	return qos1 + qos2
+}
+
+// QoSStats returns the QoS flow counters; it never blocks message flow
+func (b *Broker) QoSStats() QoSStats {
+	return b.qosManager.GetStatistics()
+}
+
 // GetRetainedMessageCount returns the number of retained messages
 func (b *Broker) GetRetainedMessageCount() int {
-	b.retainedMu.RLock()
-	defer b.retainedMu.RUnlock()
-	return len(b.retainedMsgs)
+	return b.retained.stats().Count
+}
+
+// RetainedStats returns the retained store's memory usage and limit counters
+func (b *Broker) RetainedStats() RetainedStats {
+	return b.retained.stats()
 }
 
 // HandlePubAck processes a PUBACK packet for QoS 1 flow
@@ -321,15 +571,21 @@ func (b *Broker) HandlePubAck(clientID string, packetID uint16) bool {
 	success := b.qosManager.HandlePubAck(clientID, packetID)
 	if success {
 		b.logger.LogQoSFlow(clientID, packetID, 1, "PUBACK_RECEIVED")
+		b.releaseDeferred(clientID)
+	} else {
+		b.unknownAck("PUBACK", clientID, packetID)
 	}
 	return success
 }
 
-// HandlePubRec processes a PUBREC packet for QoS 2 flow
+// HandlePubRec processes a PUBREC packet for QoS 2 flow. It returns nil
+// when packetID is not awaiting PUBREC.
 func (b *Broker) HandlePubRec(clientID string, packetID uint16) *packet.PubrelPacket {
 	pubrel, success := b.qosManager.HandlePubRec(clientID, packetID)
 	if success {
 		b.logger.LogQoSFlow(clientID, packetID, 2, "PUBREC_RECEIVED")
+	} else {
+		b.unknownAck("PUBREC", clientID, packetID)
 	}
 	return pubrel
 }
@@ -339,44 +595,60 @@ func (b *Broker) HandlePubComp(clientID string, packetID uint16) bool {
 	success := b.qosManager.HandlePubComp(clientID, packetID)
 	if success {
 		b.logger.LogQoSFlow(clientID, packetID, 2, "PUBCOMP_RECEIVED")
+		b.releaseDeferred(clientID)
+	} else {
+		b.unknownAck("PUBCOMP", clientID, packetID)
 	}
 	return success
 }
 
+// unknownAck records an acknowledgement for a packet ID that is not in
+// flight, e.g. a late ack for a message that already expired
+func (b *Broker) unknownAck(packetType, clientID string, packetID uint16) {
+	b.qosManager.stats.unknownAcks.Add(1)
+	b.logger.Warn("Acknowledgement for unknown packet ID",
+		logger.ClientID(clientID),
+		logger.String("packet_type", packetType),
+		logger.Int("packet_id", int(packetID)))
+}
+
 // HandleIncomingQoS2Publish handles an incoming QoS 2 PUBLISH packet
-func (b *Broker) HandleIncomingQoS2Publish(clientID string, packetID uint16, topic string, payload []byte, retain bool) *packet.PubrecPacket {
-	pubrec := b.qosManager.HandleIncomingQoS2Publish(clientID, packetID, topic, payload, retain)
+func (b *Broker) HandleIncomingQoS2Publish(clientID string, packetID uint16, msg *Message) *packet.PubrecPacket {
+	pubrec := b.qosManager.HandleIncomingQoS2Publish(clientID, packetID, msg)
+	b.saveQoS2(clientID, packetID, msg)
 	b.logger.LogQoSFlow(clientID, packetID, 2, "PUBREC_SENT")
 	return pubrec
 }
 
-// HandleIncomingPubRel handles an incoming PUBREL packet
-func (b *Broker) HandleIncomingPubRel(clientID string, packetID uint16) (*packet.PubcompPacket, error) {
-	receivedMsg, pubcomp := b.qosManager.HandleIncomingPubRel(clientID, packetID)
-
-	// If we have the message, deliver it now
-	if receivedMsg != nil {
-		// Process the message through the broker
-		publishPacket := &packet.PublishPacket{
-			Topic:    receivedMsg.Topic,
-			Payload:  receivedMsg.Payload,
-			QoS:      packet.QoSExactlyOnce,
-			Retain:   receivedMsg.Retain,
-			PacketID: &packetID,
-		}
+// HandleIncomingPubRel handles an incoming PUBREL packet. The released
+// message is routed in the order the client published it.
+func (b *Broker) HandleIncomingPubRel(clientID string, packetID uint16) *packet.PubcompPacket {
+	pubcomp := b.qosManager.HandleIncomingPubRel(clientID, packetID)
+	b.deleteQoS2(clientID, packetID)
+	b.logger.LogQoSFlow(clientID, packetID, 2, "PUBCOMP_SENT")
+	return pubcomp
+}
 
-		if err := b.HandlePublish(clientID, publishPacket); err != nil {
-			return pubcomp, err
-		}
+// routeReleased routes an inbound QoS 2 message once its handshake is released
+func (b *Broker) routeReleased(msg *ReceivedQoS2) {
+	if err := b.PublishMessage(msg.ClientID, msg.Message, packet.QoSExactlyOnce); err != nil {
+		b.logger.LogError(err, "Error routing released QoS 2 message", logger.ClientID(msg.ClientID))
 	}
-
-	b.logger.LogQoSFlow(clientID, packetID, 2, "PUBCOMP_SENT")
-	return pubcomp, nil
 }
 
-// Stop shuts down the broker and cleanup resources
+// Stop shuts down the broker and cleans up its resources. Calls after the
+// first do nothing.
 func (b *Broker) Stop() {
-	if b.qosManager != nil {
-		b.qosManager.Stop()
-	}
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+		if b.qosManager != nil {
+			b.qosManager.Stop()
+		}
+		if b.dispatcher != nil {
+			b.dispatcher.stop()
+		}
+		if b.limits != nil {
+			b.limits.stop()
+		}
+	})
 }
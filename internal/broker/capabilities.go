@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Capabilities lists optional features the broker may switch off. MQTT 3.1.1
+// cannot advertise them in CONNACK, so they are enforced on clients that use
+// them anyway.
+type Capabilities struct {
+	RetainAvailable       bool // Whether publishes and wills may set the retain flag
+	WildcardSubscriptions bool // Whether topic filters may contain + or #
+}
+
+// defaultCapabilities enables every feature
+var defaultCapabilities = Capabilities{RetainAvailable: true, WildcardSubscriptions: true}
+
+// WithCapabilities switches off the features disabled in caps
+func WithCapabilities(caps Capabilities) Option {
+	return func(b *Broker) {
+		b.capabilities = caps
+	}
+}
+
+// CheckRetain reports whether a publish with the given retain flag is
+// accepted. Clients retaining while retain is unavailable should be
+// disconnected.
+func (b *Broker) CheckRetain(retain bool) error {
+	if retain && !b.capabilities.RetainAvailable {
+		return &er.Err{
+			Context: "Broker, Publish",
+			Message: er.ErrRetainNotSupported,
+		}
+	}
+	return nil
+}
+
+// allowsFilter reports whether topicFilter uses only available features
+func (b *Broker) allowsFilter(topicFilter string) bool {
+	return b.capabilities.WildcardSubscriptions || !strings.ContainsAny(topicFilter, "+#")
+}
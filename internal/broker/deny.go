@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// WithDeniedFilters refuses subscriptions to the given topic filters with a
+// SUBACK failure. An entry denies the filter equal to it; an entry ending in
+// /# also denies every filter under its prefix, so "$internal/#" refuses
+// "$internal/jobs" and "$internal/+/state" too. Wildcards in entries are
+// otherwise matched literally, so "#" refuses only a bare "#".
+func WithDeniedFilters(filters []string) Option {
+	return func(b *Broker) {
+		b.deniedFilters = append(b.deniedFilters[:0:0], filters...)
+	}
+}
+
+// CheckSubscribe reports whether a client may subscribe to topicFilter,
+// applying the same rules as SUBSCRIBE, for in-process consumers that read
+// messages on a user's behalf
+func (b *Broker) CheckSubscribe(topicFilter string) error {
+	if err := utils.ValidateTopicFilter(topicFilter); err != nil {
+		return err
+	}
+	if !b.allowsFilter(topicFilter) {
+		return &er.Err{Context: "Broker, Subscribe", Message: er.ErrWildcardsNotAvailable}
+	}
+	if b.deniesFilter(topicFilter) {
+		return &er.Err{Context: "Broker, Subscribe", Message: er.ErrFilterDenied}
+	}
+	return nil
+}
+
+// deniesFilter reports whether topicFilter is on the deny-list
+func (b *Broker) deniesFilter(topicFilter string) bool {
+	for _, denied := range b.deniedFilters {
+		if topicFilter == denied {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(denied, "/#"); ok {
+			if topicFilter == prefix || strings.HasPrefix(topicFilter, prefix+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"hash/maphash"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// DefaultDeliveryQueueSize is the per-worker queue length used when none is configured
+const DefaultDeliveryQueueSize = 1024
+
+// DefaultPriorityBurst is how many high priority deliveries a worker runs
+// in a row, while normal ones wait, when none is configured
+const DefaultPriorityBurst = 8
+
+// delivery is a single message routed to a single subscription
+type delivery struct {
+	subscription *Subscription
+	msg          *Message
+	qos          packet.QoSLevel
+	high         bool // Published to a priority topic
+}
+
+// workerQueues holds one worker's pending deliveries by priority
+type workerQueues struct {
+	high   chan delivery
+	normal chan delivery
+}
+
+// dispatcher hands deliveries to a fixed set of workers. Each client is
+// pinned to one worker so its messages keep their publish order within
+// each priority.
+type dispatcher struct {
+	queues []workerQueues
+	burst  int // High priority deliveries run before a waiting normal one
+	seed   maphash.Seed
+	stopCh chan struct{}
+}
+
+// WithDeliveryWorkers delivers published messages on a bounded pool of
+// workers instead of the publisher's goroutine, so a slow subscriber only
+// delays the clients sharing its worker. A full queue blocks the publisher.
+func WithDeliveryWorkers(workers, queueSize int) Option {
+	return func(b *Broker) {
+		if workers <= 0 {
+			return
+		}
+		if queueSize <= 0 {
+			queueSize = DefaultDeliveryQueueSize
+		}
+
+		d := &dispatcher{
+			queues: make([]workerQueues, workers),
+			burst:  DefaultPriorityBurst,
+			seed:   maphash.MakeSeed(),
+			stopCh: make(chan struct{}),
+		}
+		for i := range d.queues {
+			d.queues[i] = workerQueues{
+				high:   make(chan delivery, queueSize),
+				normal: make(chan delivery, queueSize),
+			}
+		}
+		b.dispatcher = d
+	}
+}
+
+// start runs the workers. It is called once all options are applied.
+func (d *dispatcher) start() {
+	for _, queues := range d.queues {
+		go d.work(queues)
+	}
+}
+
+// dispatch queues a delivery on the worker owning the subscriber
+func (d *dispatcher) dispatch(job delivery) {
+	queues := d.queues[maphash.String(d.seed, job.subscription.ClientID)%uint64(len(d.queues))]
+	queue := queues.normal
+	if job.high {
+		queue = queues.high
+	}
+	select {
+	case queue <- job:
+	case <-d.stopCh:
+	}
+}
+
+// work runs deliveries until the dispatcher stops. High priority ones go
+// first, but after burst of them in a row a waiting normal delivery runs,
+// so bulk traffic keeps moving while priority traffic is heavy.
+func (d *dispatcher) work(queues workerQueues) {
+	served := 0 // High priority deliveries since the last normal one
+	for {
+		preferred, other := queues.high, queues.normal
+		if served >= d.burst {
+			preferred, other = other, preferred
+		}
+
+		var job delivery
+		select {
+		case job = <-preferred:
+		default:
+			select {
+			case <-d.stopCh:
+				return
+			case job = <-preferred:
+			case job = <-other:
+			}
+		}
+
+		if job.high {
+			served++
+		} else {
+			served = 0
+		}
+		job.subscription.Handler(job.msg, job.qos)
+	}
+}
+
+// stop terminates the workers; queued deliveries are dropped
+func (d *dispatcher) stop() {
+	close(d.stopCh)
+}
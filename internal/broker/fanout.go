@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"hash/maphash"
+	"runtime"
+	"sync"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// fanout delivers large fan-outs on several goroutines at once. Deliveries
+// are partitioned by client so each client is written to by one goroutine,
+// and the publish waits for every partition, so message order per client
+// is the same as with sequential delivery.
+type fanout struct {
+	threshold int
+	workers   int
+	seed      maphash.Seed
+}
+
+// WithParallelFanout delivers messages matching at least threshold
+// subscriptions on up to workers goroutines instead of one sequential loop,
+// keeping publish latency flat for topics with thousands of subscribers.
+// It has no effect with delivery workers, which already take delivery off
+// the publisher's goroutine. workers <= 0 uses GOMAXPROCS.
+func WithParallelFanout(threshold, workers int) Option {
+	return func(b *Broker) {
+		if threshold <= 0 {
+			return
+		}
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		b.fanout = &fanout{
+			threshold: threshold,
+			workers:   workers,
+			seed:      maphash.MakeSeed(),
+		}
+	}
+}
+
+// deliver hands msg to every subscription and returns once all are done
+func (f *fanout) deliver(matches []*Subscription, msg *Message, qos packet.QoSLevel) {
+	parts := make([][]*Subscription, f.workers)
+	for _, subscription := range matches {
+		if subscription.Handler == nil {
+			continue
+		}
+		i := maphash.String(f.seed, subscription.ClientID) % uint64(len(parts))
+		parts[i] = append(parts[i], subscription)
+	}
+
+	var wg sync.WaitGroup
+	for _, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, subscription := range part {
+				subscription.Handler(msg, minQoS(qos, subscription.QoS))
+			}
+		}()
+	}
+	wg.Wait()
+}
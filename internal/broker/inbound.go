@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"io"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+)
+
+// QoS2Persister saves the QoS 2 messages persistent sessions have published
+// but not released yet, so a restart between PUBLISH and PUBREL neither
+// loses nor duplicates them
+type QoS2Persister interface {
+	SaveQoS2(clientID string, packetID uint16, topic string, payload []byte, retain bool) error
+	DeleteQoS2(clientID string, packetID uint16) error
+	DeleteQoS2s(clientID string) error
+}
+
+// WithQoS2Persister saves every QoS 2 message received from a client with
+// CleanSession=0 to p until its PUBREL arrives, it expires or the session is
+// purged. Use RestoreQoS2 to load them back.
+func WithQoS2Persister(p QoS2Persister) Option {
+	return func(b *Broker) {
+		b.qos2Persister = p
+	}
+}
+
+// RestoreQoS2 puts a persisted inbound QoS 2 message back as awaiting
+// PUBREL, along with a disconnected persistent session for its client if
+// none is stored yet. The client counts as suspended until it reconnects,
+// so the message does not expire meanwhile. Call it before clients connect.
+func (b *Broker) RestoreQoS2(clientID string, packetID uint16, topic string, payload []byte, retain bool) {
+	if _, ok := b.Get(clientID); !ok {
+		b.restoreSession(clientID)
+	}
+	b.qosManager.HandleIncomingQoS2Publish(clientID, packetID, NewMessage(topic, payload, retain))
+	b.qosManager.Suspend(clientID)
+}
+
+// saveQoS2 persists an inbound QoS 2 message of a persistent session
+func (b *Broker) saveQoS2(clientID string, packetID uint16, msg *Message) {
+	if b.qos2Persister == nil {
+		return
+	}
+	if session, ok := b.Get(clientID); !ok || session.CleanSession {
+		return
+	}
+
+	payload := msg.Payload
+	if msg.Spilled() {
+		var err error
+		if payload, err = io.ReadAll(msg.PayloadReader()); err != nil {
+			b.logger.LogError(err, "Failed to read spilled QoS 2 message", logger.ClientID(clientID))
+			return
+		}
+	}
+	if err := b.qos2Persister.SaveQoS2(clientID, packetID, msg.Topic, payload, msg.Retain); err != nil {
+		b.logger.LogError(err, "Failed to persist QoS 2 message",
+			logger.ClientID(clientID),
+			logger.Int("packet_id", int(packetID)))
+	}
+}
+
+// deleteQoS2 removes a persisted inbound QoS 2 message
+func (b *Broker) deleteQoS2(clientID string, packetID uint16) {
+	if b.qos2Persister == nil {
+		return
+	}
+	if err := b.qos2Persister.DeleteQoS2(clientID, packetID); err != nil {
+		b.logger.LogError(err, "Failed to delete persisted QoS 2 message",
+			logger.ClientID(clientID),
+			logger.Int("packet_id", int(packetID)))
+	}
+}
+
+// deleteQoS2s removes every persisted inbound QoS 2 message of a client
+func (b *Broker) deleteQoS2s(clientID string) {
+	if b.qos2Persister == nil {
+		return
+	}
+	if err := b.qos2Persister.DeleteQoS2s(clientID); err != nil {
+		b.logger.LogError(err, "Failed to delete persisted QoS 2 messages", logger.ClientID(clientID))
+	}
+}
+
+// expireQoS2 forgets an inbound QoS 2 message whose PUBREL never came
+func (b *Broker) expireQoS2(msg *ReceivedQoS2) {
+	b.deleteQoS2(msg.ClientID, msg.PacketID)
+}
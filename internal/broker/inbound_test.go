@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memQoS2 is an in-memory QoS2Persister
+type memQoS2 struct {
+	mu   sync.Mutex
+	rows map[string]map[uint16]string
+}
+
+func (m *memQoS2) SaveQoS2(clientID string, packetID uint16, topic string, _ []byte, _ bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rows[clientID] == nil {
+		m.rows[clientID] = make(map[uint16]string)
+	}
+	m.rows[clientID][packetID] = topic
+	return nil
+}
+
+func (m *memQoS2) DeleteQoS2(clientID string, packetID uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rows[clientID], packetID)
+	return nil
+}
+
+func (m *memQoS2) DeleteQoS2s(clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rows, clientID)
+	return nil
+}
+
+func (m *memQoS2) has(clientID string, packetID uint16) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.rows[clientID][packetID]
+	return ok
+}
+
+// An unreleased inbound QoS 2 message of a client that is away outlives
+// QoS2Timeout, and its PUBREL still routes it once
+func TestQoS2KeptWhileSuspended(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(b *Broker, store *memQoS2)
+	}{
+		{"restored", func(b *Broker, store *memQoS2) {
+			_ = store.SaveQoS2("c1", 7, "t/a", []byte("x"), false)
+			b.RestoreQoS2("c1", 7, "t/a", []byte("x"), false)
+		}},
+		{"suspended", func(b *Broker, _ *memQoS2) {
+			b.restoreSession("c1")
+			b.HandleIncomingQoS2Publish("c1", 7, NewMessage("t/a", []byte("x"), false))
+			b.qosManager.Suspend("c1")
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &memQoS2{rows: make(map[string]map[uint16]string)}
+			b := New(WithQoS2Persister(store))
+			defer b.Stop()
+
+			routed := make(chan *Message, 2)
+			cancel, err := b.Tap("t/#", func(msg *Message) { routed <- msg })
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cancel()
+
+			tc.setup(b, store)
+			if !store.has("c1", 7) {
+				t.Fatal("message was not persisted")
+			}
+
+			for range int(QoS2Timeout/timerTick) + timerSlots {
+				b.qosManager.processRetries()
+			}
+			if !store.has("c1", 7) {
+				t.Fatal("persisted message expired while its client was away")
+			}
+			if got := b.qosManager.GetStatistics().QoS2Received; got != 1 {
+				t.Fatalf("QoS2Received = %d, want 1", got)
+			}
+
+			b.HandleIncomingPubRel("c1", 7)
+			select {
+			case msg := <-routed:
+				if msg.Topic != "t/a" || string(msg.Payload) != "x" {
+					t.Fatalf("routed %q %q", msg.Topic, msg.Payload)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("PUBREL did not route the message")
+			}
+			if store.has("c1", 7) {
+				t.Fatal("released message is still persisted")
+			}
+
+			b.HandleIncomingPubRel("c1", 7)
+			select {
+			case <-routed:
+				t.Fatal("second PUBREL routed the message again")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// inflightWindow caps the outbound QoS 1 and 2 messages awaiting
+// acknowledgement per client. Deliveries beyond the window wait in a
+// per-client queue and are sent, in order, as acknowledgements free it.
+type inflightWindow struct {
+	limit      int // Messages in flight per client, counting QoS 2 until PUBCOMP
+	queueLimit int // Messages deferred per client; the oldest is dropped beyond it. 0 is unlimited
+	mu         sync.Mutex
+	deferred   map[string][]queuedMessage
+	queued     atomic.Int64
+	dropped    atomic.Uint64
+}
+
+// InflightStats is a point-in-time view of the in-flight window queues
+type InflightStats struct {
+	Limit    int    `json:"limit"`    // Messages in flight per client; 0 is unlimited
+	Queue    int    `json:"queue"`    // Messages deferred per client; 0 is unlimited
+	Deferred int64  `json:"deferred"` // Messages waiting for room in their client's window
+	Dropped  uint64 `json:"dropped"`  // Messages dropped because a deferred queue was full
+}
+
+// WithInflightWindow lets each client have at most limit QoS 1 and 2
+// messages awaiting acknowledgement. Further deliveries are deferred until
+// acknowledgements arrive, keeping up to queueLimit per client (0 is
+// unlimited) before the oldest is dropped.
+func WithInflightWindow(limit, queueLimit int) Option {
+	return func(b *Broker) {
+		if limit > 0 {
+			b.inflight = &inflightWindow{
+				limit:      limit,
+				queueLimit: max(queueLimit, 0),
+				deferred:   make(map[string][]queuedMessage),
+			}
+		}
+	}
+}
+
+// admit reports whether a QoS 1 or 2 delivery to clientID may be sent now.
+// Otherwise it is deferred: when the window is full, or when older
+// deliveries are already waiting so it can't overtake them.
+func (b *Broker) admit(clientID string, msg *Message, qos packet.QoSLevel) bool {
+	w := b.inflight
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue := w.deferred[clientID]
+	if len(queue) == 0 && b.qosManager.Inflight(clientID) < w.limit {
+		return true
+	}
+	if w.queueLimit > 0 && len(queue) >= w.queueLimit {
+		queue[0] = queuedMessage{}
+		queue = queue[1:]
+		w.queued.Add(-1)
+		w.dropped.Add(1)
+		b.logger.Warn("Dropping deferred message: in-flight queue full", logger.ClientID(clientID))
+	}
+	w.deferred[clientID] = append(queue, queuedMessage{msg: msg, qos: qos})
+	w.queued.Add(1)
+	return false
+}
+
+// releaseDeferred sends deferred deliveries to clientID while its window
+// has room. It is called whenever an acknowledgement frees a slot.
+func (b *Broker) releaseDeferred(clientID string) {
+	if b.inflight == nil {
+		return
+	}
+	w := b.inflight
+	// Held across the send so a new delivery can't be admitted and written
+	// between taking a deferred one off the queue and writing it
+	order := b.lockDelivery(clientID)
+	defer order.Unlock()
+	for {
+		w.mu.Lock()
+		queue := w.deferred[clientID]
+		if len(queue) == 0 || b.qosManager.Inflight(clientID) >= w.limit {
+			w.mu.Unlock()
+			return
+		}
+		next := queue[0]
+		queue[0] = queuedMessage{}
+		if len(queue) == 1 {
+			delete(w.deferred, clientID)
+		} else {
+			w.deferred[clientID] = queue[1:]
+		}
+		w.queued.Add(-1)
+		w.mu.Unlock()
+
+		session, ok := b.Get(clientID)
+		if !ok || session.Conn == nil {
+			// Disconnected; HandleClientDisconnect takes the rest
+			w.mu.Lock()
+			w.deferred[clientID] = append([]queuedMessage{next}, w.deferred[clientID]...)
+			w.queued.Add(1)
+			w.mu.Unlock()
+			return
+		}
+		b.transmit(session, next.msg, next.qos)
+	}
+}
+
+// takeDeferred removes and returns the deliveries deferred for clientID
+func (w *inflightWindow) takeDeferred(clientID string) []queuedMessage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue := w.deferred[clientID]
+	delete(w.deferred, clientID)
+	w.queued.Add(-int64(len(queue)))
+	return queue
+}
+
+// SetInflightWindow changes how many QoS 1 and 2 messages each client may
+// have awaiting acknowledgement and how many are deferred beyond that.
+// Clients with deferred deliveries are sent as many as the new window
+// allows. The window can only be resized, not enabled, at runtime.
+func (b *Broker) SetInflightWindow(limit, queueLimit int) error {
+	w := b.inflight
+	if w == nil {
+		return &er.Err{
+			Context: "Broker, Inflight Window",
+			Message: er.ErrInflightWindowDisabled,
+		}
+	}
+
+	w.mu.Lock()
+	w.limit = max(limit, 1)
+	w.queueLimit = max(queueLimit, 0)
+	waiting := make([]string, 0, len(w.deferred))
+	for clientID, queue := range w.deferred {
+		if over := len(queue) - w.queueLimit; w.queueLimit > 0 && over > 0 {
+			clear(queue[:over])
+			queue = queue[over:]
+			w.deferred[clientID] = queue
+			w.queued.Add(-int64(over))
+			w.dropped.Add(uint64(over))
+		}
+		waiting = append(waiting, clientID)
+	}
+	w.mu.Unlock()
+
+	for _, clientID := range waiting {
+		b.releaseDeferred(clientID)
+	}
+	return nil
+}
+
+// InflightStats returns the in-flight window's limits and queue counters
+func (b *Broker) InflightStats() InflightStats {
+	if b.inflight == nil {
+		return InflightStats{}
+	}
+	b.inflight.mu.Lock()
+	limit, queueLimit := b.inflight.limit, b.inflight.queueLimit
+	b.inflight.mu.Unlock()
+	return InflightStats{
+		Limit:    limit,
+		Queue:    queueLimit,
+		Deferred: b.inflight.queued.Load(),
+		Dropped:  b.inflight.dropped.Load(),
+	}
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"errors"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Interceptor inspects a message before it is routed. It may change the
+// message's fields; returning an error drops the message, and returning
+// er.ErrMessageDropped drops it without logging an error.
+type Interceptor func(clientID string, msg *Message) error
+
+// WithInterceptor adds fn to the interceptors run, in the order added, on
+// every message before it is routed or retained
+func WithInterceptor(fn Interceptor) Option {
+	return func(b *Broker) {
+		b.interceptors = append(b.interceptors, fn)
+	}
+}
+
+// intercept runs the interceptors on msg and returns the first error
+func (b *Broker) intercept(clientID string, msg *Message) error {
+	for _, fn := range b.interceptors {
+		if err := fn(clientID, msg); err != nil {
+			if errors.Is(err, er.ErrMessageDropped) {
+				b.logger.Debug("Message dropped by interceptor", logger.ClientID(clientID), logger.String("topic", msg.Topic))
+			}
+			return err
+		}
+	}
+	return nil
+}
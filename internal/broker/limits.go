@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Fractions of the memory limit at which the broker starts shedding load
+const (
+	shedQoS0Ratio = 0.80
+	rejectRatio   = 0.95
+)
+
+// loadSampleInterval is how often heap usage is compared against the memory limit
+const loadSampleInterval = 500 * time.Millisecond
+
+// heapObjectsMetric is the runtime metric sampled for heap usage
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// ResourceLimits bounds the memory the broker may use before it degrades
+// instead of running out of memory
+type ResourceLimits struct {
+	MemoryLimit    int64          // Heap bytes; QoS 0 is shed at 80% and publishes are rejected at 95%. 0 disables
+	InflightBytes  int64          // Payload bytes held by all QoS 1/2 state. 0 is unlimited
+	InflightPolicy InflightPolicy // What happens once InflightBytes is reached
+}
+
+// InflightPolicy decides how the broker sheds load once QoS state reaches
+// its byte budget
+type InflightPolicy int
+
+const (
+	// InflightReject refuses inbound QoS 1/2 publishes until state drains
+	InflightReject InflightPolicy = iota
+	// InflightDowngrade keeps accepting publishes but delivers them at
+	// QoS 0, so no further state is held
+	InflightDowngrade
+)
+
+// loadState is how far the broker is degrading
+type loadState int32
+
+const (
+	loadNormal   loadState = iota
+	loadShedQoS0           // QoS 0 publishes and deliveries are dropped
+	loadReject             // All inbound publishes are refused
+)
+
+func (s loadState) String() string {
+	switch s {
+	case loadShedQoS0:
+		return "shedding_qos0"
+	case loadReject:
+		return "rejecting"
+	default:
+		return "normal"
+	}
+}
+
+// LoadStats is a point-in-time view of resource usage against the configured limits
+type LoadStats struct {
+	State         string `json:"state"` // normal, shedding_qos0 or rejecting
+	HeapBytes     uint64 `json:"heap_bytes"`
+	MemoryLimit   int64  `json:"memory_limit"`
+	InflightBytes int64  `json:"inflight_bytes"` // Payload bytes held by QoS 1/2 state; shared payloads count once per holder
+	InflightLimit int64  `json:"inflight_limit"`
+	Shed          uint64 `json:"shed"`         // QoS 0 messages dropped under memory pressure
+	Rejected      uint64 `json:"rejected"`     // Inbound publishes refused over a limit
+	Downgraded    uint64 `json:"downgraded"`   // Deliveries sent at QoS 0 over the inflight budget
+	SlowDropped   uint64 `json:"slow_dropped"` // QoS 0 deliveries dropped while a client's writes were stalled
+}
+
+// loadMonitor samples heap usage and decides when to shed load
+type loadMonitor struct {
+	limits     ResourceLimits
+	state      atomic.Int32
+	heapBytes  atomic.Uint64
+	shed       atomic.Uint64
+	rejected   atomic.Uint64
+	downgraded atomic.Uint64
+	stopCh     chan struct{}
+}
+
+// WithResourceLimits makes the broker shed QoS 0 traffic and then reject
+// publishes as it approaches its limits, instead of growing until it is
+// killed. Pair MemoryLimit with debug.SetMemoryLimit so the GC works
+// harder before shedding starts.
+func WithResourceLimits(limits ResourceLimits) Option {
+	return func(b *Broker) {
+		if limits.MemoryLimit <= 0 && limits.InflightBytes <= 0 {
+			return
+		}
+		m := &loadMonitor{
+			limits: limits,
+			stopCh: make(chan struct{}),
+		}
+		if limits.MemoryLimit > 0 {
+			m.sample()
+			go m.run()
+		}
+		b.limits = m
+	}
+}
+
+func (m *loadMonitor) run() {
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// sample reads heap usage and updates the load state
+func (m *loadMonitor) sample() {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return
+	}
+	heap := sample[0].Value.Uint64()
+	m.heapBytes.Store(heap)
+
+	state := loadNormal
+	switch ratio := float64(heap) / float64(m.limits.MemoryLimit); {
+	case ratio >= rejectRatio:
+		state = loadReject
+	case ratio >= shedQoS0Ratio:
+		state = loadShedQoS0
+	}
+	m.state.Store(int32(state))
+}
+
+func (m *loadMonitor) stop() {
+	close(m.stopCh)
+}
+
+// admit reports whether an inbound publish may be routed
+func (m *loadMonitor) admit(qos packet.QoSLevel, inflightBytes int64) bool {
+	switch loadState(m.state.Load()) {
+	case loadReject:
+		return false
+	case loadShedQoS0:
+		if qos == packet.QoSAtMostOnce {
+			return false
+		}
+	}
+	if qos > packet.QoSAtMostOnce && m.limits.InflightPolicy == InflightReject && m.overBudget(inflightBytes) {
+		return false
+	}
+	return true
+}
+
+// overBudget reports whether QoS state has reached the inflight budget
+func (m *loadMonitor) overBudget(inflightBytes int64) bool {
+	return m.limits.InflightBytes > 0 && inflightBytes >= m.limits.InflightBytes
+}
+
+// AdmitPublish checks an inbound publish at qos against the resource limits.
+// Refused QoS 0 messages should be dropped; refused QoS 1 and 2 messages
+// must not be acknowledged, so the client resends them later.
+func (b *Broker) AdmitPublish(qos packet.QoSLevel) error {
+	if b.limits == nil {
+		return nil
+	}
+	if b.limits.admit(qos, b.inflightBytes()) {
+		return nil
+	}
+
+	if qos == packet.QoSAtMostOnce {
+		b.limits.shed.Add(1)
+	} else {
+		b.limits.rejected.Add(1)
+	}
+	return &er.Err{
+		Context: "Broker",
+		Message: er.ErrBrokerOverloaded,
+	}
+}
+
+// deliveryQoS returns the QoS to deliver at, downgrading QoS 1/2 to QoS 0
+// while over the inflight budget with InflightDowngrade
+func (b *Broker) deliveryQoS(qos packet.QoSLevel) packet.QoSLevel {
+	if qos == packet.QoSAtMostOnce || b.limits == nil || b.limits.limits.InflightPolicy != InflightDowngrade {
+		return qos
+	}
+	if !b.limits.overBudget(b.inflightBytes()) {
+		return qos
+	}
+	b.limits.downgraded.Add(1)
+	return packet.QoSAtMostOnce
+}
+
+// inflightBytes returns the payload bytes held by all QoS 1/2 state
+func (b *Broker) inflightBytes() int64 {
+	return b.qosManager.stats.pendingBytes.Load() + b.qosManager.stats.heldBytes.Load()
+}
+
+// shedDelivery reports whether an outbound QoS 0 delivery should be dropped
+func (b *Broker) shedDelivery() bool {
+	if b.limits == nil || loadState(b.limits.state.Load()) == loadNormal {
+		return false
+	}
+	b.limits.shed.Add(1)
+	return true
+}
+
+// LoadStats returns resource usage against the configured limits
+func (b *Broker) LoadStats() LoadStats {
+	stats := LoadStats{
+		State:         loadNormal.String(),
+		InflightBytes: b.inflightBytes(),
+		SlowDropped:   b.slowDropped.Load(),
+	}
+	if b.limits == nil {
+		return stats
+	}
+
+	stats.State = loadState(b.limits.state.Load()).String()
+	stats.HeapBytes = b.limits.heapBytes.Load()
+	stats.MemoryLimit = b.limits.limits.MemoryLimit
+	stats.InflightLimit = b.limits.limits.InflightBytes
+	stats.Shed = b.limits.shed.Load()
+	stats.Rejected = b.limits.rejected.Load()
+	stats.Downgraded = b.limits.downgraded.Load()
+	return stats
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// QoSPolicy decides what happens to publishes above the broker's maximum QoS.
+// MQTT 3.1.1 cannot advertise a maximum QoS, so clients may send them.
+type QoSPolicy int
+
+const (
+	// QoSDowngrade acknowledges the publish as sent and routes it at the
+	// maximum QoS
+	QoSDowngrade QoSPolicy = iota
+	// QoSDisconnect closes the publisher's connection
+	QoSDisconnect
+)
+
+// WithMaxQoS caps subscriptions and routing at maxQoS and applies policy to
+// publishes above it
+func WithMaxQoS(maxQoS packet.QoSLevel, policy QoSPolicy) Option {
+	return func(b *Broker) {
+		b.maxQoS = min(maxQoS, packet.QoSExactlyOnce)
+		b.qosPolicy = policy
+	}
+}
+
+// CheckPublishQoS reports whether an inbound publish at qos is accepted.
+// Accepted publishes above the maximum are routed at the maximum QoS.
+func (b *Broker) CheckPublishQoS(qos packet.QoSLevel) error {
+	if qos <= b.maxQoS || b.qosPolicy == QoSDowngrade {
+		return nil
+	}
+	return &er.Err{
+		Context: "Broker, Publish",
+		Message: er.ErrQoSNotSupported,
+	}
+}
@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// Message is a published message shared by every delivery of a fan-out,
+// the QoS retry state and the retained store. Its PUBLISH frame is encoded
+// at most once per QoS level.
+//
+// Ownership: the payload handed to NewMessage belongs to the message from
+// then on and is read-only. Callers must not modify or reuse the slice, and
+// holders must never write to Payload; share the *Message instead of copying.
+//
+// Payloads above the configured threshold are spilled to disk (see
+// NewSpilledMessage); Payload is then nil and the frame holds only the header.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+	Origin  string   // In-process publisher that created it, such as a bridge; empty for client publishes
+	Route   []string // IDs of the brokers it was bridged from, oldest first; read-only
+
+	spill   *spillFile
+	frames  [3]encodedFrame // Indexed by QoS level
+	batched bool            // Published to a batch topic
+}
+
+// encodedFrame lazily holds an encoded PUBLISH for one QoS level
+type encodedFrame struct {
+	once sync.Once
+	data []byte
+}
+
+// NewMessage creates a message for delivery to subscribers
+func NewMessage(topic string, payload []byte, retain bool) *Message {
+	return &Message{
+		Topic:   topic,
+		Payload: payload,
+		Retain:  retain,
+	}
+}
+
+// Size returns the payload length in bytes
+func (m *Message) Size() int {
+	if m.spill != nil {
+		return int(m.spill.size)
+	}
+	return len(m.Payload)
+}
+
+// Spilled reports whether the payload is kept on disk instead of in Payload
+func (m *Message) Spilled() bool {
+	return m.spill != nil
+}
+
+// PayloadReader returns a reader over the payload, wherever it is kept
+func (m *Message) PayloadReader() io.Reader {
+	if m.spill != nil {
+		return io.NewSectionReader(m.spill.file, 0, m.spill.size)
+	}
+	return bytes.NewReader(m.Payload)
+}
+
+// Frame returns the encoded PUBLISH for the given QoS. QoS 0 frames are
+// shared and must not be modified; for QoS 1 and 2 the cached frame is
+// copied and packetID is written into the copy. For spilled messages the
+// frame ends after the header and the payload is streamed by writeMessage.
+func (m *Message) Frame(qos packet.QoSLevel, packetID uint16) []byte {
+	f := &m.frames[qos]
+	f.once.Do(func() {
+		pp := &packet.PublishPacket{
+			Topic:   m.Topic,
+			Payload: m.Payload,
+			QoS:     qos,
+			Retain:  m.Retain,
+		}
+		if qos > packet.QoSAtMostOnce {
+			pp.PacketID = new(uint16) // Placeholder, patched per delivery
+		}
+		if m.spill != nil {
+			f.data = pp.EncodeHeader(m.Size())
+		} else {
+			f.data = pp.Encode()
+		}
+	})
+
+	if qos == packet.QoSAtMostOnce {
+		return f.data
+	}
+
+	frame := make([]byte, len(f.data))
+	copy(frame, f.data)
+	// The packet ID sits directly before the payload
+	binary.BigEndian.PutUint16(frame[len(frame)-len(m.Payload)-2:], packetID)
+	return frame
+}
@@ -0,0 +1,242 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// queuedMessage is a delivery waiting for its client to reconnect
+type queuedMessage struct {
+	msg *Message
+	qos packet.QoSLevel
+}
+
+// offlineQueue holds QoS 1 and 2 messages for persistent sessions while
+// their client is disconnected. A client has a queue from the moment it
+// disconnects until the queue has been drained after it reconnects; while
+// it has one, every delivery to it goes through the queue so messages
+// published during the drain cannot overtake older ones.
+type offlineQueue struct {
+	limit   int // Messages kept per client; the oldest is dropped beyond it
+	mu      sync.Mutex
+	queues  map[string][]queuedMessage
+	holding atomic.Int32 // len(queues), read without the lock on every delivery
+	queued  atomic.Int64
+	dropped atomic.Uint64
+}
+
+// OfflineStats is a point-in-time view of the offline queues
+type OfflineStats struct {
+	Limit    int    `json:"limit"`    // Messages kept per client; 0 means the queue is disabled
+	Sessions int    `json:"sessions"` // Persistent sessions with messages held for them
+	Queued   int64  `json:"queued"`   // Messages waiting for their client to reconnect
+	Dropped  uint64 `json:"dropped"`  // Messages dropped because a queue was full
+}
+
+// WithOfflineQueue queues up to limit QoS 1 and 2 messages for each
+// persistent session (CleanSession=0) while its client is disconnected,
+// delivering them once it reconnects. When a queue is full the oldest
+// message is dropped. QoS 0 messages are never queued.
+func WithOfflineQueue(limit int) Option {
+	return func(b *Broker) {
+		if limit > 0 {
+			b.offline = &offlineQueue{limit: limit, queues: make(map[string][]queuedMessage)}
+		}
+	}
+}
+
+// open starts holding deliveries for clientID
+func (q *offlineQueue) open(clientID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.queues[clientID]; !ok {
+		q.queues[clientID] = nil
+		q.holding.Add(1)
+	}
+}
+
+// hold queues msg if clientID has a queue and reports whether it did. A
+// QoS 0 message for a disconnected client is discarded and also reported
+// as held, since there is nothing else to do with it.
+func (q *offlineQueue) hold(clientID string, online bool, msg *Message, qos packet.QoSLevel) bool {
+	if q.holding.Load() == 0 {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, ok := q.queues[clientID]
+	if !ok {
+		return false
+	}
+	if qos == packet.QoSAtMostOnce && !online {
+		return true
+	}
+	if len(queue) >= q.limit {
+		queue[0] = queuedMessage{}
+		queue = queue[1:]
+		q.queued.Add(-1)
+		q.dropped.Add(1)
+	}
+	q.queues[clientID] = append(queue, queuedMessage{msg: msg, qos: qos})
+	q.queued.Add(1)
+	return true
+}
+
+// next takes the messages queued for clientID. Once none are left the
+// queue is removed and deliveries go straight to the client again.
+func (q *offlineQueue) next(clientID string) []queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, ok := q.queues[clientID]
+	if !ok {
+		return nil
+	}
+	if len(queue) == 0 {
+		delete(q.queues, clientID)
+		q.holding.Add(-1)
+		return nil
+	}
+	q.queues[clientID] = nil
+	q.queued.Add(-int64(len(queue)))
+	return queue
+}
+
+// requeue puts messages back at the front of clientID's queue, such as
+// deliveries deferred by the in-flight window when the client disconnected
+func (q *offlineQueue) requeue(clientID string, messages []queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, ok := q.queues[clientID]
+	if !ok {
+		q.holding.Add(1)
+	}
+	queue = append(messages, queue...)
+	q.queued.Add(int64(len(messages)))
+	if over := len(queue) - q.limit; over > 0 {
+		queue = queue[over:]
+		q.queued.Add(-int64(over))
+		q.dropped.Add(uint64(over))
+	}
+	q.queues[clientID] = queue
+}
+
+// empty drops the messages in clientID's queue, keeping the queue itself so
+// deliveries are still held while the client is away, and returns how many
+// were dropped
+func (q *offlineQueue) empty(clientID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[clientID]
+	if len(queue) > 0 {
+		q.queues[clientID] = nil
+		q.queued.Add(-int64(len(queue)))
+	}
+	return len(queue)
+}
+
+// discard removes clientID's queue and everything in it
+func (q *offlineQueue) discard(clientID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queue, ok := q.queues[clientID]; ok {
+		delete(q.queues, clientID)
+		q.holding.Add(-1)
+		q.queued.Add(-int64(len(queue)))
+	}
+}
+
+// setLimit changes how many messages are kept per client, dropping the
+// oldest from queues already over it
+func (q *offlineQueue) setLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limit = limit
+	for clientID, queue := range q.queues {
+		if over := len(queue) - limit; over > 0 {
+			clear(queue[:over])
+			q.queues[clientID] = queue[over:]
+			q.queued.Add(-int64(over))
+			q.dropped.Add(uint64(over))
+		}
+	}
+}
+
+func (q *offlineQueue) stats() OfflineStats {
+	q.mu.Lock()
+	limit := q.limit
+	q.mu.Unlock()
+	return OfflineStats{
+		Limit:    limit,
+		Sessions: int(q.holding.Load()),
+		Queued:   q.queued.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
+
+// DrainOffline delivers the messages queued for clientID while it was
+// disconnected, in the order they were published. Call it once the client's
+// CONNACK has been sent and its new connection stored.
+func (b *Broker) DrainOffline(clientID string) {
+	if b.offline == nil {
+		return
+	}
+
+	delivered := 0
+	for {
+		queue := b.offline.next(clientID)
+		if queue == nil {
+			break
+		}
+		session, ok := b.Get(clientID)
+		if !ok {
+			// Expired while draining
+			b.offline.dropped.Add(uint64(len(queue)))
+			return
+		}
+		if session.Conn == nil {
+			// Disconnected again; keep the rest for the next connection
+			b.offline.requeue(clientID, queue)
+			return
+		}
+		for _, queued := range queue {
+			b.send(session, queued.msg, queued.qos)
+		}
+		delivered += len(queue)
+	}
+	if delivered > 0 {
+		b.logger.LogClientConnection(clientID, "", "offline_queue_drained", logger.Int("delivered", delivered))
+	}
+}
+
+// SetOfflineQueue changes how many messages are queued per persistent
+// session. The queue can only be resized, not enabled, at runtime.
+func (b *Broker) SetOfflineQueue(limit int) error {
+	if b.offline == nil {
+		return &er.Err{
+			Context: "Broker, Offline Queue",
+			Message: er.ErrOfflineQueueDisabled,
+		}
+	}
+	b.offline.setLimit(max(limit, 1))
+	return nil
+}
+
+// OfflineStats returns the offline queues' size and drop counters
+func (b *Broker) OfflineStats() OfflineStats {
+	if b.offline == nil {
+		return OfflineStats{}
+	}
+	return b.offline.stats()
+}
@@ -0,0 +1,4 @@
+package broker
+
+// Option configures optional broker behavior
+type Option func(*Broker)
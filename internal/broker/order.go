@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+)
+
+// lockDelivery locks the mutex that serializes deliveries to clientID.
+// Publishes, subscribe-time retained sends, deferred releases and retries
+// can run on different goroutines; holding it from packet ID assignment
+// through the write keeps each client's messages on the wire in the order
+// they were admitted [MQTT-4.6.0-6]. A mutex dropped by forgetDeliveryLock
+// while waiting for it no longer belongs to the client, so the lock is
+// taken again on the current one.
+func (b *Broker) lockDelivery(clientID string) *sync.Mutex {
+	for {
+		mu := b.deliveryLock(clientID)
+		mu.Lock()
+		if current, ok := b.deliveryLocks.Load(clientID); ok && current == mu {
+			return mu
+		}
+		mu.Unlock()
+	}
+}
+
+// forgetDeliveryLock drops clientID's mutex once its session is gone,
+// waiting for a delivery holding it to finish first
+func (b *Broker) forgetDeliveryLock(clientID string) {
+	mu := b.lockDelivery(clientID)
+	b.deliveryLocks.Delete(clientID)
+	mu.Unlock()
+}
+
+// retryDelivery resends an unacknowledged message with DUP set to its
+// client's current connection, holding the delivery lock so the retry is
+// not written in the middle of another delivery's turn
+func (b *Broker) retryDelivery(msg *PendingMessage) {
+	mu := b.lockDelivery(msg.ClientID)
+	defer mu.Unlock()
+
+	session, ok := b.Get(msg.ClientID)
+	if !ok || session.Conn == nil {
+		return
+	}
+	// QoS 1 and 2 frames are private copies, so setting DUP is safe
+	frame := msg.Message.Frame(msg.QoS, msg.PacketID)
+	frame[0] |= 0x08
+	if err := writeMessage(session.Conn, msg.Message, frame); err != nil {
+		b.logger.LogError(err, "Failed to resend message", logger.ClientID(msg.ClientID))
+	}
+}
+
+// deliveryLock returns clientID's mutex, creating it on first use
+func (b *Broker) deliveryLock(clientID string) *sync.Mutex {
+	if mu, ok := b.deliveryLocks.Load(clientID); ok {
+		return mu.(*sync.Mutex)
+	}
+	mu, _ := b.deliveryLocks.LoadOrStore(clientID, new(sync.Mutex))
+	return mu.(*sync.Mutex)
+}
@@ -0,0 +1,217 @@
+package broker
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"slices"
+)
+
+// pmapSeed hashes the keys of every pmap
+var pmapSeed = maphash.MakeSeed()
+
+const (
+	pmapBits     = 5
+	pmapMaxShift = 60 // Past the last full level of a 64-bit hash, keys that collide share a list
+)
+
+// pmap is a persistent hash array mapped trie from strings to V. Updates
+// return a new map that shares all but the O(log n) nodes on the changed
+// key's path with the old one, which stays valid and unchanged for readers
+// still holding it. The zero value is an empty map.
+type pmap[V any] struct {
+	root *pmapNode[V]
+	size int
+}
+
+// pmapNode holds up to 32 entries, one per 5-bit slice of the key hash,
+// packed in bitmap order. Below pmapMaxShift it is a plain list instead.
+type pmapNode[V any] struct {
+	bitmap  uint32
+	entries []pmapEntry[V]
+}
+
+// pmapEntry is either a key and its value or, when node is set, a subtrie
+type pmapEntry[V any] struct {
+	hash  uint64
+	key   string
+	value V
+	node  *pmapNode[V]
+}
+
+// Len returns the number of keys in the map
+func (m pmap[V]) Len() int {
+	return m.size
+}
+
+// Get returns the value stored for key
+func (m pmap[V]) Get(key string) (V, bool) {
+	h := maphash.String(pmapSeed, key)
+	node := m.root
+	for shift := 0; node != nil; shift += pmapBits {
+		if shift >= pmapMaxShift {
+			for _, e := range node.entries {
+				if e.key == key {
+					return e.value, true
+				}
+			}
+			break
+		}
+		bit := uint32(1) << ((h >> shift) & 31)
+		if node.bitmap&bit == 0 {
+			break
+		}
+		e := node.entries[bits.OnesCount32(node.bitmap&(bit-1))]
+		if e.node == nil {
+			if e.key == key {
+				return e.value, true
+			}
+			break
+		}
+		node = e.node
+	}
+	var zero V
+	return zero, false
+}
+
+// Set returns a map with key set to value
+func (m pmap[V]) Set(key string, value V) pmap[V] {
+	root, added := m.root.set(pmapEntry[V]{hash: maphash.String(pmapSeed, key), key: key, value: value}, 0)
+	if added {
+		m.size++
+	}
+	m.root = root
+	return m
+}
+
+// Delete returns a map without key, or m itself when key is not in it
+func (m pmap[V]) Delete(key string) pmap[V] {
+	root, removed := m.root.delete(maphash.String(pmapSeed, key), key, 0)
+	if !removed {
+		return m
+	}
+	return pmap[V]{root: root, size: m.size - 1}
+}
+
+// All iterates over the keys and values in no particular order
+func (m pmap[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		m.root.each(yield)
+	}
+}
+
+func (n *pmapNode[V]) each(yield func(string, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	for _, e := range n.entries {
+		if e.node != nil {
+			if !e.node.each(yield) {
+				return false
+			}
+		} else if !yield(e.key, e.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// set returns a copy of n with entry added, or replacing the entry with the
+// same key, and reports whether the key is new
+func (n *pmapNode[V]) set(entry pmapEntry[V], shift int) (*pmapNode[V], bool) {
+	if n == nil {
+		n = &pmapNode[V]{}
+	}
+	if shift >= pmapMaxShift {
+		for i, e := range n.entries {
+			if e.key == entry.key {
+				c := n.copy()
+				c.entries[i] = entry
+				return c, false
+			}
+		}
+		return &pmapNode[V]{entries: append(slices.Clip(n.entries), entry)}, true
+	}
+
+	bit := uint32(1) << ((entry.hash >> shift) & 31)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		return &pmapNode[V]{bitmap: n.bitmap | bit, entries: slices.Insert(slices.Clone(n.entries), i, entry)}, true
+	}
+
+	c := n.copy()
+	e := n.entries[i]
+	added := false
+	switch {
+	case e.node != nil:
+		var sub *pmapNode[V]
+		sub, added = e.node.set(entry, shift+pmapBits)
+		c.entries[i] = pmapEntry[V]{node: sub}
+	case e.key == entry.key:
+		c.entries[i] = entry
+	default:
+		// Two keys share this slot: push both one level down
+		sub, _ := (*pmapNode[V])(nil).set(e, shift+pmapBits)
+		sub, _ = sub.set(entry, shift+pmapBits)
+		c.entries[i] = pmapEntry[V]{node: sub}
+		added = true
+	}
+	return c, added
+}
+
+// delete returns a copy of n without key, nil once it is empty, and reports
+// whether key was found. n itself is returned when it was not.
+func (n *pmapNode[V]) delete(hash uint64, key string, shift int) (*pmapNode[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+	if shift >= pmapMaxShift {
+		i := slices.IndexFunc(n.entries, func(e pmapEntry[V]) bool { return e.key == key })
+		if i < 0 {
+			return n, false
+		}
+		if len(n.entries) == 1 {
+			return nil, true
+		}
+		return &pmapNode[V]{entries: slices.Delete(slices.Clone(n.entries), i, i+1)}, true
+	}
+
+	bit := uint32(1) << ((hash >> shift) & 31)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	e := n.entries[i]
+	if e.node == nil {
+		if e.key != key {
+			return n, false
+		}
+		if len(n.entries) == 1 {
+			return nil, true
+		}
+		return &pmapNode[V]{bitmap: n.bitmap &^ bit, entries: slices.Delete(slices.Clone(n.entries), i, i+1)}, true
+	}
+
+	child, removed := e.node.delete(hash, key, shift+pmapBits)
+	if !removed {
+		return n, false
+	}
+	if child == nil {
+		if len(n.entries) == 1 {
+			return nil, true
+		}
+		return &pmapNode[V]{bitmap: n.bitmap &^ bit, entries: slices.Delete(slices.Clone(n.entries), i, i+1)}, true
+	}
+	c := n.copy()
+	if len(child.entries) == 1 && child.entries[0].node == nil {
+		// A lone key moves back up rather than keeping a chain of single entries
+		c.entries[i] = child.entries[0]
+	} else {
+		c.entries[i] = pmapEntry[V]{node: child}
+	}
+	return c, true
+}
+
+func (n *pmapNode[V]) copy() *pmapNode[V] {
+	return &pmapNode[V]{bitmap: n.bitmap, entries: slices.Clone(n.entries)}
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+func TestPmap(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var m pmap[int]
+	want := make(map[string]int)
+	snapshots := make([]pmap[int], 0, 10)
+	wants := make([]map[string]int, 0, 10)
+
+	for i := range 20000 {
+		key := strconv.Itoa(rng.IntN(2000))
+		if rng.IntN(3) == 0 {
+			m = m.Delete(key)
+			delete(want, key)
+		} else {
+			m = m.Set(key, i)
+			want[key] = i
+		}
+		if i%2000 == 0 {
+			snap := make(map[string]int, len(want))
+			for k, v := range want {
+				snap[k] = v
+			}
+			snapshots = append(snapshots, m)
+			wants = append(wants, snap)
+		}
+	}
+
+	// Earlier versions are unaffected by later updates
+	snapshots = append(snapshots, m)
+	wants = append(wants, want)
+	for i, snap := range snapshots {
+		checkPmap(t, i, snap, wants[i])
+	}
+}
+
+func checkPmap(t *testing.T, version int, m pmap[int], want map[string]int) {
+	t.Helper()
+	if m.Len() != len(want) {
+		t.Errorf("version %d: Len() = %d, want %d", version, m.Len(), len(want))
+	}
+	for k, v := range want {
+		if got, ok := m.Get(k); !ok || got != v {
+			t.Errorf("version %d: Get(%q) = %d, %t, want %d", version, k, got, ok, v)
+		}
+	}
+	seen := 0
+	for k, v := range m.All() {
+		seen++
+		if want[k] != v {
+			t.Errorf("version %d: All() yielded %q = %d, want %d", version, k, v, want[k])
+		}
+	}
+	if seen != len(want) {
+		t.Errorf("version %d: All() yielded %d keys, want %d", version, seen, len(want))
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Errorf("version %d: Get(missing) found a value", version)
+	}
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// PresenceClientIDPlaceholder is replaced by the client ID in presence topic patterns
+const PresenceClientIDPlaceholder = "{client_id}"
+
+// PresenceOptions controls the presence messages published on connect and disconnect
+type PresenceOptions struct {
+	Topic          string // Pattern containing {client_id}
+	QoS            packet.QoSLevel
+	Retain         bool
+	OnlinePayload  string
+	OfflinePayload string
+}
+
+// WithPresence enables publishing presence messages for every client
+func WithPresence(opts PresenceOptions) Option {
+	return func(b *Broker) {
+		b.presence = &opts
+	}
+}
+
+// PublishPresence publishes the online or offline presence message of a client.
+// It is a no-op unless presence is enabled.
+func (b *Broker) PublishPresence(clientID string, online bool) {
+	if b.presence == nil || clientID == "" {
+		return
+	}
+
+	payload := b.presence.OfflinePayload
+	if online {
+		payload = b.presence.OnlinePayload
+	}
+
+	presence := &packet.PublishPacket{
+		Topic:   strings.ReplaceAll(b.presence.Topic, PresenceClientIDPlaceholder, clientID),
+		Payload: []byte(payload),
+		QoS:     b.presence.QoS,
+		Retain:  b.presence.Retain,
+	}
+	if err := b.HandlePublish(clientID, presence); err != nil {
+		b.logger.LogError(err, "Failed to publish presence", logger.ClientID(clientID))
+	}
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// WithPriorityTopics delivers messages published to topics matching filters
+// ahead of other messages waiting for the same delivery worker, such as
+// commands ahead of bulk telemetry. After burst priority deliveries in a row
+// a waiting normal one is delivered, so normal traffic is never starved; 0
+// uses DefaultPriorityBurst. Messages of different priorities may overtake
+// each other. Priorities only apply with WithDeliveryWorkers, since without
+// workers messages are delivered as they are published.
+func WithPriorityTopics(filters []string, burst int) Option {
+	return func(b *Broker) {
+		for _, filter := range filters {
+			if err := utils.ValidateTopicFilter(filter); err != nil {
+				b.logger.LogError(err, "Ignoring invalid priority topic filter", logger.String("topic_filter", filter))
+				continue
+			}
+			b.priorityFilters = append(b.priorityFilters, filter)
+		}
+		if burst <= 0 {
+			burst = DefaultPriorityBurst
+		}
+		b.priorityBurst = burst
+	}
+}
+
+// isPriority reports whether topic matches a priority filter
+func (b *Broker) isPriority(topic string) bool {
+	for _, filter := range b.priorityFilters {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
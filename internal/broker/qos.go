@@ -1,7 +1,11 @@
 package broker
 
 import (
+	"cmp"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pyr33x/goqtt/internal/logger"
@@ -12,42 +16,90 @@ import (
 type QoSManager struct {
 	pendingQoS1  map[string]map[uint16]*PendingMessage // clientID -> packetID -> message
 	pendingQoS2  map[string]map[uint16]*PendingMessage // clientID -> packetID -> message
-	qos2Received map[string]map[uint16]*ReceivedQoS2   // clientID -> packetID -> received message
+	qos2Received map[string]map[uint16]*ReceivedQoS2   // clientID -> packetID -> delivered message awaiting PUBCOMP
+	inbound      map[string]*inboundQoS2               // clientID -> QoS 2 messages published by the client
+	nextID       map[string]uint16                     // clientID -> last packet ID issued
+	suspended    map[string]struct{}                   // Persistent sessions whose client is away; their outbound flows wait for Resume
+	sent         uint64                                // Orders outbound messages by when they were first sent
+	onRelease    func(*ReceivedQoS2)                   // Routes inbound messages once released, in arrival order
+	onExpire     func(*ReceivedQoS2)                   // Called for inbound messages dropped without a PUBREL
+	onRetry      func(*PendingMessage)                 // Resends an unacknowledged message; retryMessage when nil
 	mu           sync.RWMutex
+	timers       *timerWheel // Retry and expiry timers, guarded by mu
+	stats        qosCounters
 	retryTicker  *time.Ticker
 	stopCh       chan struct{}
 	logger       *logger.Logger
 }
 
+// qosCounters are updated alongside the maps so reading them never takes the lock
+type qosCounters struct {
+	qos1Pending  atomic.Int64
+	qos2Pending  atomic.Int64
+	qos2Received atomic.Int64
+	pendingBytes atomic.Int64 // Payload bytes of outbound messages awaiting acknowledgement
+	heldBytes    atomic.Int64 // Payload bytes of messages held in QoS 2 handshakes
+	retries      atomic.Uint64
+	expired      atomic.Uint64
+	dropped      atomic.Uint64
+	unknownAcks  atomic.Uint64
+}
+
+// QoSStats is a point-in-time view of the QoS manager counters
+type QoSStats struct {
+	QoS1Pending  int64  `json:"qos1_pending"`  // Outbound QoS 1 messages awaiting PUBACK
+	QoS2Pending  int64  `json:"qos2_pending"`  // Outbound QoS 2 messages awaiting PUBREC
+	QoS2Received int64  `json:"qos2_received"` // QoS 2 handshakes awaiting PUBREL or PUBCOMP
+	PendingBytes int64  `json:"pending_bytes"` // Payload bytes of QoS 1/2 messages awaiting acknowledgement
+	HeldBytes    int64  `json:"held_bytes"`    // Payload bytes of messages held in QoS 2 handshakes
+	Retries      uint64 `json:"retries"`       // Redeliveries sent since start
+	Expired      uint64 `json:"expired"`       // Messages dropped after exhausting retries or timing out
+	Dropped      uint64 `json:"dropped"`       // Messages discarded by client cleanup
+	UnknownAcks  uint64 `json:"unknown_acks"`  // PUBACK, PUBREC and PUBCOMP for packet IDs not in flight
+}
+
 // PendingMessage represents a message waiting for acknowledgment
 type PendingMessage struct {
 	PacketID   uint16
 	ClientID   string
-	Topic      string
-	Payload    []byte
+	Message    *Message // Shared with the other deliveries, never copied
 	QoS        packet.QoSLevel
-	Retain     bool
 	Timestamp  time.Time
 	RetryCount int
 	MaxRetries int
 	RetryDelay time.Duration
 	Session    *Session
+	seq        uint64 // Send order, kept across retries and resumes
 }
 
 // ReceivedQoS2 represents a QoS 2 message in the middle of the handshake
 type ReceivedQoS2 struct {
 	PacketID  uint16
 	ClientID  string
-	Topic     string
-	Payload   []byte
-	Retain    bool
+	Message   *Message
 	Timestamp time.Time
+	released  bool // PUBREL received; waiting for messages received before it
+}
+
+// inboundQoS2 tracks the QoS 2 messages a client has published that have not
+// been routed yet. A message released by PUBREL is only routed once every
+// message received before it was released too, so subscribers see them in
+// the order the publisher sent them.
+type inboundQoS2 struct {
+	received map[uint16]*ReceivedQoS2 // Awaiting PUBREL, by packet ID
+	order    []*ReceivedQoS2          // Awaiting PUBREL or routing, in arrival order
+	release  sync.Mutex               // Held while routing so releases never overtake each other
 }
 
 const (
 	DefaultMaxRetries = 3
 	DefaultRetryDelay = 30 * time.Second
 	QoS2Timeout       = 5 * time.Minute
+
+	// timerTick is the resolution of retries and expiries
+	timerTick = time.Second
+	// timerSlots covers one minute per revolution of the wheel
+	timerSlots = 60
 )
 
 // NewQoSManager creates a new QoS flow manager
@@ -56,7 +108,11 @@ func NewQoSManager() *QoSManager {
 		pendingQoS1:  make(map[string]map[uint16]*PendingMessage),
 		pendingQoS2:  make(map[string]map[uint16]*PendingMessage),
 		qos2Received: make(map[string]map[uint16]*ReceivedQoS2),
-		retryTicker:  time.NewTicker(10 * time.Second), // Check for retries every 10 seconds
+		inbound:      make(map[string]*inboundQoS2),
+		nextID:       make(map[string]uint16),
+		suspended:    make(map[string]struct{}),
+		timers:       newTimerWheel(timerSlots, timerTick),
+		retryTicker:  time.NewTicker(timerTick),
 		stopCh:       make(chan struct{}),
 		logger:       logger.NewMQTTLogger("qos"),
 	}
@@ -73,34 +129,103 @@ func (qm *QoSManager) Stop() {
 	qm.retryTicker.Stop()
 }
 
-// AddPendingQoS1 adds a QoS 1 message waiting for PUBACK
-func (qm *QoSManager) AddPendingQoS1(msg *PendingMessage) {
+// AddPendingQoS1 adds a QoS 1 message waiting for PUBACK. A zero PacketID
+// is replaced by one not in flight for the client; false is returned when
+// the client has no free packet IDs left.
+func (qm *QoSManager) AddPendingQoS1(msg *PendingMessage) bool {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
+	if msg.PacketID == 0 {
+		id, ok := qm.allocatePacketID(msg.ClientID)
+		if !ok {
+			return false
+		}
+		msg.PacketID = id
+	}
+
 	if qm.pendingQoS1[msg.ClientID] == nil {
 		qm.pendingQoS1[msg.ClientID] = make(map[uint16]*PendingMessage)
 	}
 
+	qm.sent++
+	msg.seq = qm.sent
 	msg.Timestamp = time.Now()
 	msg.MaxRetries = DefaultMaxRetries
 	msg.RetryDelay = DefaultRetryDelay
+	if old, exists := qm.pendingQoS1[msg.ClientID][msg.PacketID]; exists {
+		qm.stats.pendingBytes.Add(-int64(old.Message.Size()))
+	} else {
+		qm.stats.qos1Pending.Add(1)
+	}
+	qm.stats.pendingBytes.Add(int64(msg.Message.Size()))
 	qm.pendingQoS1[msg.ClientID][msg.PacketID] = msg
+	qm.timers.schedule(msg.RetryDelay, wheelEntry{kind: timerRetryQoS1, clientID: msg.ClientID, packetID: msg.PacketID, pending: msg})
+	return true
 }
 
-// AddPendingQoS2 adds a QoS 2 message waiting for PUBREC
-func (qm *QoSManager) AddPendingQoS2(msg *PendingMessage) {
+// AddPendingQoS2 adds a QoS 2 message waiting for PUBREC. Packet IDs are
+// allocated as in AddPendingQoS1.
+func (qm *QoSManager) AddPendingQoS2(msg *PendingMessage) bool {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
+	if msg.PacketID == 0 {
+		id, ok := qm.allocatePacketID(msg.ClientID)
+		if !ok {
+			return false
+		}
+		msg.PacketID = id
+	}
+
 	if qm.pendingQoS2[msg.ClientID] == nil {
 		qm.pendingQoS2[msg.ClientID] = make(map[uint16]*PendingMessage)
 	}
 
+	qm.sent++
+	msg.seq = qm.sent
 	msg.Timestamp = time.Now()
 	msg.MaxRetries = DefaultMaxRetries
 	msg.RetryDelay = DefaultRetryDelay
+	if old, exists := qm.pendingQoS2[msg.ClientID][msg.PacketID]; exists {
+		qm.stats.pendingBytes.Add(-int64(old.Message.Size()))
+	} else {
+		qm.stats.qos2Pending.Add(1)
+	}
+	qm.stats.pendingBytes.Add(int64(msg.Message.Size()))
 	qm.pendingQoS2[msg.ClientID][msg.PacketID] = msg
+	qm.timers.schedule(msg.RetryDelay, wheelEntry{kind: timerRetryQoS2, clientID: msg.ClientID, packetID: msg.PacketID, pending: msg})
+	return true
+}
+
+// allocatePacketID returns the first packet ID after the last one issued to
+// the client that is not still in flight, so a wrapped counter never reuses
+// an ID awaiting acknowledgement. It must be called with qm.mu held.
+func (qm *QoSManager) allocatePacketID(clientID string) (uint16, bool) {
+	id := qm.nextID[clientID]
+	for range math.MaxUint16 {
+		id++
+		if id == 0 {
+			id = 1 // Packet ID 0 is reserved
+		}
+		if !qm.packetIDInUse(clientID, id) {
+			qm.nextID[clientID] = id
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// packetIDInUse reports whether any QoS flow of the client holds id
+func (qm *QoSManager) packetIDInUse(clientID string, id uint16) bool {
+	if _, ok := qm.pendingQoS1[clientID][id]; ok {
+		return true
+	}
+	if _, ok := qm.pendingQoS2[clientID][id]; ok {
+		return true
+	}
+	_, ok := qm.qos2Received[clientID][id]
+	return ok
 }
 
 // HandlePubAck processes a PUBACK packet for QoS 1 flow
@@ -109,11 +234,13 @@ func (qm *QoSManager) HandlePubAck(clientID string, packetID uint16) bool {
 	defer qm.mu.Unlock()
 
 	if clientMessages, exists := qm.pendingQoS1[clientID]; exists {
-		if _, exists := clientMessages[packetID]; exists {
+		if msg, exists := clientMessages[packetID]; exists {
 			delete(clientMessages, packetID)
 			if len(clientMessages) == 0 {
 				delete(qm.pendingQoS1, clientID)
 			}
+			qm.stats.qos1Pending.Add(-1)
+			qm.stats.pendingBytes.Add(-int64(msg.Message.Size()))
 			return true
 		}
 	}
@@ -132,6 +259,8 @@ func (qm *QoSManager) HandlePubRec(clientID string, packetID uint16) (*packet.Pu
 			if len(clientMessages) == 0 {
 				delete(qm.pendingQoS2, clientID)
 			}
+			qm.stats.qos2Pending.Add(-1)
+			qm.stats.pendingBytes.Add(-int64(msg.Message.Size()))
 
 			// Create PUBREL packet
 			pubrel := &packet.PubrelPacket{
@@ -143,14 +272,20 @@ func (qm *QoSManager) HandlePubRec(clientID string, packetID uint16) (*packet.Pu
 				qm.qos2Received[clientID] = make(map[uint16]*ReceivedQoS2)
 			}
 
-			qm.qos2Received[clientID][packetID] = &ReceivedQoS2{
+			received := &ReceivedQoS2{
 				PacketID:  packetID,
 				ClientID:  clientID,
-				Topic:     msg.Topic,
-				Payload:   msg.Payload,
-				Retain:    msg.Retain,
+				Message:   msg.Message,
 				Timestamp: time.Now(),
 			}
+			if old, exists := qm.qos2Received[clientID][packetID]; exists {
+				qm.stats.heldBytes.Add(-int64(old.Message.Size()))
+			} else {
+				qm.stats.qos2Received.Add(1)
+			}
+			qm.stats.heldBytes.Add(int64(received.Message.Size()))
+			qm.qos2Received[clientID][packetID] = received
+			qm.scheduleExpiry(received)
 
 			return pubrel, true
 		}
@@ -164,11 +299,13 @@ func (qm *QoSManager) HandlePubComp(clientID string, packetID uint16) bool {
 	defer qm.mu.Unlock()
 
 	if clientMessages, exists := qm.qos2Received[clientID]; exists {
-		if _, exists := clientMessages[packetID]; exists {
+		if msg, exists := clientMessages[packetID]; exists {
 			delete(clientMessages, packetID)
 			if len(clientMessages) == 0 {
 				delete(qm.qos2Received, clientID)
 			}
+			qm.stats.qos2Received.Add(-1)
+			qm.stats.heldBytes.Add(-int64(msg.Message.Size()))
 			return true
 		}
 	}
@@ -176,67 +313,204 @@ func (qm *QoSManager) HandlePubComp(clientID string, packetID uint16) bool {
 }
 
 // HandleIncomingQoS2Publish handles an incoming QoS 2 PUBLISH packet
-func (qm *QoSManager) HandleIncomingQoS2Publish(clientID string, packetID uint16, topic string, payload []byte, retain bool) *packet.PubrecPacket {
+func (qm *QoSManager) HandleIncomingQoS2Publish(clientID string, packetID uint16, msg *Message) *packet.PubrecPacket {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
-	// Check if we already received this packet (duplicate)
-	if clientMessages, exists := qm.qos2Received[clientID]; exists {
-		if _, exists := clientMessages[packetID]; exists {
-			// Duplicate - just send PUBREC again
-			return &packet.PubrecPacket{PacketID: packetID}
-		}
+	in := qm.inbound[clientID]
+	if in == nil {
+		in = &inboundQoS2{received: make(map[uint16]*ReceivedQoS2)}
+		qm.inbound[clientID] = in
 	}
 
-	// Store the received message
-	if qm.qos2Received[clientID] == nil {
-		qm.qos2Received[clientID] = make(map[uint16]*ReceivedQoS2)
+	// Check if we already received this packet (duplicate)
+	if _, exists := in.received[packetID]; exists {
+		// Duplicate - just send PUBREC again
+		return &packet.PubrecPacket{PacketID: packetID}
 	}
 
-	qm.qos2Received[clientID][packetID] = &ReceivedQoS2{
+	// Store the received message
+	received := &ReceivedQoS2{
 		PacketID:  packetID,
 		ClientID:  clientID,
-		Topic:     topic,
-		Payload:   payload,
-		Retain:    retain,
+		Message:   msg,
 		Timestamp: time.Now(),
 	}
+	in.received[packetID] = received
+	in.order = append(in.order, received)
+	qm.stats.qos2Received.Add(1)
+	qm.stats.heldBytes.Add(int64(msg.Size()))
+	qm.timers.schedule(QoS2Timeout, wheelEntry{kind: timerExpireQoS2Inbound, clientID: clientID, packetID: packetID, received: received})
 
 	return &packet.PubrecPacket{PacketID: packetID}
 }
 
-// HandleIncomingPubRel handles an incoming PUBREL packet
-func (qm *QoSManager) HandleIncomingPubRel(clientID string, packetID uint16) (*ReceivedQoS2, *packet.PubcompPacket) {
+// HandleIncomingPubRel handles an incoming PUBREL packet. The released
+// message is passed to the release handler after every message the client
+// published before it, which may be immediately or on a later PUBREL.
+func (qm *QoSManager) HandleIncomingPubRel(clientID string, packetID uint16) *packet.PubcompPacket {
 	qm.mu.Lock()
-	defer qm.mu.Unlock()
+	released := false
+	if in := qm.inbound[clientID]; in != nil {
+		if msg, exists := in.received[packetID]; exists {
+			delete(in.received, packetID)
+			msg.released = true
+			released = true
+			qm.stats.qos2Received.Add(-1)
+		}
+	}
+	qm.mu.Unlock()
 
-	if clientMessages, exists := qm.qos2Received[clientID]; exists {
-		if msg, exists := clientMessages[packetID]; exists {
-			// Return the message for delivery and create PUBCOMP
-			pubcomp := &packet.PubcompPacket{PacketID: packetID}
+	if released {
+		qm.releaseInOrder(clientID)
+	}
 
-			// Remove from received messages
-			delete(clientMessages, packetID)
-			if len(clientMessages) == 0 {
-				delete(qm.qos2Received, clientID)
-			}
+	// If we don't have the message, still send PUBCOMP (MQTT spec requirement)
+	return &packet.PubcompPacket{PacketID: packetID}
+}
 
-			return msg, pubcomp
-		}
+// releaseInOrder routes the released messages at the front of the client's
+// arrival order; a message still awaiting PUBREL holds back the ones after it
+func (qm *QoSManager) releaseInOrder(clientID string) {
+	qm.mu.Lock()
+	in := qm.inbound[clientID]
+	qm.mu.Unlock()
+	if in == nil {
+		return
 	}
 
-	// If we don't have the message, still send PUBCOMP (MQTT spec requirement)
-	return nil, &packet.PubcompPacket{PacketID: packetID}
+	in.release.Lock()
+	defer in.release.Unlock()
+
+	qm.mu.Lock()
+	n := 0
+	for n < len(in.order) && in.order[n].released {
+		qm.stats.heldBytes.Add(-int64(in.order[n].Message.Size()))
+		n++
+	}
+	ready := slices.Clone(in.order[:n])
+	in.order = slices.Delete(in.order, 0, n)
+	if len(in.order) == 0 && qm.inbound[clientID] == in {
+		delete(qm.inbound, clientID)
+	}
+	qm.mu.Unlock()
+
+	if qm.onRelease == nil {
+		return
+	}
+	for _, msg := range ready {
+		qm.onRelease(msg)
+	}
 }
 
-// CleanupClient removes all pending messages for a disconnected client
-func (qm *QoSManager) CleanupClient(clientID string) {
+// CleanupClient removes all pending messages for a client and returns how
+// many were dropped. Messages the client published and already released
+// are still routed.
+func (qm *QoSManager) CleanupClient(clientID string) int {
 	qm.mu.Lock()
-	defer qm.mu.Unlock()
 
+	in := qm.inbound[clientID]
+	var unreleased int
+	if in != nil {
+		unreleased = len(in.received)
+	}
+	qos1, qos2, received := len(qm.pendingQoS1[clientID]), len(qm.pendingQoS2[clientID]), len(qm.qos2Received[clientID])+unreleased
+	dropped := qos1 + qos2 + received
+	qm.stats.qos1Pending.Add(-int64(qos1))
+	qm.stats.qos2Pending.Add(-int64(qos2))
+	qm.stats.qos2Received.Add(-int64(received))
+	qm.stats.dropped.Add(uint64(dropped))
+	for _, pending := range [...]map[uint16]*PendingMessage{qm.pendingQoS1[clientID], qm.pendingQoS2[clientID]} {
+		for _, msg := range pending {
+			qm.stats.pendingBytes.Add(-int64(msg.Message.Size()))
+		}
+	}
+	for _, msg := range qm.qos2Received[clientID] {
+		qm.stats.heldBytes.Add(-int64(msg.Message.Size()))
+	}
+	pendingRelease := false
+	if in != nil {
+		for _, msg := range in.received {
+			qm.stats.heldBytes.Add(-int64(msg.Message.Size()))
+		}
+		clear(in.received)
+		in.order = slices.DeleteFunc(in.order, func(msg *ReceivedQoS2) bool { return !msg.released })
+		pendingRelease = len(in.order) > 0
+	}
 	delete(qm.pendingQoS1, clientID)
 	delete(qm.pendingQoS2, clientID)
 	delete(qm.qos2Received, clientID)
+	delete(qm.nextID, clientID)
+	delete(qm.suspended, clientID)
+	qm.mu.Unlock()
+
+	if pendingRelease {
+		qm.releaseInOrder(clientID)
+	}
+	return dropped
+}
+
+// Suspend stops retrying a client's outbound QoS 1/2 messages and expiring
+// its PUBREC'd ones while it is disconnected. Its state is kept for Resume
+// when a persistent session's client reconnects; the messages it published
+// and has not released yet are kept too, so a PUBREL after it reconnects
+// still routes them exactly once [MQTT-4.1.0-1].
+func (qm *QoSManager) Suspend(clientID string) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.suspended[clientID] = struct{}{}
+}
+
+// Resume restarts the outbound QoS 1/2 flows of a client on a new
+// connection. It returns the messages to publish again, in the order they
+// were first sent, and the packet IDs to send PUBREL for, in the order
+// their PUBRECs arrived. Their retry and expiry timers start over.
+func (qm *QoSManager) Resume(clientID string) (publishes []*PendingMessage, released []uint16) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	delete(qm.suspended, clientID)
+	now := time.Now()
+	kinds := [...]timerKind{timerRetryQoS1, timerRetryQoS2}
+	for i, pending := range [...]map[uint16]*PendingMessage{qm.pendingQoS1[clientID], qm.pendingQoS2[clientID]} {
+		for id, msg := range pending {
+			// A copy leaves the timers scheduled for the old connection stale
+			resumed := *msg
+			resumed.RetryCount = 0
+			resumed.Timestamp = now
+			pending[id] = &resumed
+			qm.timers.schedule(resumed.RetryDelay, wheelEntry{kind: kinds[i], clientID: clientID, packetID: id, pending: &resumed})
+			publishes = append(publishes, &resumed)
+		}
+	}
+	slices.SortFunc(publishes, func(a, b *PendingMessage) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	var received []*ReceivedQoS2
+	for id, msg := range qm.qos2Received[clientID] {
+		resumed := *msg
+		qm.qos2Received[clientID][id] = &resumed
+		qm.scheduleExpiry(&resumed)
+		received = append(received, &resumed)
+	}
+	slices.SortFunc(received, func(a, b *ReceivedQoS2) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	for _, msg := range received {
+		released = append(released, msg.PacketID)
+	}
+	return publishes, released
+}
+
+// Inflight returns how many outbound QoS 1 and 2 messages a client has not
+// fully acknowledged, counting QoS 2 messages until PUBCOMP
+func (qm *QoSManager) Inflight(clientID string) int {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+
+	return len(qm.pendingQoS1[clientID]) + len(qm.pendingQoS2[clientID]) + len(qm.qos2Received[clientID])
 }
 
 // GetPendingMessageCount returns the number of pending messages for a client
@@ -258,7 +532,7 @@ func (qm *QoSManager) GetPendingMessageCount(clientID string) (int, int) {
 	return qos1Count, qos2Count
 }
 
-// retryLoop handles message retries and timeouts
+// retryLoop advances the timer wheel once per tick
 func (qm *QoSManager) retryLoop() {
 	for {
 		select {
@@ -266,126 +540,149 @@ func (qm *QoSManager) retryLoop() {
 			return
 		case <-qm.retryTicker.C:
 			qm.processRetries()
-			qm.cleanupTimedOutMessages()
 		}
 	}
 }
 
-// processRetries handles retry logic for pending messages
+// processRetries handles the timers that are due on this tick
 func (qm *QoSManager) processRetries() {
-	qm.mu.Lock()
-	defer qm.mu.Unlock()
-
-	now := time.Now()
-
-	// Process QoS 1 retries
-	for clientID, clientMessages := range qm.pendingQoS1 {
-		for packetID, msg := range clientMessages {
-			if now.Sub(msg.Timestamp) >= msg.RetryDelay {
-				if msg.RetryCount < msg.MaxRetries {
-					msg.RetryCount++
-					msg.Timestamp = now
-					qm.retryMessage(msg)
-				} else {
-					// Max retries reached, remove message
-					delete(clientMessages, packetID)
-					if len(clientMessages) == 0 {
-						delete(qm.pendingQoS1, clientID)
-					}
-				}
-			}
-		}
-	}
-
-	// Process QoS 2 retries
-	for clientID, clientMessages := range qm.pendingQoS2 {
-		for packetID, msg := range clientMessages {
-			if now.Sub(msg.Timestamp) >= msg.RetryDelay {
-				if msg.RetryCount < msg.MaxRetries {
-					msg.RetryCount++
-					msg.Timestamp = now
-					qm.retryMessage(msg)
-				} else {
-					// Max retries reached, remove message
-					delete(clientMessages, packetID)
-					if len(clientMessages) == 0 {
-						delete(qm.pendingQoS2, clientID)
-					}
-				}
-			}
-		}
-	}
-}
-
-// retryMessage resends a message
-func (qm *QoSManager) retryMessage(msg *PendingMessage) {
-	if msg.Session == nil || msg.Session.Conn == nil {
-		return
+	// Retries are written after the lock is released so a slow client
+	// cannot stall acknowledgements for everyone else
+	due, expired := qm.collectRetries()
+	retry := qm.retryMessage
+	if qm.onRetry != nil {
+		retry = qm.onRetry
 	}
-
-	// Create PUBLISH packet for retry
-	publishPacket := &packet.PublishPacket{
-		Topic:    msg.Topic,
-		Payload:  msg.Payload,
-		QoS:      msg.QoS,
-		Retain:   msg.Retain,
-		PacketID: &msg.PacketID,
-		DUP:      true, // Set DUP flag for retries
+	for _, msg := range due {
+		retry(&msg)
 	}
-
-	// Send the packet
-	data := publishPacket.Encode()
-	if data != nil {
-		if _, err := msg.Session.Conn.Write(data); err != nil {
-			qm.logger.LogError(err, "Failed writing data", logger.ClientID(msg.ClientID))
+	for _, msg := range expired {
+		if qm.onExpire != nil {
+			qm.onExpire(msg)
 		}
+		qm.releaseInOrder(msg.ClientID)
 	}
 }
 
-// cleanupTimedOutMessages removes QoS 2 received messages that have timed out
-func (qm *QoSManager) cleanupTimedOutMessages() {
+// collectRetries fires the due timers: it returns copies of the messages to
+// retry, reschedules them, drops messages that have exhausted their retries
+// and expires QoS 2 state that was never completed. It also returns the
+// inbound messages that expired, whose clients' released messages may have
+// been waiting on them.
+func (qm *QoSManager) collectRetries() (due []PendingMessage, expired []*ReceivedQoS2) {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
 	now := time.Now()
 
-	for clientID, clientMessages := range qm.qos2Received {
-		for packetID, msg := range clientMessages {
-			if now.Sub(msg.Timestamp) >= QoS2Timeout {
-				delete(clientMessages, packetID)
-				if len(clientMessages) == 0 {
-					delete(qm.qos2Received, clientID)
+	for _, entry := range qm.timers.advance() {
+		switch entry.kind {
+		case timerRetryQoS1, timerRetryQoS2:
+			pending := qm.pendingQoS1
+			if entry.kind == timerRetryQoS2 {
+				pending = qm.pendingQoS2
+			}
+			counter := &qm.stats.qos1Pending
+			if entry.kind == timerRetryQoS2 {
+				counter = &qm.stats.qos2Pending
+			}
+			msg := entry.pending
+			if pending[entry.clientID][entry.packetID] != msg {
+				continue // Acknowledged or replaced since it was scheduled
+			}
+			if _, away := qm.suspended[entry.clientID]; away {
+				continue // Resume schedules it again
+			}
+
+			if msg.RetryCount < msg.MaxRetries {
+				msg.RetryCount++
+				msg.Timestamp = now
+				due = append(due, *msg)
+				qm.timers.schedule(msg.RetryDelay, entry)
+				qm.stats.retries.Add(1)
+			} else {
+				// Max retries reached, remove message
+				deleteEntry(pending, entry.clientID, entry.packetID)
+				counter.Add(-1)
+				qm.stats.pendingBytes.Add(-int64(msg.Message.Size()))
+				qm.stats.expired.Add(1)
+			}
+
+		case timerExpireQoS2Received:
+			if _, away := qm.suspended[entry.clientID]; away {
+				continue // Resume schedules it again
+			}
+			if qm.qos2Received[entry.clientID][entry.packetID] == entry.received {
+				deleteEntry(qm.qos2Received, entry.clientID, entry.packetID)
+				qm.stats.qos2Received.Add(-1)
+				qm.stats.heldBytes.Add(-int64(entry.received.Message.Size()))
+				qm.stats.expired.Add(1)
+			}
+
+		case timerExpireQoS2Inbound:
+			in := qm.inbound[entry.clientID]
+			if in != nil && in.received[entry.packetID] == entry.received {
+				if _, away := qm.suspended[entry.clientID]; away {
+					// Kept for the PUBREL its client sends after reconnecting
+					qm.timers.schedule(QoS2Timeout, entry)
+					continue
 				}
+				delete(in.received, entry.packetID)
+				if i := slices.Index(in.order, entry.received); i >= 0 {
+					in.order = slices.Delete(in.order, i, i+1)
+				}
+				qm.stats.qos2Received.Add(-1)
+				qm.stats.heldBytes.Add(-int64(entry.received.Message.Size()))
+				qm.stats.expired.Add(1)
+				expired = append(expired, entry.received)
 			}
 		}
 	}
-}
 
-// GetStatistics returns QoS manager statistics
-func (qm *QoSManager) GetStatistics() map[string]any {
-	qm.mu.RLock()
-	defer qm.mu.RUnlock()
+	return due, expired
+}
 
-	totalQoS1Pending := make(map[string]int)
-	totalQoS2Pending := make(map[string]int)
-	totalQoS2Received := make(map[string]int)
+// scheduleExpiry drops a QoS 2 handshake that is not completed within QoS2Timeout
+func (qm *QoSManager) scheduleExpiry(msg *ReceivedQoS2) {
+	qm.timers.schedule(QoS2Timeout, wheelEntry{kind: timerExpireQoS2Received, clientID: msg.ClientID, packetID: msg.PacketID, received: msg})
+}
 
-	for clientID, messages := range qm.pendingQoS1 {
-		totalQoS1Pending[clientID] = len(messages)
+// deleteEntry removes a message from a per-client map, dropping the client when it empties
+func deleteEntry[T any](messages map[string]map[uint16]T, clientID string, packetID uint16) {
+	clientMessages := messages[clientID]
+	delete(clientMessages, packetID)
+	if len(clientMessages) == 0 {
+		delete(messages, clientID)
 	}
+}
 
-	for clientID, messages := range qm.pendingQoS2 {
-		totalQoS2Pending[clientID] = len(messages)
+// retryMessage resends a message
+func (qm *QoSManager) retryMessage(msg *PendingMessage) {
+	if msg.Session == nil || msg.Session.Conn == nil {
+		return
 	}
 
-	for clientID, messages := range qm.qos2Received {
-		totalQoS2Received[clientID] = len(messages)
+	// QoS 1 and 2 frames are private copies, so setting DUP is safe
+	data := msg.Message.Frame(msg.QoS, msg.PacketID)
+	data[0] |= 0x08 // Set DUP flag for retries
+
+	// Send the packet
+	if err := writeMessage(msg.Session.Conn, msg.Message, data); err != nil {
+		qm.logger.LogError(err, "Failed writing data", logger.ClientID(msg.ClientID))
 	}
+}
 
-	return map[string]any{
-		"qos1_pending":  totalQoS1Pending,
-		"qos2_pending":  totalQoS2Pending,
-		"qos2_received": totalQoS2Received,
-		"total_clients": len(qm.pendingQoS1) + len(qm.pendingQoS2) + len(qm.qos2Received),
+// GetStatistics returns the QoS manager counters without taking the lock
+func (qm *QoSManager) GetStatistics() QoSStats {
+	return QoSStats{
+		QoS1Pending:  qm.stats.qos1Pending.Load(),
+		QoS2Pending:  qm.stats.qos2Pending.Load(),
+		QoS2Received: qm.stats.qos2Received.Load(),
+		PendingBytes: qm.stats.pendingBytes.Load(),
+		HeldBytes:    qm.stats.heldBytes.Load(),
+		Retries:      qm.stats.retries.Load(),
+		Expired:      qm.stats.expired.Load(),
+		Dropped:      qm.stats.dropped.Load(),
+		UnknownAcks:  qm.stats.unknownAcks.Load(),
 	}
 }
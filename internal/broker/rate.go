@@ -0,0 +1,243 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Rate is a publish budget per second. Up to one second's worth may be used
+// in a burst. Zero fields are unlimited.
+type Rate struct {
+	Messages float64 // Publishes per second
+	Bytes    int64   // Payload bytes per second
+}
+
+// TopicRate is a budget shared by every publisher to topics under Prefix
+type TopicRate struct {
+	Prefix string
+	Rate
+}
+
+// RatePolicy decides what happens to a publisher over its rate limit
+type RatePolicy int
+
+const (
+	// RateDrop acknowledges publishes over the limit without routing them
+	RateDrop RatePolicy = iota
+	// RateDisconnect closes the publisher's connection
+	RateDisconnect
+)
+
+// RateLimits bounds how fast clients may publish
+type RateLimits struct {
+	Client Rate        // Budget of each client
+	Topics []TopicRate // Budgets of topic prefixes; a topic uses the first one matching it
+	Policy RatePolicy
+}
+
+// RateStats is a point-in-time view of the publish rate limiter
+type RateStats struct {
+	Limited uint64 `json:"limited"` // Inbound publishes over a rate limit
+}
+
+// rateLimiter keeps a token bucket per client and one per topic prefix
+type rateLimiter struct {
+	limits  RateLimits
+	mu      sync.Mutex
+	clients map[string]*rateBucket
+	topics  []*rateBucket // Parallel to limits.Topics
+	active  atomic.Bool   // Whether any limit is set, checked before taking the lock
+	limited atomic.Uint64
+}
+
+// rateBucket refills a message and a byte budget at their rates
+type rateBucket struct {
+	rate     Rate
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+// WithRateLimits refuses inbound publishes over the per-client or
+// per-topic-prefix rates, dropping them or disconnecting the publisher
+// according to limits.Policy. The per-client rate can be changed later
+// with SetClientRate.
+func WithRateLimits(limits RateLimits) Option {
+	return func(b *Broker) {
+		l := &rateLimiter{
+			limits:  limits,
+			clients: make(map[string]*rateBucket),
+		}
+		now := time.Now()
+		for _, topic := range limits.Topics {
+			l.topics = append(l.topics, newRateBucket(topic.Rate, now))
+		}
+		l.active.Store(limits.Client != (Rate{}) || len(limits.Topics) > 0)
+		b.rates = l
+	}
+}
+
+func newRateBucket(rate Rate, now time.Time) *rateBucket {
+	return &rateBucket{
+		rate:     rate,
+		messages: rate.Messages,
+		bytes:    float64(rate.Bytes),
+		last:     now,
+	}
+}
+
+// refill adds the budget earned since the last publish, up to one second's worth
+func (r *rateBucket) refill(now time.Time) {
+	elapsed := now.Sub(r.last).Seconds()
+	r.last = now
+	r.messages = min(r.rate.Messages, r.messages+elapsed*r.rate.Messages)
+	r.bytes = min(float64(r.rate.Bytes), r.bytes+elapsed*float64(r.rate.Bytes))
+}
+
+// allows reports whether a publish of size bytes fits the budget. One
+// bigger than a whole second's worth is let through once the budget is full
+// and paid back afterwards.
+func (r *rateBucket) allows(size int) bool {
+	if r.rate.Messages > 0 && r.messages < min(1, r.rate.Messages) {
+		return false
+	}
+	return r.rate.Bytes <= 0 || r.bytes >= min(float64(size), float64(r.rate.Bytes))
+}
+
+// retune switches the bucket to rate. A budget that was unlimited starts
+// full; otherwise what is left carries over, capped at the new rate.
+func (r *rateBucket) retune(rate Rate) {
+	if r.rate.Messages > 0 {
+		r.messages = min(r.messages, rate.Messages)
+	} else {
+		r.messages = rate.Messages
+	}
+	if r.rate.Bytes > 0 {
+		r.bytes = min(r.bytes, float64(rate.Bytes))
+	} else {
+		r.bytes = float64(rate.Bytes)
+	}
+	r.rate = rate
+}
+
+func (r *rateBucket) take(size int) {
+	r.messages--
+	r.bytes -= float64(size)
+}
+
+// allow charges a publish to its client's and topic's budgets, unless either is spent
+func (l *rateLimiter) allow(clientID, topic string, size int) bool {
+	if !l.active.Load() {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make([]*rateBucket, 0, 2)
+	if l.limits.Client != (Rate{}) {
+		bucket := l.clients[clientID]
+		if bucket == nil {
+			bucket = newRateBucket(l.limits.Client, now)
+			l.clients[clientID] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	for i, limit := range l.limits.Topics {
+		if strings.HasPrefix(topic, limit.Prefix) {
+			buckets = append(buckets, l.topics[i])
+			break
+		}
+	}
+
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		if !bucket.allows(size) {
+			l.limited.Add(1)
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.take(size)
+	}
+	return true
+}
+
+// forgetRate drops the budget of a disconnected client
+func (b *Broker) forgetRate(clientID string) {
+	if b.rates == nil {
+		return
+	}
+	b.rates.mu.Lock()
+	defer b.rates.mu.Unlock()
+	delete(b.rates.clients, clientID)
+}
+
+// CheckPublishRate charges an inbound publish of size payload bytes to
+// topic to the rate limits, and reports whether it is within them. What
+// happens to a refused publish is up to RatePolicy.
+func (b *Broker) CheckPublishRate(clientID, topic string, size int) error {
+	if b.rates == nil || b.rates.allow(clientID, topic, size) {
+		return nil
+	}
+	return &er.Err{
+		Context: "Broker, Publish",
+		Message: er.ErrRateLimited,
+	}
+}
+
+// ClientRate returns the budget each client publishes within
+func (b *Broker) ClientRate() Rate {
+	if b.rates == nil {
+		return Rate{}
+	}
+	b.rates.mu.Lock()
+	defer b.rates.mu.Unlock()
+	return b.rates.limits.Client
+}
+
+// SetClientRate changes the budget each client publishes within. Clients
+// that already have a budget keep what is left of it, capped at the new rate.
+func (b *Broker) SetClientRate(rate Rate) error {
+	l := b.rates
+	if l == nil {
+		return &er.Err{
+			Context: "Broker, Rate Limits",
+			Message: er.ErrRateLimitsDisabled,
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.limits.Client = rate
+	for _, bucket := range l.clients {
+		bucket.refill(now)
+		bucket.retune(rate)
+	}
+	if rate == (Rate{}) {
+		clear(l.clients)
+	}
+	l.active.Store(rate != (Rate{}) || len(l.limits.Topics) > 0)
+	return nil
+}
+
+// RatePolicy returns what happens to publishes over a rate limit
+func (b *Broker) RatePolicy() RatePolicy {
+	if b.rates == nil {
+		return RateDrop
+	}
+	return b.rates.limits.Policy
+}
+
+// RateStats returns the rate limiter's counters
+func (b *Broker) RateStats() RateStats {
+	if b.rates == nil {
+		return RateStats{}
+	}
+	return RateStats{Limited: b.rates.limited.Load()}
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// ReplayPrefix starts the topic filters that ask for a replay of logged
+// messages. Subscribing to $replay/<start>/<filter> sends the logged
+// messages on topics matching filter once, from start on, each on the topic
+// $replay/<start>/<original topic>. start is a log offset or an RFC 3339
+// UTC timestamp such as 2026-10-16T08:00:00Z.
+const ReplayPrefix = "$replay/"
+
+// ReplaySource is the message log $replay subscriptions read
+type ReplaySource interface {
+	// OffsetAt returns the offset of the first message logged at or after t
+	OffsetAt(t time.Time) (uint64, error)
+	// ReplayMessages calls fn with the logged messages on topics matching
+	// filter from offset on, oldest first, until fn returns false
+	ReplayMessages(filter string, offset uint64, fn func(*Message) bool) error
+}
+
+// WithReplay serves $replay subscriptions from source, sending at most limit
+// messages for each
+func WithReplay(source ReplaySource, limit int) Option {
+	return func(b *Broker) {
+		b.replaySource = source
+		b.replayLimit = limit
+	}
+}
+
+// ParseReplayStart reads a replay start point, which is either an offset or
+// an RFC 3339 timestamp
+func ParseReplayStart(source ReplaySource, start string) (uint64, error) {
+	if offset, err := strconv.ParseUint(start, 10, 64); err == nil {
+		return offset, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, start)
+	if err != nil {
+		return 0, fmt.Errorf("replay start %q is neither an offset nor an RFC 3339 timestamp", start)
+	}
+	return source.OffsetAt(t)
+}
+
+// replayFilter splits a $replay filter into its start and the filter of the
+// logged topics. It reports false for other filters or when replay is off.
+func (b *Broker) replayFilter(topicFilter string) (start, filter string, ok bool) {
+	if b.replaySource == nil {
+		return "", "", false
+	}
+	rest, ok := strings.CutPrefix(topicFilter, ReplayPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
+
+// replay sends the logged messages a $replay subscription asks for. The
+// subscription isn't kept; later messages arrive on ordinary subscriptions.
+func (b *Broker) replay(session *Session, start, filter string, qos packet.QoSLevel) error {
+	if err := b.CheckSubscribe(filter); err != nil {
+		return err
+	}
+	offset, err := ParseReplayStart(b.replaySource, start)
+	if err != nil {
+		return err
+	}
+
+	prefix := ReplayPrefix + start + "/"
+	sent := 0
+	err = b.replaySource.ReplayMessages(filter, offset, func(msg *Message) bool {
+		// A broad filter can match topics under a denied prefix
+		if b.CheckSubscribe(msg.Topic) != nil {
+			return true
+		}
+		msg.Topic = prefix + msg.Topic
+		b.deliverMessage(session, msg, qos)
+		sent++
+		return sent < b.replayLimit
+	})
+	b.logger.Info("Replayed logged messages", logger.ClientID(session.ClientID),
+		logger.String("topic_filter", filter), logger.String("start", start), logger.Int("count", sent))
+	return err
+}
@@ -0,0 +1,33 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// WithSystemPublishers lets the given authenticated users publish to topics
+// starting with $, which are otherwise reserved for the broker itself
+func WithSystemPublishers(usernames []string) Option {
+	return func(b *Broker) {
+		b.sysPublishers = make(map[string]struct{}, len(usernames))
+		for _, name := range usernames {
+			b.sysPublishers[name] = struct{}{}
+		}
+	}
+}
+
+// CheckPublish reports whether a client authenticated as username may
+// publish to topic. Anonymous clients never may publish to $ topics.
+func (b *Broker) CheckPublish(username, topic string) error {
+	if !strings.HasPrefix(topic, "$") {
+		return nil
+	}
+	if _, ok := b.sysPublishers[username]; ok && username != "" {
+		return nil
+	}
+	return &er.Err{
+		Context: "Broker, Publish",
+		Message: er.ErrReservedTopic,
+	}
+}
@@ -0,0 +1,291 @@
+package broker
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// RetainedPolicy decides what happens when storing a retained message
+// would take the store past its memory or message count limit
+type RetainedPolicy int
+
+const (
+	// RetainedEvict drops the least recently used retained messages to make room
+	RetainedEvict RetainedPolicy = iota
+	// RetainedReject keeps the store as is and does not retain the new message
+	RetainedReject
+)
+
+type RetainedMessage struct {
+	Message *Message // Shared with the publish that stored it
+	QoS     packet.QoSLevel
+
+	size int64 // Bytes charged against the store limit
+}
+
+// RetainedStats is a point-in-time view of the retained store
+type RetainedStats struct {
+	Count       int    `json:"count"`
+	Bytes       int64  `json:"bytes"`        // Topic and in-memory payload bytes held
+	Limit       int64  `json:"limit"`        // 0 means unlimited
+	MaxMessages int    `json:"max_messages"` // 0 means unlimited
+	MaxPayload  int    `json:"max_payload"`  // Largest payload retained in bytes; 0 means unlimited
+	Evicted     uint64 `json:"evicted"`      // Messages dropped to make room since start
+	Rejected    uint64 `json:"rejected"`     // Messages not retained because of a limit, including oversized ones
+	Oversized   uint64 `json:"oversized"`    // Messages not retained because their payload exceeded max_payload
+}
+
+// retainedStore holds the last retained message per topic. With a limit set,
+// messages are kept in least recently used order, where storing a message or
+// delivering it to a new subscriber counts as a use.
+type retainedStore struct {
+	mu          sync.Mutex
+	msgs        map[string]*list.Element // Values are *RetainedMessage
+	lru         *list.List               // Front is the most recently used
+	bytes       int64
+	limit       int64
+	maxMessages int // 0 means unlimited
+	maxPayload  int // 0 means unlimited
+	policy      RetainedPolicy
+	evicted     uint64
+	rejected    uint64
+	oversized   uint64
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{
+		msgs: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// WithRetainedLimit caps the memory held by retained messages at maxBytes.
+// Payloads spilled to disk only count their topic. A limit of 0 disables the cap.
+func WithRetainedLimit(maxBytes int64, policy RetainedPolicy) Option {
+	return func(b *Broker) {
+		b.retained.limit = max(maxBytes, 0)
+		b.retained.policy = policy
+	}
+}
+
+// WithRetainedMessageLimits caps how many topics hold a retained message
+// and the largest payload retained, so a runaway publisher can't fill
+// memory with them. Oversized messages are never retained; at the count
+// cap policy decides between evicting the least recently used message and
+// rejecting the new one. 0 disables either cap.
+func WithRetainedMessageLimits(maxMessages, maxPayload int, policy RetainedPolicy) Option {
+	return func(b *Broker) {
+		b.retained.maxMessages = max(maxMessages, 0)
+		b.retained.maxPayload = max(maxPayload, 0)
+		b.retained.policy = policy
+	}
+}
+
+// RetainedPersister saves retained messages outside the broker so they
+// survive restarts. Calls are made on the publishing goroutine.
+type RetainedPersister interface {
+	SaveRetained(topic string, payload []byte, qos packet.QoSLevel) error
+	DeleteRetained(topic string) error
+}
+
+// WithRetainedPersister saves every retained message stored, replaced,
+// removed or evicted to p. Use RestoreRetained to load them back.
+func WithRetainedPersister(p RetainedPersister) Option {
+	return func(b *Broker) {
+		b.retainedPersister = p
+	}
+}
+
+// RestoreRetained puts a persisted retained message back into the retained
+// store. Call it before clients connect.
+func (b *Broker) RestoreRetained(topic string, payload []byte, qos packet.QoSLevel) {
+	evicted, ok := b.retained.store(NewMessage(topic, payload, true), minQoS(qos, b.maxQoS))
+	b.persistRetained(evicted, nil, 0)
+	if !ok {
+		b.logger.LogRetainedMessage(topic, "rejected", len(payload),
+			logger.String("reason", "retained limit reached"))
+	}
+}
+
+// persistRetained removes the deleted topics from the persister and saves
+// msg, if not nil
+func (b *Broker) persistRetained(deleted []string, msg *Message, qos packet.QoSLevel) {
+	if b.retainedPersister == nil {
+		return
+	}
+	for _, topic := range deleted {
+		if err := b.retainedPersister.DeleteRetained(topic); err != nil {
+			b.logger.LogError(err, "Failed to delete persisted retained message", logger.String("topic", topic))
+		}
+	}
+	if msg == nil {
+		return
+	}
+
+	payload := msg.Payload
+	if msg.Spilled() {
+		var err error
+		if payload, err = io.ReadAll(msg.PayloadReader()); err != nil {
+			b.logger.LogError(err, "Failed to read spilled retained message", logger.String("topic", msg.Topic))
+			return
+		}
+	}
+	if err := b.retainedPersister.SaveRetained(msg.Topic, payload, qos); err != nil {
+		b.logger.LogError(err, "Failed to persist retained message", logger.String("topic", msg.Topic))
+	}
+}
+
+// RetainHandling decides when a subscription is sent the retained messages
+// matching it, mirroring MQTT 5's Retain Handling subscription option
+type RetainHandling int
+
+const (
+	// RetainOnSubscribe sends retained messages on every SUBSCRIBE, as MQTT
+	// 3.1.1 requires [MQTT-3.3.1-6]
+	RetainOnSubscribe RetainHandling = iota
+	// RetainOnNewSubscribe skips them when the SUBSCRIBE replaces an
+	// existing subscription, such as one kept by a persistent session
+	RetainOnNewSubscribe
+	// RetainNever never sends retained messages to subscriptions
+	RetainNever
+)
+
+// WithRetainHandling sets when subscriptions receive retained messages
+func WithRetainHandling(handling RetainHandling) Option {
+	return func(b *Broker) {
+		b.retainHandling = handling
+	}
+}
+
+// sendsRetained reports whether a subscription gets retained messages
+// under the broker's retain handling
+func (b *Broker) sendsRetained(replaced bool) bool {
+	switch b.retainHandling {
+	case RetainNever:
+		return false
+	case RetainOnNewSubscribe:
+		return !replaced
+	}
+	return true
+}
+
+// retainedSize returns the bytes a retained message is charged for
+func retainedSize(msg *Message) int64 {
+	return int64(len(msg.Topic) + len(msg.Payload))
+}
+
+// store retains msg for its topic, replacing any previous message. It
+// returns the topics evicted to make room and false if the limit rejected msg.
+func (s *retainedStore) store(msg *Message, qos packet.QoSLevel) (evicted []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxPayload > 0 && msg.Size() > s.maxPayload {
+		s.oversized++
+		s.rejected++
+		return nil, false
+	}
+
+	entry := &RetainedMessage{Message: msg, QoS: qos, size: retainedSize(msg)}
+	var replaced int64
+	current, replacing := s.msgs[msg.Topic]
+	if replacing {
+		replaced = current.Value.(*RetainedMessage).size
+	}
+	full := func() bool {
+		return (s.limit > 0 && s.bytes-replaced+entry.size > s.limit) ||
+			(s.maxMessages > 0 && !replacing && len(s.msgs) >= s.maxMessages)
+	}
+
+	if full() {
+		if s.policy == RetainedReject || (s.limit > 0 && entry.size > s.limit) {
+			s.rejected++
+			return nil, false
+		}
+		// Evict from the back, never the entry being replaced
+		for elem := s.lru.Back(); elem != nil && full(); {
+			prev := elem.Prev()
+			old := elem.Value.(*RetainedMessage)
+			if old.Message.Topic != msg.Topic {
+				s.remove(elem)
+				s.evicted++
+				evicted = append(evicted, old.Message.Topic)
+			}
+			elem = prev
+		}
+	}
+
+	if elem, exists := s.msgs[msg.Topic]; exists {
+		s.bytes += entry.size - replaced
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+	} else {
+		s.bytes += entry.size
+		s.msgs[msg.Topic] = s.lru.PushFront(entry)
+	}
+	return evicted, true
+}
+
+// delete removes the retained message for topic, if any
+func (s *retainedStore) delete(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.msgs[topic]; ok {
+		s.remove(elem)
+	}
+}
+
+func (s *retainedStore) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*RetainedMessage)
+	delete(s.msgs, entry.Message.Topic)
+	s.bytes -= entry.size
+}
+
+// match returns the retained messages whose topic matches filter and marks
+// them as recently used
+func (s *retainedStore) match(filter string) []*RetainedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []*RetainedMessage
+	for topic, elem := range s.msgs {
+		if TopicMatches(filter, topic) {
+			matches = append(matches, elem.Value.(*RetainedMessage))
+			s.lru.MoveToFront(elem)
+		}
+	}
+	return matches
+}
+
+// topics returns every topic with a retained message
+func (s *retainedStore) topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topics := make([]string, 0, len(s.msgs))
+	for topic := range s.msgs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (s *retainedStore) stats() RetainedStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return RetainedStats{
+		Count:       len(s.msgs),
+		Bytes:       s.bytes,
+		Limit:       s.limit,
+		MaxMessages: s.maxMessages,
+		MaxPayload:  s.maxPayload,
+		Evicted:     s.evicted,
+		Rejected:    s.rejected,
+		Oversized:   s.oversized,
+	}
+}
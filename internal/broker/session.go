@@ -3,12 +3,16 @@ package broker
 import (
 	"maps"
 	"net"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
 )
 
 type Session struct {
 	// Key Identifiers
 	ClientID     string
 	CleanSession bool
+	Username     string // Authenticated user, empty for anonymous clients
 
 	// Will Flags
 	WillTopic   *string
@@ -34,6 +38,7 @@ func (b *Broker) Store(key string, session *Session) {
 	updated[key] = *session
 
 	b.session.Store(updated)
+	b.sessionGen.Add(1)
 }
 
 func (b *Broker) Get(key string) (*Session, bool) {
@@ -42,6 +47,36 @@ func (b *Broker) Get(key string) (*Session, bool) {
 	return &val, ok
 }
 
+// Sessions returns a snapshot of all stored sessions
+func (b *Broker) Sessions() []Session {
+	current, _ := b.session.Load().(sessionMap)
+	sessions := make([]Session, 0, len(current))
+	for _, session := range current {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// detach clears the connection of a stored session, marking its client
+// disconnected while the session itself is kept
+func (b *Broker) detach(key string) {
+	b.rwmu.Lock()
+	defer b.rwmu.Unlock()
+
+	current := b.session.Load().(sessionMap)
+	session, ok := current[key]
+	if !ok {
+		return
+	}
+	updated := make(sessionMap)
+	maps.Copy(updated, current)
+	session.Conn = nil
+	updated[key] = session
+
+	b.session.Store(updated)
+	b.sessionGen.Add(1)
+}
+
 func (b *Broker) Delete(key string) {
 	b.rwmu.Lock()
 	defer b.rwmu.Unlock()
@@ -52,4 +87,161 @@ func (b *Broker) Delete(key string) {
 	delete(updated, key)
 
 	b.session.Store(updated)
+	b.sessionGen.Add(1)
+}
+
+// SessionPresent reports the Session Present flag for a CONNECT from
+// clientID: true only when the client asks to resume (cleanSession false)
+// and a persistent session is still stored for it. Sessions left behind by
+// a clean-session connection, and expired sessions, are not resumable.
+func (b *Broker) SessionPresent(clientID string, cleanSession bool) bool {
+	if cleanSession {
+		return false
+	}
+	session, ok := b.Get(clientID)
+	return ok && !session.CleanSession
+}
+
+// SessionGeneration returns a counter that changes whenever a session is
+// stored or deleted. Callers holding a session from Get only need to look
+// it up again once the generation has moved.
+func (b *Broker) SessionGeneration() uint64 {
+	return b.sessionGen.Load()
+}
+
+// ExpireSession discards all state held for a client: its session entry,
+// subscriptions and in-flight QoS messages. Any connection still attached
+// to the session is closed. Returns false if no session exists.
+func (b *Broker) ExpireSession(clientID string) bool {
+	session, ok := b.Get(clientID)
+	if !ok {
+		return false
+	}
+
+	b.PurgeSession(clientID)
+
+	if session.Conn != nil {
+		_ = session.Conn.Close()
+	}
+	b.logger.LogClientConnection(clientID, "", "session_expired")
+	return true
+}
+
+// PurgeSession discards everything stored for a client: its session entry,
+// its subscriptions, its in-flight QoS 1/2 state and its offline and
+// deferred queues. It is what a CONNECT with CleanSession=1 starts from.
+func (b *Broker) PurgeSession(clientID string) {
+	b.subscriptions.UnsubscribeAll(clientID)
+	b.qosManager.CleanupClient(clientID)
+	if b.offline != nil {
+		b.offline.discard(clientID)
+	}
+	if b.inflight != nil {
+		b.inflight.takeDeferred(clientID)
+	}
+	if b.subPersister != nil {
+		if err := b.subPersister.DeleteSubscriptions(clientID); err != nil {
+			b.logger.LogError(err, "Failed to delete persisted subscriptions", logger.ClientID(clientID))
+		}
+	}
+	b.deleteQoS2s(clientID)
+	b.forgetDeliveryLock(clientID)
+	b.Delete(clientID)
+}
+
+// DropInflight discards the in-flight QoS 1/2 state of a client and
+// returns the number of messages dropped
+func (b *Broker) DropInflight(clientID string) (int, bool) {
+	if _, ok := b.Get(clientID); !ok {
+		return 0, false
+	}
+
+	dropped := b.qosManager.CleanupClient(clientID)
+	b.deleteQoS2s(clientID)
+	b.logger.LogClientConnection(clientID, "", "inflight_dropped", logger.Int("dropped", dropped))
+	return dropped, true
+}
+
+// ClearOfflineQueue discards the messages queued for a client while it is
+// disconnected and returns the number of messages discarded. The session
+// keeps queueing messages published after it.
+func (b *Broker) ClearOfflineQueue(clientID string) (int, bool) {
+	if _, ok := b.Get(clientID); !ok {
+		return 0, false
+	}
+	if b.offline == nil {
+		return 0, true
+	}
+
+	discarded := b.offline.empty(clientID)
+	b.logger.LogClientConnection(clientID, "", "offline_queue_cleared", logger.Int("discarded", discarded))
+	return discarded, true
+}
+
+// SubscriptionPersister saves the subscriptions of persistent sessions
+// outside the broker so they survive restarts
+type SubscriptionPersister interface {
+	SaveSubscription(clientID, filter string, qos packet.QoSLevel) error
+	DeleteSubscription(clientID, filter string) error
+	DeleteSubscriptions(clientID string) error
+}
+
+// WithSubscriptionPersister saves every subscription made by a client with
+// CleanSession=0 to p, and removes it on unsubscribe or when the session is
+// purged. Use RestoreSubscription to load them back.
+func WithSubscriptionPersister(p SubscriptionPersister) Option {
+	return func(b *Broker) {
+		b.subPersister = p
+	}
+}
+
+// RestoreSubscription puts a persisted subscription back, along with a
+// disconnected persistent session for its client if none is stored yet, so
+// the client resumes it with Session Present set and messages published in
+// the meantime are queued. Call it before clients connect.
+func (b *Broker) RestoreSubscription(clientID, filter string, qos packet.QoSLevel) {
+	session, ok := b.Get(clientID)
+	if !ok {
+		session = b.restoreSession(clientID)
+	}
+	if _, err := b.subscriptions.Subscribe(clientID, session, filter, b.getGrantedQoS(qos), b.subscriptionHandler(clientID)); err != nil {
+		b.logger.LogError(err, "Failed to restore subscription",
+			logger.ClientID(clientID),
+			logger.String("topic_filter", filter))
+	}
+}
+
+// restoreSession stores a disconnected persistent session for clientID,
+// as if its client had just gone away
+func (b *Broker) restoreSession(clientID string) *Session {
+	session := &Session{ClientID: clientID}
+	b.Store(clientID, session)
+	if b.offline != nil {
+		b.offline.open(clientID)
+	}
+	return session
+}
+
+// saveSubscription persists a subscription of a persistent session
+func (b *Broker) saveSubscription(clientID, filter string, qos packet.QoSLevel) {
+	if b.subPersister == nil {
+		return
+	}
+	if err := b.subPersister.SaveSubscription(clientID, filter, qos); err != nil {
+		b.logger.LogError(err, "Failed to persist subscription",
+			logger.ClientID(clientID),
+			logger.String("topic_filter", filter))
+	}
+}
+
+// deleteSubscription removes a persisted subscription of a persistent session
+func (b *Broker) deleteSubscription(clientID, filter string) {
+	if b.subPersister == nil {
+		return
+	}
+	if err := b.subPersister.DeleteSubscription(clientID, filter); err != nil {
+		b.logger.LogError(err, "Failed to delete persisted subscription",
+			logger.ClientID(clientID),
+			logger.String("topic_filter", filter))
+	}
 }
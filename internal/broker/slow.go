@@ -0,0 +1,42 @@
+package broker
+
+import "net"
+
+// SlowConsumerWriter is implemented by connections that know when their
+// client has stopped keeping up, and can give up on a write to it
+type SlowConsumerWriter interface {
+	// Stalled reports whether the client is currently not keeping up
+	Stalled() bool
+	// TryWrite writes p unless the client accepts none of it in time, and
+	// reports whether it was written
+	TryWrite(p []byte) (bool, error)
+}
+
+// WithSlowConsumerDrop drops QoS 0 deliveries to a client that has stopped
+// keeping up, instead of blocking the publisher behind it. QoS 1 and 2
+// deliveries still wait, and clients that stay stalled past the transport's
+// write timeout are disconnected either way.
+func WithSlowConsumerDrop() Option {
+	return func(b *Broker) {
+		b.dropSlow = true
+	}
+}
+
+// sendOrDrop writes a QoS 0 frame to a connection that may give up on slow
+// clients, and reports whether it handled the delivery. Spilled and
+// batched messages take the normal write path.
+func (b *Broker) sendOrDrop(conn net.Conn, msg *Message, frame []byte) (bool, error) {
+	writer, ok := conn.(SlowConsumerWriter)
+	if !b.dropSlow || !ok || msg.spill != nil || msg.batched || frame == nil {
+		return false, nil
+	}
+	if writer.Stalled() {
+		b.slowDropped.Add(1)
+		return true, nil
+	}
+	written, err := writer.TryWrite(frame)
+	if !written && err == nil {
+		b.slowDropped.Add(1)
+	}
+	return true, err
+}
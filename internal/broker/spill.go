@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+)
+
+// spillFile holds a payload that was streamed to disk instead of memory.
+// The file is unlinked as soon as it is written; the descriptor is closed
+// once the owning Message becomes unreachable.
+type spillFile struct {
+	file *os.File
+	size int64
+}
+
+// StreamWriter is implemented by connections that can write a frame header
+// followed by a streamed body without other writes interleaving
+type StreamWriter interface {
+	WriteStream(header []byte, body io.Reader) error
+}
+
+// NewSpilledMessage streams size bytes of payload from body into a
+// temporary file in dir and returns a message backed by that file
+func NewSpilledMessage(topic string, retain bool, body io.Reader, size int64, dir string) (*Message, error) {
+	file, err := os.CreateTemp(dir, "goqtt-payload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+	// Unlink right away so nothing is left behind if the broker dies.
+	// Where open files cannot be removed, the cleanup below retries.
+	removed := os.Remove(file.Name()) == nil
+
+	if _, err := io.CopyN(file, body, size); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to spill payload: %w", err)
+	}
+
+	msg := &Message{
+		Topic:  topic,
+		Retain: retain,
+		spill:  &spillFile{file: file, size: size},
+	}
+	runtime.AddCleanup(msg, func(f *os.File) {
+		_ = f.Close()
+		if !removed {
+			_ = os.Remove(f.Name())
+		}
+	}, file)
+	return msg, nil
+}
+
+// writeMessage writes an encoded frame to conn, streaming the payload from
+// disk after the header when the message was spilled
+func writeMessage(conn net.Conn, msg *Message, frame []byte) error {
+	if msg.spill == nil {
+		if bw, ok := conn.(BatchWriter); ok && msg.batched {
+			return bw.WriteBatched(frame)
+		}
+		_, err := conn.Write(frame)
+		return err
+	}
+
+	body := io.NewSectionReader(msg.spill.file, 0, msg.spill.size)
+	if sw, ok := conn.(StreamWriter); ok {
+		return sw.WriteStream(frame, body)
+	}
+
+	// Without stream support the frame has to be assembled in memory
+	data := make([]byte, len(frame), len(frame)+int(msg.spill.size))
+	copy(data, frame)
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(data, payload...))
+	return err
+}
@@ -1,70 +1,278 @@
 package broker
 
 import (
+	"hash/maphash"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pyr33x/goqtt/internal/packet"
 	"github.com/pyr33x/goqtt/internal/packet/utils"
 )
 
+// subscriptionShards is the number of shards holding filters with a literal first level
+const subscriptionShards = 16
+
+// matchCacheSize bounds the number of topics whose Match results are cached
+const matchCacheSize = 10000
+
+// SubscriptionTree is sharded by the first topic level so that subscribe and
+// unsubscribe churn on one branch does not block writers on the others.
+// Filters starting with a wildcard live in a dedicated shard that every
+// Match consults.
+//
+// Each shard is a copy-on-write trie: readers load the current root and walk
+// it without locking, while writers copy the nodes along the path they change
+// and publish a new root. Published nodes are never modified. Children and
+// subscribers are persistent maps, so copying a node is O(1) and changing
+// one of its entries O(log n) however many it has.
+//
+// Match results are cached per topic, and a subscription change only evicts
+// the topics its filter matches, so steady-state topics skip the trie walk.
 type SubscriptionTree struct {
-	root *TrieNode
-	mu   sync.RWMutex
+	shards   [subscriptionShards]treeShard
+	wildcard treeShard
+	seed     maphash.Seed
+	cache    atomic.Pointer[matchCache]
+	version  atomic.Uint64 // Bumped on every change, before its cache entries are evicted
+}
+
+// matchCache holds Match results by topic, indexed by topic level so the
+// entries a filter matches are found without visiting the others
+type matchCache struct {
+	entries sync.Map // Topic -> *cachedMatch
+	size    atomic.Int32
+	mu      sync.Mutex // Guards index
+	index   cacheNode
+}
+
+// cachedMatch is a cached Match result. Entries are compared by pointer, so
+// one stored by a Match that raced a change can be removed without
+// removing a newer one.
+type cachedMatch struct {
+	subs []*Subscription
+}
+
+// cacheNode is one level of the cached topics
+type cacheNode struct {
+	children map[string]*cacheNode
+	topic    string // Set when a cached topic ends at this level
+	cached   bool
+}
+
+// treeShard is an immutable trie snapshot holding part of the filters
+type treeShard struct {
+	root atomic.Pointer[TrieNode]
+	mu   sync.Mutex // serializes writers
 }
 
 type TrieNode struct {
-	children    map[string]*TrieNode
-	subscribers map[string]*Subscription // ClientID -> Subscription
-	isWildcard  bool                     // true if this node represents a wildcard
+	children    pmap[*TrieNode]
+	subscribers pmap[*Subscription] // ClientID -> Subscription
+	isWildcard  bool                // true if this node represents a wildcard
 }
 
 type Subscription struct {
-	ClientID string
-	Session  *Session
-	QoS      packet.QoSLevel
-	Handler  func(topic string, payload []byte, qos packet.QoSLevel, retain bool)
+	ClientID    string
+	TopicFilter string
+	Session     *Session
+	QoS         packet.QoSLevel
+	Handler     func(msg *Message, qos packet.QoSLevel)
 }
 
 func NewSubscriptionTree() *SubscriptionTree {
-	return &SubscriptionTree{
-		root: &TrieNode{
-			children:    make(map[string]*TrieNode),
-			subscribers: make(map[string]*Subscription),
-		},
+	st := &SubscriptionTree{seed: maphash.MakeSeed()}
+	st.wildcard.root.Store(newTrieNode(false))
+	for i := range st.shards {
+		st.shards[i].root.Store(newTrieNode(false))
+	}
+	st.cache.Store(new(matchCache))
+	return st
+}
+
+// invalidate evicts the cached Match results of the topics filter matches.
+// Writers call it after publishing a new root. The version is bumped first,
+// so a Match that started before the change either stores its result in
+// time to be evicted here or sees the new version and drops it itself.
+func (st *SubscriptionTree) invalidate(filter string) {
+	st.version.Add(1)
+	st.cache.Load().evict(filter)
+}
+
+// add caches the Match result for topic
+func (c *matchCache) add(topic string, match *cachedMatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := &c.index
+	for level := range strings.SplitSeq(topic, "/") {
+		child := node.children[level]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*cacheNode)
+			}
+			child = new(cacheNode)
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.topic, node.cached = topic, true
+	c.entries.Store(topic, match)
+}
+
+// drop removes topic's cached result if it is still match
+func (c *matchCache) drop(topic string, match *cachedMatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries.CompareAndDelete(topic, match) {
+		c.size.Add(-1)
+	}
+}
+
+// evict removes the cached results of every topic filter matches
+func (c *matchCache) evict(filter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictMatching(&c.index, strings.Split(filter, "/"), true)
+}
+
+// evictMatching removes the topics below node that match the filter levels
+// and prunes the index nodes left empty. Filters starting with a wildcard
+// never match $ topics (MQTT-4.7.2-1).
+func (c *matchCache) evictMatching(node *cacheNode, levels []string, root bool) {
+	if len(levels) == 0 {
+		c.uncache(node)
+		return
+	}
+	level := levels[0]
+	if level != "+" && level != "#" {
+		if child := node.children[level]; child != nil {
+			c.evictMatching(child, levels[1:], false)
+			prune(node, level, child)
+		}
+		return
+	}
+
+	if level == "#" && !root {
+		c.uncache(node) // sport/# also matches sport
+	}
+	for name, child := range node.children {
+		if root && strings.HasPrefix(name, "$") {
+			continue
+		}
+		if level == "#" {
+			c.evictAll(child)
+		} else {
+			c.evictMatching(child, levels[1:], false)
+		}
+		prune(node, name, child)
+	}
+}
+
+// evictAll removes every topic at or below node
+func (c *matchCache) evictAll(node *cacheNode) {
+	c.uncache(node)
+	for _, child := range node.children {
+		c.evictAll(child)
+	}
+	node.children = nil
+}
+
+func (c *matchCache) uncache(node *cacheNode) {
+	if !node.cached {
+		return
+	}
+	if _, ok := c.entries.LoadAndDelete(node.topic); ok {
+		c.size.Add(-1)
+	}
+	node.topic, node.cached = "", false
+}
+
+// prune removes child from node once no topic is cached at or below it
+func prune(node *cacheNode, level string, child *cacheNode) {
+	if !child.cached && len(child.children) == 0 {
+		delete(node.children, level)
+	}
+}
+
+func newTrieNode(isWildcard bool) *TrieNode {
+	return &TrieNode{isWildcard: isWildcard}
+}
+
+// clone returns a copy of the node that can be modified before it is
+// published. The persistent maps are shared until one of them changes.
+func (n *TrieNode) clone() *TrieNode {
+	c := *n
+	return &c
+}
+
+// empty reports whether the node holds no subscriptions and no children
+func (n *TrieNode) empty() bool {
+	return n.subscribers.Len() == 0 && n.children.Len() == 0
+}
+
+// firstLevel returns the topic up to the first separator
+func firstLevel(topic string) string {
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		return topic[:i]
 	}
+	return topic
 }
 
-// Subscribe adds a subscription to the tree
-func (st *SubscriptionTree) Subscribe(clientID string, session *Session, topicFilter string, qos packet.QoSLevel, handler func(string, []byte, packet.QoSLevel, bool)) error {
+// shardFor returns the shard holding filters whose first level is level
+func (st *SubscriptionTree) shardFor(level string) *treeShard {
+	if level == "+" || level == "#" {
+		return &st.wildcard
+	}
+	return &st.shards[maphash.String(st.seed, level)%subscriptionShards]
+}
+
+// forEachShard calls fn with the current root of every shard
+func (st *SubscriptionTree) forEachShard(fn func(root *TrieNode)) {
+	for _, shard := range st.allShards() {
+		fn(shard.root.Load())
+	}
+}
+
+func (st *SubscriptionTree) allShards() []*treeShard {
+	shards := make([]*treeShard, 0, subscriptionShards+1)
+	shards = append(shards, &st.wildcard)
+	for i := range st.shards {
+		shards = append(shards, &st.shards[i])
+	}
+	return shards
+}
+
+// Subscribe adds a subscription to the tree, replacing the client's
+// existing subscription to the same filter, and reports whether it did so
+func (st *SubscriptionTree) Subscribe(clientID string, session *Session, topicFilter string, qos packet.QoSLevel, handler func(*Message, packet.QoSLevel)) (bool, error) {
 	// Add validation step at the start
 	if err := utils.ValidateTopicFilter(topicFilter); err != nil {
-		return err
+		return false, err
 	}
 
-	st.mu.Lock()
-	defer st.mu.Unlock()
+	shard := st.shardFor(firstLevel(topicFilter))
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
 	// Split topic filter into levels
 	levels := strings.Split(topicFilter, "/")
 
-	current := st.root
+	root := shard.root.Load().clone()
+	current := root
 
-	// Navigate/create the path in the trie
+	// Copy/create the path in the trie
 	for _, level := range levels {
-		if current.children == nil {
-			current.children = make(map[string]*TrieNode)
-		}
-
-		if current.children[level] == nil {
-			current.children[level] = &TrieNode{
-				children:    make(map[string]*TrieNode),
-				subscribers: make(map[string]*Subscription),
-				isWildcard:  level == "+" || level == "#",
-			}
+		child, ok := current.children.Get(level)
+		if !ok {
+			child = newTrieNode(level == "+" || level == "#")
+		} else {
+			child = child.clone()
 		}
-
-		current = current.children[level]
+		current.children = current.children.Set(level, child)
+		current = child
 
 		// For multi-level wildcard (#), we stop here as it matches everything below
 		if level == "#" {
@@ -73,39 +281,41 @@ func (st *SubscriptionTree) Subscribe(clientID string, session *Session, topicFi
 	}
 
 	// Add/update subscription at this node
-	if current.subscribers == nil {
-		current.subscribers = make(map[string]*Subscription)
-	}
-
-	current.subscribers[clientID] = &Subscription{
-		ClientID: clientID,
-		Session:  session,
-		QoS:      qos,
-		Handler:  handler,
-	}
-
-	return nil
+	_, replaced := current.subscribers.Get(clientID)
+	current.subscribers = current.subscribers.Set(clientID, &Subscription{
+		ClientID:    clientID,
+		TopicFilter: topicFilter,
+		Session:     session,
+		QoS:         qos,
+		Handler:     handler,
+	})
+
+	shard.root.Store(root)
+	st.invalidate(topicFilter)
+	return replaced, nil
 }
 
 // Unsubscribe removes a subscription from the tree
 func (st *SubscriptionTree) Unsubscribe(clientID string, topicFilter string) error {
-	st.mu.Lock()
-	defer st.mu.Unlock()
+	shard := st.shardFor(firstLevel(topicFilter))
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
 	// Split topic filter into levels
 	levels := strings.Split(topicFilter, "/")
 
-	current := st.root
+	current := shard.root.Load()
 	path := make([]*TrieNode, 0, len(levels)+1)
 	path = append(path, current)
 
 	// Navigate to the subscription node
 	for _, level := range levels {
-		if current.children == nil || current.children[level] == nil {
+		child, ok := current.children.Get(level)
+		if !ok {
 			return nil // Subscription doesn't exist
 		}
 
-		current = current.children[level]
+		current = child
 		path = append(path, current)
 
 		if level == "#" {
@@ -113,76 +323,194 @@ func (st *SubscriptionTree) Unsubscribe(clientID string, topicFilter string) err
 		}
 	}
 
-	// Remove the subscription
-	if current.subscribers != nil {
-		delete(current.subscribers, clientID)
+	if _, exists := current.subscribers.Get(clientID); !exists {
+		return nil
 	}
 
-	// Clean up empty nodes from leaf to root
-	st.cleanupEmptyNodes(path, levels)
+	// Copy the path so readers of the old root are unaffected; each parent
+	// is linked to its child's copy once the child is final
+	for i := range path {
+		path[i] = path[i].clone()
+	}
 
+	// Remove the subscription
+	leaf := path[len(path)-1]
+	leaf.subscribers = leaf.subscribers.Delete(clientID)
+
+	// Link the copies from leaf to root, dropping nodes left empty
+	for i := len(path) - 1; i > 0; i-- {
+		parent, level := path[i-1], levels[i-1]
+		if path[i].empty() {
+			parent.children = parent.children.Delete(level)
+		} else {
+			parent.children = parent.children.Set(level, path[i])
+		}
+	}
+
+	shard.root.Store(path[0])
+	st.invalidate(topicFilter)
 	return nil
 }
 
 // UnsubscribeAll removes all subscriptions for a client
 func (st *SubscriptionTree) UnsubscribeAll(clientID string) {
-	st.mu.Lock()
-	defer st.mu.Unlock()
-
-	st.removeClientFromTree(st.root, clientID)
+	for _, shard := range st.allShards() {
+		shard.mu.Lock()
+		root := shard.root.Load()
+		var filters []string
+		if updated := st.removeClientFromTree(root, clientID, &filters); updated != root {
+			shard.root.Store(updated)
+			for _, filter := range filters {
+				st.invalidate(filter)
+			}
+		}
+		shard.mu.Unlock()
+	}
 }
 
-// removeClientFromTree recursively removes a client from all nodes
-func (st *SubscriptionTree) removeClientFromTree(node *TrieNode, clientID string) {
-	if node == nil {
-		return
-	}
+// removeClientFromTree returns node without the client's subscriptions,
+// copying only the nodes that change and pruning branches left empty, and
+// appends the filters removed to filters. The node itself is returned when
+// the client is not subscribed below it.
+func (st *SubscriptionTree) removeClientFromTree(node *TrieNode, clientID string, filters *[]string) *TrieNode {
+	var updated *TrieNode
 
 	// Remove client from current node
-	if node.subscribers != nil {
-		delete(node.subscribers, clientID)
+	if sub, exists := node.subscribers.Get(clientID); exists {
+		updated = node.clone()
+		updated.subscribers = updated.subscribers.Delete(clientID)
+		*filters = append(*filters, sub.TopicFilter)
 	}
 
 	// Recursively remove from children
-	for _, child := range node.children {
-		st.removeClientFromTree(child, clientID)
+	for level, child := range node.children.All() {
+		newChild := st.removeClientFromTree(child, clientID, filters)
+		if newChild == child {
+			continue
+		}
+		if updated == nil {
+			updated = node.clone()
+		}
+		if newChild.empty() {
+			updated.children = updated.children.Delete(level)
+		} else {
+			updated.children = updated.children.Set(level, newChild)
+		}
 	}
-}
 
-// cleanupEmptyNodes removes empty nodes from the tree
-func (st *SubscriptionTree) cleanupEmptyNodes(path []*TrieNode, levels []string) {
-	// Start from the leaf and work backwards
-	for i := len(path) - 1; i > 0; i-- {
-		node := path[i]
-		parent := path[i-1]
+	if updated == nil {
+		return node
+	}
+	return updated
+}
 
-		// If node has subscribers or children, keep it
-		if len(node.subscribers) > 0 || len(node.children) > 0 {
-			break
+// Compact prunes branches that hold no subscriptions and returns the number
+// of nodes removed. Unsubscribe paths already prune as they go, so this is a
+// safety net that keeps long-running brokers with topic churn from
+// accumulating empty nodes.
+func (st *SubscriptionTree) Compact() int {
+	removed := 0
+	for _, shard := range st.allShards() {
+		shard.mu.Lock()
+		root := shard.root.Load()
+		if updated := compactNode(root, &removed); updated != root {
+			shard.root.Store(updated)
 		}
+		shard.mu.Unlock()
+	}
+	return removed
+}
 
-		// Remove empty node from parent
-		levelIndex := i - 1
-		if levelIndex < len(levels) {
-			level := levels[levelIndex]
-			delete(parent.children, level)
+// compactNode returns node without its empty descendants, copying only the
+// nodes that change. The node itself is returned when nothing was pruned.
+func compactNode(node *TrieNode, removed *int) *TrieNode {
+	var updated *TrieNode
+	for level, child := range node.children.All() {
+		newChild := compactNode(child, removed)
+		empty := newChild.empty()
+		if newChild == child && !empty {
+			continue
+		}
+		if updated == nil {
+			updated = node.clone()
+		}
+		if empty {
+			updated.children = updated.children.Delete(level)
+			*removed++
+		} else {
+			updated.children = updated.children.Set(level, newChild)
 		}
 	}
+
+	if updated == nil {
+		return node
+	}
+	return updated
 }
 
-// Match finds all subscriptions that match a given topic
+// Match finds all subscriptions that match a given topic. The result may be
+// shared with other callers and must not be modified.
 func (st *SubscriptionTree) Match(topic string) []*Subscription {
-	st.mu.RLock()
-	defer st.mu.RUnlock()
+	// Load the version before the roots so a concurrent change cannot leave
+	// a stale result in the cache
+	version := st.version.Load()
+	cache := st.cache.Load()
+	if cached, ok := cache.entries.Load(topic); ok {
+		return cached.(*cachedMatch).subs
+	}
 
 	var matches []*Subscription
 	topicLevels := strings.Split(topic, "/")
 
-	st.matchRecursive(st.root, topicLevels, 0, &matches)
-
+	// Only the shard owning the first level and the wildcard shard can match.
+	// Filters starting with a wildcard never match $ topics (MQTT-4.7.2-1).
+	st.matchRecursive(st.shardFor(topicLevels[0]).root.Load(), topicLevels, 0, &matches)
+	if !strings.HasPrefix(topic, "$") {
+		st.matchRecursive(st.wildcard.root.Load(), topicLevels, 0, &matches)
+	}
+	matches = dedupeMatches(matches)
+
+	if cache.size.Add(1) <= matchCacheSize {
+		entry := &cachedMatch{subs: matches}
+		cache.add(topic, entry)
+		// A change published while matching may have missed the entry
+		if st.version.Load() != version {
+			cache.drop(topic, entry)
+		}
+	} else {
+		// Too many distinct topics; start over rather than grow without bound
+		st.cache.CompareAndSwap(cache, new(matchCache))
+	}
 	return matches
 }
 
+// dedupeMatches keeps one subscription per client, so a client whose
+// filters overlap, such as sensors/# and sensors/+/temp, gets a publish
+// once, at the highest QoS granted among them [MQTT-3.3.5-1]. The tree's
+// subscriptions are shared, so a higher QoS is carried by a copy.
+func dedupeMatches(matches []*Subscription) []*Subscription {
+	if len(matches) < 2 {
+		return matches
+	}
+	index := make(map[string]int, len(matches))
+	deduped := matches[:0]
+	for _, sub := range matches {
+		i, seen := index[sub.ClientID]
+		if !seen {
+			index[sub.ClientID] = len(deduped)
+			deduped = append(deduped, sub)
+			continue
+		}
+		if sub.QoS > deduped[i].QoS {
+			highest := *deduped[i]
+			highest.QoS = sub.QoS
+			deduped[i] = &highest
+		}
+	}
+	clear(matches[len(deduped):])
+	return deduped
+}
+
 // matchRecursive recursively matches topic levels against the subscription tree
 func (st *SubscriptionTree) matchRecursive(node *TrieNode, topicLevels []string, levelIndex int, matches *[]*Subscription) {
 	if node == nil {
@@ -191,7 +519,7 @@ func (st *SubscriptionTree) matchRecursive(node *TrieNode, topicLevels []string,
 
 	// If we've consumed all topic levels, collect subscribers from this node
 	if levelIndex >= len(topicLevels) {
-		for _, sub := range node.subscribers {
+		for _, sub := range node.subscribers.All() {
 			*matches = append(*matches, sub)
 		}
 		return
@@ -200,19 +528,19 @@ func (st *SubscriptionTree) matchRecursive(node *TrieNode, topicLevels []string,
 	currentLevel := topicLevels[levelIndex]
 
 	// Check for exact match
-	if exactChild, exists := node.children[currentLevel]; exists {
+	if exactChild, exists := node.children.Get(currentLevel); exists {
 		st.matchRecursive(exactChild, topicLevels, levelIndex+1, matches)
 	}
 
 	// Check for single-level wildcard (+)
-	if plusChild, exists := node.children["+"]; exists {
+	if plusChild, exists := node.children.Get("+"); exists {
 		st.matchRecursive(plusChild, topicLevels, levelIndex+1, matches)
 	}
 
 	// Check for multi-level wildcard (#)
-	if hashChild, exists := node.children["#"]; exists {
+	if hashChild, exists := node.children.Get("#"); exists {
 		// Multi-level wildcard matches everything from this point
-		for _, sub := range hashChild.subscribers {
+		for _, sub := range hashChild.subscribers.All() {
 			*matches = append(*matches, sub)
 		}
 	}
@@ -220,11 +548,10 @@ func (st *SubscriptionTree) matchRecursive(node *TrieNode, topicLevels []string,
 
 // GetSubscriptions returns all subscriptions for a specific client
 func (st *SubscriptionTree) GetSubscriptions(clientID string) []*Subscription {
-	st.mu.RLock()
-	defer st.mu.RUnlock()
-
 	var subscriptions []*Subscription
-	st.getClientSubscriptions(st.root, clientID, &subscriptions)
+	st.forEachShard(func(root *TrieNode) {
+		st.getClientSubscriptions(root, clientID, &subscriptions)
+	})
 
 	return subscriptions
 }
@@ -236,16 +563,41 @@ func (st *SubscriptionTree) getClientSubscriptions(node *TrieNode, clientID stri
 	}
 
 	// Check if client has subscription at this node
-	if sub, exists := node.subscribers[clientID]; exists {
+	if sub, exists := node.subscribers.Get(clientID); exists {
 		*subscriptions = append(*subscriptions, sub)
 	}
 
 	// Recursively check children
-	for _, child := range node.children {
+	for _, child := range node.children.All() {
 		st.getClientSubscriptions(child, clientID, subscriptions)
 	}
 }
 
+// All returns every subscription in the tree
+func (st *SubscriptionTree) All() []*Subscription {
+	var subscriptions []*Subscription
+	st.forEachShard(func(root *TrieNode) {
+		st.collectSubscriptions(root, &subscriptions)
+	})
+
+	return subscriptions
+}
+
+// collectSubscriptions recursively gathers the subscribers of every node
+func (st *SubscriptionTree) collectSubscriptions(node *TrieNode, subscriptions *[]*Subscription) {
+	if node == nil {
+		return
+	}
+
+	for _, sub := range node.subscribers.All() {
+		*subscriptions = append(*subscriptions, sub)
+	}
+
+	for _, child := range node.children.All() {
+		st.collectSubscriptions(child, subscriptions)
+	}
+}
+
 // IsValidTopicFilter validates a topic filter according to MQTT 3.1.1 rules
 func IsValidTopicFilter(topicFilter string) bool {
 	return utils.ValidateTopicFilter(topicFilter) == nil
@@ -265,6 +617,11 @@ func TopicMatches(topicFilter, topicName string) bool {
 	filterLevels := strings.Split(topicFilter, "/")
 	nameLevels := strings.Split(topicName, "/")
 
+	// Filters starting with a wildcard never match $ topics (MQTT-4.7.2-1)
+	if strings.HasPrefix(topicName, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
 	return topicMatchesRecursive(filterLevels, nameLevels, 0, 0)
 }
 
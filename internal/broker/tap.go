@@ -0,0 +1,30 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// Tap calls fn with every message published to a topic matching filter
+// until the returned cancel function is called. It lets in-process
+// consumers such as the admin API follow traffic without an MQTT
+// connection. fn runs on the delivering goroutine and must not block.
+func (b *Broker) Tap(filter string, fn func(*Message)) (cancel func(), err error) {
+	if err := utils.ValidateTopicFilter(filter); err != nil {
+		return nil, err
+	}
+
+	// $ keeps tap IDs apart from any client ID a client can choose
+	id := fmt.Sprintf("$tap/%d", b.taps.Add(1))
+	handler := func(msg *Message, _ packet.QoSLevel) {
+		fn(msg)
+	}
+	if _, err := b.subscriptions.Subscribe(id, &Session{ClientID: id}, filter, packet.QoSAtMostOnce, handler); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = b.subscriptions.Unsubscribe(id, filter)
+	}, nil
+}
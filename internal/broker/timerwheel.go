@@ -0,0 +1,72 @@
+package broker
+
+import "time"
+
+// timerKind tells the QoS manager what to do when a timer fires
+type timerKind uint8
+
+const (
+	timerRetryQoS1 timerKind = iota
+	timerRetryQoS2
+	timerExpireQoS2Received
+	timerExpireQoS2Inbound
+)
+
+// wheelEntry is a scheduled timer. The message pointer identifies the exact
+// message it was scheduled for, so timers of acknowledged or replaced
+// messages are recognised as stale and ignored instead of being cancelled.
+type wheelEntry struct {
+	kind     timerKind
+	clientID string
+	packetID uint16
+	pending  *PendingMessage
+	received *ReceivedQoS2
+	rounds   int // Full revolutions left before the entry is due
+}
+
+// timerWheel is a hashed timing wheel: each tick only visits the entries in
+// one slot, so the cost of a tick scales with due timers, not with the total
+// number in flight. It is not safe for concurrent use.
+type timerWheel struct {
+	slots [][]wheelEntry
+	tick  time.Duration
+	pos   int
+}
+
+// newTimerWheel creates a wheel with the given number of slots and tick length
+func newTimerWheel(slots int, tick time.Duration) *timerWheel {
+	return &timerWheel{
+		slots: make([][]wheelEntry, slots),
+		tick:  tick,
+	}
+}
+
+// schedule adds an entry that fires after delay, rounded up to whole ticks
+func (w *timerWheel) schedule(delay time.Duration, entry wheelEntry) {
+	ticks := max(int((delay+w.tick-1)/w.tick), 1)
+	entry.rounds = (ticks - 1) / len(w.slots)
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], entry)
+}
+
+// advance moves the wheel one tick forward and returns the entries now due
+func (w *timerWheel) advance() []wheelEntry {
+	w.pos = (w.pos + 1) % len(w.slots)
+	slot := w.slots[w.pos]
+
+	var due []wheelEntry
+	remaining := slot[:0]
+	for _, entry := range slot {
+		if entry.rounds > 0 {
+			entry.rounds--
+			remaining = append(remaining, entry)
+			continue
+		}
+		due = append(due, entry)
+	}
+
+	// Clear the tail so fired entries do not keep their messages alive
+	clear(slot[len(remaining):])
+	w.slots[w.pos] = remaining
+	return due
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"sort"
+	"strings"
+)
+
+// TopicNode is a read-only snapshot of a single level in the topic tree
+type TopicNode struct {
+	Level       string       `json:"level"`
+	Path        string       `json:"path"`
+	Subscribers int          `json:"subscribers"`
+	Retained    bool         `json:"retained"`
+	Children    []*TopicNode `json:"children,omitempty"`
+}
+
+// TopicTree returns a snapshot of the live subscription and retained topic hierarchy
+func (b *Broker) TopicTree() *TopicNode {
+	root := &TopicNode{}
+	index := make(map[string]*TopicNode)
+
+	b.subscriptions.forEachShard(func(trie *TrieNode) {
+		snapshotTrie(trie, root, true, index)
+	})
+
+	for _, topic := range b.retained.topics() {
+		insertTopicPath(root, topic, index).Retained = true
+	}
+
+	sortTopicNodes(root)
+	return root
+}
+
+// snapshotTrie copies the trie below node into the snapshot tree
+func snapshotTrie(node *TrieNode, view *TopicNode, isRoot bool, index map[string]*TopicNode) {
+	for level, child := range node.children.All() {
+		path := level
+		if !isRoot {
+			path = view.Path + "/" + level
+		}
+
+		childView := &TopicNode{
+			Level:       level,
+			Path:        path,
+			Subscribers: child.subscribers.Len(),
+		}
+		view.Children = append(view.Children, childView)
+		index[path] = childView
+
+		snapshotTrie(child, childView, false, index)
+	}
+}
+
+// insertTopicPath returns the node for topic, creating any missing levels
+func insertTopicPath(root *TopicNode, topic string, index map[string]*TopicNode) *TopicNode {
+	if node, ok := index[topic]; ok {
+		return node
+	}
+
+	current := root
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		path := strings.Join(levels[:i+1], "/")
+		node, ok := index[path]
+		if !ok {
+			node = &TopicNode{Level: level, Path: path}
+			current.Children = append(current.Children, node)
+			index[path] = node
+		}
+		current = node
+	}
+
+	return current
+}
+
+// sortTopicNodes orders children by level name so output is stable
+func sortTopicNodes(node *TopicNode) {
+	sort.Slice(node.Children, func(i, j int) bool {
+		return node.Children[i].Level < node.Children[j].Level
+	})
+	for _, child := range node.Children {
+		sortTopicNodes(child)
+	}
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// WillPolicy restricts the will messages clients may register at CONNECT
+type WillPolicy struct {
+	MaxQoS        packet.QoSLevel // Highest will QoS accepted
+	RetainAllowed bool            // Whether wills may be retained
+}
+
+// defaultWillPolicy accepts every will
+var defaultWillPolicy = WillPolicy{MaxQoS: packet.QoSExactlyOnce, RetainAllowed: true}
+
+// WithWillPolicy refuses connections whose will exceeds policy
+func WithWillPolicy(policy WillPolicy) Option {
+	return func(b *Broker) {
+		b.willPolicy = policy
+	}
+}
+
+// CheckWill reports whether a will with the given QoS and retain flag is
+// allowed. Connections with a refused will should be rejected.
+func (b *Broker) CheckWill(qos byte, retain bool) error {
+	if packet.QoSLevel(qos) > b.willPolicy.MaxQoS || (retain && !b.willPolicy.RetainAllowed) || b.CheckRetain(retain) != nil {
+		return &er.Err{
+			Context: "Broker, Will",
+			Message: er.ErrWillNotAllowed,
+		}
+	}
+	return nil
+}
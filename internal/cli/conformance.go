@@ -0,0 +1,657 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+)
+
+// conformanceCase is one spec scenario checked by `goqtt conformance`
+type conformanceCase struct {
+	clause string // Normative statement from the MQTT 3.1.1 specification
+	name   string
+	run    func(r *conformanceRun) error
+}
+
+// skipped marks a scenario that could not be checked against this broker
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+// conformanceRun holds what every scenario needs to reach the broker
+type conformanceRun struct {
+	addr     string
+	timeout  time.Duration // How long to wait for an expected packet
+	quiet    time.Duration // How long to wait before deciding nothing will arrive
+	username string
+	password string
+	runID    int // Makes client IDs and topics unique to this run
+	seq      int
+}
+
+var conformanceCases = []conformanceCase{
+	{"MQTT-3.1.0-1", "first packet must be CONNECT", checkFirstPacketConnect},
+	{"MQTT-3.1.0-2", "second CONNECT closes the connection", checkSecondConnect},
+	{"MQTT-3.1.2-2", "unsupported protocol level gets CONNACK 0x01", checkProtocolLevel},
+	{"MQTT-3.1.2-3", "reserved CONNECT flag closes the connection", checkReservedFlag},
+	{"MQTT-3.1.2-8", "will is published when the connection is lost", checkWillOnClose},
+	{"MQTT-3.1.2-10", "will is discarded on DISCONNECT", checkWillOnDisconnect},
+	{"MQTT-3.1.3-8", "empty client ID without clean session gets CONNACK 0x02", checkEmptyClientID},
+	{"MQTT-3.2.2-1", "clean session reports no session present", checkCleanSessionPresent},
+	{"MQTT-3.3.1-8", "retained message is sent to new subscriptions", checkRetainedOnSubscribe},
+	{"MQTT-3.3.1-10", "empty retained payload clears the retained message", checkRetainedClear},
+	{"MQTT-3.3.4-1", "QoS 1 PUBLISH is answered with PUBACK", checkPuback},
+	{"MQTT-3.6.4-1", "PUBREL is answered with PUBCOMP", checkPubcomp},
+	{"MQTT-3.8.1-1", "SUBSCRIBE with bad flags closes the connection", checkSubscribeFlags},
+	{"MQTT-3.8.4-2", "SUBACK carries the SUBSCRIBE packet ID", checkSubackID},
+	{"MQTT-3.12.4-1", "PINGREQ is answered with PINGRESP", checkPingresp},
+	{"MQTT-4.7.2-1", "wildcard filters do not match $ topics", checkDollarTopics},
+}
+
+// Conformance implements `goqtt conformance`, running MQTT 3.1.1 spec
+// scenarios against a running broker and reporting each clause
+func Conformance(args []string) int {
+	r := &conformanceRun{runID: os.Getpid()}
+	fs := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	fs.StringVar(&r.addr, "addr", "127.0.0.1:1883", "address of the broker under test")
+	fs.DurationVar(&r.timeout, "timeout", 2*time.Second, "how long to wait for an expected packet")
+	fs.DurationVar(&r.quiet, "quiet", 500*time.Millisecond, "how long to wait before deciding no packet will arrive")
+	fs.StringVar(&r.username, "username", "", "user allowed to publish to $ topics, needed for MQTT-4.7.2-1")
+	fs.StringVar(&r.password, "password", "", "password for --username")
+	run := fs.String("run", "", "only run clauses containing this text")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var results []checkResult
+	for _, tc := range conformanceCases {
+		if !strings.Contains(tc.clause, *run) {
+			continue
+		}
+		err := tc.run(r)
+		var skip skipped
+		switch {
+		case err == nil:
+			results = append(results, checkResult{tc.clause, statusPass, tc.name})
+		case errors.As(err, &skip):
+			results = append(results, checkResult{tc.clause, statusWarn, fmt.Sprintf("%s: skipped, %v", tc.name, err)})
+		default:
+			results = append(results, checkResult{tc.clause, statusFail, fmt.Sprintf("%s: %v", tc.name, err)})
+		}
+	}
+	return printReport(os.Stdout, results)
+}
+
+// clientID returns a new client ID within the 23 alphanumeric characters
+// every broker must accept
+func (r *conformanceRun) clientID() string {
+	r.seq++
+	return fmt.Sprintf("conformance%dn%d", r.runID, r.seq)
+}
+
+func (r *conformanceRun) topic(name string) string {
+	return fmt.Sprintf("goqtt-conformance/%d/%s", r.runID, name)
+}
+
+// dial opens a connection without sending anything
+func (r *conformanceRun) dial() (*loadClient, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &loadClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// connectOptions describes a CONNECT packet; zero values give a clean
+// 3.1.1 session with no will
+type connectOptions struct {
+	clientID    string
+	level       byte // 0 sends protocol level 4
+	flags       byte // Extra connect flag bits
+	persistent  bool
+	username    string
+	password    string
+	willTopic   string
+	willMessage string
+}
+
+func connectFrame(o connectOptions) []byte {
+	level := o.level
+	if level == 0 {
+		level = 4
+	}
+	flags := o.flags
+	if !o.persistent {
+		flags |= 0x02
+	}
+	if o.willTopic != "" {
+		flags |= 0x04
+	}
+	if o.username != "" {
+		flags |= 0x80 | 0x40
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, level, flags)
+	body = binary.BigEndian.AppendUint16(body, 30)
+	body = appendMQTTString(body, o.clientID)
+	if o.willTopic != "" {
+		body = appendMQTTString(body, o.willTopic)
+		body = appendMQTTString(body, o.willMessage)
+	}
+	if o.username != "" {
+		body = appendMQTTString(body, o.username)
+		body = appendMQTTString(body, o.password)
+	}
+	return appendFrame(nil, byte(pkt.CONNECT), body)
+}
+
+// connect opens a connection and completes the CONNECT handshake
+func (r *conformanceRun) connect(o connectOptions) (*loadClient, error) {
+	c, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(connectFrame(o)); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	ack, err := r.expect(c, pkt.CONNACK)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if len(ack) < 2 || ack[1] != pkt.ConnectionAccepted {
+		_ = c.Close()
+		return nil, fmt.Errorf("CONNECT refused with return code %#x", ack[1])
+	}
+	return c, nil
+}
+
+// expect reads the next packet and fails unless it has type want
+func (r *conformanceRun) expect(c *loadClient, want pkt.PacketType) ([]byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	header, body, err := c.readPacket(nil)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for %s: %w", want, err)
+	}
+	if got := pkt.PacketType(header & 0xF0); got != want {
+		return nil, fmt.Errorf("got %s, want %s", got, want)
+	}
+	return body, nil
+}
+
+// expectClosed fails unless the broker closes the connection without
+// sending anything further
+func (r *conformanceRun) expectClosed(c *loadClient) error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	header, _, err := c.readPacket(nil)
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return fmt.Errorf("got %s, want the connection closed", pkt.PacketType(header&0xF0))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errors.New("connection still open")
+	default:
+		return nil
+	}
+}
+
+// expectQuiet fails if a packet arrives within the quiet period
+func (r *conformanceRun) expectQuiet(c *loadClient) error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(r.quiet))
+	header, _, err := c.readPacket(nil)
+	if err == nil {
+		return fmt.Errorf("unexpected %s", pkt.PacketType(header&0xF0))
+	}
+	return nil
+}
+
+// subscribeFrame builds a single-filter SUBSCRIBE with packet ID 1
+func subscribeFrame(filter string, qos pkt.QoSLevel) []byte {
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 1)
+	body = appendMQTTString(body, filter)
+	body = append(body, byte(qos))
+	return appendFrame(nil, byte(pkt.SUBSCRIBE)|0x02, body)
+}
+
+// subscribe sends a single-filter SUBSCRIBE and waits for a successful SUBACK
+func (r *conformanceRun) subscribe(c *loadClient, filter string, qos pkt.QoSLevel) error {
+	if err := c.write(subscribeFrame(filter, qos)); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.SUBACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 3 || ack[2] == pkt.SubackFailure {
+		return fmt.Errorf("subscription to %q was refused", filter)
+	}
+	return nil
+}
+
+// publishFrame builds a PUBLISH; packetID is only sent for QoS 1 and 2
+func publishFrame(topic string, payload []byte, qos pkt.QoSLevel, retain bool, packetID uint16) []byte {
+	header := byte(pkt.PUBLISH) | byte(qos)<<1
+	if retain {
+		header |= 0x01
+	}
+	var body []byte
+	body = appendMQTTString(body, topic)
+	if qos > pkt.QoSAtMostOnce {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	return appendFrame(nil, header, append(body, payload...))
+}
+
+// expectPublish waits for a PUBLISH on topic and returns its first byte and payload
+func (r *conformanceRun) expectPublish(c *loadClient, topic string) (byte, []byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	header, body, err := c.readPacket(nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("waiting for PUBLISH on %s: %w", topic, err)
+	}
+	if pkt.PacketType(header&0xF0) != pkt.PUBLISH || len(body) < 2 {
+		return 0, nil, fmt.Errorf("got %s, want PUBLISH", pkt.PacketType(header&0xF0))
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n || string(body[2:2+n]) != topic {
+		return 0, nil, fmt.Errorf("got PUBLISH on an unexpected topic, want %s", topic)
+	}
+	body = body[2+n:]
+	if qos := pkt.QoSLevel(header>>1) & 0x03; qos > pkt.QoSAtMostOnce && len(body) >= 2 {
+		body = body[2:]
+	}
+	return header, body, nil
+}
+
+func checkFirstPacketConnect(r *conformanceRun) error {
+	c, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write([]byte{byte(pkt.PINGREQ), 0}); err != nil {
+		return err
+	}
+	return r.expectClosed(c)
+}
+
+func checkSecondConnect(r *conformanceRun) error {
+	id := r.clientID()
+	c, err := r.connect(connectOptions{clientID: id})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(connectFrame(connectOptions{clientID: id})); err != nil {
+		return err
+	}
+	return r.expectClosed(c)
+}
+
+func checkProtocolLevel(r *conformanceRun) error {
+	c, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(connectFrame(connectOptions{clientID: r.clientID(), level: 3})); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.CONNACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || ack[1] != pkt.UnacceptableProtocolVersion {
+		return fmt.Errorf("got return code %#x, want %#x", ack[1], pkt.UnacceptableProtocolVersion)
+	}
+	return r.expectClosed(c)
+}
+
+func checkReservedFlag(r *conformanceRun) error {
+	c, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(connectFrame(connectOptions{clientID: r.clientID(), flags: 0x01})); err != nil {
+		return err
+	}
+	return r.expectClosed(c)
+}
+
+// willScenario connects a subscriber to a will topic and a client holding
+// that will, then ends the will client's connection with end
+func (r *conformanceRun) willScenario(end func(c *loadClient) error) (*loadClient, string, error) {
+	topic := r.topic(fmt.Sprintf("will/%d", r.seq))
+	sub, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := r.subscribe(sub, topic, pkt.QoSAtMostOnce); err != nil {
+		_ = sub.Close()
+		return nil, "", err
+	}
+
+	c, err := r.connect(connectOptions{clientID: r.clientID(), willTopic: topic, willMessage: "gone"})
+	if err != nil {
+		_ = sub.Close()
+		return nil, "", err
+	}
+	if err := end(c); err != nil {
+		_ = sub.Close()
+		return nil, "", err
+	}
+	return sub, topic, nil
+}
+
+func checkWillOnClose(r *conformanceRun) error {
+	sub, topic, err := r.willScenario(func(c *loadClient) error {
+		return c.Close()
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	_, _, err = r.expectPublish(sub, topic)
+	return err
+}
+
+func checkWillOnDisconnect(r *conformanceRun) error {
+	sub, _, err := r.willScenario(func(c *loadClient) error {
+		defer c.Close()
+		return c.write([]byte{byte(pkt.DISCONNECT), 0})
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	return r.expectQuiet(sub)
+}
+
+func checkEmptyClientID(r *conformanceRun) error {
+	c, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(connectFrame(connectOptions{persistent: true})); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.CONNACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || ack[1] != pkt.IdentifierRejected {
+		return fmt.Errorf("got return code %#x, want %#x", ack[1], pkt.IdentifierRejected)
+	}
+	return r.expectClosed(c)
+}
+
+func checkCleanSessionPresent(r *conformanceRun) error {
+	id := r.clientID()
+	c, err := r.connect(connectOptions{clientID: id, persistent: true})
+	if err != nil {
+		return err
+	}
+	if err := r.subscribe(c, r.topic("session"), pkt.QoSAtLeastOnce); err != nil {
+		_ = c.Close()
+		return err
+	}
+	_ = c.write([]byte{byte(pkt.DISCONNECT), 0})
+	_ = c.Close()
+
+	c, err = r.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.write(connectFrame(connectOptions{clientID: id})); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.CONNACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || ack[0]&0x01 != 0 {
+		return errors.New("session present flag set for a clean session")
+	}
+	return nil
+}
+
+func checkRetainedOnSubscribe(r *conformanceRun) error {
+	topic := r.topic("retained")
+	pub, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	if err := pub.write(publishFrame(topic, []byte("kept"), pkt.QoSAtLeastOnce, true, 1)); err != nil {
+		return err
+	}
+	if _, err := r.expect(pub, pkt.PUBACK); err != nil {
+		return err
+	}
+
+	sub, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if err := sub.write(subscribeFrame(topic, pkt.QoSAtMostOnce)); err != nil {
+		return err
+	}
+
+	// The spec does not order the SUBACK against the retained messages the
+	// subscription triggers
+	_ = sub.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	peek, err := sub.reader.Peek(1)
+	if err != nil {
+		return fmt.Errorf("waiting for SUBACK: %w", err)
+	}
+	subackFirst := pkt.PacketType(peek[0]&0xF0) == pkt.SUBACK
+	if subackFirst {
+		if _, err := r.expect(sub, pkt.SUBACK); err != nil {
+			return err
+		}
+	}
+	first, payload, err := r.expectPublish(sub, topic)
+	if err != nil {
+		return err
+	}
+	if !subackFirst {
+		if _, err := r.expect(sub, pkt.SUBACK); err != nil {
+			return err
+		}
+	}
+	if first&0x01 == 0 {
+		return errors.New("retain flag not set")
+	}
+	if string(payload) != "kept" {
+		return fmt.Errorf("got payload %q, want %q", payload, "kept")
+	}
+	return nil
+}
+
+func checkRetainedClear(r *conformanceRun) error {
+	topic := r.topic("retained")
+	pub, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	if err := pub.write(publishFrame(topic, nil, pkt.QoSAtLeastOnce, true, 1)); err != nil {
+		return err
+	}
+	if _, err := r.expect(pub, pkt.PUBACK); err != nil {
+		return err
+	}
+
+	sub, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if err := r.subscribe(sub, topic, pkt.QoSAtMostOnce); err != nil {
+		return err
+	}
+	return r.expectQuiet(sub)
+}
+
+func checkPuback(r *conformanceRun) error {
+	c, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(publishFrame(r.topic("qos1"), []byte("x"), pkt.QoSAtLeastOnce, false, 7)); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.PUBACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || binary.BigEndian.Uint16(ack) != 7 {
+		return errors.New("PUBACK carries the wrong packet ID")
+	}
+	return nil
+}
+
+func checkPubcomp(r *conformanceRun) error {
+	c, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write(publishFrame(r.topic("qos2"), []byte("x"), pkt.QoSExactlyOnce, false, 9)); err != nil {
+		return err
+	}
+	if _, err := r.expect(c, pkt.PUBREC); err != nil {
+		return err
+	}
+	if err := c.write([]byte{byte(pkt.PUBREL) | 0x02, 2, 0, 9}); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.PUBCOMP)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || binary.BigEndian.Uint16(ack) != 9 {
+		return errors.New("PUBCOMP carries the wrong packet ID")
+	}
+	return nil
+}
+
+func checkSubscribeFlags(r *conformanceRun) error {
+	c, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 1)
+	body = appendMQTTString(body, r.topic("flags"))
+	body = append(body, 0)
+	if err := c.write(appendFrame(nil, byte(pkt.SUBSCRIBE), body)); err != nil {
+		return err
+	}
+	return r.expectClosed(c)
+}
+
+func checkSubackID(r *conformanceRun) error {
+	c, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 0x1234)
+	body = appendMQTTString(body, r.topic("suback"))
+	body = append(body, 0)
+	if err := c.write(appendFrame(nil, byte(pkt.SUBSCRIBE)|0x02, body)); err != nil {
+		return err
+	}
+	ack, err := r.expect(c, pkt.SUBACK)
+	if err != nil {
+		return err
+	}
+	if len(ack) < 2 || binary.BigEndian.Uint16(ack) != 0x1234 {
+		return errors.New("SUBACK carries the wrong packet ID")
+	}
+	return nil
+}
+
+func checkPingresp(r *conformanceRun) error {
+	c, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.write([]byte{byte(pkt.PINGREQ), 0}); err != nil {
+		return err
+	}
+	_, err = r.expect(c, pkt.PINGRESP)
+	return err
+}
+
+func checkDollarTopics(r *conformanceRun) error {
+	if r.username == "" {
+		return skipped("needs --username of a user allowed to publish to $ topics")
+	}
+	topic := "$" + r.topic("dollar")
+	filter := fmt.Sprintf("+/%d/dollar", r.runID)
+
+	wildcard, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer wildcard.Close()
+	if err := r.subscribe(wildcard, filter, pkt.QoSAtMostOnce); err != nil {
+		return err
+	}
+	exact, err := r.connect(connectOptions{clientID: r.clientID()})
+	if err != nil {
+		return err
+	}
+	defer exact.Close()
+	if err := r.subscribe(exact, topic, pkt.QoSAtMostOnce); err != nil {
+		return err
+	}
+
+	pub, err := r.connect(connectOptions{clientID: r.clientID(), username: r.username, password: r.password})
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	if err := pub.write(publishFrame(topic, []byte("x"), pkt.QoSAtMostOnce, false, 0)); err != nil {
+		return err
+	}
+
+	if _, _, err := r.expectPublish(exact, topic); err != nil {
+		return skipped(fmt.Sprintf("the broker did not route the $ publish: %v", err))
+	}
+	return r.expectQuiet(wildcard)
+}
@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/pyr33x/goqtt/internal/config"
+	"github.com/pyr33x/goqtt/internal/store"
+	"github.com/pyr33x/goqtt/internal/transport"
+)
+
+type checkStatus string
+
+const (
+	statusPass checkStatus = "PASS"
+	statusWarn checkStatus = "WARN"
+	statusFail checkStatus = "FAIL"
+)
+
+type checkResult struct {
+	Name    string
+	Status  checkStatus
+	Message string
+}
+
+// Doctor implements `goqtt doctor`, verifying the environment before the broker starts
+func Doctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the config file (searched for when empty)")
+	storeDir := fs.String("store", "store", "path to the store directory")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path, err := config.Find(*configPath)
+	if err != nil {
+		return printReport(os.Stdout, []checkResult{{"config", statusFail, err.Error()}})
+	}
+
+	var results []checkResult
+	cfg, result := checkConfig(path)
+	results = append(results, result)
+	results = append(results, checkConfigPermissions(path))
+	results = append(results, checkStoreDir(*storeDir))
+	dbPath := filepath.Join(*storeDir, "store.db")
+	results = append(results, checkSchema(dbPath))
+	maxConnections := transport.DefaultMaxConnections
+	if cfg != nil {
+		maxConnections = cfg.Server.MaxConnections
+	}
+	if n, ok := persistedMaxConnections(dbPath); ok {
+		maxConnections = n
+	}
+	results = append(results, checkFileLimit(maxConnections))
+	if cfg != nil {
+		results = append(results, checkPort("server port", cfg.Server.Listen(cfg.Server.Port)))
+		if cfg.Admin.Enabled {
+			results = append(results, checkPort("admin port", cfg.Admin.Listen()))
+		}
+		if cfg.TLS.Enabled {
+			results = append(results, checkPort("tls port", cfg.Server.Listen(cfg.TLS.Port)))
+			results = append(results, checkTLS(cfg.TLS))
+		}
+	}
+
+	return printReport(os.Stdout, results)
+}
+
+// printReport writes the results and returns the process exit code
+func printReport(w io.Writer, results []checkResult) int {
+	failed := 0
+	for _, r := range results {
+		fmt.Fprintf(w, "[%s] %-18s %s\n", r.Status, r.Name, r.Message)
+		if r.Status == statusFail {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "\n%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Fprintln(w, "\nall checks passed")
+	return 0
+}
+
+func checkConfig(path string) (*config.Config, checkResult) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, checkResult{"config", statusFail, err.Error()}
+	}
+
+	if err := validatePort(cfg.Server.Port); err != nil {
+		return nil, checkResult{"config", statusFail, fmt.Sprintf("server.port: %v", err)}
+	}
+	if cfg.Admin.Enabled {
+		if err := validatePort(cfg.Admin.Port); err != nil {
+			return nil, checkResult{"config", statusFail, fmt.Sprintf("admin.port: %v", err)}
+		}
+	}
+	if cfg.TLS.Enabled {
+		if err := validatePort(cfg.TLS.Port); err != nil {
+			return nil, checkResult{"config", statusFail, fmt.Sprintf("tls.port: %v", err)}
+		}
+	}
+
+	switch cfg.Server.Environment {
+	case "production", "development":
+	default:
+		return cfg, checkResult{"config", statusWarn, fmt.Sprintf("server.env %q is unknown, development will be assumed", cfg.Server.Environment)}
+	}
+
+	return cfg, checkResult{"config", statusPass, fmt.Sprintf("loaded %s", path)}
+}
+
+func checkConfigPermissions(path string) checkResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		return checkResult{"config permissions", statusFail, err.Error()}
+	}
+	if info.Mode().Perm()&0o002 != 0 {
+		return checkResult{"config permissions", statusWarn, fmt.Sprintf("%s is world-writable (%s)", path, info.Mode().Perm())}
+	}
+	return checkResult{"config permissions", statusPass, info.Mode().Perm().String()}
+}
+
+func checkStoreDir(dir string) checkResult {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		// The broker creates the directory on start, so the parent must be writable
+		parent := filepath.Dir(dir)
+		if err := probeWritable(parent); err != nil {
+			return checkResult{"store directory", statusFail, fmt.Sprintf("%s does not exist and %s is not writable: %v", dir, parent, err)}
+		}
+		return checkResult{"store directory", statusPass, fmt.Sprintf("%s will be created", dir)}
+	}
+	if err != nil {
+		return checkResult{"store directory", statusFail, err.Error()}
+	}
+	if !info.IsDir() {
+		return checkResult{"store directory", statusFail, fmt.Sprintf("%s is not a directory", dir)}
+	}
+	if err := probeWritable(dir); err != nil {
+		return checkResult{"store directory", statusFail, fmt.Sprintf("%s is not writable: %v", dir, err)}
+	}
+	return checkResult{"store directory", statusPass, fmt.Sprintf("%s is writable", dir)}
+}
+
+func checkSchema(dbPath string) checkResult {
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		return checkResult{"schema version", statusPass, "database will be created"}
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return checkResult{"schema version", statusFail, err.Error()}
+	}
+	defer func() { _ = db.Close() }()
+
+	version, err := store.Version(db)
+	if err != nil {
+		return checkResult{"schema version", statusFail, err.Error()}
+	}
+
+	switch {
+	case version > store.SchemaVersion:
+		return checkResult{"schema version", statusFail, fmt.Sprintf("database is at version %d, newer than supported version %d", version, store.SchemaVersion)}
+	case version < store.SchemaVersion:
+		return checkResult{"schema version", statusWarn, fmt.Sprintf("database is at version %d and will be migrated to %d", version, store.SchemaVersion)}
+	}
+	return checkResult{"schema version", statusPass, fmt.Sprintf("version %d", version)}
+}
+
+// persistedMaxConnections returns the connection limit saved through the
+// admin API, which the broker applies over the config file's
+func persistedMaxConnections(dbPath string) (int, bool) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return 0, false
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return 0, false
+	}
+	defer func() { _ = db.Close() }()
+
+	var value string
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = 'max_connections'").Scan(&value); err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+func checkFileLimit(maxConnections int) checkResult {
+	limit, err := openFileLimit()
+	if err != nil {
+		return checkResult{"open file limit", statusWarn, err.Error()}
+	}
+
+	// Leave headroom for the listener, database and admin API
+	required := uint64(maxConnections) + 64
+	if limit < required {
+		return checkResult{"open file limit", statusFail, fmt.Sprintf("limit %d is below the %d needed for %d connections", limit, required, maxConnections)}
+	}
+	return checkResult{"open file limit", statusPass, strconv.FormatUint(limit, 10)}
+}
+
+func checkPort(name, addr string) checkResult {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return checkResult{name, statusFail, err.Error()}
+	}
+	if err := listener.Close(); err != nil {
+		return checkResult{name, statusWarn, err.Error()}
+	}
+	return checkResult{name, statusPass, fmt.Sprintf("%s is available", addr)}
+}
+
+// certExpiryWarning is how soon before expiry a certificate is reported
+const certExpiryWarning = 30 * 24 * time.Hour
+
+func checkTLS(cfg config.TLS) checkResult {
+	tlsConfig, err := transport.NewTLSConfig(transport.TLSOptions{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		MinVersion:   cfg.MinVersion,
+		CipherSuites: cfg.CipherSuites,
+		ClientCA:     cfg.ClientCA,
+		ClientAuth:   cfg.ClientAuth,
+	})
+	if err != nil {
+		return checkResult{"tls certificate", statusFail, err.Error()}
+	}
+
+	leaf := tlsConfig.Certificates[0].Leaf
+	if leaf == nil {
+		return checkResult{"tls certificate", statusPass, cfg.CertFile}
+	}
+	remaining := time.Until(leaf.NotAfter)
+	switch {
+	case remaining <= 0:
+		return checkResult{"tls certificate", statusFail, fmt.Sprintf("%s expired on %s", cfg.CertFile, leaf.NotAfter.Format(time.DateOnly))}
+	case remaining < certExpiryWarning:
+		return checkResult{"tls certificate", statusWarn, fmt.Sprintf("%s expires on %s", cfg.CertFile, leaf.NotAfter.Format(time.DateOnly))}
+	}
+	return checkResult{"tls certificate", statusPass, fmt.Sprintf("%s valid until %s", cfg.CertFile, leaf.NotAfter.Format(time.DateOnly))}
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("%d is out of range", n)
+	}
+	return nil
+}
+
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".goqtt-doctor-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
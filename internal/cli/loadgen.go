@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// loadClient is a minimal MQTT 3.1.1 client for generating synthetic load.
+// It keeps its own allocations low so they do not drown out the broker's
+// in profiles taken from the same process.
+type loadClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex // Serializes writes from the publish loop and the ack reader
+}
+
+// dialLoadClient connects and completes the CONNECT handshake with a clean session
+func dialLoadClient(addr, clientID string) (*loadClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &loadClient{conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4, 0x02) // Protocol level 3.1.1, clean session
+	body = binary.BigEndian.AppendUint16(body, 0)
+	body = appendMQTTString(body, clientID)
+	if err := c.write(appendFrame(nil, byte(pkt.CONNECT), body)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	header, ack, err := c.readPacket(nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if pkt.PacketType(header&0xF0) != pkt.CONNACK || len(ack) < 2 || ack[1] != pkt.ConnectionAccepted {
+		_ = conn.Close()
+		return nil, fmt.Errorf("connection refused by broker")
+	}
+	return c, nil
+}
+
+// subscribe sends a single-filter SUBSCRIBE and waits for its SUBACK
+func (c *loadClient) subscribe(filter string, qos pkt.QoSLevel) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 1)
+	body = appendMQTTString(body, filter)
+	body = append(body, byte(qos))
+	if err := c.write(appendFrame(nil, byte(pkt.SUBSCRIBE)|0x02, body)); err != nil {
+		return err
+	}
+
+	header, ack, err := c.readPacket(nil)
+	if err != nil {
+		return fmt.Errorf("failed to read SUBACK: %w", err)
+	}
+	if pkt.PacketType(header&0xF0) != pkt.SUBACK || len(ack) < 3 || ack[2] == 0x80 {
+		return fmt.Errorf("subscription to %q was rejected", filter)
+	}
+	return nil
+}
+
+// consume reads until the connection closes, counting PUBLISH packets in
+// received and completing the QoS 1 and 2 acknowledgement flows
+func (c *loadClient) consume(received *atomic.Int64) {
+	var buf []byte
+	ack := make([]byte, 4)
+	for {
+		header, body, err := c.readPacket(buf)
+		if err != nil {
+			return
+		}
+		buf = body
+
+		switch pkt.PacketType(header & 0xF0) {
+		case pkt.PUBLISH:
+			received.Add(1)
+			qos := pkt.QoSLevel(header>>1) & 0x03
+			if qos == pkt.QoSAtMostOnce || len(body) < 2 {
+				continue
+			}
+			topicLen := int(binary.BigEndian.Uint16(body))
+			if len(body) < 4+topicLen {
+				continue
+			}
+			ackType := pkt.PUBACK
+			if qos == pkt.QoSExactlyOnce {
+				ackType = pkt.PUBREC
+			}
+			_ = c.write(appendAck(ack, ackType, body[2+topicLen:]))
+		case pkt.PUBREL:
+			_ = c.write(appendAck(ack, pkt.PUBCOMP, body))
+		}
+	}
+}
+
+// consumeAcks reads the broker's side of outbound QoS 1 and 2 flows and
+// frees an in-flight slot each time a flow completes
+func (c *loadClient) consumeAcks(inflight chan struct{}) {
+	var buf []byte
+	ack := make([]byte, 4)
+	for {
+		header, body, err := c.readPacket(buf)
+		if err != nil {
+			return
+		}
+		buf = body
+
+		switch pkt.PacketType(header & 0xF0) {
+		case pkt.PUBACK, pkt.PUBCOMP:
+			<-inflight
+		case pkt.PUBREC:
+			_ = c.write(appendAck(ack, pkt.PUBREL|0x02, body))
+		}
+	}
+}
+
+// readPacket reads one packet, reusing buf for the body when it is large enough
+func (c *loadClient) readPacket(buf []byte) (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		return 0, nil, err
+	}
+	return header, buf, nil
+}
+
+func (c *loadClient) write(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func (c *loadClient) Close() error {
+	return c.conn.Close()
+}
+
+// appendFrame appends a packet with the given first byte and body to dst
+func appendFrame(dst []byte, header byte, body []byte) []byte {
+	dst = append(dst, header)
+	dst = utils.AppendRemainingLength(dst, len(body))
+	return append(dst, body...)
+}
+
+// appendAck fills dst with a two-byte acknowledgement carrying the packet
+// ID at the start of id
+func appendAck(dst []byte, packetType pkt.PacketType, id []byte) []byte {
+	dst = append(dst[:0], byte(packetType), 2)
+	return append(dst, id[0], id[1])
+}
+
+func appendMQTTString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/store"
+	"github.com/pyr33x/goqtt/internal/transport"
+)
+
+// profileOptions describes the synthetic workload run by `goqtt profile`
+type profileOptions struct {
+	duration    time.Duration
+	publishers  int
+	subscribers int
+	payload     int
+	qos         int
+	inflight    int
+	workers     int
+	fanout      int
+	out         string
+}
+
+// profileResult is the measured outcome of a profiling run
+type profileResult struct {
+	published int64
+	delivered int64
+	expected  int64
+	elapsed   time.Duration
+	mallocs   uint64
+	bytes     uint64
+	gcCycles  uint32
+}
+
+// Profile implements `goqtt profile`, running an in-process broker under a
+// synthetic publish/subscribe workload and writing CPU and heap profiles
+func Profile(args []string) int {
+	var opts profileOptions
+	fs := flag.NewFlagSet("profile", flag.ContinueOnError)
+	fs.DurationVar(&opts.duration, "duration", 10*time.Second, "how long publishers send messages")
+	fs.IntVar(&opts.publishers, "publishers", 4, "number of publishing clients")
+	fs.IntVar(&opts.subscribers, "subscribers", 4, "number of subscribing clients, each receiving every message")
+	fs.IntVar(&opts.payload, "payload", 256, "payload size in bytes")
+	fs.IntVar(&opts.qos, "qos", 0, "QoS level used for publishing and subscribing (0-2)")
+	fs.IntVar(&opts.inflight, "inflight", 64, "unacknowledged messages allowed per publisher at QoS 1 and 2")
+	fs.IntVar(&opts.workers, "workers", 0, "broker delivery workers; 0 delivers on the publisher's goroutine")
+	fs.IntVar(&opts.fanout, "fanout-threshold", 0, "subscribers above which delivery runs in parallel; 0 disables")
+	fs.StringVar(&opts.out, "out", "profile", "directory for cpu.pprof, heap.pprof and summary.txt")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch {
+	case opts.duration <= 0:
+		fmt.Fprintln(os.Stderr, "--duration must be positive")
+		return 2
+	case opts.publishers < 1 || opts.subscribers < 1:
+		fmt.Fprintln(os.Stderr, "--publishers and --subscribers must be at least 1")
+		return 2
+	case opts.payload < 0:
+		fmt.Fprintln(os.Stderr, "--payload must not be negative")
+		return 2
+	case opts.qos < 0 || opts.qos > 2:
+		fmt.Fprintln(os.Stderr, "--qos must be 0, 1 or 2")
+		return 2
+	case opts.inflight < 1 || opts.inflight > 65535:
+		fmt.Fprintln(os.Stderr, "--inflight must be between 1 and 65535")
+		return 2
+	}
+
+	if err := os.MkdirAll(opts.out, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create output directory: %v\n", err)
+		return 1
+	}
+
+	// Broker logging would dominate the profile, so only errors are kept
+	logConfig := logger.ProductionConfig()
+	logConfig.Level = logger.LevelError
+	logConfig.Output = os.Stderr
+	logger.InitGlobalLogger(logConfig)
+
+	result, err := runProfile(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "profile failed: %v\n", err)
+		return 1
+	}
+
+	summary, err := os.Create(filepath.Join(opts.out, "summary.txt"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create summary: %v\n", err)
+		return 1
+	}
+	defer func() { _ = summary.Close() }()
+
+	printProfileSummary(io.MultiWriter(os.Stdout, summary), opts, result)
+	if result.delivered < result.expected {
+		return 1
+	}
+	return 0
+}
+
+func runProfile(opts profileOptions) (profileResult, error) {
+	var result profileResult
+
+	// A single connection keeps every query on the same in-memory database
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = db.Close() }()
+	db.SetMaxOpenConns(1)
+	if err := store.InitSchema(db); err != nil {
+		return result, err
+	}
+
+	var brokerOpts []broker.Option
+	if opts.workers > 0 {
+		brokerOpts = append(brokerOpts, broker.WithDeliveryWorkers(opts.workers, broker.DefaultDeliveryQueueSize))
+	}
+	if opts.fanout > 0 {
+		brokerOpts = append(brokerOpts, broker.WithParallelFanout(opts.fanout, 0))
+	}
+	b := broker.New(brokerOpts...)
+	defer b.Stop()
+
+	srv := transport.New("0", db, b)
+	srv.SetMaxConnections(opts.publishers + opts.subscribers + 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		return result, err
+	}
+	defer func() { _ = srv.Stop() }()
+	addr := srv.Addr().String()
+
+	qos := pkt.QoSLevel(opts.qos)
+	var delivered atomic.Int64
+	var clients []*loadClient
+	defer func() {
+		for _, c := range clients {
+			_ = c.Close()
+		}
+	}()
+
+	for i := range opts.subscribers {
+		c, err := dialLoadClient(addr, fmt.Sprintf("profile-sub-%d", i))
+		if err != nil {
+			return result, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		clients = append(clients, c)
+		if err := c.subscribe("profile/#", qos); err != nil {
+			return result, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		go c.consume(&delivered)
+	}
+
+	publishers := make([]*loadClient, opts.publishers)
+	for i := range publishers {
+		c, err := dialLoadClient(addr, fmt.Sprintf("profile-pub-%d", i))
+		if err != nil {
+			return result, fmt.Errorf("publisher %d: %w", i, err)
+		}
+		clients = append(clients, c)
+		publishers[i] = c
+	}
+
+	cpuFile, err := os.Create(filepath.Join(opts.out, "cpu.pprof"))
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = cpuFile.Close() }()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		return result, err
+	}
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+
+	var published atomic.Int64
+	var wg sync.WaitGroup
+	for i, c := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			published.Add(runPublisher(c, fmt.Sprintf("profile/%d", i), qos, opts, deadline))
+		}()
+	}
+	wg.Wait()
+
+	// Give in-flight deliveries a bounded amount of time to arrive
+	result.published = published.Load()
+	result.expected = result.published * int64(opts.subscribers)
+	drainDeadline := time.Now().Add(5 * time.Second)
+	for delivered.Load() < result.expected && time.Now().Before(drainDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	result.elapsed = time.Since(start)
+	result.delivered = delivered.Load()
+
+	pprof.StopCPUProfile()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	result.mallocs = after.Mallocs - before.Mallocs
+	result.bytes = after.TotalAlloc - before.TotalAlloc
+	result.gcCycles = after.NumGC - before.NumGC
+
+	heapFile, err := os.Create(filepath.Join(opts.out, "heap.pprof"))
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = heapFile.Close() }()
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(heapFile); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// runPublisher publishes to topic until deadline and returns the number of
+// messages sent. At QoS 1 and 2 at most opts.inflight messages are unacknowledged.
+func runPublisher(c *loadClient, topic string, qos pkt.QoSLevel, opts profileOptions, deadline time.Time) int64 {
+	pp := &pkt.PublishPacket{
+		Topic:   topic,
+		Payload: make([]byte, opts.payload),
+		QoS:     qos,
+	}
+	if qos > pkt.QoSAtMostOnce {
+		pp.PacketID = new(uint16)
+	}
+	frame := pp.Encode()
+	idOffset := len(frame) - opts.payload - 2
+
+	var inflight chan struct{}
+	if qos > pkt.QoSAtMostOnce {
+		inflight = make(chan struct{}, opts.inflight)
+		go c.consumeAcks(inflight)
+	}
+
+	var sent int64
+	var packetID uint16
+	for time.Now().Before(deadline) {
+		if inflight != nil {
+			inflight <- struct{}{}
+			packetID++
+			if packetID == 0 {
+				packetID = 1
+			}
+			binary.BigEndian.PutUint16(frame[idOffset:], packetID)
+		}
+		if err := c.write(frame); err != nil {
+			break
+		}
+		sent++
+	}
+
+	// Wait for outstanding acknowledgements so the broker is idle when
+	// the profile stops
+	if inflight != nil {
+		drainDeadline := time.Now().Add(5 * time.Second)
+		for len(inflight) > 0 && time.Now().Before(drainDeadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return sent
+}
+
+func printProfileSummary(w io.Writer, opts profileOptions, r profileResult) {
+	seconds := r.elapsed.Seconds()
+	fmt.Fprintln(w, "goqtt profile")
+	fmt.Fprintf(w, "  workload     %d publishers, %d subscribers, %d byte payload, QoS %d, %d delivery workers\n",
+		opts.publishers, opts.subscribers, opts.payload, opts.qos, opts.workers)
+	fmt.Fprintf(w, "  elapsed      %s\n", r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  published    %d (%.0f msgs/sec)\n", r.published, float64(r.published)/seconds)
+	fmt.Fprintf(w, "  delivered    %d of %d (%.0f msgs/sec)\n", r.delivered, r.expected, float64(r.delivered)/seconds)
+	if r.delivered > 0 {
+		// The load generator runs in the same process, so these include its
+		// share of allocations; compare runs with the same workload
+		fmt.Fprintf(w, "  allocs/msg   %.2f\n", float64(r.mallocs)/float64(r.delivered))
+		fmt.Fprintf(w, "  bytes/msg    %.0f\n", float64(r.bytes)/float64(r.delivered))
+	}
+	fmt.Fprintf(w, "  gc cycles    %d\n", r.gcCycles)
+	fmt.Fprintf(w, "  profiles     %s, %s\n", filepath.Join(opts.out, "cpu.pprof"), filepath.Join(opts.out, "heap.pprof"))
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cli
+
+import "errors"
+
+// openFileLimit is not available on this platform
+func openFileLimit() (uint64, error) {
+	return 0, errors.New("open file limit check is not supported on this platform")
+}
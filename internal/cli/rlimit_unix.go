@@ -0,0 +1,14 @@
+//go:build unix
+
+package cli
+
+import "syscall"
+
+// openFileLimit returns the soft limit on open file descriptors
+func openFileLimit() (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+	return uint64(rlimit.Cur), nil
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+)
+
+// Topics implements `goqtt topics`, printing the live topic tree from the admin API
+func Topics(args []string) int {
+	fs := flag.NewFlagSet("topics", flag.ContinueOnError)
+	addr := fs.String("admin", "http://localhost:8080", "admin API base URL")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimRight(*addr, "/") + "/topics")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query admin API: %v\n", err)
+		return 1
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "admin API returned %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+
+	var root broker.TopicNode
+	if err := json.NewDecoder(resp.Body).Decode(&root); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode topic tree: %v\n", err)
+		return 1
+	}
+
+	if len(root.Children) == 0 {
+		fmt.Println("(no topics)")
+		return 0
+	}
+	renderTopicTree(os.Stdout, root.Children, "")
+	return 0
+}
+
+// renderTopicTree prints nodes using box-drawing branches
+func renderTopicTree(w io.Writer, nodes []*broker.TopicNode, prefix string) {
+	for i, node := range nodes {
+		branch, indent := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		level := node.Level
+		if level == "" {
+			level = "<empty>"
+		}
+
+		line := fmt.Sprintf("%s%s%s (%d)", prefix, branch, level, node.Subscribers)
+		if node.Retained {
+			line += " [retained]"
+		}
+		fmt.Fprintln(w, line)
+
+		renderTopicTree(w, node.Children, prefix+indent)
+	}
+}
@@ -0,0 +1,479 @@
+// Package commitlog writes every message published to selected topics to
+// segmented append-only files, so they are kept whether or not anyone is
+// subscribed. Old segments are removed by size and age.
+package commitlog
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// DefaultSegmentBytes is the segment size used when none is configured
+const DefaultSegmentBytes = 64 << 20
+
+// A record is laid out as
+//
+//	offset (8) | unix nanos (8) | topic length (2) | payload length (4) | topic | payload | crc32 (4)
+//
+// with the CRC covering everything before it
+const (
+	headerSize = 22
+	crcSize    = 4
+)
+
+// segmentExt names segment files, which are called <base offset>.log
+const segmentExt = ".log"
+
+// Options configures a Log
+type Options struct {
+	Dir            string
+	Topics         []string      // Topic filters whose messages are logged
+	SegmentBytes   int64         // A new segment is started once the active one reaches this size
+	RetentionBytes int64         // Oldest segments are removed while the log is larger; 0 is unlimited
+	RetentionAge   time.Duration // Segments last written longer ago are removed; 0 keeps them forever
+	Fsync          bool          // Sync every append to disk instead of on segment roll and Close
+}
+
+// Record is one logged message
+type Record struct {
+	Offset  uint64
+	Time    time.Time
+	Topic   string
+	Payload []byte
+}
+
+// Log is an append-only log of published messages
+type Log struct {
+	opts       Options
+	mu         sync.Mutex
+	segments   []*segment // Oldest first; the last one is active
+	active     *os.File
+	activeSize int64
+	next       uint64 // Offset of the next record
+	logger     *logger.Logger
+}
+
+type segment struct {
+	base     uint64
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// Open opens the log in opts.Dir, creating it if needed. A record left half
+// written by a crash is cut off the end of the active segment.
+func Open(opts Options) (*Log, error) {
+	for _, filter := range opts.Topics {
+		if err := utils.ValidateTopicFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid commit log topic %q: %w", filter, err)
+		}
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create commit log directory: %w", err)
+	}
+
+	l := &Log{opts: opts, logger: logger.NewMQTTLogger("commitlog")}
+	segments, err := l.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	l.segments = segments
+
+	if len(segments) == 0 {
+		if err := l.createSegment(0); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	if err := l.recover(segments[len(segments)-1]); err != nil {
+		return nil, err
+	}
+	l.enforceRetention()
+	return l, nil
+}
+
+// Intercept is a broker.Interceptor that appends messages on the logged
+// topics. It runs before the message is routed, so a QoS 1 or 2 publish is
+// on disk by the time it is acknowledged.
+func (l *Log) Intercept(clientID string, msg *broker.Message) error {
+	if !l.logs(msg.Topic) {
+		return nil
+	}
+	_, err := l.Append(msg.Topic, msg.PayloadReader(), msg.Size())
+	return err
+}
+
+// Append writes a record and returns its offset
+func (l *Log) Append(topic string, payload io.Reader, size int) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recordSize := int64(headerSize + len(topic) + size + crcSize)
+	if l.activeSize > 0 && l.activeSize+recordSize > l.opts.SegmentBytes {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := l.next
+	if err := l.write(offset, topic, payload, size); err != nil {
+		// Cut off whatever part of the record made it to disk
+		_ = l.active.Truncate(l.activeSize)
+		return 0, fmt.Errorf("failed to append to commit log: %w", err)
+	}
+
+	l.activeSize += recordSize
+	active := l.segments[len(l.segments)-1]
+	active.size = l.activeSize
+	active.modified = time.Now()
+	l.next++
+	return offset, nil
+}
+
+// Read calls fn with every record from offset on, oldest first, until fn
+// returns false or the end of the log is reached
+func (l *Log) Read(offset uint64, fn func(Record) bool) error {
+	l.mu.Lock()
+	segments := make([]segment, 0, len(l.segments))
+	for _, seg := range l.segments {
+		segments = append(segments, *seg)
+	}
+	l.mu.Unlock()
+
+	// Start with the last segment whose base is at or before offset
+	start := 0
+	for i, seg := range segments {
+		if seg.base <= offset {
+			start = i
+		}
+	}
+
+	for _, seg := range segments[start:] {
+		more, err := readSegment(seg, offset, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// OffsetAt returns the offset of the first record written at or after t, or
+// the next offset when every record is older
+func (l *Log) OffsetAt(t time.Time) (uint64, error) {
+	// A segment last written before t holds only older records, so start
+	// with the first one written since
+	l.mu.Lock()
+	next := l.next
+	offset := next
+	for _, seg := range l.segments {
+		if !seg.modified.Before(t) {
+			offset = seg.base
+			break
+		}
+	}
+	l.mu.Unlock()
+	if offset == next {
+		return next, nil
+	}
+
+	found := next
+	err := l.Read(offset, func(rec Record) bool {
+		if rec.Time.Before(t) {
+			return true
+		}
+		found = rec.Offset
+		return false
+	})
+	return found, err
+}
+
+// Replay calls fn with the records on topics matching filter from offset
+// on, oldest first, until fn returns false
+func (l *Log) Replay(filter string, offset uint64, fn func(Record) bool) error {
+	return l.Read(offset, func(rec Record) bool {
+		if !broker.TopicMatches(filter, rec.Topic) {
+			return true
+		}
+		return fn(rec)
+	})
+}
+
+// ReplayMessages is Replay for broker.ReplaySource, which serves $replay
+// subscriptions
+func (l *Log) ReplayMessages(filter string, offset uint64, fn func(*broker.Message) bool) error {
+	return l.Replay(filter, offset, func(rec Record) bool {
+		return fn(broker.NewMessage(rec.Topic, rec.Payload, false))
+	})
+}
+
+// Offsets returns the offset of the oldest record kept and the offset the
+// next record will get
+func (l *Log) Offsets() (first, next uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[0].base, l.next
+}
+
+// Close syncs and closes the active segment
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.active.Sync(); err != nil {
+		_ = l.active.Close()
+		return err
+	}
+	return l.active.Close()
+}
+
+// logs reports whether messages on topic are logged
+func (l *Log) logs(topic string) bool {
+	for _, filter := range l.opts.Topics {
+		if broker.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Log) write(offset uint64, topic string, payload io.Reader, size int) error {
+	w := bufio.NewWriter(l.active)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(w, crc)
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint64(header[0:], offset)
+	binary.BigEndian.PutUint64(header[8:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(header[16:], uint16(len(topic)))
+	binary.BigEndian.PutUint32(header[18:], uint32(size))
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, topic); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, payload, int64(size)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if l.opts.Fsync {
+		return l.active.Sync()
+	}
+	return nil
+}
+
+// roll closes the active segment and starts a new one
+func (l *Log) roll() error {
+	if err := l.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync commit log segment: %w", err)
+	}
+	if err := l.active.Close(); err != nil {
+		return fmt.Errorf("failed to close commit log segment: %w", err)
+	}
+	if err := l.createSegment(l.next); err != nil {
+		return err
+	}
+	l.enforceRetention()
+	return nil
+}
+
+func (l *Log) createSegment(base uint64) error {
+	path := filepath.Join(l.opts.Dir, fmt.Sprintf("%020d%s", base, segmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create commit log segment: %w", err)
+	}
+	l.active = file
+	l.activeSize = 0
+	l.next = base
+	l.segments = append(l.segments, &segment{base: base, path: path, modified: time.Now()})
+	return nil
+}
+
+// recover reopens the last segment for appending, truncating a torn record
+func (l *Log) recover(last *segment) error {
+	file, err := os.OpenFile(last.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open commit log segment: %w", err)
+	}
+
+	next, size := last.base, int64(0)
+	r := bufio.NewReader(file)
+	for {
+		rec, n, err := readRecord(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				l.logger.Warn("Truncating torn commit log record", logger.String("segment", last.path),
+					logger.Int("position", int(size)), logger.String("error", err.Error()))
+			}
+			break
+		}
+		next, size = rec.Offset+1, size+n
+	}
+	if size != last.size {
+		if err := file.Truncate(size); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to truncate commit log segment: %w", err)
+		}
+		last.size = size
+	}
+
+	l.active = file
+	l.activeSize = size
+	l.next = next
+	return nil
+}
+
+// enforceRetention removes the oldest segments that are over the size or
+// age budget. The active segment is never removed.
+func (l *Log) enforceRetention() {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		overSize := l.opts.RetentionBytes > 0 && total > l.opts.RetentionBytes
+		overAge := l.opts.RetentionAge > 0 && time.Since(oldest.modified) > l.opts.RetentionAge
+		if !overSize && !overAge {
+			return
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			l.logger.LogError(err, "Failed to remove commit log segment", logger.String("segment", oldest.path))
+			return
+		}
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// listSegments returns the segments in the log directory, oldest first
+func (l *Log) listSegments() ([]*segment, error) {
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commit log segments: %w", err)
+	}
+
+	var segments []*segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat commit log segment: %w", err)
+		}
+		segments = append(segments, &segment{
+			base:     base,
+			path:     filepath.Join(l.opts.Dir, name),
+			size:     info.Size(),
+			modified: info.ModTime(),
+		})
+	}
+	slices.SortFunc(segments, func(a, b *segment) int {
+		return cmp.Compare(a.base, b.base)
+	})
+	return segments, nil
+}
+
+// readSegment calls fn with the records of seg from offset on. It reports
+// whether fn wants more records.
+func readSegment(seg segment, offset uint64, fn func(Record) bool) (bool, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil // Removed by retention while reading
+		}
+		return false, err
+	}
+	defer func() { _ = file.Close() }()
+
+	// Only read what was complete when Read was called
+	r := bufio.NewReader(io.NewSectionReader(file, 0, seg.size))
+	for {
+		rec, _, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return true, nil
+			}
+			return false, err
+		}
+		if rec.Offset < offset {
+			continue
+		}
+		if !fn(rec) {
+			return false, nil
+		}
+	}
+}
+
+// readRecord reads one record and returns it with its size on disk. It
+// returns io.EOF at a clean end of the segment.
+func readRecord(r io.Reader) (Record, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, 0, io.EOF
+		}
+		return Record{}, 0, corrupt(err.Error())
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(header[16:]))
+	payloadLen := int(binary.BigEndian.Uint32(header[18:]))
+	body := make([]byte, topicLen+payloadLen+crcSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, 0, corrupt(err.Error())
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(body[:topicLen+payloadLen])
+	if crc.Sum32() != binary.BigEndian.Uint32(body[topicLen+payloadLen:]) {
+		return Record{}, 0, corrupt("checksum mismatch")
+	}
+
+	return Record{
+		Offset:  binary.BigEndian.Uint64(header[0:]),
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(header[8:]))),
+		Topic:   string(body[:topicLen]),
+		Payload: body[topicLen : topicLen+payloadLen],
+	}, int64(headerSize + len(body)), nil
+}
+
+func corrupt(reason string) error {
+	return &er.Err{
+		Context: "Commit log",
+		Message: fmt.Errorf("%w: %s", er.ErrCorruptLogRecord, reason),
+	}
+}
@@ -0,0 +1,227 @@
+package commitlog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordBytes is the size on disk of the records appendN writes
+const recordBytes = int64(headerSize + len("t/0") + 100 + crcSize)
+
+func openTestLog(t *testing.T, opts Options) *Log {
+	t.Helper()
+	l, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// appendN appends records on t/0 to t/9 in turn with 100 byte payloads
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for range n {
+		_, next := l.Offsets()
+		topic := fmt.Sprintf("t/%d", next%10)
+		offset, err := l.Append(topic, bytes.NewReader(make([]byte, 100)), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != next {
+			t.Fatalf("appended at %d, want %d", offset, next)
+		}
+	}
+}
+
+// offsets reads every record from offset on and returns their offsets
+func offsets(t *testing.T, l *Log, offset uint64) []uint64 {
+	t.Helper()
+	var got []uint64
+	err := l.Read(offset, func(rec Record) bool {
+		got = append(got, rec.Offset)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func span(from, to uint64) []uint64 {
+	var s []uint64
+	for i := from; i < to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func sameOffsets(t *testing.T, got, want []uint64) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("read %v, want %v", got, want)
+	}
+}
+
+// segmentFiles lists the segment files in dir
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// A segment is rolled before a record would take it past SegmentBytes, and
+// reads start in the segment holding the offset and carry on across the rest
+func TestRollAndReadAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes})
+	defer l.Close()
+	appendN(t, l, 10)
+
+	files := segmentFiles(t, dir)
+	if len(files) != 4 {
+		t.Fatalf("%d segments, want 4", len(files))
+	}
+	for i, base := range []int{0, 3, 6, 9} {
+		if want := fmt.Sprintf("%020d%s", base, segmentExt); filepath.Base(files[i]) != want {
+			t.Fatalf("segment %d is %s, want %s", i, filepath.Base(files[i]), want)
+		}
+	}
+
+	sameOffsets(t, offsets(t, l, 0), span(0, 10))
+	sameOffsets(t, offsets(t, l, 4), span(4, 10))
+	sameOffsets(t, offsets(t, l, 10), nil)
+
+	// Stopping early stops across segments too
+	var got []uint64
+	if err := l.Read(2, func(rec Record) bool {
+		got = append(got, rec.Offset)
+		return len(got) < 3
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sameOffsets(t, got, span(2, 5))
+
+	var topics []string
+	if err := l.Replay("t/1", 0, func(rec Record) bool {
+		topics = append(topics, fmt.Sprintf("%s@%d", rec.Topic, rec.Offset))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(topics) != "[t/1@1]" {
+		t.Fatalf("replayed %v", topics)
+	}
+}
+
+// A record torn by a crash is cut off on open, and appending carries on
+// from the last intact offset
+func TestRecoverTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes})
+	appendN(t, l, 5)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	last := filepath.Join(dir, fmt.Sprintf("%020d%s", 3, segmentExt))
+	intact, err := os.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]byte{
+		"partial header":  intact[:headerSize-4],
+		"partial payload": intact[:recordBytes-10],
+		"bad checksum":    append(bytes.Clone(intact[:recordBytes-1]), intact[recordBytes-1]^0xff),
+	}
+	for name, torn := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(last, append(bytes.Clone(intact), torn...), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			l := openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes})
+			if info, _ := os.Stat(last); info.Size() != int64(len(intact)) {
+				t.Fatalf("segment is %d bytes after recovery, want %d", info.Size(), len(intact))
+			}
+			if _, next := l.Offsets(); next != 5 {
+				t.Fatalf("next offset %d, want 5", next)
+			}
+			sameOffsets(t, offsets(t, l, 0), span(0, 5))
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	l = openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes})
+	defer l.Close()
+	appendN(t, l, 2)
+	sameOffsets(t, offsets(t, l, 0), span(0, 7))
+}
+
+func TestRetention(t *testing.T) {
+	t.Run("bytes", func(t *testing.T) {
+		dir := t.TempDir()
+		l := openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes, RetentionBytes: 7 * recordBytes})
+		defer l.Close()
+		appendN(t, l, 10)
+
+		// Rolling to the segment at 9 left 9 records, so the oldest went
+		if first, next := l.Offsets(); first != 3 || next != 10 {
+			t.Fatalf("offsets %d to %d, want 3 to 10", first, next)
+		}
+		if files := segmentFiles(t, dir); len(files) != 3 {
+			t.Fatalf("%d segments, want 3", len(files))
+		}
+		sameOffsets(t, offsets(t, l, 0), span(3, 10))
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		l := openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes})
+		appendN(t, l, 7)
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * time.Hour)
+		for _, base := range []int{0, 3, 6} {
+			path := filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentExt))
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The active segment is kept however old it is
+		l = openTestLog(t, Options{Dir: dir, SegmentBytes: 3 * recordBytes, RetentionAge: time.Hour})
+		defer l.Close()
+		if first, next := l.Offsets(); first != 6 || next != 7 {
+			t.Fatalf("offsets %d to %d, want 6 to 7", first, next)
+		}
+		sameOffsets(t, offsets(t, l, 0), span(6, 7))
+	})
+}
+
+func TestOffsetAt(t *testing.T) {
+	l := openTestLog(t, Options{Dir: t.TempDir(), SegmentBytes: 3 * recordBytes})
+	defer l.Close()
+	appendN(t, l, 4)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	appendN(t, l, 3)
+
+	if offset, err := l.OffsetAt(since); err != nil || offset != 4 {
+		t.Fatalf("OffsetAt = %d, %v, want 4", offset, err)
+	}
+	if offset, err := l.OffsetAt(time.Time{}); err != nil || offset != 0 {
+		t.Fatalf("OffsetAt(zero) = %d, %v, want 0", offset, err)
+	}
+	if offset, err := l.OffsetAt(time.Now().Add(time.Hour)); err != nil || offset != 7 {
+		t.Fatalf("OffsetAt(future) = %d, %v, want the next offset 7", offset, err)
+	}
+}
@@ -0,0 +1,695 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Name       string      `yaml:"name"`
+	Version    string      `yaml:"version"`
+	Server     Server      `yaml:"server"`
+	Admin      Admin       `yaml:"admin"`
+	Presence   Presence    `yaml:"presence"`
+	Retained   Retained    `yaml:"retained"`
+	Limits     Limits      `yaml:"limits"`
+	RateLimit  RateLimit   `yaml:"rate_limit"`
+	Will       Will        `yaml:"will"`
+	Discovery  Discovery   `yaml:"discovery"`
+	Transforms []Transform `yaml:"transforms"`
+	CommitLog  CommitLog   `yaml:"commit_log"`
+	LastValue  LastValue   `yaml:"last_value"`
+	TLS        TLS         `yaml:"tls"`
+	WebSocket  WebSocket   `yaml:"websocket"`
+	Shutdown   Shutdown    `yaml:"shutdown"`
+	Bridges    []Bridge    `yaml:"bridges"`
+	// Ingest of enveloped messages from goqtt bridges connecting to this broker
+	BridgeIngest BridgeIngest `yaml:"bridge_ingest"`
+	// Loop prevention for messages crossing goqtt bridges
+	BridgeRouting BridgeRouting `yaml:"bridge_routing"`
+}
+
+type Server struct {
+	Host                  string        `yaml:"host"` // Interface the MQTT listeners bind, such as 127.0.0.1 or ::1; empty binds all
+	Port                  string        `yaml:"port"`
+	Environment           string        `yaml:"env"`
+	MaxHandlers           int           `yaml:"max_handlers"`           // Connections served at once, including ones being refused; more wait in the listen backlog. 0 is unlimited
+	MaxConnections        int           `yaml:"max_connections"`        // Open client connections; the admin API can change it at runtime
+	MaxConnectionsPerIP   int           `yaml:"max_connections_per_ip"` // Open connections allowed from one remote IP; 0 is unlimited
+	DeliveryWorkers       int           `yaml:"delivery_workers"`       // 0 delivers on the publisher's goroutine
+	DeliveryQueue         int           `yaml:"delivery_queue"`         // Per-worker queue length
+	PriorityTopics        []string      `yaml:"priority_topics"`        // Topic filters delivered ahead of other queued messages; needs delivery_workers
+	PriorityBurst         int           `yaml:"priority_burst"`         // Priority deliveries in a row before a waiting normal one; 0 uses the default
+	BatchTopics           []string      `yaml:"batch_topics"`           // Topic filters whose deliveries are written to subscribers in batches
+	BatchLinger           time.Duration `yaml:"batch_linger"`           // Longest a batched delivery waits for others
+	MaxInflight           int           `yaml:"max_inflight"`           // Unacknowledged QoS 1/2 deliveries per client; more wait for acks. 0 is unlimited
+	InflightQueue         int           `yaml:"inflight_queue"`         // Deliveries waiting for room in a client's window before the oldest is dropped; 0 is unlimited
+	PersistSessions       bool          `yaml:"persist_sessions"`       // Keep subscriptions and unreleased QoS 2 messages of CleanSession=0 clients in the database across restarts
+	OfflineQueue          int           `yaml:"offline_queue"`          // QoS 1/2 messages kept per disconnected persistent session; 0 disables
+	FanoutThreshold       int           `yaml:"fanout_threshold"`       // Subscribers above which a publish is delivered in parallel; 0 disables
+	FanoutWorkers         int           `yaml:"fanout_workers"`         // Goroutines per parallel fan-out; 0 uses GOMAXPROCS
+	SpillThreshold        int           `yaml:"spill_threshold"`        // PUBLISH bytes above which payloads go to disk; 0 disables
+	SpillDir              string        `yaml:"spill_dir"`              // Empty uses the OS temp directory
+	LenientConnect        bool          `yaml:"lenient_connect"`        // Reply with a CONNACK when the first packet isn't CONNECT
+	AcceptMQTT31          bool          `yaml:"accept_mqtt31"`          // Accept MQTT 3.1 CONNECTs ("MQIsdp", level 3) from legacy devices
+	StrictAcks            bool          `yaml:"strict_acks"`            // Disconnect clients acknowledging packet IDs not in flight
+	StrictTopics          bool          `yaml:"strict_topics"`          // Reject topics with empty levels such as a//b
+	SystemPublishers      []string      `yaml:"system_publishers"`      // Users allowed to publish to $ topics
+	MaxQoS                byte          `yaml:"max_qos"`                // Highest QoS the broker supports
+	QoSPolicy             string        `yaml:"qos_policy"`             // "downgrade" routes publishes above max_qos at max_qos, "disconnect" closes the connection
+	RetainAvailable       bool          `yaml:"retain_available"`       // Accept publishes and wills with the retain flag
+	WildcardSubscriptions bool          `yaml:"wildcard_subscriptions"` // Accept topic filters containing + or #
+	DeniedFilters         []string      `yaml:"denied_filters"`         // Topic filters refused on SUBSCRIBE; a trailing /# also covers filters under the prefix
+	MaxPacketSize         int           `yaml:"max_packet_size"`        // Bytes; larger packets close the connection. 0 is unlimited
+	ConnectTimeout        time.Duration `yaml:"connect_timeout"`        // Connections that don't send CONNECT within this are closed
+	IdleTimeout           time.Duration `yaml:"idle_timeout"`           // Clients with keep alive 0 silent for longer are disconnected; 0 waits forever
+	WriteTimeout          time.Duration `yaml:"write_timeout"`          // Clients that stop reading for longer are disconnected; 0 waits forever
+	SlowConsumer          string        `yaml:"slow_consumer"`          // "disconnect" at write_timeout, or also "drop" QoS 0 deliveries while a write is stalled
+	SlowConsumerStall     time.Duration `yaml:"slow_consumer_stall"`    // How long a write may block before QoS 0 deliveries are dropped
+	TCPKeepAlive          time.Duration `yaml:"tcp_keepalive"`          // Idle time before TCP keepalive probes; 0 uses Go's 15s, negative disables them
+	TCPNoDelay            bool          `yaml:"tcp_nodelay"`            // Disable Nagle's algorithm so small packets are sent at once
+	ReadBuffer            int           `yaml:"read_buffer"`            // Socket receive buffer in bytes; 0 uses the OS default
+	WriteBuffer           int           `yaml:"write_buffer"`           // Socket send buffer in bytes; 0 uses the OS default
+	DetectProtocols       bool          `yaml:"detect_protocols"`       // Also serve TLS and WebSocket on port, told apart by their first bytes
+}
+
+type Admin struct {
+	Enabled bool   `yaml:"enabled"`
+	Host    string `yaml:"host"` // Interface the admin API binds; empty binds all
+	Port    string `yaml:"port"`
+}
+
+// Listen returns the address the admin API binds to
+func (a Admin) Listen() string {
+	return net.JoinHostPort(strings.Trim(a.Host, "[]"), a.Port)
+}
+
+// Presence configures retained online/offline messages published for every client
+type Presence struct {
+	Enabled        bool   `yaml:"enabled"`
+	Topic          string `yaml:"topic"` // {client_id} is replaced by the client ID
+	QoS            byte   `yaml:"qos"`
+	Retain         bool   `yaml:"retain"`
+	OnlinePayload  string `yaml:"online_payload"`
+	OfflinePayload string `yaml:"offline_payload"`
+}
+
+// Retained bounds the memory used by retained messages and whether they
+// survive restarts
+type Retained struct {
+	MaxBytes    int64  `yaml:"max_bytes"`    // 0 means unlimited
+	MaxMessages int    `yaml:"max_messages"` // Topics holding a retained message; 0 means unlimited
+	MaxPayload  int    `yaml:"max_payload"`  // Larger payloads are delivered but not retained; 0 means unlimited
+	Policy      string `yaml:"policy"`       // At max_bytes or max_messages, "evict" drops least recently used messages, "reject" refuses new ones
+	OnSubscribe string `yaml:"on_subscribe"` // When subscriptions get retained messages: "always", "new" or "never"
+	Persist     bool   `yaml:"persist"`      // Keep retained messages in the database across restarts
+}
+
+// TLS configures the MQTT over TLS listener served alongside plain TCP
+type TLS struct {
+	Enabled      bool     `yaml:"enabled"`
+	Port         string   `yaml:"port"`
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version"`   // "1.2" or "1.3"
+	CipherSuites []string `yaml:"cipher_suites"` // Up to TLS 1.2; empty uses Go's defaults
+	ClientCA     string   `yaml:"client_ca"`     // CAs that sign client certificates
+	ClientAuth   string   `yaml:"client_auth"`   // "none", "request" or "require" a client certificate
+}
+
+// WebSocket configures the MQTT over WebSocket listener for browser clients
+type WebSocket struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    string `yaml:"port"`
+	Path    string `yaml:"path"`
+	TLS     bool   `yaml:"tls"` // Serve wss:// with the certificate of the tls block
+}
+
+// Shutdown controls how client connections are drained on SIGINT or SIGTERM
+type Shutdown struct {
+	Timeout     time.Duration `yaml:"timeout"`      // Longest to wait for in-flight messages and connections to close
+	NoticeTopic string        `yaml:"notice_topic"` // Receives "shutdown" before connections are closed; empty disables
+}
+
+// Will restricts the will messages clients may register
+type Will struct {
+	MaxQoS byte `yaml:"max_qos"` // Connections with a higher will QoS are refused
+	Retain bool `yaml:"retain"`  // Whether retained wills are accepted
+}
+
+// Discovery persists Home Assistant MQTT discovery configs
+type Discovery struct {
+	Enabled bool   `yaml:"enabled"`
+	Prefix  string `yaml:"prefix"` // Configs are published to <prefix>/<component>/[<node_id>/]<object_id>/config
+}
+
+// Bridge connects to an upstream broker as a client and forwards messages
+// between it and this one according to Topics
+type Bridge struct {
+	Name              string        `yaml:"name"`
+	Address           string        `yaml:"address"`   // host:port of the upstream broker
+	ClientID          string        `yaml:"client_id"` // Empty uses goqtt-bridge-<name>
+	Username          string        `yaml:"username"`
+	Password          string        `yaml:"password"`
+	CleanSession      bool          `yaml:"clean_session"`
+	KeepAlive         time.Duration `yaml:"keep_alive"`          // 0 uses 60s
+	ReconnectDelay    time.Duration `yaml:"reconnect_delay"`     // First delay before reconnecting, doubled after each failure; 0 uses 1s
+	MaxReconnectDelay time.Duration `yaml:"max_reconnect_delay"` // 0 uses 1m
+	Queue             int           `yaml:"queue"`               // Outbound messages buffered while the upstream is unreachable; 0 uses 1000
+	SpoolDir          string        `yaml:"spool_dir"`           // Empty uses store/bridges/<name>
+	SpoolBytes        int64         `yaml:"spool_bytes"`         // Spools outbound messages on disk up to this size instead of the queue; 0 disables
+	SpoolPolicy       string        `yaml:"spool_policy"`        // "drop-oldest" or "drop-newest" once the spool is full
+	Compression       string        `yaml:"compression"`         // "deflate" once the upstream advertises it, or "none"
+	CompressMin       int           `yaml:"compress_min"`        // Smaller payloads are sent uncompressed
+	Preset            string        `yaml:"preset"`              // "aws-iot", "azure-iot-hub" or "hivemq-cloud" applies that broker's TLS, auth and QoS requirements
+	TLS               BridgeTLS     `yaml:"tls"`
+	Topics            []BridgeTopic `yaml:"topics"`
+}
+
+// BridgeIngest lets goqtt bridges of other brokers send enveloped, such as
+// compressed, messages to this one
+type BridgeIngest struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// BridgeRouting identifies this broker in the route bridges attach to the
+// messages they forward, so goqtt brokers bridged in a loop drop a message
+// that comes back to them
+type BridgeRouting struct {
+	BrokerID string `yaml:"broker_id"` // Unique among the bridged brokers; empty only enforces max_hops
+	MaxHops  int    `yaml:"max_hops"`  // Bridges a message may cross; 0 uses 8
+}
+
+// BridgeTLS configures a bridge connecting over TLS
+type BridgeTLS struct {
+	Enabled            bool     `yaml:"enabled"`
+	CAFile             string   `yaml:"ca_file"`   // PEM CAs that sign the upstream's certificate; empty uses the system pool
+	CertFile           string   `yaml:"cert_file"` // Client certificate, for upstreams that require one
+	KeyFile            string   `yaml:"key_file"`
+	ServerName         string   `yaml:"server_name"` // Empty uses the host of address
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	ALPN               []string `yaml:"alpn"` // Protocols offered in the handshake; the aws-iot preset sets x-amzn-mqtt-ca on port 443
+}
+
+// BridgeTopic maps topics between the brokers. Filter is matched under
+// local_prefix here and under remote_prefix upstream.
+type BridgeTopic struct {
+	Filter       string `yaml:"filter"`
+	Direction    string `yaml:"direction"` // "in" from the upstream, "out" to it, or "both"
+	QoS          byte   `yaml:"qos"`
+	LocalPrefix  string `yaml:"local_prefix"`
+	RemotePrefix string `yaml:"remote_prefix"`
+}
+
+// Transform rewrites or filters messages published to topics matching Filter
+type Transform struct {
+	Filter string          `yaml:"filter"`
+	Steps  []TransformStep `yaml:"steps"`
+}
+
+// TransformStep is one operation of a transform; which fields apply depends on Op
+type TransformStep struct {
+	Op     string   `yaml:"op"`     // scale, redact, rename, set, drop or wrap
+	Field  string   `yaml:"field"`  // Dotted path such as reading.celsius
+	Fields []string `yaml:"fields"` // Paths removed by redact
+	To     string   `yaml:"to"`     // New path for rename
+	Factor float64  `yaml:"factor"` // scale multiplies by factor, then adds offset
+	Offset float64  `yaml:"offset"`
+	Value  any      `yaml:"value"` // Value written by set, or compared by drop
+}
+
+// CommitLog writes messages on selected topics to segmented append-only files
+type CommitLog struct {
+	Enabled        bool          `yaml:"enabled"`
+	Dir            string        `yaml:"dir"`
+	Topics         []string      `yaml:"topics"`          // Topic filters, such as telemetry/#
+	SegmentBytes   int64         `yaml:"segment_bytes"`   // Size at which a new segment file is started
+	RetentionBytes int64         `yaml:"retention_bytes"` // 0 is unlimited
+	RetentionAge   time.Duration `yaml:"retention_age"`   // 0 keeps segments forever
+	Fsync          bool          `yaml:"fsync"`           // Sync every append instead of only on segment roll and shutdown
+	ReplayLimit    int           `yaml:"replay_limit"`    // Most messages one $replay subscription sends; 0 turns $replay off
+}
+
+// LastValue keeps the latest message on every topic for the admin API, even
+// when it wasn't retained
+type LastValue struct {
+	Enabled   bool     `yaml:"enabled"`
+	Topics    []string `yaml:"topics"`     // Topic filters to cache
+	MaxTopics int      `yaml:"max_topics"` // New topics beyond this are not cached; 0 is unlimited
+}
+
+// Limits caps runtime resources. Zero values leave the Go runtime defaults
+// (including the GOMEMLIMIT and GOMAXPROCS environment variables) in place.
+// Retained messages have their own budget in Retained.
+type Limits struct {
+	MemoryLimit    int64  `yaml:"memory_limit"`    // Soft heap limit in bytes; QoS 0 is shed at 80% and publishes rejected at 95%
+	MaxProcs       int    `yaml:"max_procs"`       // Upper bound on OS threads running Go code
+	InflightBytes  int64  `yaml:"inflight_bytes"`  // Payload bytes held by QoS 1/2 state
+	InflightPolicy string `yaml:"inflight_policy"` // "reject" refuses QoS 1/2 publishes over the budget, "downgrade" delivers at QoS 0
+}
+
+// RateLimit bounds how fast clients may publish. Zero rates are unlimited.
+type RateLimit struct {
+	Messages float64     `yaml:"messages"` // Publishes per second per client
+	Bytes    int64       `yaml:"bytes"`    // Payload bytes per second per client
+	Topics   []TopicRate `yaml:"topics"`   // Budgets shared by every publisher to a topic prefix; the first matching prefix applies
+	Action   string      `yaml:"action"`   // "drop" acknowledges and discards publishes over a limit, "disconnect" closes the connection
+}
+
+// TopicRate is the publish budget of a topic prefix
+type TopicRate struct {
+	Prefix   string  `yaml:"prefix"`
+	Messages float64 `yaml:"messages"`
+	Bytes    int64   `yaml:"bytes"`
+}
+
+// Default returns the configuration used for any value missing from the config file
+func Default() Config {
+	return Config{
+		Server: Server{
+			MaxConnections:        1000,
+			MaxQoS:                2,
+			QoSPolicy:             "downgrade",
+			RetainAvailable:       true,
+			WildcardSubscriptions: true,
+			ConnectTimeout:        10 * time.Second,
+			WriteTimeout:          10 * time.Second,
+			SlowConsumer:          "disconnect",
+			SlowConsumerStall:     250 * time.Millisecond,
+			TCPNoDelay:            true,
+			BatchLinger:           5 * time.Millisecond,
+			OfflineQueue:          1000,
+			PersistSessions:       true,
+			MaxInflight:           20,
+			InflightQueue:         1000,
+		},
+		Admin: Admin{
+			Host: "127.0.0.1",
+		},
+		Presence: Presence{
+			Topic:          "$SYS/clients/{client_id}/status",
+			Retain:         true,
+			OnlinePayload:  "online",
+			OfflinePayload: "offline",
+		},
+		Retained: Retained{
+			Policy:      "evict",
+			OnSubscribe: "always",
+			Persist:     true,
+		},
+		Limits: Limits{
+			InflightPolicy: "reject",
+		},
+		RateLimit: RateLimit{
+			Action: "drop",
+		},
+		Will: Will{
+			MaxQoS: 2,
+			Retain: true,
+		},
+		TLS: TLS{
+			Port:       "8883",
+			MinVersion: "1.2",
+			ClientAuth: "none",
+		},
+		WebSocket: WebSocket{
+			Port: "8083",
+			Path: "/mqtt",
+		},
+		Shutdown: Shutdown{
+			Timeout:     10 * time.Second,
+			NoticeTopic: "$SYS/broker/shutdown",
+		},
+		Discovery: Discovery{
+			Prefix: "homeassistant",
+		},
+		LastValue: LastValue{
+			Topics:    []string{"#"},
+			MaxTopics: 100000,
+		},
+		CommitLog: CommitLog{
+			Dir:          filepath.Join("store", "log"),
+			SegmentBytes: 64 << 20,
+			RetentionAge: 7 * 24 * time.Hour,
+			ReplayLimit:  10000,
+		},
+	}
+}
+
+// EnvPath names the environment variable that can point at the config file
+const EnvPath = "GOQTT_CONFIG"
+
+// searchNames are the file names tried in each search directory, in order
+var searchNames = []string{"config.yml", "config.yaml", "config.json", "config.toml"}
+
+// SearchDirs returns the directories searched when no config path is given:
+// the working directory, the user config directory and /etc/goqtt
+func SearchDirs() []string {
+	dirs := []string{"."}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "goqtt"))
+	}
+	return append(dirs, "/etc/goqtt")
+}
+
+// Find resolves the config file to use. An explicit path wins, then the
+// GOQTT_CONFIG environment variable, then the first file found in SearchDirs.
+func Find(explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+	if env := os.Getenv(EnvPath); env != "" {
+		return env, nil
+	}
+
+	for _, dir := range SearchDirs() {
+		for _, name := range searchNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+
+	return "", errors.New("no config file found in " + strings.Join(SearchDirs(), ", "))
+}
+
+// Load reads and parses the config file at path. The format is chosen by
+// extension: .yml/.yaml, .json or .toml.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg := Default()
+	if err := Decode(data, formatOf(path), &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Listen returns the address the MQTT listener on port binds to
+func (s Server) Listen(port string) string {
+	return net.JoinHostPort(strings.Trim(s.Host, "[]"), port)
+}
+
+// Validate reports values that are out of range
+func (c *Config) Validate() error {
+	if host := strings.Trim(c.Server.Host, "[]"); net.ParseIP(host) == nil && strings.ContainsAny(host, ":[]/ ") {
+		return fmt.Errorf("server.host must be an IP address or host name, got %q", c.Server.Host)
+	}
+	if host := strings.Trim(c.Admin.Host, "[]"); net.ParseIP(host) == nil && strings.ContainsAny(host, ":[]/ ") {
+		return fmt.Errorf("admin.host must be an IP address or host name, got %q", c.Admin.Host)
+	}
+	if c.Server.DeliveryWorkers < 0 || c.Server.DeliveryQueue < 0 {
+		return errors.New("server.delivery_workers and server.delivery_queue must not be negative")
+	}
+	if c.Server.FanoutThreshold < 0 || c.Server.FanoutWorkers < 0 {
+		return errors.New("server.fanout_threshold and server.fanout_workers must not be negative")
+	}
+	if c.Server.MaxConnections <= 0 {
+		return errors.New("server.max_connections must be positive")
+	}
+	if c.Server.MaxHandlers < 0 {
+		return errors.New("server.max_handlers must not be negative")
+	}
+	if c.Server.MaxConnectionsPerIP < 0 {
+		return errors.New("server.max_connections_per_ip must not be negative")
+	}
+	if c.Server.MaxInflight < 0 || c.Server.InflightQueue < 0 {
+		return errors.New("server.max_inflight and server.inflight_queue must not be negative")
+	}
+	if c.Server.OfflineQueue < 0 {
+		return errors.New("server.offline_queue must not be negative")
+	}
+	if c.Server.SpillThreshold < 0 {
+		return errors.New("server.spill_threshold must not be negative")
+	}
+	if c.Limits.MemoryLimit < 0 || c.Limits.MaxProcs < 0 || c.Limits.InflightBytes < 0 {
+		return errors.New("limits.memory_limit, limits.max_procs and limits.inflight_bytes must not be negative")
+	}
+	if c.Server.MaxQoS > 2 {
+		return fmt.Errorf("server.max_qos must be 0, 1 or 2, got %d", c.Server.MaxQoS)
+	}
+	if c.Server.ReadBuffer < 0 || c.Server.WriteBuffer < 0 {
+		return fmt.Errorf("server.read_buffer and server.write_buffer must not be negative, got %d and %d", c.Server.ReadBuffer, c.Server.WriteBuffer)
+	}
+	if c.Server.ConnectTimeout <= 0 {
+		return fmt.Errorf("server.connect_timeout must be positive, got %s", c.Server.ConnectTimeout)
+	}
+	if c.Server.IdleTimeout < 0 {
+		return fmt.Errorf("server.idle_timeout must not be negative, got %s", c.Server.IdleTimeout)
+	}
+	if c.Server.WriteTimeout < 0 {
+		return errors.New("server.write_timeout must not be negative")
+	}
+	switch c.Server.SlowConsumer {
+	case "disconnect":
+	case "drop":
+		if c.Server.SlowConsumerStall <= 0 {
+			return errors.New("server.slow_consumer_stall must be positive when server.slow_consumer is drop")
+		}
+	default:
+		return fmt.Errorf("server.slow_consumer must be disconnect or drop, got %q", c.Server.SlowConsumer)
+	}
+	for _, filter := range c.Server.DeniedFilters {
+		if filter == "" {
+			return errors.New("server.denied_filters must not contain empty filters")
+		}
+	}
+	if c.Server.MaxPacketSize < 0 {
+		return errors.New("server.max_packet_size must not be negative")
+	}
+	switch c.Server.QoSPolicy {
+	case "downgrade", "disconnect":
+	default:
+		return fmt.Errorf("server.qos_policy must be downgrade or disconnect, got %q", c.Server.QoSPolicy)
+	}
+	switch c.Limits.InflightPolicy {
+	case "reject", "downgrade":
+	default:
+		return fmt.Errorf("limits.inflight_policy must be reject or downgrade, got %q", c.Limits.InflightPolicy)
+	}
+	if c.RateLimit.Messages < 0 || c.RateLimit.Bytes < 0 {
+		return errors.New("rate_limit.messages and rate_limit.bytes must not be negative")
+	}
+	for _, topic := range c.RateLimit.Topics {
+		if topic.Prefix == "" {
+			return errors.New("rate_limit.topics entries need a prefix")
+		}
+		if topic.Messages < 0 || topic.Bytes < 0 {
+			return fmt.Errorf("rate_limit.topics %q: messages and bytes must not be negative", topic.Prefix)
+		}
+	}
+	switch c.RateLimit.Action {
+	case "drop", "disconnect":
+	default:
+		return fmt.Errorf("rate_limit.action must be drop or disconnect, got %q", c.RateLimit.Action)
+	}
+	if c.Retained.MaxBytes < 0 {
+		return errors.New("retained.max_bytes must not be negative")
+	}
+	if c.Retained.MaxMessages < 0 || c.Retained.MaxPayload < 0 {
+		return errors.New("retained.max_messages and retained.max_payload must not be negative")
+	}
+	switch c.Retained.Policy {
+	case "evict", "reject":
+	default:
+		return fmt.Errorf("retained.policy must be evict or reject, got %q", c.Retained.Policy)
+	}
+	switch c.Retained.OnSubscribe {
+	case "always", "new", "never":
+	default:
+		return fmt.Errorf("retained.on_subscribe must be always, new or never, got %q", c.Retained.OnSubscribe)
+	}
+	if c.CommitLog.ReplayLimit < 0 {
+		return errors.New("commit_log.replay_limit must not be negative")
+	}
+	if len(c.BridgeRouting.BrokerID) > 255 || strings.ContainsAny(c.BridgeRouting.BrokerID, " \t\r\n") {
+		return errors.New("bridge_routing.broker_id must be at most 255 bytes without spaces")
+	}
+	if c.BridgeRouting.MaxHops < 0 || c.BridgeRouting.MaxHops > 255 {
+		return fmt.Errorf("bridge_routing.max_hops must be between 0 and 255, got %d", c.BridgeRouting.MaxHops)
+	}
+	names := make(map[string]bool, len(c.Bridges))
+	for _, bridge := range c.Bridges {
+		if err := bridge.validate(); err != nil {
+			return err
+		}
+		if names[bridge.Name] {
+			return fmt.Errorf("bridges: duplicate name %q", bridge.Name)
+		}
+		names[bridge.Name] = true
+	}
+	if c.Will.MaxQoS > 2 {
+		return fmt.Errorf("will.max_qos must be 0, 1 or 2, got %d", c.Will.MaxQoS)
+	}
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return errors.New("tls.cert_file and tls.key_file are required when tls is enabled")
+		}
+		switch c.TLS.MinVersion {
+		case "1.2", "1.3":
+		default:
+			return fmt.Errorf("tls.min_version must be 1.2 or 1.3, got %q", c.TLS.MinVersion)
+		}
+		switch c.TLS.ClientAuth {
+		case "none":
+		case "request", "require":
+			if c.TLS.ClientCA == "" {
+				return fmt.Errorf("tls.client_ca is required when tls.client_auth is %s", c.TLS.ClientAuth)
+			}
+		default:
+			return fmt.Errorf("tls.client_auth must be none, request or require, got %q", c.TLS.ClientAuth)
+		}
+	}
+	if c.WebSocket.Enabled {
+		if !strings.HasPrefix(c.WebSocket.Path, "/") {
+			return fmt.Errorf("websocket.path must start with /, got %q", c.WebSocket.Path)
+		}
+		if c.WebSocket.TLS && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+			return errors.New("websocket.tls needs tls.cert_file and tls.key_file")
+		}
+	}
+	if c.Server.DetectProtocols && !c.TLS.Enabled && !c.WebSocket.Enabled {
+		return errors.New("server.detect_protocols needs tls or websocket enabled")
+	}
+	if c.Shutdown.Timeout < 0 {
+		return fmt.Errorf("shutdown.timeout must not be negative, got %s", c.Shutdown.Timeout)
+	}
+	if c.Presence.Enabled {
+		if c.Presence.Topic == "" {
+			return errors.New("presence.topic must not be empty")
+		}
+		if c.Presence.QoS > 2 {
+			return fmt.Errorf("presence.qos must be 0, 1 or 2, got %d", c.Presence.QoS)
+		}
+	}
+	return nil
+}
+
+// Decode parses data in the given format ("yaml", "json" or "toml") into v.
+// JSON and TOML documents are normalized to YAML so a single set of yaml
+// struct tags describes every format.
+func Decode(data []byte, format string, v any) error {
+	switch format {
+	case "yaml":
+		return yaml.Unmarshal(data, v)
+	case "json":
+		var doc map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		return remarshal(doc, v)
+	case "toml":
+		doc, err := parseTOML(data)
+		if err != nil {
+			return err
+		}
+		return remarshal(doc, v)
+	default:
+		return fmt.Errorf("unsupported config format %q", format)
+	}
+}
+
+// formatOf maps a file extension to a config format, defaulting to YAML
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	default:
+		return "yaml"
+	}
+}
+
+// remarshal round-trips a generic document through YAML into v
+func remarshal(doc map[string]any, v any) error {
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// validate checks one bridge's settings
+func (b Bridge) validate() error {
+	if b.Name == "" {
+		return errors.New("bridges: every bridge needs a name")
+	}
+	if _, _, err := net.SplitHostPort(b.Address); err != nil {
+		return fmt.Errorf("bridges %q: address must be host:port, got %q", b.Name, b.Address)
+	}
+	if b.KeepAlive < 0 || b.ReconnectDelay < 0 || b.MaxReconnectDelay < 0 || b.Queue < 0 {
+		return fmt.Errorf("bridges %q: keep_alive, reconnect_delay, max_reconnect_delay and queue must not be negative", b.Name)
+	}
+	switch b.Compression {
+	case "", "none", "deflate":
+	default:
+		return fmt.Errorf("bridges %q: compression must be none or deflate, got %q", b.Name, b.Compression)
+	}
+	if b.CompressMin < 0 {
+		return fmt.Errorf("bridges %q: compress_min must not be negative", b.Name)
+	}
+	if b.SpoolBytes < 0 {
+		return fmt.Errorf("bridges %q: spool_bytes must not be negative", b.Name)
+	}
+	switch b.SpoolPolicy {
+	case "", "drop-oldest", "drop-newest":
+	default:
+		return fmt.Errorf("bridges %q: spool_policy must be drop-oldest or drop-newest, got %q", b.Name, b.SpoolPolicy)
+	}
+	switch b.Preset {
+	case "":
+	case "aws-iot":
+		if b.TLS.CertFile == "" {
+			return fmt.Errorf("bridges %q: the aws-iot preset needs tls.cert_file and tls.key_file", b.Name)
+		}
+	case "azure-iot-hub":
+		if b.ClientID == "" {
+			return fmt.Errorf("bridges %q: the azure-iot-hub preset needs client_id set to the device ID", b.Name)
+		}
+		if b.Password == "" && b.TLS.CertFile == "" {
+			return fmt.Errorf("bridges %q: the azure-iot-hub preset needs a SAS token as password or tls.cert_file", b.Name)
+		}
+	case "hivemq-cloud":
+		if b.Username == "" || b.Password == "" {
+			return fmt.Errorf("bridges %q: the hivemq-cloud preset needs username and password", b.Name)
+		}
+	default:
+		return fmt.Errorf("bridges %q: preset must be aws-iot, azure-iot-hub or hivemq-cloud, got %q", b.Name, b.Preset)
+	}
+	if (b.TLS.Enabled || b.Preset != "") && (b.TLS.CertFile == "") != (b.TLS.KeyFile == "") {
+		return fmt.Errorf("bridges %q: tls.cert_file and tls.key_file must be set together", b.Name)
+	}
+	if len(b.Topics) == 0 {
+		return fmt.Errorf("bridges %q: at least one topic is required", b.Name)
+	}
+	for _, topic := range b.Topics {
+		if topic.Filter == "" {
+			return fmt.Errorf("bridges %q: every topic needs a filter", b.Name)
+		}
+		switch topic.Direction {
+		case "in", "out", "both":
+		default:
+			return fmt.Errorf("bridges %q: topic %q direction must be in, out or both, got %q", b.Name, topic.Filter, topic.Direction)
+		}
+		if topic.QoS > 2 {
+			return fmt.Errorf("bridges %q: topic %q qos must be 0, 1 or 2, got %d", b.Name, topic.Filter, topic.QoS)
+		}
+	}
+	return nil
+}
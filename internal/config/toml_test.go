@@ -0,0 +1,254 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]any
+	}{
+		{
+			name: "empty",
+			src:  "# only a comment\n\n",
+			want: map[string]any{},
+		},
+		{
+			name: "scalars",
+			src: `name = "GoQTT"
+port = 1883
+hex = 0x1F
+big = 1_000_000
+ratio = 0.5
+neg = -3
+on = true
+off = false
+`,
+			want: map[string]any{
+				"name":  "GoQTT",
+				"port":  int64(1883),
+				"hex":   int64(31),
+				"big":   int64(1000000),
+				"ratio": 0.5,
+				"neg":   int64(-3),
+				"on":    true,
+				"off":   false,
+			},
+		},
+		{
+			name: "tables",
+			src: `[server]
+host = "127.0.0.1" # trailing comment
+port = "1883"
+
+[server.tls]
+enabled = true
+
+[admin]
+port = "8080"
+`,
+			want: map[string]any{
+				"server": map[string]any{
+					"host": "127.0.0.1",
+					"port": "1883",
+					"tls":  map[string]any{"enabled": true},
+				},
+				"admin": map[string]any{"port": "8080"},
+			},
+		},
+		{
+			name: "arrays of tables",
+			src: `[[bridges]]
+name = "central"
+
+[[bridges.topics]]
+filter = "a/#"
+
+[[bridges.topics]]
+filter = "b/#"
+
+[[bridges]]
+name = "backup"
+`,
+			want: map[string]any{
+				"bridges": []any{
+					map[string]any{
+						"name": "central",
+						"topics": []any{
+							map[string]any{"filter": "a/#"},
+							map[string]any{"filter": "b/#"},
+						},
+					},
+					map[string]any{"name": "backup"},
+				},
+			},
+		},
+		{
+			name: "dotted keys",
+			src: `server.host = "::1"
+server . port = "1883"
+"quoted.key".value = 1
+'literal'.value = 2
+`,
+			want: map[string]any{
+				"server":     map[string]any{"host": "::1", "port": "1883"},
+				"quoted.key": map[string]any{"value": int64(1)},
+				"literal":    map[string]any{"value": int64(2)},
+			},
+		},
+		{
+			name: "inline tables",
+			src: `presence = { enabled = true, topic = "status/{client_id}", qos.max = 1 }
+empty = {}
+`,
+			want: map[string]any{
+				"presence": map[string]any{
+					"enabled": true,
+					"topic":   "status/{client_id}",
+					"qos":     map[string]any{"max": int64(1)},
+				},
+				"empty": map[string]any{},
+			},
+		},
+		{
+			name: "arrays",
+			src: `topics = [
+  "a/#", # first
+  "b/+",
+]
+nested = [[1, 2], []]
+tables = [{ prefix = "x/" }]
+`,
+			want: map[string]any{
+				"topics": []any{"a/#", "b/+"},
+				"nested": []any{[]any{int64(1), int64(2)}, []any{}},
+				"tables": []any{map[string]any{"prefix": "x/"}},
+			},
+		},
+		{
+			name: "string escapes",
+			src: `basic = "tab\tquote\"slash\\nl\ncr\rbs\bff\f"
+unicode = "\u00e9\U0001F600"
+literal = 'C:\path\no escapes'
+hash = "not # a comment"
+`,
+			want: map[string]any{
+				"basic":   "tab\tquote\"slash\\nl\ncr\rbs\bff\f",
+				"unicode": "é😀",
+				"literal": `C:\path\no escapes`,
+				"hash":    "not # a comment",
+			},
+		},
+		{
+			name: "crlf line endings",
+			src:  "a = 1\r\n[t]\r\nb = 2\r\n",
+			want: map[string]any{
+				"a": int64(1),
+				"t": map[string]any{"b": int64(2)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("parseTOML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"missing equals", "a 1\n", "toml line 1: expected = after key"},
+		{"missing key", "= 1\n", "toml line 1: expected key"},
+		{"missing value", "a =\n", "toml line 1: expected value"},
+		{"unquoted string", "a = nope\n", "toml line 1: expected value"},
+		{"invalid number", "a = 1.2.3\n", `toml line 1: invalid value "1.2.3"`},
+		{"duplicate key", "a = 1\n\n# comment\na = 2\n", `toml line 4: key "a" is already defined`},
+		{"duplicate dotted key", "a.b = 1\na.b = 2\n", `toml line 2: key "b" is already defined`},
+		{"value as table", "a = 1\n[a]\n", `toml line 2: key "a" is already defined`},
+		{"value as array of tables", "a = 1\n[[a]]\n", `toml line 2: key "a" is already defined`},
+		{"unclosed table", "[server\n", "toml line 1: expected ] to close table header"},
+		{"unclosed array of tables", "[[bridges]\n", "toml line 1: expected ]] to close array of tables header"},
+		{"text after value", "a = 1 2\n", `toml line 1: unexpected '2' after value`},
+		{"unterminated string", "a = 1\nb = \"open\n", "toml line 2: unterminated string"},
+		{"unterminated literal string", "a = 'open\n", "toml line 1: unterminated string"},
+		{"invalid escape", `a = "\q"` + "\n", `toml line 1: invalid escape \q`},
+		{"invalid unicode escape", `a = "\u12"` + "\n", "toml line 1: invalid unicode escape"},
+		{"unclosed array", "a = [1, 2\nb = 3\n", "toml line 2: expected , or ] in array"},
+		{"unclosed inline table", "a = { b = 1\n", "toml line 1: expected , or } in inline table"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.src))
+			if err == nil {
+				t.Fatalf("parseTOML() = nil error, want %q", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("parseTOML() error = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTOML(t *testing.T) {
+	src := `[server]
+host = "127.0.0.1"
+port = "1884"
+write_timeout = "5s"
+denied_filters = ["#"]
+
+[rate_limit]
+messages = 10
+topics = [{ prefix = "telemetry/", bytes = 4096 }]
+
+[[bridges]]
+name = "central"
+address = "central:1883"
+
+[[bridges.topics]]
+filter = "sensors/#"
+direction = "out"
+qos = 1
+`
+	cfg := Default()
+	if err := Decode([]byte(src), "toml", &cfg); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if cfg.Server.Host != "127.0.0.1" || cfg.Server.Port != "1884" {
+		t.Errorf("server address = %q:%q, want 127.0.0.1:1884", cfg.Server.Host, cfg.Server.Port)
+	}
+	if cfg.Server.WriteTimeout != 5*time.Second {
+		t.Errorf("server.write_timeout = %v, want 5s", cfg.Server.WriteTimeout)
+	}
+	if cfg.Server.MaxQoS != 2 {
+		t.Errorf("server.max_qos = %d, want the default 2", cfg.Server.MaxQoS)
+	}
+	if !reflect.DeepEqual(cfg.Server.DeniedFilters, []string{"#"}) {
+		t.Errorf("server.denied_filters = %v, want [#]", cfg.Server.DeniedFilters)
+	}
+	if cfg.RateLimit.Messages != 10 || len(cfg.RateLimit.Topics) != 1 || cfg.RateLimit.Topics[0].Bytes != 4096 {
+		t.Errorf("rate_limit = %+v, want 10 messages and one 4096 byte topic limit", cfg.RateLimit)
+	}
+	if len(cfg.Bridges) != 1 || len(cfg.Bridges[0].Topics) != 1 || cfg.Bridges[0].Topics[0].QoS != 1 {
+		t.Fatalf("bridges = %+v, want one bridge with one QoS 1 topic", cfg.Bridges)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+// Package discovery keeps the Home Assistant MQTT discovery configs
+// published under a discovery prefix, so they survive broker restarts even
+// when publishers forget to retain them.
+package discovery
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Entity is one discovered config, published to
+// <prefix>/<component>/[<node_id>/]<object_id>/config
+type Entity struct {
+	Topic     string          `json:"topic"`
+	Component string          `json:"component"`
+	NodeID    string          `json:"node_id,omitempty"`
+	ObjectID  string          `json:"object_id"`
+	Name      string          `json:"name,omitempty"`
+	UniqueID  string          `json:"unique_id,omitempty"`
+	Config    json.RawMessage `json:"config"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Registry validates and persists discovery configs
+type Registry struct {
+	db       *sql.DB
+	prefix   string
+	mu       sync.RWMutex
+	entities map[string]*Entity // Topic -> Entity
+	logger   *logger.Logger
+}
+
+// New loads the persisted discovery configs under prefix
+func New(db *sql.DB, prefix string) (*Registry, error) {
+	r := &Registry{
+		db:       db,
+		prefix:   prefix,
+		entities: make(map[string]*Entity),
+		logger:   logger.NewMQTTLogger("discovery"),
+	}
+
+	rows, err := db.Query("SELECT topic, payload, updated_at FROM discovery")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load discovery configs: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var topic string
+		var payload []byte
+		var updatedAt int64
+		if err := rows.Scan(&topic, &payload, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to load discovery configs: %w", err)
+		}
+		entity, err := r.parse(topic, payload)
+		if err != nil {
+			r.logger.LogError(err, "Skipping invalid persisted discovery config", logger.String("topic", topic))
+			continue
+		}
+		entity.UpdatedAt = time.Unix(updatedAt, 0)
+		r.entities[topic] = entity
+	}
+	return r, rows.Err()
+}
+
+// Restore republishes the persisted configs as retained messages. Call it
+// once the broker has started and before clients connect.
+func (r *Registry) Restore(b *broker.Broker) {
+	// Publishing runs Intercept, so the lock can't be held here
+	for _, entity := range r.Entities() {
+		msg := broker.NewMessage(entity.Topic, entity.Config, true)
+		if err := b.PublishMessage("", msg, packet.QoSAtLeastOnce); err != nil {
+			r.logger.LogError(err, "Failed to restore discovery config", logger.String("topic", entity.Topic))
+		}
+	}
+}
+
+// Intercept is a broker.Interceptor. It drops malformed discovery configs,
+// retains valid ones and persists them; an empty payload removes a config.
+func (r *Registry) Intercept(clientID string, msg *broker.Message) error {
+	if !strings.HasPrefix(msg.Topic, r.prefix+"/") || !strings.HasSuffix(msg.Topic, "/config") {
+		return nil
+	}
+	if msg.Spilled() {
+		return r.reject(msg.Topic, "payload too large")
+	}
+
+	if len(msg.Payload) == 0 {
+		msg.Retain = true // An empty retained message clears the retained config
+		return r.remove(msg.Topic)
+	}
+
+	entity, err := r.parse(msg.Topic, msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Retain = true
+	if r.unchanged(entity) {
+		return nil
+	}
+	entity.UpdatedAt = time.Now()
+	return r.save(entity)
+}
+
+// Entities returns the discovered configs sorted by topic
+func (r *Registry) Entities() []Entity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entities := make([]Entity, 0, len(r.entities))
+	for _, entity := range r.entities {
+		entities = append(entities, *entity)
+	}
+	slices.SortFunc(entities, func(a, b Entity) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	return entities
+}
+
+// parse checks topic and payload against the discovery format
+func (r *Registry) parse(topic string, payload []byte) (*Entity, error) {
+	// <prefix>/<component>/[<node_id>/]<object_id>/config
+	levels := strings.Split(strings.TrimPrefix(topic, r.prefix+"/"), "/")
+	if len(levels) != 3 && len(levels) != 4 {
+		return nil, r.reject(topic, "topic must be <prefix>/<component>/[<node_id>/]<object_id>/config")
+	}
+	for _, level := range levels[:len(levels)-1] {
+		if !validID(level) {
+			return nil, r.reject(topic, fmt.Sprintf("%q may only contain letters, digits, _ and -", level))
+		}
+	}
+
+	var config map[string]any
+	if err := json.Unmarshal(payload, &config); err != nil {
+		return nil, r.reject(topic, "payload must be a JSON object")
+	}
+
+	entity := &Entity{
+		Topic:     topic,
+		Component: levels[0],
+		ObjectID:  levels[len(levels)-2],
+		Name:      stringField(config, "name"),
+		UniqueID:  stringField(config, "unique_id", "uniq_id"),
+		Config:    json.RawMessage(payload),
+	}
+	if len(levels) == 4 {
+		entity.NodeID = levels[1]
+	}
+	return entity, nil
+}
+
+// unchanged reports whether entity's config is already stored, as it is for
+// configs republished by Restore or by devices on every reconnect
+func (r *Registry) unchanged(entity *Entity) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stored, ok := r.entities[entity.Topic]
+	return ok && bytes.Equal(stored.Config, entity.Config)
+}
+
+func (r *Registry) save(entity *Entity) error {
+	_, err := r.db.Exec(`INSERT INTO discovery (topic, payload, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(topic) DO UPDATE SET payload = excluded.payload, updated_at = excluded.updated_at`,
+		entity.Topic, []byte(entity.Config), entity.UpdatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to persist discovery config: %w", err)
+	}
+
+	r.mu.Lock()
+	r.entities[entity.Topic] = entity
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) remove(topic string) error {
+	if _, err := r.db.Exec("DELETE FROM discovery WHERE topic = ?", topic); err != nil {
+		return fmt.Errorf("failed to remove discovery config: %w", err)
+	}
+
+	r.mu.Lock()
+	delete(r.entities, topic)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) reject(topic, reason string) error {
+	return &er.Err{
+		Context: "Discovery, " + topic,
+		Message: fmt.Errorf("%w: %s", er.ErrInvalidDiscoveryConfig, reason),
+	}
+}
+
+// validID reports whether s is a valid component, node ID or object ID
+func validID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// stringField returns the first of keys holding a string in config.
+// Home Assistant accepts abbreviated keys such as uniq_id.
+func stringField(config map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := config[key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+// Package lastvalue keeps the latest message published to every topic,
+// retained or not, so current state can be read without subscribing.
+package lastvalue
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+)
+
+// Entry is the latest message on a topic
+type Entry struct {
+	Message   *broker.Message
+	UpdatedAt time.Time
+}
+
+// Cache holds the latest message per topic for the topics it follows
+type Cache struct {
+	filters   []string
+	maxTopics int // 0 is unlimited
+	mu        sync.RWMutex
+	entries   map[string]Entry
+	skipped   atomic.Uint64 // New topics not cached because the cache was full
+	cancels   []func()
+}
+
+// New creates a cache following the given topic filters, holding at most
+// maxTopics topics
+func New(filters []string, maxTopics int) *Cache {
+	return &Cache{
+		filters:   filters,
+		maxTopics: maxTopics,
+		entries:   make(map[string]Entry),
+	}
+}
+
+// Start follows the cache's filters on b
+func (c *Cache) Start(b *broker.Broker) error {
+	for _, filter := range c.filters {
+		cancel, err := b.Tap(filter, c.store)
+		if err != nil {
+			c.Stop()
+			return err
+		}
+		c.cancels = append(c.cancels, cancel)
+	}
+	return nil
+}
+
+// Stop stops following new messages; cached values stay readable
+func (c *Cache) Stop() {
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+	c.cancels = nil
+}
+
+// Get returns the latest message on topic
+func (c *Cache) Get(topic string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[topic]
+	return entry, ok
+}
+
+// Query returns the latest message on every topic matching filter, sorted
+// by topic
+func (c *Cache) Query(filter string) []Entry {
+	c.mu.RLock()
+	entries := make([]Entry, 0)
+	for topic, entry := range c.entries {
+		if broker.TopicMatches(filter, topic) {
+			entries = append(entries, entry)
+		}
+	}
+	c.mu.RUnlock()
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Message.Topic, b.Message.Topic)
+	})
+	return entries
+}
+
+// Stats reports the cache's size
+type Stats struct {
+	Topics  int    `json:"topics"`
+	Skipped uint64 `json:"skipped"` // Messages on new topics not cached because the cache was full
+}
+
+// Stats returns the number of cached topics and skipped messages
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Stats{Topics: len(c.entries), Skipped: c.skipped.Load()}
+}
+
+// store records msg as the latest value of its topic. Messages are shared
+// read-only across deliveries, so keeping one holds no extra payload copy.
+func (c *Cache) store(msg *broker.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[msg.Topic]; !ok && c.maxTopics > 0 && len(c.entries) >= c.maxTopics {
+		c.skipped.Add(1)
+		return
+	}
+	c.entries[msg.Topic] = Entry{Message: msg, UpdatedAt: time.Now()}
+}
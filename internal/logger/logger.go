@@ -45,14 +45,18 @@ type Config struct {
 var (
 	globalLogger *Logger
 	mu           sync.RWMutex
+
+	// levelVar backs the handler level so it can be changed at runtime
+	levelVar = new(slog.LevelVar)
 )
 
 // New creates a new logger with the given configuration
 func New(config Config) *Logger {
 	var handler slog.Handler
 
+	levelVar.Set(convertLevel(config.Level))
 	opts := &slog.HandlerOptions{
-		Level:     convertLevel(config.Level),
+		Level:     levelVar,
 		AddSource: config.AddSource,
 	}
 
@@ -111,6 +115,65 @@ func GetGlobalLogger() *Logger {
 	return globalLogger
 }
 
+// SetLevel changes the level of all loggers derived from the global logger
+func SetLevel(level LogLevel) {
+	levelVar.Set(convertLevel(level))
+}
+
+// GetLevel returns the current runtime log level
+func GetLevel() LogLevel {
+	switch l := levelVar.Level(); {
+	case l <= slog.LevelDebug:
+		return LevelDebug
+	case l <= slog.LevelInfo:
+		return LevelInfo
+	case l <= slog.LevelWarn:
+		return LevelWarn
+	default:
+		return LevelError
+	}
+}
+
+// Enabled reports whether messages at level are currently logged. Hot paths
+// use it to skip building attributes for messages that would be discarded.
+func Enabled(level LogLevel) bool {
+	return convertLevel(level) >= levelVar.Level()
+}
+
+// ParseLevel converts a level name ("debug", "info", "warn", "error") to a LogLevel
+func ParseLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// String returns the lowercase name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
 // NewMQTTLogger creates a component-specific logger for MQTT operations
 func NewMQTTLogger(component string) *Logger {
 	global := GetGlobalLogger()
@@ -156,6 +219,10 @@ func ProductionConfig() Config {
 
 // LogClientConnection logs client connection events
 func (l *Logger) LogClientConnection(clientID, remoteAddr string, action string, attrs ...slog.Attr) {
+	if !Enabled(LevelInfo) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("client_id", clientID),
 		slog.String("remote_addr", remoteAddr),
@@ -168,6 +235,10 @@ func (l *Logger) LogClientConnection(clientID, remoteAddr string, action string,
 
 // LogMQTTPacket logs MQTT packet information
 func (l *Logger) LogMQTTPacket(packetType string, clientID string, direction string, attrs ...slog.Attr) {
+	if !Enabled(LevelDebug) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("packet_type", packetType),
 		slog.String("client_id", clientID),
@@ -180,6 +251,10 @@ func (l *Logger) LogMQTTPacket(packetType string, clientID string, direction str
 
 // LogPublish logs PUBLISH packet details
 func (l *Logger) LogPublish(clientID, topic string, qos int, retain bool, payloadSize int, attrs ...slog.Attr) {
+	if !Enabled(LevelInfo) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("client_id", clientID),
 		slog.String("topic", topic),
@@ -194,6 +269,10 @@ func (l *Logger) LogPublish(clientID, topic string, qos int, retain bool, payloa
 
 // LogSubscription logs subscription events
 func (l *Logger) LogSubscription(clientID, topic string, qos int, action string, attrs ...slog.Attr) {
+	if !Enabled(LevelInfo) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("client_id", clientID),
 		slog.String("topic_filter", topic),
@@ -233,6 +312,10 @@ func (l *Logger) LogAuth(clientID, username string, success bool, reason string,
 
 // LogQoSFlow logs QoS flow control events
 func (l *Logger) LogQoSFlow(clientID string, packetID uint16, qos int, step string, attrs ...slog.Attr) {
+	if !Enabled(LevelDebug) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("client_id", clientID),
 		slog.Int("packet_id", int(packetID)),
@@ -246,6 +329,10 @@ func (l *Logger) LogQoSFlow(clientID string, packetID uint16, qos int, step stri
 
 // LogRetainedMessage logs retained message operations
 func (l *Logger) LogRetainedMessage(topic string, action string, payloadSize int, attrs ...slog.Attr) {
+	if !Enabled(LevelDebug) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("topic", topic),
 		slog.String("action", action), // "stored", "removed", "delivered"
@@ -258,6 +345,10 @@ func (l *Logger) LogRetainedMessage(topic string, action string, payloadSize int
 
 // LogPerformance logs performance metrics
 func (l *Logger) LogPerformance(metric string, value any, unit string, attrs ...slog.Attr) {
+	if !Enabled(LevelInfo) {
+		return
+	}
+
 	baseAttrs := []slog.Attr{
 		slog.String("metric", metric),
 		slog.Any("value", value),
@@ -1,5 +1,7 @@
 package packet
 
+import "github.com/pyr33x/goqtt/internal/packet/utils"
+
 const (
 	ConnectionAccepted          = 0x00 // Connection Accepted
 	UnacceptableProtocolVersion = 0x01 // The Server does not support the level of the MQTT protocol requested by the Client
@@ -9,6 +11,23 @@ const (
 	NotAuthorized               = 0x05 // The Client is not authorized to connect
 )
 
+// MQTT 5 reason codes used by CONNACK and DISCONNECT
+const (
+	ReasonSuccess                    = 0x00 // Also Normal Disconnection
+	ReasonDisconnectWithWill         = 0x04 // The Client wants its Will Message published
+	ReasonUnspecifiedError           = 0x80 // The Server does not wish to reveal the reason, or none of the others apply
+	ReasonMalformedPacket            = 0x81 // Data within the packet could not be correctly parsed
+	ReasonProtocolError              = 0x82 // Data in the packet does not conform to the specification
+	ReasonUnsupportedProtocolVersion = 0x84 // The Server does not support the version of the MQTT protocol requested by the Client
+	ReasonClientIdentifierNotValid   = 0x85 // The Client Identifier is a valid string but is not allowed by the Server
+	ReasonBadUserNameOrPassword      = 0x86 // The Server does not accept the User Name or Password
+	ReasonNotAuthorized              = 0x87 // The Client is not authorized
+	ReasonServerUnavailable          = 0x88 // The MQTT Server is not available
+	ReasonServerShuttingDown         = 0x8B // The Server is shutting down
+	ReasonKeepAliveTimeout           = 0x8D // Nothing was received for 1.5 times the Keep Alive
+	ReasonSessionTakenOver           = 0x8E // Another connection using the same Client ID has connected
+)
+
 func NewConnAck(sessionPresent bool, returnCode byte) []byte {
 	flags := byte(0x00)
 	if sessionPresent {
@@ -22,3 +41,14 @@ func NewConnAck(sessionPresent bool, returnCode byte) []byte {
 		returnCode,
 	}
 }
+
+// NewConnAckV5 encodes an MQTT 5 CONNACK
+func NewConnAckV5(sessionPresent bool, reasonCode byte, props Properties) []byte {
+	flags := byte(0x00)
+	if sessionPresent {
+		flags = 0x01
+	}
+
+	body := AppendProperties([]byte{flags, reasonCode}, props)
+	return append(utils.AppendRemainingLength([]byte{0x20}, len(body)), body...)
+}
@@ -3,9 +3,10 @@ package packet
 import (
 	"encoding/binary"
 	"errors"
-	"regexp"
+	"sync/atomic"
 
 	"github.com/google/uuid"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
 	"github.com/pyr33x/goqtt/pkg/er"
 )
 
@@ -20,6 +21,7 @@ type ConnectPacket struct {
 	WillFlag      bool
 	CleanSession  bool
 	KeepAlive     uint16
+	Properties    Properties // MQTT 5 only
 
 	// Payload
 	ClientID    string
@@ -28,6 +30,9 @@ type ConnectPacket struct {
 	Username    *string // (if Username flag is set)
 	Password    *string // (if Password flag is set)
 
+	// MQTT 5 only, sent ahead of WillTopic (if Will flag is set)
+	WillProperties Properties
+
 	// Raw
 	Raw []byte
 }
@@ -47,8 +52,28 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 		}
 	}
 
+	// MQTT 3.1.1: CONNECT fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{
+			Context: "Connect, Fixed Header",
+			Message: er.ErrInvalidFixedHeaderFlags,
+		}
+	}
+
 	cp.Raw = raw
-	offset := 2 // Skip fixed header (packet type + remaining length)
+
+	// Skip the fixed header; the remaining length takes 1 to 4 bytes
+	remainingLength, offset, err := utils.ParseRemainingLength(raw[1:])
+	if err != nil {
+		return err
+	}
+	if len(raw) != 1+offset+remainingLength {
+		return &er.Err{
+			Context: "Connect, Packet Length",
+			Message: er.ErrInvalidPacketLength,
+		}
+	}
+	offset++
 
 	if offset+2 > len(raw) {
 		return &er.Err{
@@ -71,15 +96,23 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	cp.ProtocolName = string(raw[offset : offset+int(protocolNameLen)])
 	offset += int(protocolNameLen)
 
-	// Enforce "MQTT" as ProtocolName (strict, case-sensitive)
-	if cp.ProtocolName != "MQTT" {
+	if err := utils.ValidateString(cp.ProtocolName); err != nil {
 		return &er.Err{
 			Context: "Connect, ProtocolName",
 			Message: er.ErrUnsupportedProtocolName,
 		}
 	}
 
-	// Parse Protocol Level (strict to 4 = MQTT 3.1.1)
+	// Enforce "MQTT" as ProtocolName (strict, case-sensitive), or MQTT 3.1's
+	// "MQIsdp" when accepted
+	if cp.ProtocolName != "MQTT" && (cp.ProtocolName != "MQIsdp" || !acceptMQTT31.Load()) {
+		return &er.Err{
+			Context: "Connect, ProtocolName",
+			Message: er.ErrUnsupportedProtocolName,
+		}
+	}
+
+	// Parse Protocol Level (5 = MQTT 5, 4 = MQTT 3.1.1, 3 = MQTT 3.1), which must match the name
 	if offset >= len(raw) {
 		return &er.Err{
 			Context: "Connect",
@@ -88,7 +121,7 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	}
 	cp.ProtocolLevel = raw[offset]
 	offset++
-	if cp.ProtocolLevel != 4 {
+	if (cp.ProtocolName == "MQTT" && cp.ProtocolLevel != 4 && cp.ProtocolLevel != 5) || (cp.ProtocolName == "MQIsdp" && cp.ProtocolLevel != 3) {
 		return &er.Err{
 			Context: "Connect, ProtocolLevel",
 			Message: er.ErrUnsupportedProtocolLevel,
@@ -105,6 +138,14 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	connectFlags := raw[offset]
 	offset++
 
+	// MQTT 3.1.1: the reserved connect flag (bit 0) must be 0 [MQTT-3.1.2-3]
+	if connectFlags&0x01 != 0 {
+		return &er.Err{
+			Context: "Connect, Reserved Flag",
+			Message: er.ErrInvalidReservedFlag,
+		}
+	}
+
 	cp.UsernameFlag = (connectFlags & 0x80) != 0 // bit 7
 	cp.PasswordFlag = (connectFlags & 0x40) != 0 // bit 6
 	cp.WillRetain = (connectFlags & 0x20) != 0   // bit 5
@@ -120,6 +161,14 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 		}
 	}
 
+	// Without a will, WillQoS and WillRetain must be 0 [MQTT-3.1.2-13] [MQTT-3.1.2-15]
+	if !cp.WillFlag && (cp.WillQoS != 0 || cp.WillRetain) {
+		return &er.Err{
+			Context: "Connect, WillFlag",
+			Message: er.ErrInvalidWillFlags,
+		}
+	}
+
 	// Parse Keep Alive
 	if offset+2 > len(raw) {
 		return &er.Err{
@@ -130,6 +179,21 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	cp.KeepAlive = binary.BigEndian.Uint16(raw[offset : offset+2])
 	offset += 2
 
+	if cp.IsMQTT5() {
+		props, n, err := parseProperties(raw[offset:], connectProperties)
+		if err != nil {
+			return err
+		}
+		cp.Properties = props
+		offset += n
+	}
+
+	if offset+2 > len(raw) {
+		return &er.Err{
+			Context: "Connect, ClientID",
+			Message: er.ErrInvalidConnPacket,
+		}
+	}
 	clientIDLen := binary.BigEndian.Uint16(raw[offset : offset+2])
 	offset += 2
 
@@ -142,11 +206,25 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	cp.ClientID = string(raw[offset : offset+int(clientIDLen)])
 	offset += int(clientIDLen)
 
+	if err := utils.ValidateString(cp.ClientID); err != nil {
+		return &er.Err{
+			Context: "Connect, ClientID",
+			Message: er.ErrInvalidCharsClientID,
+		}
+	}
+
 	cErr := cp.ValidateClientID()
 	if cErr != nil {
-		if errors.Is(cErr, er.ErrEmptyClientID) {
+		if errors.Is(cErr, er.ErrEmptyClientID) && cp.IsMQTT31() {
+			// MQTT 3.1 requires a client ID of 1 to 23 characters
+			return &er.Err{
+				Context: "Connect, ClientID",
+				Message: er.ErrIdentifierRejected,
+			}
+		} else if errors.Is(cErr, er.ErrEmptyClientID) || (errors.Is(cErr, er.ErrEmptyAndCleanSessionClientID) && cp.IsMQTT5()) {
 			// If Client ID is not set from client
-			// We assign a uuid to the Client ID from the server
+			// We assign a uuid to the Client ID from the server. MQTT 5
+			// allows this whatever Clean Start is.
 			cp.ClientID = uuid.NewString()
 		} else if errors.Is(cErr, er.ErrEmptyAndCleanSessionClientID) {
 			// Client must set clean session to 1
@@ -162,6 +240,14 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 
 	// Parse WillTopic & WillMessage if Will is WillFlag is set
 	if cp.WillFlag {
+		if cp.IsMQTT5() {
+			props, n, err := parseProperties(raw[offset:], willProperties)
+			if err != nil {
+				return err
+			}
+			cp.WillProperties = props
+			offset += n
+		}
 		if offset+2 > len(raw) {
 			return &er.Err{
 				Context: "Connect, WillFlag",
@@ -178,6 +264,14 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 		}
 		cp.WillTopic = stringPtr(string(raw[offset : offset+int(willTopicLen)]))
 		offset += int(willTopicLen)
+
+		// The will is published like any message, so its topic must be a valid topic name
+		if err := utils.ValidateTopicName(*cp.WillTopic); err != nil {
+			return &er.Err{
+				Context: "Connect, WillTopic",
+				Message: er.ErrInvalidWillTopic,
+			}
+		}
 		if offset+2 > len(raw) {
 			return &er.Err{
 				Context: "Connect, WillTopic",
@@ -197,8 +291,8 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 		offset += int(willMessageLen)
 	}
 
-	// Username/Password dependency check
-	if !cp.UsernameFlag && cp.PasswordFlag {
+	// Username/Password dependency check; MQTT 5 allows a password alone
+	if !cp.UsernameFlag && cp.PasswordFlag && !cp.IsMQTT5() {
 		return &er.Err{
 			Context: "Connect, UsernameFlag + PasswordFlag",
 			Message: er.ErrPasswordWithoutUsername,
@@ -225,6 +319,13 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 		}
 		cp.Username = stringPtr(string(raw[offset : offset+int(usernameLen)]))
 		offset += int(usernameLen)
+
+		if err := utils.ValidateString(*cp.Username); err != nil {
+			return &er.Err{
+				Context: "Connect, Username",
+				Message: er.ErrMalformedUsernameField,
+			}
+		}
 	}
 
 	// Parse Password if PasswordFlag is set
@@ -251,6 +352,26 @@ func (cp *ConnectPacket) Parse(raw []byte) error {
 	return nil
 }
 
+// acceptMQTT31 lets CONNECT use MQTT 3.1's protocol name and level
+var acceptMQTT31 atomic.Bool
+
+// SetAcceptMQTT31 accepts CONNECTs from MQTT 3.1 clients, which send
+// protocol name "MQIsdp" and level 3. Off by default, so they are refused
+// with UnacceptableProtocolVersion.
+func SetAcceptMQTT31(accept bool) {
+	acceptMQTT31.Store(accept)
+}
+
+// IsMQTT31 reports whether the client connected with MQTT 3.1
+func (cp *ConnectPacket) IsMQTT31() bool {
+	return cp.ProtocolLevel == 3
+}
+
+// IsMQTT5 reports whether the client connected with MQTT 5
+func (cp *ConnectPacket) IsMQTT5() bool {
+	return cp.ProtocolLevel == 5
+}
+
 func (cp *ConnectPacket) ValidateClientID() error {
 	// Check if ClientID is empty (zero bytes)
 	if len(cp.ClientID) == 0 {
@@ -275,18 +396,24 @@ func (cp *ConnectPacket) ValidateClientID() error {
 		}
 	}
 
-	// Allowed Pattern: UTF-8 + Symbols
-	allowdPattern := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
-	if !allowdPattern.MatchString(cp.ClientID) {
-		return &er.Err{
-			Context: "Connect, ClientID",
-			Message: er.ErrInvalidCharsClientID,
+	// Allowed Pattern: ^[a-zA-Z0-9_-]+$
+	for i := 0; i < len(cp.ClientID); i++ {
+		if !isClientIDChar(cp.ClientID[i]) {
+			return &er.Err{
+				Context: "Connect, ClientID",
+				Message: er.ErrInvalidCharsClientID,
+			}
 		}
 	}
 
 	return nil
 }
 
+// isClientIDChar reports whether c is allowed in a client identifier
+func isClientIDChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
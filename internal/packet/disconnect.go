@@ -1,8 +1,15 @@
 package packet
 
-import "github.com/pyr33x/goqtt/pkg/er"
+import (
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
 
-type DisconnectPacket struct{}
+type DisconnectPacket struct {
+	// MQTT 5 only
+	ReasonCode byte
+	Properties Properties
+}
 
 func (dp *DisconnectPacket) Parse(raw []byte) error {
 	if len(raw) < 2 {
@@ -12,14 +19,21 @@ func (dp *DisconnectPacket) Parse(raw []byte) error {
 		}
 	}
 
-	// First byte should be 0xE0 (type = 14 << 4, flags = 0)
-	if PacketType(raw[0]) != DISCONNECT {
+	if PacketType(raw[0]&0xF0) != DISCONNECT {
 		return &er.Err{
 			Context: "Disconnect, Control",
 			Message: er.ErrInvalidDisconnectPacket,
 		}
 	}
 
+	// MQTT 3.1.1: DISCONNECT fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{
+			Context: "Disconnect, Fixed Header",
+			Message: er.ErrInvalidFixedHeaderFlags,
+		}
+	}
+
 	// Remaining length must be 0
 	if raw[1] != 0x00 {
 		return &er.Err{
@@ -30,3 +44,59 @@ func (dp *DisconnectPacket) Parse(raw []byte) error {
 
 	return nil
 }
+
+// ParseV5 parses an MQTT 5 DISCONNECT, whose reason code and properties
+// may be left out when they would be Normal Disconnection and none
+func (dp *DisconnectPacket) ParseV5(raw []byte) error {
+	if len(raw) < 2 || PacketType(raw[0]&0xF0) != DISCONNECT {
+		return &er.Err{
+			Context: "Disconnect",
+			Message: er.ErrInvalidDisconnectPacket,
+		}
+	}
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{
+			Context: "Disconnect, Fixed Header",
+			Message: er.ErrInvalidFixedHeaderFlags,
+		}
+	}
+
+	remainingLength, n, err := utils.ParseRemainingLength(raw[1:])
+	if err != nil {
+		return err
+	}
+	body := raw[1+n:]
+	if len(body) != remainingLength {
+		return &er.Err{
+			Context: "Disconnect, Packet Length",
+			Message: er.ErrInvalidPacketLength,
+		}
+	}
+
+	dp.ReasonCode, dp.Properties = ReasonSuccess, nil
+	if len(body) == 0 {
+		return nil
+	}
+	dp.ReasonCode = body[0]
+	if len(body) == 1 {
+		return nil
+	}
+	props, used, err := parseProperties(body[1:], disconnectProperties)
+	if err != nil {
+		return err
+	}
+	if 1+used != len(body) {
+		return malformedProperties("%d bytes follow the properties", len(body)-1-used)
+	}
+	dp.Properties = props
+	return nil
+}
+
+// NewDisconnectV5 encodes an MQTT 5 DISCONNECT sent by the server
+func NewDisconnectV5(reasonCode byte, props Properties) []byte {
+	if reasonCode == ReasonSuccess && len(props) == 0 {
+		return []byte{byte(DISCONNECT), 0x00}
+	}
+	body := AppendProperties([]byte{reasonCode}, props)
+	return append(utils.AppendRemainingLength([]byte{byte(DISCONNECT)}, len(body)), body...)
+}
@@ -0,0 +1,106 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+)
+
+// benchString encodes s with its 2-byte length prefix
+func benchString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// benchPacket prepends a fixed header to body
+func benchPacket(header byte, body []byte) []byte {
+	raw := append([]byte{header}, utils.EncodeRemainingLength(len(body))...)
+	return append(raw, body...)
+}
+
+func benchConnect() []byte {
+	var body []byte
+	body = append(body, benchString("MQTT")...)
+	body = append(body, 4, 0xC2, 0, 60) // level, username+password+clean session, keep alive
+	body = append(body, benchString("sensor-gateway-01")...)
+	body = append(body, benchString("user")...)
+	body = append(body, benchString("secret")...)
+	return benchPacket(byte(CONNECT), body)
+}
+
+func benchPublish(qos QoSLevel, payloadSize int) []byte {
+	body := benchString("factory/line-3/sensors/temperature")
+	if qos > QoSAtMostOnce {
+		body = append(body, 0x12, 0x34)
+	}
+	body = append(body, bytes.Repeat([]byte{'x'}, payloadSize)...)
+	return benchPacket(byte(PUBLISH)|byte(qos)<<1, body)
+}
+
+func benchSubscribe() []byte {
+	body := []byte{0x00, 0x01}
+	for _, filter := range []string{"factory/+/sensors/#", "factory/line-3/alarms", "$SYS/broker/+"} {
+		body = append(body, benchString(filter)...)
+		body = append(body, 1)
+	}
+	return benchPacket(byte(SUBSCRIBE)|0x02, body)
+}
+
+func BenchmarkParseConnect(b *testing.B) {
+	raw := benchConnect()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := Parse(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParsePublishQoS0(b *testing.B) {
+	raw := benchPublish(QoSAtMostOnce, 256)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for b.Loop() {
+		if _, err := Parse(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParsePublishQoS1Large(b *testing.B) {
+	raw := benchPublish(QoSAtLeastOnce, 64*1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for b.Loop() {
+		if _, err := Parse(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseSubscribe(b *testing.B) {
+	raw := benchSubscribe()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := Parse(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodePublish(b *testing.B) {
+	packetID := uint16(42)
+	pp := &PublishPacket{
+		Topic:    "factory/line-3/sensors/temperature",
+		QoS:      QoSAtLeastOnce,
+		PacketID: &packetID,
+		Payload:  bytes.Repeat([]byte{'x'}, 256),
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = pp.Encode()
+	}
+}
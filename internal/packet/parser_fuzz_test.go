@@ -0,0 +1,174 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Run a target with, for example:
+//
+//	go test ./internal/packet -run '^$' -fuzz '^FuzzParse$' -fuzztime 1m
+//
+// Inputs that make a target fail are written to testdata/fuzz/<target>;
+// commit them with the fix so `go test` keeps replaying them.
+
+// fuzzSeeds returns a valid packet of every type the broker parses
+func fuzzSeeds() [][]byte {
+	return [][]byte{
+		benchConnect(),
+		longConnect(),
+		connectV5(),
+		benchPublish(QoSAtMostOnce, 16),
+		benchPublish(QoSAtLeastOnce, 16),
+		benchPublish(QoSExactlyOnce, 0),
+		benchSubscribe(),
+		benchPacket(byte(UNSUBSCRIBE)|0x02, append([]byte{0x00, 0x02}, benchString("factory/+/alarms")...)),
+		benchPacket(byte(PUBACK), []byte{0x12, 0x34}),
+		benchPacket(byte(PUBREC), []byte{0x12, 0x34}),
+		benchPacket(byte(PUBREL)|0x02, []byte{0x12, 0x34}),
+		benchPacket(byte(PUBCOMP), []byte{0x12, 0x34}),
+		benchPacket(byte(SUBACK), []byte{0x00, 0x01, 0x00, 0x01, 0x80}),
+		benchPacket(byte(UNSUBACK), []byte{0x00, 0x02}),
+		benchPacket(byte(PINGREQ), nil),
+		benchPacket(byte(DISCONNECT), nil),
+	}
+}
+
+// longConnect returns a CONNECT whose remaining length takes two bytes
+func longConnect() []byte {
+	var body []byte
+	body = append(body, benchString("MQTT")...)
+	body = append(body, 4, 0x06, 0, 60) // level, will+clean session, keep alive
+	body = append(body, benchString("sensor-gateway-02")...)
+	body = append(body, benchString("factory/line-3/status")...)
+	body = append(body, benchString(string(bytes.Repeat([]byte{'x'}, 200)))...)
+	return benchPacket(byte(CONNECT), body)
+}
+
+// connectV5 returns an MQTT 5 CONNECT with connect and will properties
+func connectV5() []byte {
+	var body []byte
+	body = append(body, benchString("MQTT")...)
+	body = append(body, 5, 0x06, 0, 60)                                                            // level, will+clean start, keep alive
+	body = append(body, 8, PropSessionExpiryInterval, 0, 0, 0x0E, 0x10, PropReceiveMaximum, 0, 20) // properties
+	body = append(body, benchString("sensor-v5")...)
+	body = append(body, 5, PropWillDelayInterval, 0, 0, 0, 30) // will properties
+	body = append(body, benchString("factory/line-3/status")...)
+	body = append(body, benchString("offline")...)
+	return benchPacket(byte(CONNECT), body)
+}
+
+// exact caps raw at its length, so a parser reading past the end panics
+// instead of silently reading spare capacity, as it would in the pooled
+// buffers the broker parses from
+func exact(raw []byte) []byte {
+	return raw[:len(raw):len(raw)]
+}
+
+// seedsOf adds the seeds whose type matches packetType to f
+func seedsOf(f *testing.F, packetType PacketType) {
+	for _, seed := range fuzzSeeds() {
+		if PacketType(seed[0]&0xF0) == packetType {
+			f.Add(seed)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		p, err := Parse(raw)
+		if err != nil {
+			return
+		}
+		if p.Type != PacketType(raw[0]&0xF0) {
+			t.Fatalf("parsed %s from a %s header", p.Type, PacketType(raw[0]&0xF0))
+		}
+	})
+}
+
+func FuzzConnectParse(f *testing.F) {
+	seedsOf(f, CONNECT)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		var cp ConnectPacket
+		if err := cp.Parse(raw); err != nil {
+			return
+		}
+		if cp.ProtocolName != "MQTT" || (cp.ProtocolLevel != 4 && cp.ProtocolLevel != 5) {
+			t.Fatalf("accepted protocol %q level %d", cp.ProtocolName, cp.ProtocolLevel)
+		}
+		if cp.WillFlag && (cp.WillTopic == nil || cp.WillMessage == nil) {
+			t.Fatal("will flag set without a will topic and message")
+		}
+	})
+}
+
+func FuzzPublishParse(f *testing.F) {
+	seedsOf(f, PUBLISH)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		var pp PublishPacket
+		if err := pp.Parse(raw); err != nil {
+			return
+		}
+
+		// Whatever parses must survive an encode and parse round trip
+		var again PublishPacket
+		if err := again.Parse(pp.Encode()); err != nil {
+			t.Fatalf("re-parsing the encoded packet: %v", err)
+		}
+		if again.Topic != pp.Topic || again.QoS != pp.QoS || again.Retain != pp.Retain || !bytes.Equal(again.Payload, pp.Payload) {
+			t.Fatalf("round trip changed the packet: %+v != %+v", again, pp)
+		}
+	})
+}
+
+func FuzzSubscribeParse(f *testing.F) {
+	seedsOf(f, SUBSCRIBE)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		var sp SubscribePacket
+		if err := sp.Parse(raw); err != nil {
+			return
+		}
+		if len(sp.Filters) == 0 {
+			t.Fatal("accepted a SUBSCRIBE without filters")
+		}
+		for _, filter := range sp.Filters {
+			if filter.QoS > QoSExactlyOnce {
+				t.Fatalf("accepted QoS %d for %q", filter.QoS, filter.Topic)
+			}
+		}
+	})
+}
+
+func FuzzUnsubscribeParse(f *testing.F) {
+	seedsOf(f, UNSUBSCRIBE)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		var up UnsubscribePacket
+		_ = up.Parse(raw)
+	})
+}
+
+func FuzzAckParse(f *testing.F) {
+	for _, packetType := range []PacketType{PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, PINGREQ, DISCONNECT} {
+		seedsOf(f, packetType)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		raw = exact(raw)
+		_ = (&PubackPacket{}).Parse(raw)
+		_ = (&PubrecPacket{}).Parse(raw)
+		_ = (&PubrelPacket{}).Parse(raw)
+		_ = (&PubcompPacket{}).Parse(raw)
+		_ = (&SubackPacket{}).Parse(raw)
+		_ = (&UnsubackPacket{}).Parse(raw)
+		_ = (&PingreqPacket{}).Parse(raw)
+		_ = (&DisconnectPacket{}).Parse(raw)
+		_ = (&DisconnectPacket{}).ParseV5(raw)
+	})
+}
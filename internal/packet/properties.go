@@ -0,0 +1,260 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// MQTT 5 property identifiers
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// propertyType is how a property's value is encoded
+type propertyType byte
+
+const (
+	propByte propertyType = iota
+	propTwoByte
+	propFourByte
+	propVarInt
+	propString
+	propBinary
+	propStringPair
+)
+
+var propertyTypes = map[byte]propertyType{
+	PropPayloadFormatIndicator:          propByte,
+	PropMessageExpiryInterval:           propFourByte,
+	PropContentType:                     propString,
+	PropResponseTopic:                   propString,
+	PropCorrelationData:                 propBinary,
+	PropSubscriptionIdentifier:          propVarInt,
+	PropSessionExpiryInterval:           propFourByte,
+	PropAssignedClientIdentifier:        propString,
+	PropServerKeepAlive:                 propTwoByte,
+	PropAuthenticationMethod:            propString,
+	PropAuthenticationData:              propBinary,
+	PropRequestProblemInformation:       propByte,
+	PropWillDelayInterval:               propFourByte,
+	PropRequestResponseInformation:      propByte,
+	PropResponseInformation:             propString,
+	PropServerReference:                 propString,
+	PropReasonString:                    propString,
+	PropReceiveMaximum:                  propTwoByte,
+	PropTopicAliasMaximum:               propTwoByte,
+	PropTopicAlias:                      propTwoByte,
+	PropMaximumQoS:                      propByte,
+	PropRetainAvailable:                 propByte,
+	PropUserProperty:                    propStringPair,
+	PropMaximumPacketSize:               propFourByte,
+	PropWildcardSubscriptionAvailable:   propByte,
+	PropSubscriptionIdentifierAvailable: propByte,
+	PropSharedSubscriptionAvailable:     propByte,
+}
+
+// The properties each packet may carry. Any other identifier makes the
+// packet malformed.
+var (
+	connectProperties = []byte{
+		PropSessionExpiryInterval, PropReceiveMaximum, PropMaximumPacketSize, PropTopicAliasMaximum,
+		PropRequestResponseInformation, PropRequestProblemInformation, PropUserProperty,
+		PropAuthenticationMethod, PropAuthenticationData,
+	}
+	willProperties = []byte{
+		PropWillDelayInterval, PropPayloadFormatIndicator, PropMessageExpiryInterval, PropContentType,
+		PropResponseTopic, PropCorrelationData, PropUserProperty,
+	}
+	connAckProperties = []byte{
+		PropSessionExpiryInterval, PropReceiveMaximum, PropMaximumQoS, PropRetainAvailable,
+		PropMaximumPacketSize, PropAssignedClientIdentifier, PropTopicAliasMaximum, PropReasonString,
+		PropUserProperty, PropWildcardSubscriptionAvailable, PropSubscriptionIdentifierAvailable,
+		PropSharedSubscriptionAvailable, PropServerKeepAlive, PropResponseInformation,
+		PropServerReference, PropAuthenticationMethod, PropAuthenticationData,
+	}
+	disconnectProperties = []byte{
+		PropSessionExpiryInterval, PropReasonString, PropUserProperty, PropServerReference,
+	}
+)
+
+// Property is one MQTT 5 property. Integer values are held in Uint, UTF-8
+// strings and binary data in String, and a user property's name and value
+// in String and Value.
+type Property struct {
+	ID     byte
+	Uint   uint32
+	String string
+	Value  string
+}
+
+// Properties is a packet's MQTT 5 property list, in the order sent
+type Properties []Property
+
+// Get returns the first property with id
+func (ps Properties) Get(id byte) (Property, bool) {
+	for _, p := range ps {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Uint returns the integer value of property id, or def when it's absent
+func (ps Properties) Uint(id byte, def uint32) uint32 {
+	if p, ok := ps.Get(id); ok {
+		return p.Uint
+	}
+	return def
+}
+
+// AppendProperties appends the encoded property list, length first, to dst
+func AppendProperties(dst []byte, ps Properties) []byte {
+	var body []byte
+	for _, p := range ps {
+		body = append(body, p.ID)
+		switch propertyTypes[p.ID] {
+		case propByte:
+			body = append(body, byte(p.Uint))
+		case propTwoByte:
+			body = binary.BigEndian.AppendUint16(body, uint16(p.Uint))
+		case propFourByte:
+			body = binary.BigEndian.AppendUint32(body, p.Uint)
+		case propVarInt:
+			body = utils.AppendRemainingLength(body, int(p.Uint))
+		case propString, propBinary:
+			body = appendString(body, p.String)
+		case propStringPair:
+			body = appendString(body, p.String)
+			body = appendString(body, p.Value)
+		}
+	}
+	dst = utils.AppendRemainingLength(dst, len(body))
+	return append(dst, body...)
+}
+
+// parseProperties reads a property list, length first, allowing only the
+// given identifiers. It returns the properties and the bytes read.
+func parseProperties(data []byte, allowed []byte) (Properties, int, error) {
+	length, n, err := utils.ParseRemainingLength(data)
+	if err != nil {
+		return nil, 0, malformedProperties("property length: %v", err)
+	}
+	if n+length > len(data) {
+		return nil, 0, malformedProperties("property length %d exceeds the packet", length)
+	}
+
+	var ps Properties
+	body := data[n : n+length]
+	for len(body) > 0 {
+		id := body[0]
+		body = body[1:]
+		if !slices.Contains(allowed, id) {
+			return nil, 0, malformedProperties("property 0x%02X is not allowed here", id)
+		}
+		// Only user properties may be repeated
+		if _, seen := ps.Get(id); seen && id != PropUserProperty {
+			return nil, 0, &er.Err{
+				Context: "Properties",
+				Message: fmt.Errorf("%w: 0x%02X", er.ErrDuplicateProperty, id),
+			}
+		}
+
+		p := Property{ID: id}
+		switch propertyTypes[id] {
+		case propByte:
+			if len(body) < 1 {
+				return nil, 0, malformedProperties("property 0x%02X is truncated", id)
+			}
+			p.Uint, body = uint32(body[0]), body[1:]
+		case propTwoByte:
+			if len(body) < 2 {
+				return nil, 0, malformedProperties("property 0x%02X is truncated", id)
+			}
+			p.Uint, body = uint32(binary.BigEndian.Uint16(body)), body[2:]
+		case propFourByte:
+			if len(body) < 4 {
+				return nil, 0, malformedProperties("property 0x%02X is truncated", id)
+			}
+			p.Uint, body = binary.BigEndian.Uint32(body), body[4:]
+		case propVarInt:
+			v, vn, err := utils.ParseRemainingLength(body)
+			if err != nil {
+				return nil, 0, malformedProperties("property 0x%02X: %v", id, err)
+			}
+			p.Uint, body = uint32(v), body[vn:]
+		case propString, propBinary:
+			if p.String, body, err = cutString(body, propertyTypes[id] == propString); err != nil {
+				return nil, 0, malformedProperties("property 0x%02X: %v", id, err)
+			}
+		case propStringPair:
+			if p.String, body, err = cutString(body, true); err != nil {
+				return nil, 0, malformedProperties("property 0x%02X: %v", id, err)
+			}
+			if p.Value, body, err = cutString(body, true); err != nil {
+				return nil, 0, malformedProperties("property 0x%02X: %v", id, err)
+			}
+		}
+		ps = append(ps, p)
+	}
+	return ps, n + length, nil
+}
+
+// cutString reads a length-prefixed string off the front of data, checking
+// it is a valid MQTT string when text is set
+func cutString(data []byte, text bool) (string, []byte, error) {
+	if text {
+		s, n, err := utils.ParseString(data)
+		if err != nil {
+			return "", nil, err
+		}
+		return s, data[n:], nil
+	}
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return "", nil, er.ErrShortBuffer
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	return string(data[2:n]), data[n:], nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+func malformedProperties(format string, args ...any) error {
+	return &er.Err{
+		Context: "Properties",
+		Message: fmt.Errorf("%w: %s", er.ErrMalformedProperties, fmt.Sprintf(format, args...)),
+	}
+}
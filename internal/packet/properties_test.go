@@ -0,0 +1,147 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	props := Properties{
+		{ID: PropSessionExpiryInterval, Uint: 3600},
+		{ID: PropReceiveMaximum, Uint: 20},
+		{ID: PropMaximumQoS, Uint: 1},
+		{ID: PropAssignedClientIdentifier, String: "auto-1"},
+		{ID: PropUserProperty, String: "region", Value: "eu"},
+		{ID: PropUserProperty, String: "region", Value: "us"},
+		{ID: PropAuthenticationData, String: "\x00\xff"},
+	}
+	raw := AppendProperties(nil, props)
+	got, n, err := parseProperties(raw, connAckProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(raw) {
+		t.Fatalf("read %d of %d bytes", n, len(raw))
+	}
+	if !reflect.DeepEqual(got, props) {
+		t.Fatalf("got %+v, want %+v", got, props)
+	}
+	if v := got.Uint(PropReceiveMaximum, 65535); v != 20 {
+		t.Fatalf("Uint(ReceiveMaximum) = %d", v)
+	}
+	if v := got.Uint(PropTopicAliasMaximum, 7); v != 7 {
+		t.Fatalf("Uint of an absent property = %d, want the default", v)
+	}
+}
+
+func TestParsePropertiesErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"length past the end", []byte{5, PropReceiveMaximum, 0, 1}, er.ErrMalformedProperties},
+		{"unterminated length", []byte{0x80}, er.ErrMalformedProperties},
+		{"not allowed in CONNECT", []byte{2, PropMaximumQoS, 1}, er.ErrMalformedProperties},
+		{"unknown identifier", []byte{2, 0x7F, 1}, er.ErrMalformedProperties},
+		{"truncated integer", []byte{3, PropSessionExpiryInterval, 0, 0}, er.ErrMalformedProperties},
+		{"truncated string", []byte{4, PropAuthenticationMethod, 0, 5, 'a'}, er.ErrMalformedProperties},
+		{"invalid UTF-8", []byte{4, PropAuthenticationMethod, 0, 1, 0xff}, er.ErrMalformedProperties},
+		{"user property without value", []byte{4, PropUserProperty, 0, 1, 'k'}, er.ErrMalformedProperties},
+		{"duplicate", []byte{6, PropReceiveMaximum, 0, 1, PropReceiveMaximum, 0, 2}, er.ErrDuplicateProperty},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseProperties(tc.raw, connectProperties)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestConnectV5(t *testing.T) {
+	var cp ConnectPacket
+	if err := cp.Parse(connectV5()); err != nil {
+		t.Fatal(err)
+	}
+	if !cp.IsMQTT5() || cp.ClientID != "sensor-v5" {
+		t.Fatalf("level %d client %q", cp.ProtocolLevel, cp.ClientID)
+	}
+	if v := cp.Properties.Uint(PropSessionExpiryInterval, 0); v != 3600 {
+		t.Fatalf("session expiry = %d", v)
+	}
+	if v := cp.WillProperties.Uint(PropWillDelayInterval, 0); v != 30 {
+		t.Fatalf("will delay = %d", v)
+	}
+	if *cp.WillTopic != "factory/line-3/status" || *cp.WillMessage != "offline" {
+		t.Fatalf("will %q %q", *cp.WillTopic, *cp.WillMessage)
+	}
+
+	// A password alone and an empty client ID without Clean Start are both
+	// allowed in MQTT 5
+	var body []byte
+	body = append(body, benchString("MQTT")...)
+	body = append(body, 5, 0x40, 0, 60, 0)
+	body = append(body, benchString("")...)
+	body = append(body, benchString("token")...)
+	cp = ConnectPacket{}
+	if err := cp.Parse(benchPacket(byte(CONNECT), body)); err != nil {
+		t.Fatal(err)
+	}
+	if cp.ClientID == "" || *cp.Password != "token" {
+		t.Fatalf("client %q password %v", cp.ClientID, cp.Password)
+	}
+
+	// The same CONNECT at level 4 has no property length and is refused
+	body[6] = 4
+	if err := (&ConnectPacket{}).Parse(benchPacket(byte(CONNECT), body)); err == nil {
+		t.Fatal("3.1.1 CONNECT with a password alone was accepted")
+	}
+}
+
+func TestDisconnectV5(t *testing.T) {
+	cases := []struct {
+		name   string
+		raw    []byte
+		reason byte
+		props  Properties
+		want   error
+	}{
+		{"empty", []byte{0xE0, 0}, ReasonSuccess, nil, nil},
+		{"reason only", []byte{0xE0, 1, ReasonDisconnectWithWill}, ReasonDisconnectWithWill, nil, nil},
+		{"properties", NewDisconnectV5(ReasonServerShuttingDown, Properties{{ID: PropReasonString, String: "bye"}}),
+			ReasonServerShuttingDown, Properties{{ID: PropReasonString, String: "bye"}}, nil},
+		{"trailing bytes", []byte{0xE0, 3, 0, 0, 0}, 0, nil, er.ErrMalformedProperties},
+		{"not allowed property", []byte{0xE0, 4, 0, 2, PropMaximumQoS, 1}, 0, nil, er.ErrMalformedProperties},
+		{"length mismatch", []byte{0xE0, 2, 0}, 0, nil, er.ErrInvalidPacketLength},
+		{"flags", []byte{0xE1, 0}, 0, nil, er.ErrInvalidFixedHeaderFlags},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var dp DisconnectPacket
+			err := dp.ParseV5(tc.raw)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			if err == nil && (dp.ReasonCode != tc.reason || !reflect.DeepEqual(dp.Properties, tc.props)) {
+				t.Fatalf("got %#x %+v", dp.ReasonCode, dp.Properties)
+			}
+		})
+	}
+}
+
+func TestNewConnAckV5(t *testing.T) {
+	got := NewConnAckV5(true, ReasonSuccess, Properties{{ID: PropAssignedClientIdentifier, String: "a"}})
+	want := []byte{0x20, 7, 0x01, ReasonSuccess, 4, PropAssignedClientIdentifier, 0, 1, 'a'}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+	if got := NewConnAckV5(false, ReasonUnsupportedProtocolVersion, nil); !bytes.Equal(got, []byte{0x20, 3, 0, 0x84, 0}) {
+		t.Fatalf("refusal = % x", got)
+	}
+}
@@ -63,6 +63,11 @@ func (p *PubackPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "PUBACK", Message: er.ErrInvalidPacketType}
 	}
 
+	// PUBACK fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{Context: "PUBACK", Message: er.ErrInvalidFixedHeaderFlags}
+	}
+
 	if raw[1] != 0x02 { // Remaining length must be 2
 		return &er.Err{Context: "PUBACK", Message: er.ErrInvalidPacketLength}
 	}
@@ -80,6 +85,11 @@ func (p *PubrecPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "PUBREC", Message: er.ErrInvalidPacketType}
 	}
 
+	// PUBREC fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{Context: "PUBREC", Message: er.ErrInvalidFixedHeaderFlags}
+	}
+
 	if raw[1] != 0x02 {
 		return &er.Err{Context: "PUBREC", Message: er.ErrInvalidPacketLength}
 	}
@@ -99,7 +109,7 @@ func (p *PubrelPacket) Parse(raw []byte) error {
 
 	// PUBREL fixed header flags must be 0010
 	if (raw[0] & 0x0F) != 0x02 {
-		return &er.Err{Context: "PUBREL", Message: er.ErrInvalidPacketType}
+		return &er.Err{Context: "PUBREL", Message: er.ErrInvalidPubrelFlags}
 	}
 
 	if raw[1] != 0x02 {
@@ -119,6 +129,11 @@ func (p *PubcompPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "PUBCOMP", Message: er.ErrInvalidPacketType}
 	}
 
+	// PUBCOMP fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{Context: "PUBCOMP", Message: er.ErrInvalidFixedHeaderFlags}
+	}
+
 	if raw[1] != 0x02 {
 		return &er.Err{Context: "PUBCOMP", Message: er.ErrInvalidPacketLength}
 	}
@@ -27,10 +27,13 @@ type PublishPacket struct {
 	PacketID *uint16 // nil for QoS 0, pointer to ID for QoS 1/2
 
 	// Payload
-	Payload []byte
+	Payload []byte // Aliases Raw after Parse; copy it if Raw is reused
 
 	// Raw
 	Raw []byte
+
+	// packetID backs PacketID after Parse so it needs no separate allocation
+	packetID uint16
 }
 
 func (pp *PublishPacket) Parse(raw []byte) error {
@@ -139,7 +142,8 @@ func (pp *PublishPacket) Parse(raw []byte) error {
 				Message: er.ErrInvalidPacketID,
 			}
 		}
-		pp.PacketID = &packetID
+		pp.packetID = packetID
+		pp.PacketID = &pp.packetID
 		offset += 2
 	}
 
@@ -155,8 +159,9 @@ func (pp *PublishPacket) Parse(raw []byte) error {
 			}
 		}
 
-		pp.Payload = make([]byte, payloadLen)
-		copy(pp.Payload, raw[offset:])
+		// Zero-copy: the payload shares the packet buffer, which is
+		// allocated per packet by the reader and never reused
+		pp.Payload = raw[offset:]
 	}
 
 	return nil
@@ -167,9 +172,19 @@ func (pp *PublishPacket) Encode() []byte {
 	if pp == nil {
 		return nil
 	}
+	return pp.encode(len(pp.Payload), true)
+}
 
-	var packet []byte
+// EncodeHeader encodes the fixed and variable header of a PUBLISH whose
+// payload of payloadLen bytes is written separately, e.g. streamed from disk
+func (pp *PublishPacket) EncodeHeader(payloadLen int) []byte {
+	if pp == nil {
+		return nil
+	}
+	return pp.encode(payloadLen, false)
+}
 
+func (pp *PublishPacket) encode(payloadLen int, withPayload bool) []byte {
 	// Fixed Header: Build the first byte
 	firstByte := byte(PUBLISH)
 	if pp.DUP {
@@ -193,30 +208,30 @@ func (pp *PublishPacket) Encode() []byte {
 	}
 
 	// Payload
-	remainingLength += len(pp.Payload)
-
-	// Encode remaining length (supports up to 4 bytes)
-	remainingLengthBytes := utils.EncodeRemainingLength(remainingLength)
+	remainingLength += payloadLen
 
-	// Build the packet
+	// Build the packet in a single allocation sized for the whole frame
+	frameSize := utils.CalculateFixedHeaderSize(remainingLength) + remainingLength
+	if !withPayload {
+		frameSize -= payloadLen
+	}
+	packet := make([]byte, 0, frameSize)
 	packet = append(packet, firstByte)
-	packet = append(packet, remainingLengthBytes...)
+	packet = utils.AppendRemainingLength(packet, remainingLength)
 
 	// Variable Header: Topic
-	topicLengthBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(topicLengthBytes, uint16(len(pp.Topic)))
-	packet = append(packet, topicLengthBytes...)
-	packet = append(packet, []byte(pp.Topic)...)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(pp.Topic)))
+	packet = append(packet, pp.Topic...)
 
 	// Variable Header: Packet ID (for QoS 1 and 2)
 	if pp.QoS > QoSAtMostOnce && pp.PacketID != nil {
-		packetIDBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(packetIDBytes, *pp.PacketID)
-		packet = append(packet, packetIDBytes...)
+		packet = binary.BigEndian.AppendUint16(packet, *pp.PacketID)
 	}
 
 	// Payload
-	packet = append(packet, pp.Payload...)
+	if withPayload {
+		packet = append(packet, pp.Payload...)
+	}
 
 	return packet
 }
@@ -78,6 +78,11 @@ func (p *SubackPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "SUBACK", Message: er.ErrInvalidPacketType}
 	}
 
+	// SUBACK fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{Context: "SUBACK", Message: er.ErrInvalidFixedHeaderFlags}
+	}
+
 	remainingLength, offset, err := utils.ParseRemainingLength(raw[1:])
 	if err != nil {
 		return err
@@ -90,6 +95,11 @@ func (p *SubackPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "SUBACK", Message: er.ErrInvalidPacketLength}
 	}
 
+	// Packet ID plus at least one return code
+	if remainingLength < 3 {
+		return &er.Err{Context: "SUBACK", Message: er.ErrInvalidPacketLength}
+	}
+
 	// Adjust index based on the actual remaining length field size
 	packetIDIndex := 1 + offset
 	p.PacketID = binary.BigEndian.Uint16(raw[packetIDIndex : packetIDIndex+2])
@@ -94,7 +94,8 @@ func (sp *SubscribePacket) Parse(raw []byte) error {
 	offset += 2
 
 	// Parse Payload (Topic Filters)
-	sp.Filters = make([]SubscribeFilter, 0)
+	// Most SUBSCRIBE packets carry a single filter
+	sp.Filters = make([]SubscribeFilter, 0, 1)
 
 	for offset < len(raw) {
 		// Parse topic filter length
@@ -212,11 +213,12 @@ func validateTopicFilter(topicFilter string) error {
 }
 
 func validateWildcards(topicFilter string) error {
-	runes := []rune(topicFilter)
-	length := len(runes)
+	// Byte indexing is safe: '#', '+' and '/' are ASCII and never appear
+	// inside a multi-byte UTF-8 sequence
+	length := len(topicFilter)
 
-	for i, r := range runes {
-		switch r {
+	for i := 0; i < length; i++ {
+		switch topicFilter[i] {
 		case '#':
 			// Multi-level wildcard rules:
 			// 1. Must be the last character
@@ -227,7 +229,7 @@ func validateWildcards(topicFilter string) error {
 					Message: er.ErrMultiLevelWildcardNotLast,
 				}
 			}
-			if i > 0 && runes[i-1] != '/' {
+			if i > 0 && topicFilter[i-1] != '/' {
 				return &er.Err{
 					Context: "Subscribe, Topic Filter Wildcard",
 					Message: er.ErrMultiLevelWildcardNotAlone,
@@ -238,13 +240,13 @@ func validateWildcards(topicFilter string) error {
 			// Single-level wildcard rules:
 			// 1. Must be between '/' or at start/end
 			// 2. Cannot be adjacent to non-'/' characters
-			if i > 0 && runes[i-1] != '/' {
+			if i > 0 && topicFilter[i-1] != '/' {
 				return &er.Err{
 					Context: "Subscribe, Topic Filter Wildcard",
 					Message: er.ErrSingleLevelWildcardNotAlone,
 				}
 			}
-			if i < length-1 && runes[i+1] != '/' {
+			if i < length-1 && topicFilter[i+1] != '/' {
 				return &er.Err{
 					Context: "Subscribe, Topic Filter Wildcard",
 					Message: er.ErrSingleLevelWildcardNotAlone,
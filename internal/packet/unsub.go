@@ -27,6 +27,11 @@ func (p *UnsubackPacket) Parse(raw []byte) error {
 		return &er.Err{Context: "UNSUBACK", Message: er.ErrInvalidPacketType}
 	}
 
+	// UNSUBACK fixed header flags must be 0000
+	if (raw[0] & 0x0F) != 0x00 {
+		return &er.Err{Context: "UNSUBACK", Message: er.ErrInvalidFixedHeaderFlags}
+	}
+
 	if raw[1] != 0x02 { // Remaining length must be 2
 		return &er.Err{Context: "UNSUBACK", Message: er.ErrInvalidPacketLength}
 	}
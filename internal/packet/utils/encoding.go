@@ -2,6 +2,8 @@ package utils
 
 import (
 	"encoding/binary"
+	"strings"
+	"sync/atomic"
 	"unicode/utf8"
 
 	"github.com/pyr33x/goqtt/pkg/er"
@@ -10,11 +12,17 @@ import (
 // EncodeRemainingLength encodes the remaining length field according to MQTT specification
 // Supports up to 4 bytes (max value: 268,435,455)
 func EncodeRemainingLength(length int) []byte {
+	return AppendRemainingLength(make([]byte, 0, 4), length)
+}
+
+// AppendRemainingLength appends the encoded remaining length field to dst
+func AppendRemainingLength(dst []byte, length int) []byte {
 	if length < 0 {
-		return []byte{0}
+		return append(dst, 0)
 	}
 
-	var encoded []byte
+	encoded := dst
+	start := len(dst)
 
 	for {
 		encodedByte := byte(length % 128)
@@ -31,7 +39,7 @@ func EncodeRemainingLength(length int) []byte {
 		}
 
 		// Prevent infinite loop for values that are too large
-		if len(encoded) >= 4 {
+		if len(encoded)-start >= 4 {
 			break
 		}
 	}
@@ -103,16 +111,32 @@ func ParseString(data []byte) (string, int, error) {
 	strBytes := data[2 : 2+length]
 	str := string(strBytes)
 
-	if !utf8.ValidString(str) {
-		return "", 0, &er.Err{
-			Context: "ParseString",
-			Message: er.ErrInvalidUTF8String,
-		}
+	if err := ValidateString(str); err != nil {
+		return "", 0, err
 	}
 
 	return str, int(2 + length), nil
 }
 
+// ValidateString checks the rules every MQTT UTF-8 encoded string must
+// follow: well-formed UTF-8, which excludes the UTF-16 surrogates
+// U+D800..U+DFFF [MQTT-1.5.3-1], and no U+0000 [MQTT-1.5.3-2]
+func ValidateString(s string) error {
+	if !utf8.ValidString(s) {
+		return &er.Err{
+			Context: "ValidateString",
+			Message: er.ErrInvalidUTF8String,
+		}
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return &er.Err{
+			Context: "ValidateString",
+			Message: er.ErrNullCharacterInString,
+		}
+	}
+	return nil
+}
+
 // ValidateTopicFilter validates a topic filter according to MQTT 3.1.1 rules
 func ValidateTopicFilter(topicFilter string) error {
 	if topicFilter == "" {
@@ -140,8 +164,8 @@ func ValidateTopicFilter(topicFilter string) error {
 		}
 	}
 
-	// Check for empty levels (consecutive slashes)
-	if hasEmptyLevels(topicFilter) {
+	// Check for empty levels (consecutive slashes) in strict mode
+	if strictTopicLevels.Load() && hasEmptyLevels(topicFilter) {
 		return &er.Err{
 			Context: "ValidateTopicFilter",
 			Message: er.ErrEmptyTopicLevel,
@@ -197,8 +221,8 @@ func ValidateTopicName(topicName string) error {
 		}
 	}
 
-	// Check for empty levels
-	if hasEmptyLevels(topicName) {
+	// Check for empty levels in strict mode
+	if strictTopicLevels.Load() && hasEmptyLevels(topicName) {
 		return &er.Err{
 			Context: "ValidateTopicName",
 			Message: er.ErrEmptyTopicLevel,
@@ -208,6 +232,15 @@ func ValidateTopicName(topicName string) error {
 	return nil
 }
 
+// strictTopicLevels makes topic names and filters with empty levels invalid
+var strictTopicLevels atomic.Bool
+
+// SetStrictTopicLevels rejects topics with empty levels such as a//b or a/.
+// MQTT 3.1.1 allows empty levels, so they are accepted by default.
+func SetStrictTopicLevels(strict bool) {
+	strictTopicLevels.Store(strict)
+}
+
 // hasEmptyLevels checks if the topic has empty levels (consecutive slashes)
 func hasEmptyLevels(topic string) bool {
 	// Check for consecutive slashes
@@ -237,9 +270,18 @@ func containsWildcards(topic string) bool {
 
 // validateWildcards validates wildcard usage in topic filters
 func validateWildcards(topicFilter string) error {
-	levels := splitTopicLevels(topicFilter)
+	// Walk the levels in place rather than splitting into a slice
+	start := 0
+	for {
+		end := strings.IndexByte(topicFilter[start:], '/')
+		last := end < 0
+		if last {
+			end = len(topicFilter)
+		} else {
+			end += start
+		}
+		level := topicFilter[start:end]
 
-	for i, level := range levels {
 		// Check single-level wildcard rules
 		if containsSingleLevelWildcard(level) {
 			if level != "+" {
@@ -258,38 +300,21 @@ func validateWildcards(topicFilter string) error {
 					Message: er.ErrInvalidMultiLevelWildcard,
 				}
 			}
-			if i != len(levels)-1 {
+			if !last {
 				return &er.Err{
 					Context: "ValidateTopicFilter",
 					Message: er.ErrMultiLevelWildcardNotLast,
 				}
 			}
 		}
-	}
-
-	return nil
-}
 
-// splitTopicLevels splits a topic into levels
-func splitTopicLevels(topic string) []string {
-	if topic == "" {
-		return []string{}
-	}
-
-	var levels []string
-	start := 0
-
-	for i, char := range topic {
-		if char == '/' {
-			levels = append(levels, topic[start:i])
-			start = i + 1
+		if last {
+			break
 		}
+		start = end + 1
 	}
 
-	// Add the last level
-	levels = append(levels, topic[start:])
-
-	return levels
+	return nil
 }
 
 // containsSingleLevelWildcard checks if a level contains the + wildcard
@@ -341,7 +366,16 @@ func ParsePacketID(data []byte) (uint16, error) {
 
 // CalculateFixedHeaderSize calculates the size of the fixed header
 func CalculateFixedHeaderSize(remainingLength int) int {
-	return 1 + len(EncodeRemainingLength(remainingLength))
+	switch {
+	case remainingLength < 128:
+		return 2
+	case remainingLength < 16384:
+		return 3
+	case remainingLength < 2097152:
+		return 4
+	default:
+		return 5
+	}
 }
 
 // IsValidPacketID checks if a packet ID is valid (non-zero)
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// QoS2 keeps the QoS 2 messages persistent sessions have published but not
+// released yet in the inbound_qos2 table, so a restart between PUBLISH and
+// PUBREL doesn't lose them. It is a broker.QoS2Persister.
+type QoS2 struct {
+	db *sql.DB
+}
+
+// NewQoS2 returns an inbound QoS 2 store backed by db
+func NewQoS2(db *sql.DB) *QoS2 {
+	return &QoS2{db: db}
+}
+
+// SaveQoS2 stores a message awaiting PUBREL, replacing one with the same packet ID
+func (q *QoS2) SaveQoS2(clientID string, packetID uint16, topic string, payload []byte, retain bool) error {
+	if payload == nil {
+		payload = []byte{}
+	}
+	_, err := q.db.Exec(
+		`INSERT INTO inbound_qos2 (client_id, packet_id, topic, payload, retain) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(client_id, packet_id) DO UPDATE SET topic = excluded.topic, payload = excluded.payload, retain = excluded.retain`,
+		clientID, int(packetID), topic, payload, retain)
+	return err
+}
+
+// DeleteQoS2 removes one message of a client
+func (q *QoS2) DeleteQoS2(clientID string, packetID uint16) error {
+	_, err := q.db.Exec("DELETE FROM inbound_qos2 WHERE client_id = ? AND packet_id = ?", clientID, int(packetID))
+	return err
+}
+
+// DeleteQoS2s removes every message of a client
+func (q *QoS2) DeleteQoS2s(clientID string) error {
+	_, err := q.db.Exec("DELETE FROM inbound_qos2 WHERE client_id = ?", clientID)
+	return err
+}
+
+// Load calls restore with every stored message
+func (q *QoS2) Load(restore func(clientID string, packetID uint16, topic string, payload []byte, retain bool)) error {
+	rows, err := q.db.Query("SELECT client_id, packet_id, topic, payload, retain FROM inbound_qos2")
+	if err != nil {
+		return fmt.Errorf("failed to load QoS 2 messages: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var clientID, topic string
+		var packetID int
+		var payload []byte
+		var retain bool
+		if err := rows.Scan(&clientID, &packetID, &topic, &payload, &retain); err != nil {
+			return fmt.Errorf("failed to load QoS 2 messages: %w", err)
+		}
+		restore(clientID, uint16(packetID), topic, payload, retain)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// Retained keeps retained messages in the retained_messages table, so they
+// survive broker restarts. It is a broker.RetainedPersister.
+type Retained struct {
+	db *sql.DB
+}
+
+// NewRetained returns a retained message store backed by db
+func NewRetained(db *sql.DB) *Retained {
+	return &Retained{db: db}
+}
+
+// SaveRetained stores payload as the retained message for topic
+func (r *Retained) SaveRetained(topic string, payload []byte, qos packet.QoSLevel) error {
+	_, err := r.db.Exec(
+		`INSERT INTO retained_messages (topic, payload, qos, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(topic) DO UPDATE SET payload = excluded.payload, qos = excluded.qos, updated_at = excluded.updated_at`,
+		topic, payload, int(qos), time.Now().Unix())
+	return err
+}
+
+// DeleteRetained removes the retained message for topic, if any
+func (r *Retained) DeleteRetained(topic string) error {
+	_, err := r.db.Exec("DELETE FROM retained_messages WHERE topic = ?", topic)
+	return err
+}
+
+// Load calls restore with every stored retained message
+func (r *Retained) Load(restore func(topic string, payload []byte, qos packet.QoSLevel)) error {
+	rows, err := r.db.Query("SELECT topic, payload, qos FROM retained_messages")
+	if err != nil {
+		return fmt.Errorf("failed to load retained messages: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var topic string
+		var payload []byte
+		var qos int
+		if err := rows.Scan(&topic, &payload, &qos); err != nil {
+			return fmt.Errorf("failed to load retained messages: %w", err)
+		}
+		restore(topic, payload, packet.QoSLevel(qos))
+	}
+	return rows.Err()
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SchemaVersion is bumped whenever the schema below changes
+const SchemaVersion = 5
+
+const schema = `
+CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	secret TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS discovery (
+	topic TEXT PRIMARY KEY,
+	payload BLOB NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS retained_messages (
+	topic TEXT PRIMARY KEY,
+	payload BLOB NOT NULL,
+	qos INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS subscriptions (
+	client_id TEXT NOT NULL,
+	filter TEXT NOT NULL,
+	qos INTEGER NOT NULL,
+	PRIMARY KEY (client_id, filter)
+);
+CREATE TABLE IF NOT EXISTS inbound_qos2 (
+	client_id TEXT NOT NULL,
+	packet_id INTEGER NOT NULL,
+	topic TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	retain INTEGER NOT NULL,
+	PRIMARY KEY (client_id, packet_id)
+);`
+
+// InitSchema creates missing tables and records the schema version
+func InitSchema(db *sql.DB) error {
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion))
+	return err
+}
+
+// Version returns the schema version recorded in the database
+func Version(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pyr33x/goqtt/internal/packet"
+)
+
+// Subscriptions keeps the subscriptions of persistent sessions in the
+// subscriptions table, so they survive broker restarts. It is a
+// broker.SubscriptionPersister.
+type Subscriptions struct {
+	db *sql.DB
+}
+
+// NewSubscriptions returns a subscription store backed by db
+func NewSubscriptions(db *sql.DB) *Subscriptions {
+	return &Subscriptions{db: db}
+}
+
+// SaveSubscription stores a subscription, replacing one to the same filter
+func (s *Subscriptions) SaveSubscription(clientID, filter string, qos packet.QoSLevel) error {
+	_, err := s.db.Exec(
+		`INSERT INTO subscriptions (client_id, filter, qos) VALUES (?, ?, ?)
+		ON CONFLICT(client_id, filter) DO UPDATE SET qos = excluded.qos`,
+		clientID, filter, int(qos))
+	return err
+}
+
+// DeleteSubscription removes one subscription of a client
+func (s *Subscriptions) DeleteSubscription(clientID, filter string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE client_id = ? AND filter = ?", clientID, filter)
+	return err
+}
+
+// DeleteSubscriptions removes every subscription of a client
+func (s *Subscriptions) DeleteSubscriptions(clientID string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE client_id = ?", clientID)
+	return err
+}
+
+// Load calls restore with every stored subscription
+func (s *Subscriptions) Load(restore func(clientID, filter string, qos packet.QoSLevel)) error {
+	rows, err := s.db.Query("SELECT client_id, filter, qos FROM subscriptions")
+	if err != nil {
+		return fmt.Errorf("failed to load subscriptions: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var clientID, filter string
+		var qos int
+		if err := rows.Scan(&clientID, &filter, &qos); err != nil {
+			return fmt.Errorf("failed to load subscriptions: %w", err)
+		}
+		restore(clientID, filter, packet.QoSLevel(qos))
+	}
+	return rows.Err()
+}
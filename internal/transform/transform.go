@@ -0,0 +1,257 @@
+// Package transform rewrites or filters messages in the publish pipeline
+// according to rules loaded from config. Rules are a fixed set of steps
+// rather than arbitrary code, so a bad rule can't hang or crash the broker.
+// They stand in for a WASM or Starlark scripting hook, whose runtimes aren't
+// dependencies of the module.
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// Step operations
+const (
+	OpScale  = "scale"  // Field = Field*Factor + Offset, for unit conversion
+	OpRedact = "redact" // Remove Fields
+	OpRename = "rename" // Move Field to To
+	OpSet    = "set"    // Field = Value
+	OpDrop   = "drop"   // Drop the message, or only when Field equals Value
+	OpWrap   = "wrap"   // Turn a plain payload into {"<Field>": payload}
+)
+
+// Step is one operation of a rule. Field names may use dots to reach into
+// nested objects, as in "reading.celsius".
+type Step struct {
+	Op     string
+	Field  string
+	Fields []string
+	To     string
+	Factor float64
+	Offset float64
+	Value  any
+}
+
+// Rule applies its steps, in order, to messages whose topic matches Filter
+type Rule struct {
+	Filter string
+	Steps  []Step
+}
+
+// Pipeline runs the configured rules on every published message
+type Pipeline struct {
+	rules []Rule
+}
+
+// New validates rules and returns a pipeline running them
+func New(rules []Rule) (*Pipeline, error) {
+	for i, rule := range rules {
+		if err := utils.ValidateTopicFilter(rule.Filter); err != nil {
+			return nil, invalid(i, fmt.Sprintf("filter %q: %v", rule.Filter, err))
+		}
+		if len(rule.Steps) == 0 {
+			return nil, invalid(i, "no steps")
+		}
+		for _, step := range rule.Steps {
+			if err := step.validate(); err != nil {
+				return nil, invalid(i, err.Error())
+			}
+		}
+	}
+	return &Pipeline{rules: rules}, nil
+}
+
+// Intercept is a broker.Interceptor. Every matching rule runs, in config
+// order, each seeing the output of the one before. Field steps only apply
+// to JSON object payloads; other payloads pass through them unchanged.
+// Messages spilled to disk are never transformed.
+func (p *Pipeline) Intercept(clientID string, msg *broker.Message) error {
+	if msg.Spilled() {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if !broker.TopicMatches(rule.Filter, msg.Topic) {
+			continue
+		}
+		payload, err := rule.apply(msg.Payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+	}
+	return nil
+}
+
+// apply runs the rule's steps on payload
+func (r Rule) apply(payload []byte) ([]byte, error) {
+	var doc map[string]any
+	isObject := json.Unmarshal(payload, &doc) == nil && doc != nil
+	changed := false
+
+	for _, step := range r.Steps {
+		switch step.Op {
+		case OpDrop:
+			if step.Field == "" {
+				return nil, er.ErrMessageDropped
+			}
+			if isObject {
+				if value, ok := lookup(doc, step.Field); ok && equal(value, step.Value) {
+					return nil, er.ErrMessageDropped
+				}
+			}
+		case OpWrap:
+			if isObject {
+				continue
+			}
+			doc = map[string]any{step.Field: plainValue(payload)}
+			isObject, changed = true, true
+		default:
+			if isObject && step.applyField(doc) {
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return payload, nil
+	}
+	return json.Marshal(doc)
+}
+
+// applyField runs a field step on doc and reports whether it changed it
+func (s Step) applyField(doc map[string]any) bool {
+	switch s.Op {
+	case OpScale:
+		value, ok := lookup(doc, s.Field)
+		if !ok {
+			return false
+		}
+		n, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		return store(doc, s.Field, n*s.Factor+s.Offset)
+	case OpRedact:
+		changed := false
+		for _, field := range s.Fields {
+			if remove(doc, field) {
+				changed = true
+			}
+		}
+		return changed
+	case OpRename:
+		value, ok := lookup(doc, s.Field)
+		if !ok {
+			return false
+		}
+		remove(doc, s.Field)
+		return store(doc, s.To, value)
+	case OpSet:
+		return store(doc, s.Field, s.Value)
+	}
+	return false
+}
+
+func (s Step) validate() error {
+	switch s.Op {
+	case OpScale:
+		if s.Field == "" || s.Factor == 0 {
+			return fmt.Errorf("%s needs a field and a non-zero factor", s.Op)
+		}
+	case OpRedact:
+		if len(s.Fields) == 0 {
+			return fmt.Errorf("%s needs fields", s.Op)
+		}
+	case OpRename:
+		if s.Field == "" || s.To == "" {
+			return fmt.Errorf("%s needs a field and to", s.Op)
+		}
+	case OpSet, OpWrap:
+		if s.Field == "" {
+			return fmt.Errorf("%s needs a field", s.Op)
+		}
+	case OpDrop:
+	default:
+		return fmt.Errorf("unknown op %q", s.Op)
+	}
+	return nil
+}
+
+func invalid(rule int, reason string) error {
+	return &er.Err{
+		Context: "Transform, rule " + strconv.Itoa(rule+1),
+		Message: fmt.Errorf("%w: %s", er.ErrInvalidTransform, reason),
+	}
+}
+
+// lookup returns the value at a dotted path in doc
+func lookup(doc map[string]any, path string) (any, bool) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		doc = next
+	}
+	value, ok := doc[keys[len(keys)-1]]
+	return value, ok
+}
+
+// store sets the value at a dotted path in doc, creating missing objects.
+// It reports false when the path runs through a value that isn't an object.
+func store(doc map[string]any, path string, value any) bool {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key]
+		if !ok {
+			next = make(map[string]any)
+			doc[key] = next
+		}
+		if doc, ok = next.(map[string]any); !ok {
+			return false
+		}
+	}
+	doc[keys[len(keys)-1]] = value
+	return true
+}
+
+// remove deletes the value at a dotted path in doc
+func remove(doc map[string]any, path string) bool {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(map[string]any)
+		if !ok {
+			return false
+		}
+		doc = next
+	}
+	last := keys[len(keys)-1]
+	if _, ok := doc[last]; !ok {
+		return false
+	}
+	delete(doc, last)
+	return true
+}
+
+// equal compares a decoded JSON value with a config value, which YAML may
+// have decoded as an int where JSON gives a float64
+func equal(value, want any) bool {
+	return fmt.Sprint(value) == fmt.Sprint(want)
+}
+
+// plainValue decodes a non-object payload as a JSON scalar, such as the
+// bare "21.5" many sensors publish, or keeps it as a string
+func plainValue(payload []byte) any {
+	var value any
+	if err := json.Unmarshal(payload, &value); err == nil {
+		return value
+	}
+	return string(payload)
+}
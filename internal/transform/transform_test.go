@@ -0,0 +1,158 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// run applies one rule matching every topic to payload
+func run(t *testing.T, payload string, steps ...Step) (string, error) {
+	t.Helper()
+	p, err := New([]Rule{{Filter: "#", Steps: steps}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := broker.NewMessage("a/b", []byte(payload), false)
+	err = p.Intercept("c", msg)
+	return string(msg.Payload), err
+}
+
+// sameJSON compares JSON documents regardless of key order
+func sameJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("output %q is not JSON: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestOps(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		steps   []Step
+		want    string
+	}{
+		{"scale", `{"value":20}`, []Step{{Op: OpScale, Field: "value", Factor: 1.8, Offset: 32}}, `{"value":68}`},
+		{"scale nested", `{"reading":{"celsius":100}}`, []Step{{Op: OpScale, Field: "reading.celsius", Factor: 1.8, Offset: 32}}, `{"reading":{"celsius":212}}`},
+		{"scale skips non-numbers", `{"value":"hot"}`, []Step{{Op: OpScale, Field: "value", Factor: 2}}, `{"value":"hot"}`},
+		{"redact", `{"a":1,"serial":"x","owner":{"email":"e","name":"n"}}`, []Step{{Op: OpRedact, Fields: []string{"serial", "owner.email", "missing.field"}}}, `{"a":1,"owner":{"name":"n"}}`},
+		{"rename", `{"value":1}`, []Step{{Op: OpRename, Field: "value", To: "celsius"}}, `{"celsius":1}`},
+		{"rename into a new object", `{"temp":{"c":1},"x":2}`, []Step{{Op: OpRename, Field: "temp.c", To: "reading.celsius"}}, `{"temp":{},"reading":{"celsius":1},"x":2}`},
+		{"rename missing", `{"x":2}`, []Step{{Op: OpRename, Field: "value", To: "celsius"}}, `{"x":2}`},
+		{"set", `{"x":1}`, []Step{{Op: OpSet, Field: "source", Value: "legacy"}}, `{"x":1,"source":"legacy"}`},
+		{"set nested", `{"meta":{"a":1}}`, []Step{{Op: OpSet, Field: "meta.site.id", Value: 7}}, `{"meta":{"a":1,"site":{"id":7}}}`},
+		{"set through a non-object", `{"meta":5}`, []Step{{Op: OpSet, Field: "meta.site", Value: 7}}, `{"meta":5}`},
+		{"wrap number", `21.5`, []Step{{Op: OpWrap, Field: "value"}}, `{"value":21.5}`},
+		{"wrap text", `on`, []Step{{Op: OpWrap, Field: "state"}}, `{"state":"on"}`},
+		{"wrap leaves objects", `{"value":1}`, []Step{{Op: OpWrap, Field: "other"}}, `{"value":1}`},
+		{"wrap then scale", `20`, []Step{{Op: OpWrap, Field: "value"}, {Op: OpScale, Field: "value", Factor: 2}}, `{"value":40}`},
+		{"drop when not matching", `{"level":"info"}`, []Step{{Op: OpDrop, Field: "level", Value: "trace"}}, `{"level":"info"}`},
+		{"drop on a nested field when not matching", `{"log":{"level":2}}`, []Step{{Op: OpDrop, Field: "log.level", Value: 1}}, `{"log":{"level":2}}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := run(t, tc.payload, tc.steps...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameJSON(t, got, tc.want)
+		})
+	}
+}
+
+func TestDrop(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		step    Step
+	}{
+		{"always", `not json`, Step{Op: OpDrop}},
+		{"field equals", `{"level":"trace"}`, Step{Op: OpDrop, Field: "level", Value: "trace"}},
+		{"nested field equals", `{"log":{"level":1}}`, Step{Op: OpDrop, Field: "log.level", Value: 1}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := run(t, tc.payload, tc.step); !errors.Is(err, er.ErrMessageDropped) {
+				t.Fatalf("err = %v, want ErrMessageDropped", err)
+			}
+		})
+	}
+}
+
+// Field steps leave payloads that aren't JSON objects as they are
+func TestNonObjectPayloads(t *testing.T) {
+	for _, payload := range []string{`21.5`, `[1,2]`, `null`, `not json`, ``} {
+		got, err := run(t, payload, Step{Op: OpSet, Field: "x", Value: 1}, Step{Op: OpRedact, Fields: []string{"x"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != payload {
+			t.Fatalf("%q became %q", payload, got)
+		}
+	}
+}
+
+// Rules run in order on matching topics only, each seeing the previous output
+func TestRulesByTopic(t *testing.T) {
+	p, err := New([]Rule{
+		{Filter: "sensors/+/temp", Steps: []Step{{Op: OpScale, Field: "value", Factor: 2}}},
+		{Filter: "sensors/#", Steps: []Step{{Op: OpRename, Field: "value", To: "v"}}},
+		{Filter: "other/#", Steps: []Step{{Op: OpDrop}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := broker.NewMessage("sensors/1/temp", []byte(`{"value":3}`), false)
+	if err := p.Intercept("c", msg); err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, string(msg.Payload), `{"v":6}`)
+
+	msg = broker.NewMessage("sensors/1/humidity", []byte(`{"value":3}`), false)
+	if err := p.Intercept("c", msg); err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, string(msg.Payload), `{"v":3}`)
+
+	msg = broker.NewMessage("elsewhere", []byte(`{"value":3}`), false)
+	if err := p.Intercept("c", msg); err != nil || string(msg.Payload) != `{"value":3}` {
+		t.Fatalf("unmatched topic: %q, %v", msg.Payload, err)
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	cases := []struct {
+		name string
+		rule Rule
+	}{
+		{"bad filter", Rule{Filter: "a/#/b", Steps: []Step{{Op: OpDrop}}}},
+		{"no steps", Rule{Filter: "#"}},
+		{"unknown op", Rule{Filter: "#", Steps: []Step{{Op: "script"}}}},
+		{"scale without factor", Rule{Filter: "#", Steps: []Step{{Op: OpScale, Field: "v"}}}},
+		{"scale without field", Rule{Filter: "#", Steps: []Step{{Op: OpScale, Factor: 2}}}},
+		{"redact without fields", Rule{Filter: "#", Steps: []Step{{Op: OpRedact}}}},
+		{"rename without to", Rule{Filter: "#", Steps: []Step{{Op: OpRename, Field: "v"}}}},
+		{"set without field", Rule{Filter: "#", Steps: []Step{{Op: OpSet, Value: 1}}}},
+		{"wrap without field", Rule{Filter: "#", Steps: []Step{{Op: OpWrap}}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New([]Rule{tc.rule}); !errors.Is(err, er.ErrInvalidTransform) {
+				t.Fatalf("err = %v, want ErrInvalidTransform", err)
+			}
+		})
+	}
+}
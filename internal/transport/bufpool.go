@@ -0,0 +1,39 @@
+package transport
+
+import "sync"
+
+// bufferClasses are the capacities of the pooled packet buffers. Larger
+// packets get a dedicated allocation that is left to the GC.
+var bufferClasses = [...]int{64, 256, 1024, 4096, 16384, 65536}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+// getBuffer returns a buffer with capacity for at least n bytes. The caller
+// owns it until it is handed back with putBuffer.
+func getBuffer(n int) *[]byte {
+	for i, size := range bufferClasses {
+		if n > size {
+			continue
+		}
+		if buf, ok := bufferPools[i].Get().(*[]byte); ok {
+			return buf
+		}
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	buf := make([]byte, n)
+	return &buf
+}
+
+// putBuffer returns a buffer to its pool. Nothing may reference the buffer
+// afterwards, including slices taken from it during parsing.
+func putBuffer(buf *[]byte) {
+	for i, size := range bufferClasses {
+		if cap(*buf) == size {
+			*buf = (*buf)[:size]
+			bufferPools[i].Put(buf)
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+)
+
+// tlsHandshakeRecord is the first byte of a TLS ClientHello [RFC 8446 5.1].
+// MQTT has no packet type 1 with reserved flags 0x6, and HTTP requests
+// start with a method name, so one byte tells the three apart.
+const tlsHandshakeRecord = 0x16
+
+// SetProtocolDetection makes the TCP listener also serve TLS, and WebSocket
+// upgrades over plain or TLS connections, told apart by their first bytes.
+// They use the settings given to SetTLS and SetWebSocket, whose own
+// listeners keep serving as well. It must be called before Start.
+func (srv *TCPServer) SetProtocolDetection(enabled bool) {
+	srv.detectProtocols = enabled
+}
+
+// detect reads the first byte of conn to tell MQTT, TLS and HTTP apart.
+// It returns the connection to serve as MQTT, or nil once conn was handed
+// to the WebSocket server or closed.
+func (srv *TCPServer) detect(conn net.Conn) net.Conn {
+	if srv.connectTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(srv.connectTimeout))
+	}
+	first, conn, err := peek(conn)
+	if err == nil && first == tlsHandshakeRecord {
+		config := srv.tlsConfig
+		if config == nil {
+			config = srv.wsTLSConfig
+		}
+		if config == nil {
+			srv.logger.Warn("TLS connection refused, no certificate is configured",
+				logger.String("remote_addr", conn.RemoteAddr().String()))
+			_ = conn.Close()
+			return nil
+		}
+		// Reading the first byte of the plaintext completes the handshake
+		first, conn, err = peek(tls.Server(conn, config))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if first == 'G' && srv.wsHandoff != nil {
+		if !srv.wsHandoff.hand(conn) {
+			_ = conn.Close()
+		}
+		return nil
+	}
+	return conn
+}
+
+// peekedConn is a connection whose first bytes were read to detect its
+// protocol. Reads return them before the rest of the stream.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// peek returns the first byte of conn and a connection that still reads it
+func peek(conn net.Conn) (byte, net.Conn, error) {
+	// Reads larger than the buffer bypass it once the peeked byte is consumed
+	reader := bufio.NewReaderSize(conn, 16)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return 0, conn, err
+	}
+	return first[0], &peekedConn{Conn: conn, reader: reader}, nil
+}
+
+// handoffListener passes connections detected as HTTP on the TCP listener
+// to the WebSocket server
+type handoffListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newHandoffListener(addr net.Addr) *handoffListener {
+	return &handoffListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// hand passes conn to the server, and reports false if it has stopped
+func (l *handoffListener) hand(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handoffListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *handoffListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/logger"
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+)
+
+// closeFlushTimeout bounds how long closing a connection waits to flush
+// packets still queued for a client that stopped reading
+const closeFlushTimeout = time.Second
+
+// disconnectReason records why a connection was closed
+type disconnectReason int
+
+const (
+	reasonNone             disconnectReason = iota // The connection stays open
+	reasonConnectionLost                           // EOF, read or write error
+	reasonClientDisconnect                         // The client sent DISCONNECT
+	reasonProtocolError                            // Malformed or unexpected packet
+	reasonConnectRejected                          // CONNECT refused with a CONNACK error code
+	reasonOverloaded                               // Publish refused over a resource limit
+	reasonRateLimited                              // Publish over a rate limit with the disconnect policy
+	reasonSessionLost                              // The session was expired or taken over
+	reasonQoSNotSupported                          // Publish above the broker's maximum QoS
+	reasonSlowConsumer                             // A write timed out on a full TCP window
+	reasonTimeout                                  // No CONNECT in time, or keep alive expired
+	reasonShutdown                                 // Closed by Drain
+	reasonServerError                              // Internal failure
+	numDisconnectReasons
+)
+
+func (r disconnectReason) String() string {
+	switch r {
+	case reasonConnectionLost:
+		return "connection_lost"
+	case reasonClientDisconnect:
+		return "client_disconnect"
+	case reasonProtocolError:
+		return "protocol_error"
+	case reasonConnectRejected:
+		return "connect_rejected"
+	case reasonOverloaded:
+		return "overloaded"
+	case reasonRateLimited:
+		return "rate_limited"
+	case reasonSessionLost:
+		return "session_lost"
+	case reasonQoSNotSupported:
+		return "qos_not_supported"
+	case reasonSlowConsumer:
+		return "slow_consumer"
+	case reasonShutdown:
+		return "shutdown"
+	case reasonTimeout:
+		return "timeout"
+	case reasonServerError:
+		return "server_error"
+	default:
+		return "none"
+	}
+}
+
+// DisconnectStats returns how many connections were closed for each reason
+func (srv *TCPServer) DisconnectStats() map[string]uint64 {
+	stats := make(map[string]uint64, numDisconnectReasons-1)
+	for r := reasonConnectionLost; r < numDisconnectReasons; r++ {
+		stats[r.String()] = srv.disconnects[r].Load()
+	}
+	return stats
+}
+
+// closeConnection is the single exit path of an accepted connection. It
+// flushes packets still queued for the client, closes the socket, publishes
+// the will registered by this connection unless the client disconnected
+// cleanly, releases the client's broker state and records the reason. The
+// will is taken from the connection rather than the stored session, so it
+// is still published when the session was expired in the meantime. MQTT 3.1.1 has no server-sent
+// DISCONNECT, so the client learns why only from a final CONNACK, if any.
+func (srv *TCPServer) closeConnection(w *connWriter, clientID string, will *pkt.PublishPacket, reason disconnectReason) {
+	remoteAddr := w.RemoteAddr().String()
+
+	w.closed.Store(true)
+	srv.conns.Delete(w)
+	srv.releaseIP(w.RemoteAddr())
+	if srv.draining.Load() && (reason == reasonConnectionLost || reason == reasonTimeout) {
+		reason = reasonShutdown
+	}
+
+	// A slow consumer's connection was already closed by the timed-out write,
+	// and a taken over one by the connection that replaced it
+	if w.slow.Load() {
+		reason = reasonSlowConsumer
+	} else if w.ousted.Load() {
+		reason = reasonSessionLost
+	} else {
+		// Best effort: the deadline also unblocks a delivery stuck writing
+		// to a client that stopped reading when no write timeout is set
+		_ = w.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		_ = w.Flush()
+		if err := w.Close(); err != nil {
+			srv.logger.LogError(err, "Close error", logger.String("remote_addr", remoteAddr))
+		}
+	}
+	srv.currentConnections.Add(-1)
+	srv.disconnects[reason].Add(1)
+
+	// Will message delivery on any disconnect but a clean DISCONNECT, with
+	// the will's own QoS and retain flag
+	if will != nil && reason != reasonClientDisconnect {
+		srv.logger.LogPublish(clientID, will.Topic, int(will.QoS), will.Retain, len(will.Payload))
+		if err := srv.broker.HandlePublish(clientID, will); err != nil {
+			srv.logger.LogError(err, "Error publishing Will message", logger.ClientID(clientID))
+		}
+	}
+
+	// After a takeover the session belongs to the new connection, whose
+	// subscriptions must survive this one closing
+	if clientID != "" {
+		if session, ok := srv.broker.Get(clientID); ok && session.Conn == net.Conn(w) {
+			srv.broker.HandleClientDisconnect(clientID)
+			srv.broker.PublishPresence(clientID, false)
+		}
+	}
+
+	srv.logger.LogClientConnection(clientID, remoteAddr, "closed", logger.String("reason", reason.String()))
+}
+
+// takeOver closes the connection still attached to a session that conn has
+// just replaced, so a ClientID is only ever connected once [MQTT-3.1.4-2].
+// The old connection's will is published as on any other server close.
+func (srv *TCPServer) takeOver(previous *broker.Session, conn *connWriter) {
+	old, ok := previous.Conn.(*connWriter)
+	if !ok || old == conn || old.closed.Load() || !old.ousted.CompareAndSwap(false, true) {
+		return
+	}
+	_ = old.Conn.Close()
+	srv.logger.LogClientConnection(previous.ClientID, conn.RemoteAddr().String(), "session_taken_over",
+		logger.String("previous_addr", old.RemoteAddr().String()))
+}
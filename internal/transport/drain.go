@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+)
+
+// drainPoll is how often Drain checks for in-flight messages and open connections
+const drainPoll = 50 * time.Millisecond
+
+// Drain stops accepting connections and closes every client connection for
+// shutdown; call Stop afterwards. A non-empty noticeTopic first gets a
+// "shutdown" message, so subscribers
+// learn why they are about to be disconnected. Outbound QoS 1 and 2
+// messages then get until ctx is done to be acknowledged, and connections
+// are closed once their queued packets are flushed. MQTT 3.1.1 has no
+// server DISCONNECT, so clients only see the connection close; wills are
+// published as on any server close.
+func (srv *TCPServer) Drain(ctx context.Context, noticeTopic string) {
+	srv.isShuttingdown.Store(true)
+	if err := srv.closeListeners(); err != nil {
+		srv.logger.LogError(err, "Failed to close listeners")
+	}
+
+	if noticeTopic != "" {
+		notice := &pkt.PublishPacket{Topic: noticeTopic, Payload: []byte("shutdown"), QoS: pkt.QoSAtLeastOnce}
+		if err := srv.broker.HandlePublish("", notice); err != nil {
+			srv.logger.LogError(err, "Failed to publish shutdown notice", logger.String("topic", noticeTopic))
+		}
+	}
+
+	// Let in-flight deliveries complete while clients are still connected
+	srv.waitFor(ctx, func() bool {
+		stats := srv.broker.QoSStats()
+		return stats.QoS1Pending == 0 && stats.QoS2Pending == 0
+	})
+
+	// Read loops stop before their next read, and an expired read deadline
+	// ends the ones blocked reading; each then flushes and closes its
+	// connection
+	srv.draining.Store(true)
+	open := 0
+	srv.conns.Range(func(key, _ any) bool {
+		_ = key.(*connWriter).SetReadDeadline(time.Now())
+		open++
+		return true
+	})
+	if open == 0 {
+		return
+	}
+	srv.logger.Info("Draining connections", logger.Int("connections", open))
+
+	if !srv.waitFor(ctx, func() bool { return srv.currentConnections.Load() == 0 }) {
+		srv.conns.Range(func(key, _ any) bool {
+			_ = key.(*connWriter).Conn.Close()
+			return true
+		})
+		srv.logger.Warn("Drain timed out; closed remaining connections",
+			logger.Int("connections", int(srv.currentConnections.Load())))
+	}
+}
+
+// waitFor polls done until it reports true or ctx ends, and reports which
+func (srv *TCPServer) waitFor(ctx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
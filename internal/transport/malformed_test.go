@@ -0,0 +1,67 @@
+package transport_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyr33x/goqtt/pkg/brokertest"
+)
+
+// connectFrame is a clean-session 3.1.1 CONNECT for client "m"
+var connectFrame = []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 0, 0, 1, 'm'}
+
+// A malformed packet gets a CONNACK only when it is the CONNECT; after
+// connecting the broker just closes the connection
+func TestMalformedPacket(t *testing.T) {
+	cases := []struct {
+		name      string
+		connected bool
+		frame     []byte
+		want      []byte // Sent before closing
+	}{
+		{"remaining length before connect", false, []byte{0x10, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, []byte{0x20, 2, 0, 0x01}},
+		{"parse error before connect", false, []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 3, 0x02, 0, 0, 0, 1, 'm'}, []byte{0x20, 2, 0, 0x01}},
+		{"remaining length after connect", true, []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, nil},
+		{"parse error after connect", true, []byte{0x80, 6, 0, 1, 0, 1, 'a', 0}, nil},
+	}
+	srv := brokertest.New(t)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", srv.Addr(), brokertest.DefaultTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(brokertest.DefaultTimeout))
+
+			if tc.connected {
+				if _, err := conn.Write(connectFrame); err != nil {
+					t.Fatal(err)
+				}
+				ack := make([]byte, 4)
+				if _, err := io.ReadFull(conn, ack); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(ack, []byte{0x20, 2, 0, 0}) {
+					t.Fatalf("CONNACK = % x", ack)
+				}
+			}
+
+			if _, err := conn.Write(tc.frame); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(conn)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("connection still open")
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("got % x before close, want % x", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package transport_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyr33x/goqtt/pkg/brokertest"
+)
+
+// MQTT 5 clients are refused in a CONNACK they can parse: 0x84 for a valid
+// CONNECT, and 0x81 or 0x82 for malformed properties
+func TestMQTT5Refused(t *testing.T) {
+	cases := []struct {
+		name  string
+		props []byte // Property list, length first
+		want  []byte
+	}{
+		{"valid", []byte{3, 0x21, 0, 10}, []byte{0x20, 3, 0, 0x84, 0}},
+		{"malformed properties", []byte{2, 0x24, 1}, []byte{0x20, 3, 0, 0x81, 0}},
+		{"duplicate property", []byte{6, 0x21, 0, 1, 0x21, 0, 2}, []byte{0x20, 3, 0, 0x82, 0}},
+	}
+	srv := brokertest.New(t)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := []byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 60}
+			body = append(body, tc.props...)
+			body = append(body, 0, 2, 'v', '5')
+			frame := append([]byte{0x10, byte(len(body))}, body...)
+
+			conn, err := net.DialTimeout("tcp", srv.Addr(), brokertest.DefaultTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(brokertest.DefaultTimeout))
+
+			if _, err := conn.Write(frame); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("got % x before close, want % x", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package transport
+
+import "net"
+
+// SetMaxConnectionsPerIP limits how many connections one remote IP may hold
+// open, so a single misbehaving gateway can't use up the global limit. 0
+// is unlimited.
+func (srv *TCPServer) SetMaxConnectionsPerIP(n int) {
+	srv.maxPerIP = n
+}
+
+// acquireIP counts a new connection from addr, and reports false without
+// counting it when the address already holds the maximum
+func (srv *TCPServer) acquireIP(addr net.Addr) bool {
+	if srv.maxPerIP <= 0 {
+		return true
+	}
+	ip := remoteIP(addr)
+
+	srv.ipMu.Lock()
+	defer srv.ipMu.Unlock()
+	if srv.ipConns[ip] >= srv.maxPerIP {
+		return false
+	}
+	if srv.ipConns == nil {
+		srv.ipConns = make(map[string]int)
+	}
+	srv.ipConns[ip]++
+	return true
+}
+
+// releaseIP uncounts a connection counted by acquireIP
+func (srv *TCPServer) releaseIP(addr net.Addr) {
+	if srv.maxPerIP <= 0 {
+		return
+	}
+	ip := remoteIP(addr)
+
+	srv.ipMu.Lock()
+	defer srv.ipMu.Unlock()
+	if srv.ipConns[ip] <= 1 {
+		delete(srv.ipConns, ip)
+		return
+	}
+	srv.ipConns[ip]--
+}
+
+// remoteIP strips the port from a remote address
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+)
+
+// SocketOptions tune the TCP sockets of accepted connections. Zero values
+// leave Go's and the OS's defaults in place.
+type SocketOptions struct {
+	KeepAlive   time.Duration // Idle time before TCP keepalive probes, and the interval between them; negative disables them
+	NoDelay     bool          // Send small packets immediately instead of coalescing them (Nagle's algorithm off)
+	ReadBuffer  int           // SO_RCVBUF in bytes
+	WriteBuffer int           // SO_SNDBUF in bytes
+}
+
+// SetSocketOptions sets the TCP options applied to every accepted
+// connection, whichever listener it arrived on
+func (srv *TCPServer) SetSocketOptions(opts SocketOptions) {
+	srv.socketOptions = &opts
+}
+
+// applySocketOptions applies the configured options to the TCP socket under
+// conn, if there is one
+func (srv *TCPServer) applySocketOptions(conn net.Conn) {
+	opts := srv.socketOptions
+	if opts == nil {
+		return
+	}
+	tcpConn, ok := tcpSocket(conn)
+	if !ok {
+		return
+	}
+
+	var err error
+	switch {
+	case opts.KeepAlive < 0:
+		err = tcpConn.SetKeepAlive(false)
+	case opts.KeepAlive > 0:
+		err = tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     opts.KeepAlive,
+			Interval: opts.KeepAlive,
+		})
+	}
+	if err == nil {
+		err = tcpConn.SetNoDelay(opts.NoDelay)
+	}
+	if err == nil && opts.ReadBuffer > 0 {
+		err = tcpConn.SetReadBuffer(opts.ReadBuffer)
+	}
+	if err == nil && opts.WriteBuffer > 0 {
+		err = tcpConn.SetWriteBuffer(opts.WriteBuffer)
+	}
+	if err != nil {
+		srv.logger.LogError(err, "Failed to set socket options", logger.String("remote_addr", conn.RemoteAddr().String()))
+	}
+}
+
+// tcpSocket unwraps WebSocket, TLS and detected connections down to their
+// TCP socket
+func tcpSocket(conn net.Conn) (*net.TCPConn, bool) {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.Conn
+	}
+	if peeked, ok := conn.(*peekedConn); ok {
+		conn = peeked.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if peeked, ok := conn.(*peekedConn); ok {
+		conn = peeked.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
@@ -3,11 +3,15 @@ package transport
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,56 +23,249 @@ import (
 	pkt "github.com/pyr33x/goqtt/internal/packet"
 )
 
+// DefaultMaxConnections is the connection limit applied by New
+const DefaultMaxConnections = 1000
+
+// maxConnectSize is the largest possible CONNECT packet: a 5 byte fixed
+// header, a 10 byte variable header and five length-prefixed payload fields
+const maxConnectSize = 5 + 10 + 5*(2+65535)
+
+// defaultConnectTimeout is how long a new connection may take to send
+// CONNECT unless SetConnectTimeout changes it
+const defaultConnectTimeout = 10 * time.Second
+
 type TCPServer struct {
-	addr               string
+	addr               string // Port, or host:port, of the TCP listener
 	listener           net.Listener
+	tlsAddr            string      // Port, or host:port, of the TLS listener
+	tlsConfig          *tls.Config // nil serves plain TCP only
+	tlsListener        net.Listener
+	wsAddr             string      // Port, or host:port, of the WebSocket listener; empty serves none
+	wsPath             string      // Path that accepts WebSocket upgrades
+	wsTLSConfig        *tls.Config // Serves wss:// when set
+	wsServer           *http.Server
+	wsHandoff          *handoffListener // Feeds the WebSocket server upgrades detected on the TCP listener
+	detectProtocols    bool             // Also serve TLS and WebSocket on the TCP listener
 	broker             *broker.Broker
 	isShuttingdown     atomic.Bool
-	maxConnections     int
+	listenersClosed    atomic.Bool
+	stopOnce           sync.Once
+	stopErr            error       // Result of the first Stop
+	draining           atomic.Bool // Drain is closing client connections
+	conns              sync.Map    // Open connections, *connWriter -> struct{}
+	maxConnections     atomic.Int32
 	currentConnections atomic.Int32
+	handlers           chan struct{}  // One token per connection being served, when bounded by SetMaxHandlers
+	maxPerIP           int            // Connections allowed from one remote IP; 0 is unlimited
+	ipMu               sync.Mutex     // Guards ipConns
+	ipConns            map[string]int // Open connections by remote IP, when maxPerIP is set
 	authStore          *auth.Store
+	spillThreshold     int            // PUBLISH packets larger than this are spilled to disk; 0 disables
+	spillDir           string         // Directory for spill files; empty uses the OS temp directory
+	lenientConnect     bool           // Answer a non-CONNECT first packet with a CONNACK instead of just closing
+	strictAcks         bool           // Close connections that acknowledge packet IDs not in flight
+	maxPacketSize      int            // Largest packet accepted in bytes; 0 is the protocol maximum
+	connectTimeout     time.Duration  // Longest a new connection may take to send CONNECT
+	idleTimeout        time.Duration  // Read timeout of sessions with keep alive 0; 0 waits forever
+	writeTimeout       time.Duration  // Longest a write to a client may block; 0 waits forever
+	batchLinger        time.Duration  // Longest a batched delivery is held before it is written
+	socketOptions      *SocketOptions // nil leaves accepted sockets untouched
+	stallThreshold     time.Duration  // How long a write may block before the client counts as stalled
+	disconnects        [numDisconnectReasons]atomic.Uint64
 	logger             *logger.Logger
 }
 
-// New creates a new TCPServer instance
-func New(addr string, db *sql.DB) *TCPServer {
-	return &TCPServer{
+// New creates a new TCPServer instance. addr is a port, which binds every
+// interface, or a host:port such as 127.0.0.1:1883 or [::1]:1883.
+func New(addr string, db *sql.DB, b *broker.Broker) *TCPServer {
+	srv := &TCPServer{
 		addr:           addr,
-		broker:         broker.New(),
-		maxConnections: 1000,
+		broker:         b,
 		authStore:      auth.NewStore(db),
+		connectTimeout: defaultConnectTimeout,
 		logger:         logger.NewMQTTLogger("tcp-server"),
 	}
+	srv.maxConnections.Store(DefaultMaxConnections)
+	return srv
+}
+
+// Broker returns the broker backing this server
+func (srv *TCPServer) Broker() *broker.Broker {
+	return srv.broker
+}
+
+// MaxConnections returns the current connection limit
+func (srv *TCPServer) MaxConnections() int {
+	return int(srv.maxConnections.Load())
+}
+
+// CurrentConnections returns the number of open client connections
+func (srv *TCPServer) CurrentConnections() int {
+	return int(srv.currentConnections.Load())
+}
+
+// SetMaxConnections changes the connection limit; existing connections are not affected
+func (srv *TCPServer) SetMaxConnections(n int) {
+	srv.maxConnections.Store(int32(n))
+}
+
+// SetSpill streams PUBLISH packets larger than threshold bytes into files
+// in dir instead of holding them in memory; a threshold of 0 disables it
+func (srv *TCPServer) SetSpill(threshold int, dir string) {
+	srv.spillThreshold = threshold
+	srv.spillDir = dir
+}
+
+// SetLenientConnect makes the server reply with a CONNACK before closing a
+// connection whose first packet isn't CONNECT. The spec requires closing
+// without a reply; some older clients rely on the CONNACK to report the error.
+func (srv *TCPServer) SetLenientConnect(lenient bool) {
+	srv.lenientConnect = lenient
 }
 
-// Start begins accepting TCP connections
+// SetStrictAcks makes the server close connections that send PUBACK, PUBREC
+// or PUBCOMP for a packet ID that is not in flight. By default such
+// acknowledgements are counted, logged and otherwise ignored.
+func (srv *TCPServer) SetStrictAcks(strict bool) {
+	srv.strictAcks = strict
+}
+
+// SetConnectTimeout sets how long a new connection may take to send CONNECT
+// before it is closed, so connections that never do can't hold a slot
+func (srv *TCPServer) SetConnectTimeout(timeout time.Duration) {
+	srv.connectTimeout = timeout
+}
+
+// SetIdleTimeout closes connections of clients with keep alive 0, which
+// have no keep alive to enforce, after timeout without a packet. 0 leaves
+// them open indefinitely.
+func (srv *TCPServer) SetIdleTimeout(timeout time.Duration) {
+	srv.idleTimeout = timeout
+}
+
+// SetWriteTimeout bounds how long a write to a client may block on a full
+// TCP window. Clients that stop reading for longer are disconnected as slow
+// consumers instead of stalling the goroutines delivering to them. 0
+// disables the timeout.
+func (srv *TCPServer) SetWriteTimeout(timeout time.Duration) {
+	srv.writeTimeout = timeout
+}
+
+// SetStallThreshold sets how long a write to a client may block before the
+// client counts as stalled, so broker.WithSlowConsumerDrop can drop its QoS
+// 0 deliveries. 0 never reports a stall.
+func (srv *TCPServer) SetStallThreshold(threshold time.Duration) {
+	srv.stallThreshold = threshold
+}
+
+// SetBatchLinger sets how long deliveries on batch topics (see
+// broker.WithBatchTopics) may be held so they are written together with the
+// deliveries that follow. 0 writes them immediately.
+func (srv *TCPServer) SetBatchLinger(linger time.Duration) {
+	srv.batchLinger = linger
+}
+
+// SetMaxPacketSize makes the server close connections that send a packet
+// larger than size bytes, including its fixed header. 0 accepts any size.
+func (srv *TCPServer) SetMaxPacketSize(size int) {
+	srv.maxPacketSize = size
+}
+
+// listenAddress turns a bare port into an address on every interface and
+// leaves a host:port as it is
+func listenAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort("", addr)
+}
+
+// Start begins accepting TCP connections, and TLS and WebSocket connections
+// if SetTLS and SetWebSocket were called
 func (srv *TCPServer) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", srv.addr))
+	listener, err := net.Listen("tcp", listenAddress(srv.addr))
 	if err != nil {
 		return err
 	}
 	srv.listener = listener
-	go srv.accept(ctx)
+
+	if srv.tlsConfig != nil {
+		tlsListener, err := tls.Listen("tcp", listenAddress(srv.tlsAddr), srv.tlsConfig)
+		if err != nil {
+			_ = srv.closeListeners()
+			return err
+		}
+		srv.tlsListener = tlsListener
+		go srv.accept(ctx, tlsListener, false)
+	}
+	if srv.wsAddr != "" {
+		if err := srv.startWebSocket(); err != nil {
+			_ = srv.closeListeners()
+			return err
+		}
+		if srv.detectProtocols {
+			srv.wsHandoff = newHandoffListener(listener.Addr())
+			go srv.serveWebSocket(srv.wsHandoff)
+		}
+	}
+	go srv.accept(ctx, listener, srv.detectProtocols)
 	return nil
 }
 
-// Stop shuts down the listener gracefully
+// Addr returns the address the server is listening on, or nil before Start
+func (srv *TCPServer) Addr() net.Addr {
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// Stop stops accepting connections, closes the ones still open and stops
+// the broker's background work. Call Drain first to close connections
+// gracefully. Only the first call has an effect; later ones return its
+// result.
 func (srv *TCPServer) Stop() error {
-	srv.isShuttingdown.Store(true)
+	srv.stopOnce.Do(func() {
+		srv.isShuttingdown.Store(true)
+		srv.stopErr = srv.closeListeners()
+		srv.conns.Range(func(key, _ any) bool {
+			_ = key.(*connWriter).Conn.Close()
+			return true
+		})
+		srv.broker.Stop()
+	})
+	return srv.stopErr
+}
+
+// closeListeners stops accepting connections on every listener. Open
+// connections are not affected. Calls after the first do nothing.
+func (srv *TCPServer) closeListeners() error {
+	if srv.listenersClosed.Swap(true) {
+		return nil
+	}
+	var errs []error
+	if srv.wsServer != nil {
+		errs = append(errs, srv.wsServer.Close())
+	}
+	if srv.tlsListener != nil {
+		errs = append(errs, srv.tlsListener.Close())
+	}
 	if srv.listener != nil {
-		return srv.listener.Close()
+		errs = append(errs, srv.listener.Close())
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (srv *TCPServer) accept(ctx context.Context) {
+// accept serves the connections of listener, detecting their protocol first
+// when detect is set
+func (srv *TCPServer) accept(ctx context.Context, listener net.Listener, detect bool) {
 	for {
 		select {
 		case <-ctx.Done():
 			srv.logger.Info("shutting down accept...")
 			return
 		default:
-			conn, err := srv.listener.Accept()
+			conn, err := listener.Accept()
 			if err != nil {
 				if srv.isShuttingdown.Load() {
 					return
@@ -76,59 +273,77 @@ func (srv *TCPServer) accept(ctx context.Context) {
 				srv.logger.LogError(err, "accept error")
 				continue
 			}
-			go srv.handleConnection(conn)
+			// Not accepting while every handler is busy leaves further
+			// connections in the listen backlog instead of costing a goroutine each
+			if !srv.acquireHandler(ctx) {
+				_ = conn.Close()
+				srv.logger.Info("shutting down accept...")
+				return
+			}
+			go func() {
+				defer srv.releaseHandler()
+				if detect {
+					if conn = srv.detect(conn); conn == nil {
+						return
+					}
+				}
+				srv.handleConnection(conn)
+			}()
 		}
 	}
 }
 
+// SetMaxHandlers bounds how many connections are served at once, counting
+// those only being refused. Further connections wait in the listen backlog,
+// and WebSocket upgrades wait in their HTTP handler, until one closes. 0 is
+// unlimited. It must be called before Start.
+func (srv *TCPServer) SetMaxHandlers(n int) {
+	if n <= 0 {
+		srv.handlers = nil
+		return
+	}
+	srv.handlers = make(chan struct{}, n)
+}
+
+// acquireHandler waits for a free handler slot, and reports false if ctx
+// ends first
+func (srv *TCPServer) acquireHandler(ctx context.Context) bool {
+	if srv.handlers == nil {
+		return true
+	}
+	select {
+	case srv.handlers <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseHandler frees a slot taken by acquireHandler
+func (srv *TCPServer) releaseHandler() {
+	if srv.handlers != nil {
+		<-srv.handlers
+	}
+}
+
 // Checks if the server can accept a new connection
 func (srv *TCPServer) checkServerAvailability() string {
 	if srv.isShuttingdown.Load() {
 		return "server is shutting down"
 	}
-	if srv.currentConnections.Load() >= int32(srv.maxConnections) {
+	if srv.currentConnections.Load() >= srv.maxConnections.Load() {
 		return "maximum connections exceeded"
 	}
 	return ""
 }
 
 func (srv *TCPServer) handleConnection(conn net.Conn) {
-	var clientID string
-	defer func() {
-		if r := recover(); r != nil {
-			srv.logger.Error("panic recovered in connection handler", logger.Any("error", r))
-		}
-		if err := conn.Close(); err != nil {
-			srv.logger.LogError(err, "Close error", logger.String("remote_addr", conn.RemoteAddr().String()))
-		}
-		srv.currentConnections.Add(-1)
-
-		if clientID != "" {
-			session, ok := srv.broker.Get(clientID)
-			if ok {
-				// Will message delivery on unexpected disconnect
-				if session.WillTopic != nil && session.WillMessage != nil {
-					will := &pkt.PublishPacket{
-						Topic:   *session.WillTopic,
-						Payload: []byte(*session.WillMessage),
-						QoS:     pkt.QoSLevel(session.WillQoS),
-						Retain:  session.WillRetain,
-					}
-					srv.logger.LogPublish(clientID, *session.WillTopic, int(session.WillQoS), session.WillRetain, len(will.Payload))
-					if err := srv.broker.HandlePublish(clientID, will); err != nil {
-						srv.logger.LogError(err, "Error publishing Will message", logger.ClientID(clientID))
-					}
-				}
-
-				srv.broker.HandleClientDisconnect(clientID)
-			}
-		}
-
-		srv.logger.LogClientConnection("", conn.RemoteAddr().String(), "closed")
-	}()
-
 	// Server load and shutdown checks
-	if reason := srv.checkServerAvailability(); reason != "" {
+	refusal := srv.checkServerAvailability()
+	if refusal == "" && !srv.acquireIP(conn.RemoteAddr()) {
+		refusal = "maximum connections per IP exceeded"
+	}
+	if refusal != "" {
 		ack := pkt.NewConnAck(false, pkt.ServerUnavailable)
 		if _, err := conn.Write(ack); err != nil {
 			srv.logger.LogError(err, "Write error", logger.String("remote_addr", conn.RemoteAddr().String()))
@@ -139,20 +354,74 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		return
 	}
 
+	srv.applySocketOptions(conn)
 	srv.currentConnections.Add(1)
 	srv.logger.LogClientConnection("", conn.RemoteAddr().String(), "connected",
 		logger.Int("current_connections", int(srv.currentConnections.Load())),
-		logger.Int("max_connections", int(srv.maxConnections)))
+		logger.Int("max_connections", srv.MaxConnections()))
+
+	w := newConnWriter(conn, srv.writeTimeout, srv.batchLinger, srv.stallThreshold)
+	srv.conns.Store(w, struct{}{})
+	var clientID string
+	var will *pkt.PublishPacket    // This connection's will, even if its session is later replaced
+	reason := reasonConnectionLost // Every return below that is not a lost connection sets its reason
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logger.Error("panic recovered in connection handler", logger.Any("error", r))
+			reason = reasonServerError
+		}
+		srv.closeConnection(w, clientID, will, reason)
+	}()
 
 	reader := bufio.NewReader(conn)
 	sessionEstablished := false
 
+	// How long the client may stay silent: until CONNECT arrives, then one
+	// and a half times its keep alive [MQTT-3.1.2-24]. 0 waits forever.
+	readTimeout := srv.connectTimeout
+
+	// The session bound to this connection, refreshed only when the
+	// broker's session map changes (takeover, expiry, clean start)
+	var currentSession *broker.Session
+	var sessionGen uint64
+
+	// Buffer of the previous packet, recycled once that packet was handled
+	var release *[]byte
+
 	for {
+		if release != nil {
+			putBuffer(release)
+			release = nil
+		}
+
+		// Send batched acknowledgements once no more inbound packets are buffered
+		if reader.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				srv.logger.LogError(err, "Write error", logger.String("remote_addr", conn.RemoteAddr().String()))
+				return
+			}
+		}
+
+		if readTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		// Checked after the deadline is set, so Drain either expires it or is seen here
+		if srv.draining.Load() {
+			reason = reasonShutdown
+			return
+		}
+
 		// Read fixed header (1 byte)
 		fixedHeaderByte, err := reader.ReadByte()
 		if err != nil {
 			if err == io.EOF {
 				srv.logger.LogClientConnection("", conn.RemoteAddr().String(), "disconnected")
+			} else if isTimeout(err) && srv.draining.Load() {
+				reason = reasonShutdown
+			} else if isTimeout(err) {
+				srv.logger.Warn("Client silent past its read timeout", logger.ClientID(clientID),
+					logger.String("remote_addr", conn.RemoteAddr().String()), logger.String("timeout", readTimeout.String()))
+				reason = reasonTimeout
 			} else {
 				srv.logger.LogError(err, "Read error", logger.String("remote_addr", conn.RemoteAddr().String()))
 			}
@@ -160,7 +429,7 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		}
 
 		// Read Remaining Length (variable-length int, max 4 bytes)
-		remLenBuf := make([]byte, 4)
+		var remLenBuf [4]byte
 		remLenOffset := 0
 		remainingLength := 0
 		multiplier := 1
@@ -168,12 +437,19 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		for {
 			if remLenOffset >= len(remLenBuf) {
 				srv.logger.Error("Remaining length too large", logger.String("remote_addr", conn.RemoteAddr().String()))
-				srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+				reason = reasonProtocolError
+				// CONNACK only answers a CONNECT
+				if !sessionEstablished {
+					srv.refuse(w, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+				}
 				return
 			}
 			b, err := reader.ReadByte()
 			if err != nil {
 				srv.logger.LogError(err, "Error reading remaining length", logger.String("remote_addr", conn.RemoteAddr().String()))
+				if isTimeout(err) {
+					reason = reasonTimeout
+				}
 				return
 			}
 			remLenBuf[remLenOffset] = b
@@ -185,24 +461,74 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 			}
 		}
 
-		// Allocate full packet buffer (fixed header + remaining length + variable header/payload)
+		// Until CONNECT is accepted nothing larger than a CONNECT can arrive,
+		// so an unauthenticated connection can't make the server allocate
+		// up to the protocol maximum
+		limit := srv.maxPacketSize
+		if !sessionEstablished && (limit == 0 || limit > maxConnectSize) {
+			limit = maxConnectSize
+		}
+		if limit > 0 && 1+remLenOffset+remainingLength > limit {
+			srv.logger.Error("Packet exceeds maximum packet size",
+				logger.String("remote_addr", conn.RemoteAddr().String()),
+				logger.Int("size", 1+remLenOffset+remainingLength))
+			reason = reasonProtocolError
+			return
+		}
+
+		// Large PUBLISH bodies are streamed to disk instead of being buffered
+		if sessionEstablished && pkt.PacketType(fixedHeaderByte&0xF0) == pkt.PUBLISH &&
+			srv.spillThreshold > 0 && remainingLength > srv.spillThreshold {
+			if reason = srv.readSpilledPublish(reader, w, clientID, fixedHeaderByte, remainingLength); reason != reasonNone {
+				return
+			}
+			continue
+		}
+
+		// Allocate full packet buffer (fixed header + remaining length + variable header/payload).
+		// A PUBLISH payload aliases its buffer and is handed to the broker, so
+		// it gets an exact allocation; every other packet copies what it keeps
+		// and uses a pooled buffer that is recycled once the packet is handled.
 		totalPacketSize := 1 + remLenOffset + remainingLength
-		rawPacket := make([]byte, totalPacketSize)
+		var rawPacket []byte
+		if pkt.PacketType(fixedHeaderByte&0xF0) == pkt.PUBLISH {
+			rawPacket = make([]byte, totalPacketSize)
+		} else {
+			release = getBuffer(totalPacketSize)
+			rawPacket = (*release)[:totalPacketSize]
+		}
 		rawPacket[0] = fixedHeaderByte
 		copy(rawPacket[1:1+remLenOffset], remLenBuf[:remLenOffset])
 
 		_, err = io.ReadFull(reader, rawPacket[1+remLenOffset:])
 		if err != nil {
 			srv.logger.LogError(err, "Error reading full packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+			if isTimeout(err) {
+				reason = reasonTimeout
+			}
 			return
 		}
 
 		packet, err := pkt.Parse(rawPacket)
 		if err != nil {
 			srv.logger.LogError(err, "Parse error", logger.String("remote_addr", conn.RemoteAddr().String()))
+			reason = reasonProtocolError
+
+			// CONNACK only answers a CONNECT. Once connected, a malformed
+			// packet just closes the connection, which publishes the will.
+			if sessionEstablished {
+				return
+			}
 
 			var returnCode byte
 			switch {
+			case errors.Is(err, er.ErrMalformedProperties):
+				// Only MQTT 5 CONNECTs carry properties, so answer in its format
+				srv.refuse(w, pkt.NewConnAckV5(false, pkt.ReasonMalformedPacket, nil))
+				return
+			case errors.Is(err, er.ErrDuplicateProperty):
+				srv.refuse(w, pkt.NewConnAckV5(false, pkt.ReasonProtocolError, nil))
+				return
 			case errors.Is(err, er.ErrUnsupportedProtocolLevel), errors.Is(err, er.ErrUnsupportedProtocolName):
 				returnCode = pkt.UnacceptableProtocolVersion
 			case errors.Is(err, er.ErrInvalidCharsClientID), errors.Is(err, er.ErrClientIDLengthExceed), errors.Is(err, er.ErrIdentifierRejected):
@@ -210,13 +536,20 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 			case errors.Is(err, er.ErrPasswordWithoutUsername), errors.Is(err, er.ErrMalformedUsernameField), errors.Is(err, er.ErrMalformedPasswordField):
 				returnCode = pkt.BadUsernameOrPassword
 			case errors.Is(err, er.ErrInvalidPacketLength):
-				srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+				srv.refuse(w, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+				return
+			case errors.Is(err, er.ErrInvalidFixedHeaderFlags), errors.Is(err, er.ErrInvalidReservedFlag),
+				errors.Is(err, er.ErrInvalidPubrelFlags), errors.Is(err, er.ErrInvalidSubscribeFlags),
+				errors.Is(err, er.ErrInvalidUnsubscribeFlags), errors.Is(err, er.ErrInvalidPingreqFlags),
+				errors.Is(err, er.ErrInvalidWillQos), errors.Is(err, er.ErrInvalidWillFlags), errors.Is(err, er.ErrInvalidWillTopic):
+				// Malformed fixed headers and wills are protocol violations: close without a reply
 				return
 			default:
-				srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.ServerUnavailable))
+				srv.refuse(w, pkt.NewConnAck(false, pkt.ServerUnavailable))
 				return
 			}
-			srv.sendAndClose(conn, pkt.NewConnAck(false, returnCode))
+			reason = reasonConnectRejected
+			srv.refuse(w, pkt.NewConnAck(false, returnCode))
 			return
 		}
 
@@ -225,39 +558,88 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 				srv.logger.Error("Expected CONNECT packet",
 					logger.String("remote_addr", conn.RemoteAddr().String()),
 					logger.String("got_packet_type", packet.Type.String()))
-				srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+				// The spec requires closing without a CONNACK [MQTT-3.1.0-1]
+				reason = reasonProtocolError
+				var ack []byte
+				if srv.lenientConnect {
+					ack = pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion)
+				}
+				srv.refuse(w, ack)
 				return
 			}
 			session := packet.GetConnect()
 			if session == nil {
 				srv.logger.Error("Invalid CONNECT packet", logger.String("remote_addr", conn.RemoteAddr().String()))
-				srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.ServerUnavailable))
+				reason = reasonProtocolError
+				srv.refuse(w, pkt.NewConnAck(false, pkt.ServerUnavailable))
+				return
+			}
+
+			// MQTT 5 CONNECTs parse, but sessions only speak 3.1.1 packets.
+			// The refusal is in MQTT 5's format, which the client can parse.
+			if session.IsMQTT5() {
+				srv.logger.LogError(&er.Err{Context: "Connect", Message: er.ErrMQTT5NotSupported}, "Refused MQTT 5 client",
+					logger.ClientID(session.ClientID), logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonConnectRejected
+				srv.refuse(w, pkt.NewConnAckV5(false, pkt.ReasonUnsupportedProtocolVersion, nil))
 				return
 			}
 
 			// Auth check if username/password is provided
-			if session.UsernameFlag && session.PasswordFlag {
+			// A verified client certificate authenticates on its own; the
+			// password, if any, is not checked
+			var username string
+			if cert := peerCertificate(conn); cert != nil {
+				var requested string
+				if session.UsernameFlag {
+					requested = *session.Username
+				}
+				identity, err := srv.authStore.AuthenticateCertificate(cert, requested)
+				if err != nil {
+					srv.logger.LogAuth(session.ClientID, requested, false, "client certificate rejected")
+					reason = reasonConnectRejected
+					srv.refuse(w, pkt.NewConnAck(false, pkt.BadUsernameOrPassword))
+					return
+				}
+				username = identity
+			} else if session.UsernameFlag && session.PasswordFlag {
 				if err := srv.authStore.Authenticate(*session.Username, *session.Password); err != nil {
 					srv.logger.LogAuth(session.ClientID, *session.Username, false, "authentication failed")
-					srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.BadUsernameOrPassword))
+					reason = reasonConnectRejected
+					srv.refuse(w, pkt.NewConnAck(false, pkt.BadUsernameOrPassword))
+					return
+				}
+				username = *session.Username
+			}
+
+			if session.WillFlag {
+				err := srv.broker.CheckWill(session.WillQoS, session.WillRetain)
+				if err == nil {
+					err = srv.broker.CheckPublish(username, *session.WillTopic)
+				}
+				if err != nil {
+					srv.logger.LogError(err, "Will refused", logger.ClientID(session.ClientID))
+					reason = reasonConnectRejected
+					srv.refuse(w, pkt.NewConnAck(false, pkt.NotAuthorized))
 					return
 				}
 			}
 
 			// Session management: Clean or resume
-			_, sessionExists := srv.broker.Get(session.ClientID)
-			sessionPresent := false
+			previous, sessionExists := srv.broker.Get(session.ClientID)
+			sessionPresent := srv.broker.SessionPresent(session.ClientID, session.CleanSession)
+			// MQTT 3.1 has no Session Present flag; the CONNACK byte is reserved
+			ackPresent := sessionPresent && !session.IsMQTT31()
 
 			if session.CleanSession && sessionExists {
 				srv.logger.LogClientConnection(session.ClientID, conn.RemoteAddr().String(), "clean_session_requested")
-				srv.broker.Delete(session.ClientID)
-			} else if !session.CleanSession && sessionExists {
+				srv.broker.PurgeSession(session.ClientID)
+			} else if sessionPresent {
 				srv.logger.LogClientConnection(session.ClientID, conn.RemoteAddr().String(), "persistent_session_resumed")
-				sessionPresent = true
 			}
 
 			// Send CONNACK
-			if _, err := conn.Write(pkt.NewConnAck(sessionPresent, pkt.ConnectionAccepted)); err != nil {
+			if _, err := w.Write(pkt.NewConnAck(ackPresent, pkt.ConnectionAccepted)); err != nil {
 				srv.logger.LogError(err, "Write error", logger.String("remote_addr", conn.RemoteAddr().String()))
 			}
 			sessionEstablished = true
@@ -267,6 +649,7 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 				// Key Identifiers
 				ClientID:     session.ClientID,
 				CleanSession: session.CleanSession,
+				Username:     username,
 
 				// Will Flags
 				WillTopic:   session.WillTopic,
@@ -277,25 +660,63 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 				// Connection
 				KeepAlive:           session.KeepAlive,
 				ConnectionTimestamp: time.Now().Unix(),
-				Conn:                conn,
+				Conn:                w,
 			}
 			srv.broker.Store(session.ClientID, brokerSession)
 			clientID = session.ClientID // Store for cleanup
+			if sessionExists {
+				srv.takeOver(previous, w)
+			}
+			srv.broker.ResendInflight(clientID)
+			srv.broker.DrainOffline(clientID)
+			readTimeout = time.Duration(session.KeepAlive) * time.Second * 3 / 2
+			if readTimeout == 0 {
+				readTimeout = srv.idleTimeout
+			}
+			if readTimeout == 0 {
+				_ = conn.SetReadDeadline(time.Time{})
+			}
+			if session.WillFlag {
+				will = &pkt.PublishPacket{
+					Topic:   *session.WillTopic,
+					Payload: []byte(*session.WillMessage),
+					QoS:     pkt.QoSLevel(session.WillQoS),
+					Retain:  session.WillRetain,
+				}
+			}
+			srv.broker.PublishPresence(clientID, true)
 			continue
 		}
 
+		// A second CONNECT is a protocol violation [MQTT-3.1.0-2]. MQTT 3.1.1
+		// has no reason codes, so the connection is closed without a reply.
+		if packet.Type == pkt.CONNECT {
+			srv.logger.Error("Duplicate CONNECT on established connection",
+				logger.ClientID(clientID),
+				logger.String("remote_addr", conn.RemoteAddr().String()))
+			reason = reasonProtocolError
+			return
+		}
+
 		// Get current session for packet handling
-		currentSession, exists := srv.broker.Get(clientID)
-		if !exists {
+		if gen := srv.broker.SessionGeneration(); currentSession == nil || gen != sessionGen {
+			sessionGen = gen
+			bound, exists := srv.broker.Get(clientID)
+			if exists {
+				currentSession = bound
+			} else {
+				currentSession = nil
+			}
+		}
+		if currentSession == nil {
 			// Check if packet type can be handled without a session
 			if packet.Type == pkt.DISCONNECT {
 				srv.logger.LogClientConnection("", conn.RemoteAddr().String(), "disconnect_without_session")
-				if err := conn.Close(); err != nil {
-					srv.logger.LogError(err, "Close error", logger.String("remote_addr", conn.RemoteAddr().String()))
-				}
+				reason = reasonClientDisconnect
 				return
 			}
 			srv.logger.Error("Session not found for connection", logger.String("remote_addr", conn.RemoteAddr().String()))
+			reason = reasonSessionLost
 			return
 		}
 
@@ -304,66 +725,38 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 			p := packet.Publish
 			if p == nil {
 				srv.logger.Error("Nil PUBLISH packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
-			srv.logger.LogPublish(currentSession.ClientID, p.Topic, int(p.QoS), p.Retain, len(p.Payload))
-
-			// Handle different QoS levels for incoming PUBLISH
-			switch p.QoS {
-			case pkt.QoSAtMostOnce:
-				// QoS 0: Just process the message
-				if err := srv.broker.HandlePublish(currentSession.ClientID, p); err != nil {
-					srv.logger.LogError(err, "Error handling PUBLISH", logger.ClientID(currentSession.ClientID))
-				}
-
-			case pkt.QoSAtLeastOnce:
-				// QoS 1: Process and send PUBACK
-				if p.PacketID == nil {
-					srv.logger.Error("Missing PacketID for QoS 1", logger.ClientID(currentSession.ClientID))
-					return
-				}
-
-				if err := srv.broker.HandlePublish(currentSession.ClientID, p); err != nil {
-					srv.logger.LogError(err, "Error handling PUBLISH", logger.ClientID(currentSession.ClientID))
-				}
-
-				puback := pkt.NewPubAck(p)
-				if _, err := conn.Write(puback.Encode()); err != nil {
-					srv.logger.LogError(err, "Error sending PUBACK", logger.ClientID(currentSession.ClientID))
-					return
-				}
-				srv.logger.LogQoSFlow(currentSession.ClientID, *p.PacketID, 1, "PUBACK_SENT")
-
-			case pkt.QoSExactlyOnce:
-				// QoS 2: Send PUBREC, wait for PUBREL
-				if p.PacketID == nil {
-					srv.logger.Error("Missing PacketID for QoS 2", logger.ClientID(currentSession.ClientID))
-					return
-				}
-
-				pubrec := srv.broker.HandleIncomingQoS2Publish(currentSession.ClientID, *p.PacketID, p.Topic, p.Payload, p.Retain)
-				if _, err := conn.Write(pubrec.Encode()); err != nil {
-					srv.logger.LogError(err, "Error sending PUBREC", logger.ClientID(currentSession.ClientID))
-					return
-				}
-				srv.logger.LogQoSFlow(currentSession.ClientID, *p.PacketID, 2, "PUBREC_SENT")
+			msg := broker.NewMessage(p.Topic, p.Payload, p.Retain)
+			if reason = srv.handlePublish(w, currentSession.ClientID, msg, p.QoS, p.PacketID); reason != reasonNone {
+				return
 			}
 
 		case pkt.PUBACK:
 			if packet.Puback == nil {
 				srv.logger.Error("Nil PUBACK packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
+				return
+			}
+			if !srv.broker.HandlePubAck(currentSession.ClientID, packet.Puback.PacketID) && srv.strictAcks {
+				reason = reasonProtocolError
 				return
 			}
-			srv.broker.HandlePubAck(currentSession.ClientID, packet.Puback.PacketID)
 
 		case pkt.PUBREC:
 			if packet.Pubrec == nil {
 				srv.logger.Error("Nil PUBREC packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 			pubrel := srv.broker.HandlePubRec(currentSession.ClientID, packet.Pubrec.PacketID)
+			if pubrel == nil && srv.strictAcks {
+				reason = reasonProtocolError
+				return
+			}
 			if pubrel != nil {
-				if _, err := conn.Write(pubrel.Encode()); err != nil {
+				if err := w.queue(pubrel.Encode()); err != nil {
 					srv.logger.LogError(err, "Error sending PUBREL", logger.ClientID(currentSession.ClientID))
 					return
 				}
@@ -373,14 +766,12 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		case pkt.PUBREL:
 			if packet.Pubrel == nil {
 				srv.logger.Error("Nil PUBREL packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
-			pubcomp, err := srv.broker.HandleIncomingPubRel(currentSession.ClientID, packet.Pubrel.PacketID)
-			if err != nil {
-				srv.logger.LogError(err, "Error handling PUBREL", logger.ClientID(currentSession.ClientID))
-			}
+			pubcomp := srv.broker.HandleIncomingPubRel(currentSession.ClientID, packet.Pubrel.PacketID)
 			if pubcomp != nil {
-				if _, err := conn.Write(pubcomp.Encode()); err != nil {
+				if err := w.queue(pubcomp.Encode()); err != nil {
 					srv.logger.LogError(err, "Error sending PUBCOMP", logger.ClientID(currentSession.ClientID))
 					return
 				}
@@ -390,13 +781,18 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		case pkt.PUBCOMP:
 			if packet.Pubcomp == nil {
 				srv.logger.Error("Nil PUBCOMP packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
+				return
+			}
+			if !srv.broker.HandlePubComp(currentSession.ClientID, packet.Pubcomp.PacketID) && srv.strictAcks {
+				reason = reasonProtocolError
 				return
 			}
-			srv.broker.HandlePubComp(currentSession.ClientID, packet.Pubcomp.PacketID)
 
 		case pkt.SUBSCRIBE:
 			if packet.Subscribe == nil {
 				srv.logger.Error("Nil SUBSCRIBE packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 
@@ -404,11 +800,12 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 			suback := srv.broker.HandleSubscribe(currentSession, packet.Subscribe)
 			if suback == nil {
 				srv.logger.Error("Failed to handle SUBSCRIBE", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 
 			// Send SUBACK response
-			if _, err := conn.Write(suback.Encode()); err != nil {
+			if _, err := w.Write(suback.Encode()); err != nil {
 				srv.logger.LogError(err, "Error sending SUBACK", logger.ClientID(currentSession.ClientID))
 				return
 			}
@@ -417,6 +814,7 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		case pkt.UNSUBSCRIBE:
 			if packet.Unsubscribe == nil {
 				srv.logger.Error("Nil UNSUBSCRIBE packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 
@@ -424,11 +822,12 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 			unsuback := srv.broker.HandleUnsubscribe(currentSession, packet.Unsubscribe)
 			if unsuback == nil {
 				srv.logger.Error("Failed to handle UNSUBSCRIBE", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 
 			// Send UNSUBACK response
-			if _, err := conn.Write(unsuback.Encode()); err != nil {
+			if _, err := w.Write(unsuback.Encode()); err != nil {
 				srv.logger.LogError(err, "Error sending UNSUBACK", logger.ClientID(currentSession.ClientID))
 				return
 			}
@@ -436,7 +835,7 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 
 		case pkt.PINGREQ:
 			pingresp := pkt.CreatePingresp()
-			if _, err := conn.Write(pingresp.Encode()); err != nil {
+			if _, err := w.Write(pingresp.Encode()); err != nil {
 				srv.logger.LogError(err, "Error sending PINGRESP", logger.ClientID(currentSession.ClientID))
 				return
 			}
@@ -445,6 +844,7 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		case pkt.SUBACK:
 			if packet.Suback == nil {
 				srv.logger.Error("Nil SUBACK packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 			srv.logger.LogMQTTPacket("SUBACK", currentSession.ClientID, "inbound", logger.Int("packet_id", int(packet.Suback.PacketID)))
@@ -452,42 +852,210 @@ func (srv *TCPServer) handleConnection(conn net.Conn) {
 		case pkt.UNSUBACK:
 			if packet.Unsuback == nil {
 				srv.logger.Error("Nil UNSUBACK packet", logger.String("remote_addr", conn.RemoteAddr().String()))
+				reason = reasonProtocolError
 				return
 			}
 			srv.logger.LogMQTTPacket("UNSUBACK", currentSession.ClientID, "inbound", logger.Int("packet_id", int(packet.Unsuback.PacketID)))
 
 		case pkt.DISCONNECT:
 			srv.logger.LogClientConnection(currentSession.ClientID, conn.RemoteAddr().String(), "disconnect")
-
-			// Clean up subscriptions for this client
-			if currentSession != nil {
-				srv.broker.HandleClientDisconnect(currentSession.ClientID)
-			}
-
-			if err := conn.Close(); err != nil {
-				srv.logger.LogError(err, "Close error", logger.String("remote_addr", conn.RemoteAddr().String()))
-			}
-
+			reason = reasonClientDisconnect
 			return
 
 		default:
 			srv.logger.Error("Unhandled packet type",
 				logger.String("packet_type", packet.Type.String()),
 				logger.String("remote_addr", conn.RemoteAddr().String()))
-			srv.sendAndClose(conn, pkt.NewConnAck(false, pkt.UnacceptableProtocolVersion))
+			reason = reasonProtocolError
 			return
 		}
 	}
 }
 
-// sendAndClose sends an ACK (usually CONNACK) and closes the connection
-func (srv *TCPServer) sendAndClose(conn net.Conn, ack []byte) {
-	if len(ack) > 0 {
-		if _, err := conn.Write(ack); err != nil {
-			srv.logger.LogError(err, "Error sending ACK", logger.String("remote_addr", conn.RemoteAddr().String()))
+// handlePublish routes an inbound PUBLISH and acknowledges it according to
+// its QoS. It returns why the connection should be closed, or reasonNone.
+func (srv *TCPServer) handlePublish(w *connWriter, clientID string, msg *broker.Message, qos pkt.QoSLevel, packetID *uint16) disconnectReason {
+	srv.logger.LogPublish(clientID, msg.Topic, int(qos), msg.Retain, msg.Size())
+
+	if strings.HasPrefix(msg.Topic, "$") {
+		session, _ := srv.broker.Get(clientID)
+		if err := srv.broker.CheckPublish(session.Username, msg.Topic); err != nil {
+			srv.logger.Warn("Dropped PUBLISH to reserved $ topic",
+				logger.ClientID(clientID), logger.String("topic", msg.Topic))
+			return srv.discardPublish(w, clientID, qos, packetID)
+		}
+	}
+
+	if err := srv.broker.CheckPublishQoS(qos); err != nil {
+		srv.logger.Warn("PUBLISH above maximum QoS, closing connection",
+			logger.ClientID(clientID), logger.Int("qos", int(qos)))
+		return reasonQoSNotSupported
+	}
+
+	if err := srv.broker.CheckRetain(msg.Retain); err != nil {
+		srv.logger.Warn("Retained PUBLISH while retain is unavailable, closing connection", logger.ClientID(clientID))
+		return reasonProtocolError
+	}
+
+	if err := srv.broker.CheckPublishRate(clientID, msg.Topic, msg.Size()); err != nil {
+		if srv.broker.RatePolicy() == broker.RateDisconnect {
+			srv.logger.Warn("PUBLISH over rate limit, closing connection",
+				logger.ClientID(clientID), logger.String("topic", msg.Topic))
+			return reasonRateLimited
+		}
+		if logger.Enabled(logger.LevelDebug) {
+			srv.logger.Debug("Dropped PUBLISH over rate limit",
+				logger.ClientID(clientID), logger.String("topic", msg.Topic))
+		}
+		return srv.discardPublish(w, clientID, qos, packetID)
+	}
+
+	if err := srv.broker.AdmitPublish(qos); err != nil {
+		if qos == pkt.QoSAtMostOnce {
+			if logger.Enabled(logger.LevelDebug) {
+				srv.logger.Debug("Dropped QoS 0 PUBLISH under memory pressure", logger.ClientID(clientID))
+			}
+			return reasonNone
+		}
+		// Without an acknowledgement the client keeps the message and
+		// resends it once it reconnects
+		srv.logger.Warn("Rejected PUBLISH over resource limits, closing connection",
+			logger.ClientID(clientID), logger.Int("qos", int(qos)))
+		return reasonOverloaded
+	}
+
+	// Handle different QoS levels for incoming PUBLISH
+	switch qos {
+	case pkt.QoSAtMostOnce:
+		// QoS 0: Just process the message
+		if err := srv.broker.PublishMessage(clientID, msg, qos); err != nil {
+			srv.logger.LogError(err, "Error handling PUBLISH", logger.ClientID(clientID))
+		}
+
+	case pkt.QoSAtLeastOnce:
+		// QoS 1: Process and send PUBACK
+		if packetID == nil {
+			srv.logger.Error("Missing PacketID for QoS 1", logger.ClientID(clientID))
+			return reasonProtocolError
+		}
+
+		if err := srv.broker.PublishMessage(clientID, msg, qos); err != nil {
+			srv.logger.LogError(err, "Error handling PUBLISH", logger.ClientID(clientID))
+		}
+
+		puback := &pkt.PubackPacket{PacketID: *packetID}
+		if err := w.queue(puback.Encode()); err != nil {
+			srv.logger.LogError(err, "Error sending PUBACK", logger.ClientID(clientID))
+			return reasonConnectionLost
+		}
+		srv.logger.LogQoSFlow(clientID, *packetID, 1, "PUBACK_SENT")
+
+	case pkt.QoSExactlyOnce:
+		// QoS 2: Send PUBREC, wait for PUBREL
+		if packetID == nil {
+			srv.logger.Error("Missing PacketID for QoS 2", logger.ClientID(clientID))
+			return reasonProtocolError
+		}
+
+		pubrec := srv.broker.HandleIncomingQoS2Publish(clientID, *packetID, msg)
+		if err := w.queue(pubrec.Encode()); err != nil {
+			srv.logger.LogError(err, "Error sending PUBREC", logger.ClientID(clientID))
+			return reasonConnectionLost
+		}
+		srv.logger.LogQoSFlow(clientID, *packetID, 2, "PUBREC_SENT")
+	}
+
+	return reasonNone
+}
+
+// discardPublish acknowledges a publish without routing it. MQTT 3.1.1 has
+// no negative acknowledgement, so a refused QoS 1/2 message is acknowledged
+// to stop the client from resending it forever.
+func (srv *TCPServer) discardPublish(w *connWriter, clientID string, qos pkt.QoSLevel, packetID *uint16) disconnectReason {
+	if qos == pkt.QoSAtMostOnce {
+		return reasonNone
+	}
+	if packetID == nil {
+		srv.logger.Error("Missing PacketID", logger.ClientID(clientID), logger.Int("qos", int(qos)))
+		return reasonProtocolError
+	}
+
+	var ack []byte
+	if qos == pkt.QoSAtLeastOnce {
+		ack = (&pkt.PubackPacket{PacketID: *packetID}).Encode()
+	} else {
+		ack = (&pkt.PubrecPacket{PacketID: *packetID}).Encode()
+	}
+	if err := w.queue(ack); err != nil {
+		srv.logger.LogError(err, "Error acknowledging discarded PUBLISH", logger.ClientID(clientID))
+		return reasonConnectionLost
+	}
+	return reasonNone
+}
+
+// readSpilledPublish reads the variable header of a large PUBLISH, streams
+// its payload into a spill file and routes it. It returns why the
+// connection should be closed, or reasonNone.
+func (srv *TCPServer) readSpilledPublish(reader *bufio.Reader, w *connWriter, clientID string, fixedHeaderByte byte, remainingLength int) disconnectReason {
+	qos := pkt.QoSLevel((fixedHeaderByte >> 1) & 0x03)
+	retain := fixedHeaderByte&0x01 == 0x01
+	if qos > pkt.QoSExactlyOnce {
+		srv.logger.Error("Invalid QoS in PUBLISH", logger.ClientID(clientID))
+		return reasonProtocolError
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
+		srv.logger.LogError(err, "Error reading PUBLISH topic", logger.ClientID(clientID))
+		return reasonConnectionLost
+	}
+	topicLen := int(binary.BigEndian.Uint16(lenBuf[:]))
+
+	headerLen := 2 + topicLen
+	if qos > pkt.QoSAtMostOnce {
+		headerLen += 2
+	}
+	if headerLen > remainingLength {
+		srv.logger.Error("Malformed PUBLISH variable header", logger.ClientID(clientID))
+		return reasonProtocolError
+	}
+
+	topic := make([]byte, topicLen)
+	if _, err := io.ReadFull(reader, topic); err != nil {
+		srv.logger.LogError(err, "Error reading PUBLISH topic", logger.ClientID(clientID))
+		return reasonConnectionLost
+	}
+
+	var packetID *uint16
+	if qos > pkt.QoSAtMostOnce {
+		if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
+			srv.logger.LogError(err, "Error reading PUBLISH packet ID", logger.ClientID(clientID))
+			return reasonConnectionLost
+		}
+		id := binary.BigEndian.Uint16(lenBuf[:])
+		if id == 0 {
+			srv.logger.Error("Invalid PacketID in PUBLISH", logger.ClientID(clientID))
+			return reasonProtocolError
 		}
+		packetID = &id
+	}
+
+	msg, err := broker.NewSpilledMessage(string(topic), retain, reader, int64(remainingLength-headerLen), srv.spillDir)
+	if err != nil {
+		srv.logger.LogError(err, "Error spilling PUBLISH payload", logger.ClientID(clientID))
+		return reasonServerError
+	}
+
+	return srv.handlePublish(w, clientID, msg, qos, packetID)
+}
+
+// refuse queues a final packet, usually a CONNACK with an error code, that
+// closeConnection flushes before closing. A nil ack closes without a reply.
+func (srv *TCPServer) refuse(w *connWriter, ack []byte) {
+	if len(ack) == 0 {
+		return
 	}
-	if err := conn.Close(); err != nil {
-		srv.logger.LogError(err, "Close error", logger.String("remote_addr", conn.RemoteAddr().String()))
+	if err := w.queue(ack); err != nil {
+		srv.logger.LogError(err, "Error sending ACK", logger.String("remote_addr", w.RemoteAddr().String()))
 	}
 }
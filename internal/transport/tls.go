@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/pyr33x/goqtt/pkg/er"
+)
+
+// TLSOptions are the certificate and protocol settings of the TLS listener
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string   // "1.2" or "1.3"; empty is 1.2
+	CipherSuites []string // Names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; empty uses Go's defaults
+	ClientCA     string   // PEM bundle of CAs that sign client certificates
+	ClientAuth   string   // "none", "request" (verify a certificate if sent) or "require"; empty is none
+}
+
+// NewTLSConfig loads the certificate and key, and the client CA when client
+// certificates are verified, and builds the server's TLS config. Cipher
+// suites only apply up to TLS 1.2; TLS 1.3 suites are not configurable.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, &er.Err{
+			Context: "TLS, Certificate",
+			Message: fmt.Errorf("%w: %v", er.ErrInvalidTLSConfig, err),
+		}
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch opts.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, &er.Err{
+			Context: "TLS, MinVersion",
+			Message: fmt.Errorf("%w: unsupported version %q", er.ErrInvalidTLSConfig, opts.MinVersion),
+		}
+	}
+
+	if len(opts.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range opts.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, &er.Err{
+					Context: "TLS, CipherSuites",
+					Message: fmt.Errorf("%w: unknown or insecure cipher suite %q", er.ErrInvalidTLSConfig, name),
+				}
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	switch opts.ClientAuth {
+	case "", "none":
+		return config, nil
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, &er.Err{
+			Context: "TLS, ClientAuth",
+			Message: fmt.Errorf("%w: unsupported client auth %q", er.ErrInvalidTLSConfig, opts.ClientAuth),
+		}
+	}
+	pem, err := os.ReadFile(opts.ClientCA)
+	if err != nil {
+		return nil, &er.Err{
+			Context: "TLS, ClientCA",
+			Message: fmt.Errorf("%w: %v", er.ErrInvalidTLSConfig, err),
+		}
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, &er.Err{
+			Context: "TLS, ClientCA",
+			Message: fmt.Errorf("%w: no certificates in %s", er.ErrInvalidTLSConfig, opts.ClientCA),
+		}
+	}
+	return config, nil
+}
+
+// peerCertificate returns the client certificate verified during the TLS
+// handshake, or nil for plain connections and clients that sent none
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.Conn
+	}
+	if peeked, ok := conn.(*peekedConn); ok {
+		conn = peeked.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// SetTLS makes Start also accept MQTT over TLS on addr, a port or a
+// host:port, alongside plain TCP
+func (srv *TCPServer) SetTLS(addr string, config *tls.Config) {
+	srv.tlsAddr = addr
+	srv.tlsConfig = config
+}
+
+// TLSAddr returns the address of the TLS listener, or nil if there is none
+func (srv *TCPServer) TLSAddr() net.Addr {
+	if srv.tlsListener == nil {
+		return nil
+	}
+	return srv.tlsListener.Addr()
+}
@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyr33x/goqtt/internal/logger"
+)
+
+// websocketGUID is appended to the client's key to compute the handshake
+// accept value [RFC 6455 1.3]
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes [RFC 6455 5.2]
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// errTextFrame reports a text frame; MQTT is only carried in binary frames
+var errTextFrame = errors.New("websocket: text frame received")
+
+// SetWebSocket makes Start also accept MQTT over WebSocket on addr, for
+// upgrade requests to path. A non-nil config serves wss:// instead of ws://.
+func (srv *TCPServer) SetWebSocket(addr, path string, config *tls.Config) {
+	srv.wsAddr = addr
+	srv.wsPath = path
+	srv.wsTLSConfig = config
+}
+
+// startWebSocket listens for WebSocket upgrades until Stop
+func (srv *TCPServer) startWebSocket() error {
+	listener, err := net.Listen("tcp", listenAddress(srv.wsAddr))
+	if err != nil {
+		return err
+	}
+	if srv.wsTLSConfig != nil {
+		listener = tls.NewListener(listener, srv.wsTLSConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(srv.wsPath, srv.handleWebSocket)
+	srv.wsServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: srv.connectTimeout,
+	}
+	go srv.serveWebSocket(listener)
+	return nil
+}
+
+// serveWebSocket serves upgrade requests from listener until Stop
+func (srv *TCPServer) serveWebSocket(listener net.Listener) {
+	if err := srv.wsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		srv.logger.LogError(err, "WebSocket server error")
+	}
+}
+
+// handleWebSocket completes the WebSocket handshake and serves the
+// connection like any other MQTT connection
+func (srv *TCPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// MQTT clients offer "mqtt", or "mqttv3.1" for MQTT 3.1 [MQTT-6.0.0-3]
+	var protocol string
+	for _, offered := range headerTokens(r.Header, "Sec-WebSocket-Protocol") {
+		if offered == "mqtt" || offered == "mqttv3.1" {
+			protocol = offered
+			break
+		}
+	}
+
+	if !srv.acquireHandler(r.Context()) {
+		return
+	}
+	defer srv.releaseHandler()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		srv.logger.LogError(err, "WebSocket hijack error", logger.String("remote_addr", r.RemoteAddr))
+		return
+	}
+	// The HTTP server's deadlines no longer apply
+	_ = conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
+		srv.logger.LogError(err, "WebSocket handshake error", logger.String("remote_addr", r.RemoteAddr))
+		_ = conn.Close()
+		return
+	}
+
+	srv.handleConnection(&wsConn{Conn: conn, reader: rw.Reader})
+}
+
+// headerContains reports whether a comma-separated header lists token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range headerTokens(h, name) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens splits every value of a comma-separated header
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, value := range h.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			tokens = append(tokens, strings.TrimSpace(token))
+		}
+	}
+	return tokens
+}
+
+// wsConn carries an MQTT byte stream in WebSocket binary frames. Reads
+// unmask frame payloads as they arrive, so a packet may span frames and a
+// frame may hold several packets [MQTT-6.0.0-2]. Every Write is sent as one
+// frame.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	mu        sync.Mutex // Serializes frames written by Write, pongs and close
+	remaining uint64     // Payload bytes left in the current data frame
+	mask      [4]byte
+	offset    int // Position in the current frame's payload, for unmasking
+	closed    bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	for i := range n {
+		p[i] ^= c.mask[(c.offset+i)%4]
+	}
+	c.offset += n
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with payload, answering
+// control frames on the way. A close frame ends the stream with io.EOF.
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return errors.New("websocket: unmasked client frame")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+		return err
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		c.remaining = length
+		c.offset = 0
+		return nil
+	case opText:
+		return errTextFrame
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+		switch opcode {
+		case opClose:
+			_ = c.writeFrame(opClose, nil)
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %#x", opcode)
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends one unmasked, final frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(c.Conn)
+	if opcode == opClose {
+		c.closed = true
+	}
+	return err
+}
+
+// Close sends a close frame, if none was sent yet, and closes the connection
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
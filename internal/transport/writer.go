@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connWriter serializes writes to a connection and lets the read loop batch
+// small packets. Queued packets stay buffered until the next Flush or Write,
+// so acknowledgements for a burst of inbound packets go out in one syscall.
+// Write flushes anything queued first, keeping packets in order.
+type connWriter struct {
+	net.Conn
+	mu      sync.Mutex
+	buf     *bufio.Writer
+	timeout time.Duration // Longest a write may block; 0 waits forever
+	slow    atomic.Bool   // A write timed out because the client stopped reading
+	busy    atomic.Int64  // When the write in progress started, in Unix nanoseconds; 0 when idle
+	stall   time.Duration // How long a write may be in progress before the client counts as stalled; 0 never
+	dropped atomic.Int64  // When TryWrite last gave up, in Unix nanoseconds; 0 once a write succeeds
+	tail    atomic.Bool   // TryWrite is finishing a partly sent frame in the background
+	closed  atomic.Bool   // closeConnection has run
+	ousted  atomic.Bool   // Closed because a new connection took its session over
+	linger  time.Duration // Longest a batched frame waits for the next write
+	flusher *time.Timer   // Flushes batched frames once linger has passed
+	pending bool          // flusher is running
+}
+
+func newConnWriter(conn net.Conn, timeout, linger, stall time.Duration) *connWriter {
+	return &connWriter{
+		Conn:    conn,
+		buf:     bufio.NewWriter(conn),
+		timeout: timeout,
+		linger:  linger,
+		stall:   stall,
+	}
+}
+
+// arm starts the write deadline for the writes that follow, and marks a
+// write in progress until check. The caller must hold mu.
+func (w *connWriter) arm() {
+	w.busy.Store(time.Now().UnixNano())
+	if w.timeout > 0 {
+		_ = w.Conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+}
+
+// check marks the client slow and closes its connection if err is a write
+// timeout, so a client whose TCP window stays full cannot hold mu and block
+// broker goroutines. Closing also ends the client's read loop.
+func (w *connWriter) check(err error) error {
+	w.busy.Store(0)
+	if isTimeout(err) && w.slow.CompareAndSwap(false, true) {
+		_ = w.Conn.Close()
+	}
+	return err
+}
+
+// Stalled reports whether the client has stopped keeping up: a write has
+// been in progress for longer than the stall threshold, TryWrite is
+// finishing a frame the client only took part of, or it gave up less than
+// a threshold ago
+func (w *connWriter) Stalled() bool {
+	if w.stall <= 0 {
+		return false
+	}
+	if w.tail.Load() {
+		return true
+	}
+	if since := w.busy.Load(); since != 0 && time.Since(time.Unix(0, since)) > w.stall {
+		return true
+	}
+	since := w.dropped.Load()
+	return since != 0 && time.Since(time.Unix(0, since)) < w.stall
+}
+
+// TryWrite sends p unless the client accepts none of it within the stall
+// threshold, and reports whether it was sent. Once part of p is out the
+// rest must follow before anything else, so it is finished in the
+// background, still holding mu, within the write timeout; the caller is
+// not held up and Stalled reports the client meanwhile. Only plain TCP
+// connections can give up on a write; on others TryWrite is Write.
+func (w *connWriter) TryWrite(p []byte) (bool, error) {
+	if _, ok := w.Conn.(*net.TCPConn); !ok || w.stall <= 0 {
+		_, err := w.Write(p)
+		return err == nil, err
+	}
+
+	w.mu.Lock()
+	w.arm()
+	if err := w.buf.Flush(); err != nil {
+		w.mu.Unlock()
+		return false, w.check(err)
+	}
+	_ = w.Conn.SetWriteDeadline(time.Now().Add(w.stall))
+	n, err := w.Conn.Write(p)
+	if !isTimeout(err) {
+		if err == nil {
+			w.dropped.Store(0)
+		}
+		err = w.check(err)
+		w.mu.Unlock()
+		return err == nil, err
+	}
+
+	// The short deadline must not outlive this write
+	w.arm()
+	if w.timeout <= 0 {
+		_ = w.Conn.SetWriteDeadline(time.Time{})
+	}
+	if n == 0 {
+		w.dropped.Store(time.Now().UnixNano())
+		_ = w.check(nil)
+		w.mu.Unlock()
+		return false, nil
+	}
+	w.tail.Store(true)
+	go func() {
+		defer w.mu.Unlock()
+		if _, err := w.Conn.Write(p[n:]); w.check(err) == nil {
+			w.dropped.Store(0)
+		}
+		w.tail.Store(false)
+	}()
+	return true, nil
+}
+
+// isTimeout reports whether err is a read or write deadline expiring
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Write sends p immediately along with anything queued before it
+func (w *connWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.arm()
+	n, err := w.buf.Write(p)
+	if err != nil {
+		return n, w.check(err)
+	}
+	return n, w.check(w.buf.Flush())
+}
+
+// queue buffers p until the next Flush or Write
+func (w *connWriter) queue(p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Writing may flush a full buffer
+	w.arm()
+	_, err := w.buf.Write(p)
+	return w.check(err)
+}
+
+// WriteBatched buffers p and sends it within the linger time, together with
+// whatever else is written by then. A full buffer is sent straight away.
+func (w *connWriter) WriteBatched(p []byte) error {
+	if w.linger <= 0 {
+		_, err := w.Write(p)
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.arm()
+	if _, err := w.buf.Write(p); w.check(err) != nil {
+		return err
+	}
+	if w.pending {
+		return nil
+	}
+	w.pending = true
+	if w.flusher == nil {
+		w.flusher = time.AfterFunc(w.linger, w.flushBatch)
+	} else {
+		w.flusher.Reset(w.linger)
+	}
+	return nil
+}
+
+// flushBatch sends the frames held by WriteBatched, unless a write in the
+// meantime already has
+func (w *connWriter) flushBatch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = false
+	if w.buf.Buffered() > 0 {
+		w.arm()
+		_ = w.check(w.buf.Flush())
+	}
+}
+
+// Flush sends any queued packets
+func (w *connWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.arm()
+	return w.check(w.buf.Flush())
+}
+
+// WriteStream sends header followed by everything read from body, without
+// letting other writes interleave
+func (w *connWriter) WriteStream(header []byte, body io.Reader) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The deadline covers the whole stream
+	w.arm()
+	if _, err := w.buf.Write(header); err != nil {
+		return w.check(err)
+	}
+	if _, err := w.buf.ReadFrom(body); err != nil {
+		return w.check(err)
+	}
+	return w.check(w.buf.Flush())
+}
@@ -2,32 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"flag"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"gopkg.in/yaml.v3"
 
+	"github.com/pyr33x/goqtt/internal/admin"
+	"github.com/pyr33x/goqtt/internal/bridge"
+	"github.com/pyr33x/goqtt/internal/broker"
+	"github.com/pyr33x/goqtt/internal/cli"
+	"github.com/pyr33x/goqtt/internal/commitlog"
+	"github.com/pyr33x/goqtt/internal/config"
+	"github.com/pyr33x/goqtt/internal/discovery"
+	"github.com/pyr33x/goqtt/internal/lastvalue"
 	"github.com/pyr33x/goqtt/internal/logger"
+	"github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/internal/store"
+	"github.com/pyr33x/goqtt/internal/transform"
 	"github.com/pyr33x/goqtt/internal/transport"
 )
 
-type Config struct {
-	Name    string `yaml:"name"`
-	Version string `yaml:"version"`
-	Server  Server `yaml:"server"`
-}
-
-type Server struct {
-	Port        string `yaml:"port"`
-	Environment string `yaml:"env"`
-}
-
-func gracefulShutdown(tcpServer *transport.TCPServer, cancel context.CancelFunc, done chan struct{}) {
+func gracefulShutdown(tcpServer *transport.TCPServer, adminServer *admin.Server, shutdown config.Shutdown, cancel context.CancelFunc, done chan struct{}) {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
@@ -35,27 +39,49 @@ func gracefulShutdown(tcpServer *transport.TCPServer, cancel context.CancelFunc,
 	logger.Info("Graceful shutdown has triggered...")
 
 	defer cancel()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdown.Timeout)
+	tcpServer.Drain(drainCtx, shutdown.NoticeTopic)
+	cancelDrain()
 	if err := tcpServer.Stop(); err != nil {
 		logger.Error("Shutdown error", logger.String("error", err.Error()))
 	}
-	time.Sleep(1 * time.Second)
+	if adminServer != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := adminServer.Stop(shutdownCtx); err != nil {
+			logger.Error("Admin shutdown error", logger.String("error", err.Error()))
+		}
+		cancelShutdown()
+	}
 
 	close(done)
 }
 
 func main() {
-	var cfg Config
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "topics":
+			os.Exit(cli.Topics(os.Args[2:]))
+		case "doctor":
+			os.Exit(cli.Doctor(os.Args[2:]))
+		case "profile":
+			os.Exit(cli.Profile(os.Args[2:]))
+		case "conformance":
+			os.Exit(cli.Conformance(os.Args[2:]))
+		}
+	}
+
+	configPath := flag.String("config", "", "path to the config file (.yml, .yaml, .json or .toml)")
+	flag.Parse()
+
 	done := make(chan struct{}, 1)
 
-	config, err := os.ReadFile("config.yml")
+	path, err := config.Find(*configPath)
 	if err != nil {
-		logger.Fatal("failed to read config from yaml file")
-		return
+		logger.Fatal("Failed to locate config", logger.String("error", err.Error()))
 	}
-
-	err = yaml.Unmarshal([]byte(config), &cfg)
+	cfg, err := config.Load(path)
 	if err != nil {
-		logger.Fatal("Failed to unmarshal yaml config", logger.String("error", err.Error()))
+		logger.Fatal("Failed to load config", logger.String("error", err.Error()))
 	}
 
 	switch cfg.Server.Environment {
@@ -79,33 +105,365 @@ func main() {
 		logger.Fatal("Failed to open sqlite db", logger.String("error", err.Error()))
 	}
 
-	if err := initSchema(db); err != nil {
+	if err := store.InitSchema(db); err != nil {
 		logger.Fatal("Failed to initialize schema", logger.String("error", err.Error()))
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	srv := transport.New(cfg.Server.Port, db)
+	if cfg.Limits.MemoryLimit > 0 {
+		debug.SetMemoryLimit(cfg.Limits.MemoryLimit)
+	}
+	if cfg.Limits.MaxProcs > 0 {
+		runtime.GOMAXPROCS(cfg.Limits.MaxProcs)
+	}
+	utils.SetStrictTopicLevels(cfg.Server.StrictTopics)
+	packet.SetAcceptMQTT31(cfg.Server.AcceptMQTT31)
+
+	var brokerOpts []broker.Option
+	inflightPolicy := broker.InflightReject
+	if cfg.Limits.InflightPolicy == "downgrade" {
+		inflightPolicy = broker.InflightDowngrade
+	}
+	brokerOpts = append(brokerOpts, broker.WithResourceLimits(broker.ResourceLimits{
+		MemoryLimit:    cfg.Limits.MemoryLimit,
+		InflightBytes:  cfg.Limits.InflightBytes,
+		InflightPolicy: inflightPolicy,
+	}))
+	ratePolicy := broker.RateDrop
+	if cfg.RateLimit.Action == "disconnect" {
+		ratePolicy = broker.RateDisconnect
+	}
+	topicRates := make([]broker.TopicRate, 0, len(cfg.RateLimit.Topics))
+	for _, topic := range cfg.RateLimit.Topics {
+		topicRates = append(topicRates, broker.TopicRate{
+			Prefix: topic.Prefix,
+			Rate:   broker.Rate{Messages: topic.Messages, Bytes: topic.Bytes},
+		})
+	}
+	brokerOpts = append(brokerOpts, broker.WithRateLimits(broker.RateLimits{
+		Client: broker.Rate{Messages: cfg.RateLimit.Messages, Bytes: cfg.RateLimit.Bytes},
+		Topics: topicRates,
+		Policy: ratePolicy,
+	}))
+	if cfg.Server.DeliveryWorkers > 0 {
+		brokerOpts = append(brokerOpts, broker.WithDeliveryWorkers(cfg.Server.DeliveryWorkers, cfg.Server.DeliveryQueue))
+	}
+	if len(cfg.Server.PriorityTopics) > 0 {
+		if cfg.Server.DeliveryWorkers == 0 {
+			logger.Warn("priority_topics has no effect without delivery_workers")
+		}
+		brokerOpts = append(brokerOpts, broker.WithPriorityTopics(cfg.Server.PriorityTopics, cfg.Server.PriorityBurst))
+	}
+	if len(cfg.Server.BatchTopics) > 0 {
+		brokerOpts = append(brokerOpts, broker.WithBatchTopics(cfg.Server.BatchTopics))
+	}
+	if cfg.Server.SlowConsumer == "drop" {
+		brokerOpts = append(brokerOpts, broker.WithSlowConsumerDrop())
+	}
+	if cfg.Server.OfflineQueue > 0 {
+		brokerOpts = append(brokerOpts, broker.WithOfflineQueue(cfg.Server.OfflineQueue))
+	}
+	if cfg.Server.MaxInflight > 0 {
+		brokerOpts = append(brokerOpts, broker.WithInflightWindow(cfg.Server.MaxInflight, cfg.Server.InflightQueue))
+	}
+	if cfg.Server.FanoutThreshold > 0 {
+		brokerOpts = append(brokerOpts, broker.WithParallelFanout(cfg.Server.FanoutThreshold, cfg.Server.FanoutWorkers))
+	}
+	retainedPolicy := broker.RetainedEvict
+	if cfg.Retained.Policy == "reject" {
+		retainedPolicy = broker.RetainedReject
+	}
+	if cfg.Retained.MaxBytes > 0 {
+		brokerOpts = append(brokerOpts, broker.WithRetainedLimit(cfg.Retained.MaxBytes, retainedPolicy))
+	}
+	if cfg.Retained.MaxMessages > 0 || cfg.Retained.MaxPayload > 0 {
+		brokerOpts = append(brokerOpts, broker.WithRetainedMessageLimits(cfg.Retained.MaxMessages, cfg.Retained.MaxPayload, retainedPolicy))
+	}
+	var retainedStore *store.Retained
+	if cfg.Retained.Persist {
+		retainedStore = store.NewRetained(db)
+		brokerOpts = append(brokerOpts, broker.WithRetainedPersister(retainedStore))
+	}
+	var subscriptionStore *store.Subscriptions
+	var qos2Store *store.QoS2
+	if cfg.Server.PersistSessions {
+		subscriptionStore = store.NewSubscriptions(db)
+		qos2Store = store.NewQoS2(db)
+		brokerOpts = append(brokerOpts,
+			broker.WithSubscriptionPersister(subscriptionStore),
+			broker.WithQoS2Persister(qos2Store))
+	}
+	switch cfg.Retained.OnSubscribe {
+	case "new":
+		brokerOpts = append(brokerOpts, broker.WithRetainHandling(broker.RetainOnNewSubscribe))
+	case "never":
+		brokerOpts = append(brokerOpts, broker.WithRetainHandling(broker.RetainNever))
+	}
+	brokerOpts = append(brokerOpts, broker.WithWillPolicy(broker.WillPolicy{
+		MaxQoS:        packet.QoSLevel(cfg.Will.MaxQoS),
+		RetainAllowed: cfg.Will.Retain,
+	}))
+	brokerOpts = append(brokerOpts, broker.WithSystemPublishers(cfg.Server.SystemPublishers))
+	qosPolicy := broker.QoSDowngrade
+	if cfg.Server.QoSPolicy == "disconnect" {
+		qosPolicy = broker.QoSDisconnect
+	}
+	brokerOpts = append(brokerOpts, broker.WithMaxQoS(packet.QoSLevel(cfg.Server.MaxQoS), qosPolicy))
+	brokerOpts = append(brokerOpts, broker.WithCapabilities(broker.Capabilities{
+		RetainAvailable:       cfg.Server.RetainAvailable,
+		WildcardSubscriptions: cfg.Server.WildcardSubscriptions,
+	}))
+	if len(cfg.Server.DeniedFilters) > 0 {
+		brokerOpts = append(brokerOpts, broker.WithDeniedFilters(cfg.Server.DeniedFilters))
+	}
+	if cfg.Presence.Enabled {
+		brokerOpts = append(brokerOpts, broker.WithPresence(broker.PresenceOptions{
+			Topic:          cfg.Presence.Topic,
+			QoS:            packet.QoSLevel(cfg.Presence.QoS),
+			Retain:         cfg.Presence.Retain,
+			OnlinePayload:  cfg.Presence.OnlinePayload,
+			OfflinePayload: cfg.Presence.OfflinePayload,
+		}))
+	}
+
+	// Unwrapped first, so the other interceptors see the original message
+	if cfg.BridgeIngest.Enabled {
+		brokerOpts = append(brokerOpts, broker.WithInterceptor(bridge.Ingest(cfg.BridgeRouting.BrokerID, cfg.BridgeRouting.MaxHops)))
+	}
+
+	if len(cfg.Transforms) > 0 {
+		rules := make([]transform.Rule, 0, len(cfg.Transforms))
+		for _, t := range cfg.Transforms {
+			rule := transform.Rule{Filter: t.Filter}
+			for _, step := range t.Steps {
+				rule.Steps = append(rule.Steps, transform.Step(step))
+			}
+			rules = append(rules, rule)
+		}
+		pipeline, err := transform.New(rules)
+		if err != nil {
+			logger.Fatal("Failed to load transforms", logger.String("error", err.Error()))
+		}
+		brokerOpts = append(brokerOpts, broker.WithInterceptor(pipeline.Intercept))
+	}
+
+	var registry *discovery.Registry
+	if cfg.Discovery.Enabled {
+		registry, err = discovery.New(db, cfg.Discovery.Prefix)
+		if err != nil {
+			logger.Fatal("Failed to load discovery configs", logger.String("error", err.Error()))
+		}
+		brokerOpts = append(brokerOpts, broker.WithInterceptor(registry.Intercept))
+	}
+
+	// Logged last, so it records messages as the other interceptors left them
+	var commitLog *commitlog.Log
+	if cfg.CommitLog.Enabled {
+		commitLog, err = commitlog.Open(commitlog.Options{
+			Dir:            cfg.CommitLog.Dir,
+			Topics:         cfg.CommitLog.Topics,
+			SegmentBytes:   cfg.CommitLog.SegmentBytes,
+			RetentionBytes: cfg.CommitLog.RetentionBytes,
+			RetentionAge:   cfg.CommitLog.RetentionAge,
+			Fsync:          cfg.CommitLog.Fsync,
+		})
+		if err != nil {
+			logger.Fatal("Failed to open commit log", logger.String("error", err.Error()))
+		}
+		brokerOpts = append(brokerOpts, broker.WithInterceptor(commitLog.Intercept))
+		if cfg.CommitLog.ReplayLimit > 0 {
+			brokerOpts = append(brokerOpts, broker.WithReplay(commitLog, cfg.CommitLog.ReplayLimit))
+		}
+	}
+
+	b := broker.New(brokerOpts...)
+	if retainedStore != nil {
+		if err := retainedStore.Load(b.RestoreRetained); err != nil {
+			logger.Fatal("Failed to load retained messages", logger.String("error", err.Error()))
+		}
+		logger.Info("Retained messages restored", logger.Int("count", b.GetRetainedMessageCount()))
+	}
+	if subscriptionStore != nil {
+		if err := subscriptionStore.Load(b.RestoreSubscription); err != nil {
+			logger.Fatal("Failed to load persisted subscriptions", logger.String("error", err.Error()))
+		}
+		if err := qos2Store.Load(b.RestoreQoS2); err != nil {
+			logger.Fatal("Failed to load persisted QoS 2 messages", logger.String("error", err.Error()))
+		}
+	}
+	if registry != nil {
+		registry.Restore(b)
+	}
+	if err := bridge.Advertise(b, cfg.BridgeIngest.Enabled, cfg.BridgeRouting.BrokerID); err != nil {
+		logger.Error("Failed to advertise bridge features", logger.String("error", err.Error()))
+	}
+
+	var lastValues *lastvalue.Cache
+	if cfg.LastValue.Enabled {
+		lastValues = lastvalue.New(cfg.LastValue.Topics, cfg.LastValue.MaxTopics)
+		if err := lastValues.Start(b); err != nil {
+			logger.Fatal("Failed to start last-value cache", logger.String("error", err.Error()))
+		}
+	}
+
+	bridges := make([]*bridge.Bridge, 0, len(cfg.Bridges))
+	for _, bc := range cfg.Bridges {
+		opts := bridge.Options{
+			Name:              bc.Name,
+			Address:           bc.Address,
+			ClientID:          bc.ClientID,
+			Username:          bc.Username,
+			Password:          bc.Password,
+			CleanSession:      bc.CleanSession,
+			KeepAlive:         bc.KeepAlive,
+			ReconnectDelay:    bc.ReconnectDelay,
+			MaxReconnectDelay: bc.MaxReconnectDelay,
+			Queue:             bc.Queue,
+			Compression:       bc.Compression,
+			CompressMin:       bc.CompressMin,
+			Preset:            bc.Preset,
+			SpoolDir:          bc.SpoolDir,
+			SpoolBytes:        bc.SpoolBytes,
+			SpoolPolicy:       bc.SpoolPolicy,
+			BrokerID:          cfg.BridgeRouting.BrokerID,
+			MaxHops:           cfg.BridgeRouting.MaxHops,
+		}
+		if opts.SpoolDir == "" {
+			opts.SpoolDir = filepath.Join("store", "bridges", bc.Name)
+		}
+		// Every preset broker requires TLS
+		if bc.TLS.Enabled || bc.Preset != "" {
+			opts.TLS, err = bridge.NewTLSConfig(bridge.TLSOptions{
+				CAFile:             bc.TLS.CAFile,
+				CertFile:           bc.TLS.CertFile,
+				KeyFile:            bc.TLS.KeyFile,
+				ServerName:         bc.TLS.ServerName,
+				InsecureSkipVerify: bc.TLS.InsecureSkipVerify,
+				ALPN:               bc.TLS.ALPN,
+			})
+			if err != nil {
+				logger.Fatal("Failed to load bridge TLS config", logger.String("bridge", bc.Name), logger.String("error", err.Error()))
+			}
+		}
+		for _, t := range bc.Topics {
+			direction := bridge.Both
+			switch t.Direction {
+			case "in":
+				direction = bridge.In
+			case "out":
+				direction = bridge.Out
+			}
+			opts.Topics = append(opts.Topics, bridge.Topic{
+				Filter:       t.Filter,
+				Direction:    direction,
+				QoS:          packet.QoSLevel(t.QoS),
+				LocalPrefix:  t.LocalPrefix,
+				RemotePrefix: t.RemotePrefix,
+			})
+		}
+		br := bridge.New(b, opts)
+		if err := br.Start(); err != nil {
+			logger.Fatal("Failed to start bridge", logger.String("bridge", bc.Name), logger.String("error", err.Error()))
+		}
+		bridges = append(bridges, br)
+		logger.Info("Bridge started", logger.String("bridge", bc.Name), logger.String("address", bc.Address))
+	}
+
+	srv := transport.New(cfg.Server.Listen(cfg.Server.Port), db, b)
+	srv.SetSpill(cfg.Server.SpillThreshold, cfg.Server.SpillDir)
+	srv.SetMaxConnections(cfg.Server.MaxConnections)
+	srv.SetMaxHandlers(cfg.Server.MaxHandlers)
+	srv.SetMaxConnectionsPerIP(cfg.Server.MaxConnectionsPerIP)
+	srv.SetLenientConnect(cfg.Server.LenientConnect)
+	srv.SetStrictAcks(cfg.Server.StrictAcks)
+	srv.SetMaxPacketSize(cfg.Server.MaxPacketSize)
+	srv.SetConnectTimeout(cfg.Server.ConnectTimeout)
+	srv.SetIdleTimeout(cfg.Server.IdleTimeout)
+	srv.SetWriteTimeout(cfg.Server.WriteTimeout)
+	if cfg.Server.SlowConsumer == "drop" {
+		srv.SetStallThreshold(cfg.Server.SlowConsumerStall)
+	}
+	srv.SetBatchLinger(cfg.Server.BatchLinger)
+	srv.SetSocketOptions(transport.SocketOptions{
+		KeepAlive:   cfg.Server.TCPKeepAlive,
+		NoDelay:     cfg.Server.TCPNoDelay,
+		ReadBuffer:  cfg.Server.ReadBuffer,
+		WriteBuffer: cfg.Server.WriteBuffer,
+	})
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled || (cfg.WebSocket.Enabled && cfg.WebSocket.TLS) {
+		tlsConfig, err = transport.NewTLSConfig(transport.TLSOptions{
+			CertFile:     cfg.TLS.CertFile,
+			KeyFile:      cfg.TLS.KeyFile,
+			MinVersion:   cfg.TLS.MinVersion,
+			CipherSuites: cfg.TLS.CipherSuites,
+			ClientCA:     cfg.TLS.ClientCA,
+			ClientAuth:   cfg.TLS.ClientAuth,
+		})
+		if err != nil {
+			logger.Fatal("Failed to load TLS config", logger.String("error", err.Error()))
+		}
+	}
+	if cfg.TLS.Enabled {
+		srv.SetTLS(cfg.Server.Listen(cfg.TLS.Port), tlsConfig)
+	}
+	if cfg.WebSocket.Enabled {
+		var wsTLS *tls.Config
+		if cfg.WebSocket.TLS {
+			wsTLS = tlsConfig
+		}
+		srv.SetWebSocket(cfg.Server.Listen(cfg.WebSocket.Port), cfg.WebSocket.Path, wsTLS)
+	}
+	srv.SetProtocolDetection(cfg.Server.DetectProtocols)
+	if err := admin.LoadPersistedSettings(db, srv); err != nil {
+		logger.Error("Failed to load persisted runtime settings", logger.String("error", err.Error()))
+	}
 
 	go func() {
 		if err := srv.Start(ctx); err != nil {
 			logger.Fatal("server error", logger.String("error", err.Error()))
 		}
 	}()
-	logger.Info("Server started listening", logger.String("port", cfg.Server.Port))
+	logger.Info("Server started listening", logger.String("address", cfg.Server.Listen(cfg.Server.Port)))
+	if cfg.TLS.Enabled {
+		logger.Info("TLS listener started", logger.String("address", cfg.Server.Listen(cfg.TLS.Port)))
+	}
+	if cfg.WebSocket.Enabled {
+		logger.Info("WebSocket listener started", logger.String("address", cfg.Server.Listen(cfg.WebSocket.Port)), logger.String("path", cfg.WebSocket.Path))
+	}
 
-	go gracefulShutdown(srv, cancel, done)
+	var adminSrv *admin.Server
+	if cfg.Admin.Enabled {
+		adminSrv = admin.New(cfg.Admin.Listen(), srv, db)
+		if registry != nil {
+			adminSrv.SetDiscovery(registry)
+		}
+		if lastValues != nil {
+			adminSrv.SetLastValues(lastValues)
+		}
+		if commitLog != nil {
+			adminSrv.SetCommitLog(commitLog)
+		}
+		if err := adminSrv.Start(); err != nil {
+			logger.Fatal("admin server error", logger.String("error", err.Error()))
+		}
+		logger.Info("Admin API started listening", logger.String("address", cfg.Admin.Listen()))
+	}
+
+	go gracefulShutdown(srv, adminSrv, cfg.Shutdown, cancel, done)
 
 	<-done
+	for _, br := range bridges {
+		br.Stop()
+	}
+	if commitLog != nil {
+		if err := commitLog.Close(); err != nil {
+			logger.Error("Failed to close commit log", logger.String("error", err.Error()))
+		}
+	}
+	if err := db.Close(); err != nil {
+		logger.Error("Failed to close sqlite db", logger.String("error", err.Error()))
+	}
 	logger.Info("Graceful shutdown complete.")
 }
-
-func initSchema(db *sql.DB) error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		username TEXT PRIMARY KEY,
-		secret TEXT NOT NULL
-	);`
-	_, err := db.Exec(schema)
-	return err
-}
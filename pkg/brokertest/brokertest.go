@@ -0,0 +1,462 @@
+// Package brokertest runs a goqtt broker inside a test, with a small MQTT
+// 3.1.1 client for publishing and asserting deliveries:
+//
+//	func TestAlarm(t *testing.T) {
+//		srv := brokertest.New(t)
+//		sub := srv.Connect("dashboard")
+//		sub.Subscribe("alarms/#", 1)
+//
+//		srv.Connect("sensor").Publish("alarms/boiler", []byte("overheat"), 1, false)
+//		sub.Expect("alarms/boiler", []byte("overheat"))
+//	}
+//
+// Every failure is reported through the test's testing.TB, and everything
+// started is cleaned up when the test ends.
+package brokertest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/pyr33x/goqtt/internal/broker"
+	pkt "github.com/pyr33x/goqtt/internal/packet"
+	"github.com/pyr33x/goqtt/internal/packet/utils"
+	"github.com/pyr33x/goqtt/internal/store"
+	"github.com/pyr33x/goqtt/internal/transport"
+	"github.com/pyr33x/goqtt/pkg/hash"
+)
+
+// DefaultTimeout is how long a client waits for the broker by default
+const DefaultTimeout = 2 * time.Second
+
+// dbCount names each server's in-memory database
+var dbCount atomic.Uint64
+
+// Server is a broker listening on a random local port, with its user store
+// in memory
+type Server struct {
+	tb  testing.TB
+	srv *transport.TCPServer
+	db  *sql.DB
+}
+
+// New starts a broker that is stopped when the test ends
+func New(tb testing.TB) *Server {
+	tb.Helper()
+
+	// A named shared-cache database lives as long as a connection to it is open
+	dsn := fmt.Sprintf("file:brokertest%d?mode=memory&cache=shared", dbCount.Add(1))
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		tb.Fatalf("brokertest: opening the user store: %v", err)
+	}
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	if err := store.InitSchema(db); err != nil {
+		_ = db.Close()
+		tb.Fatalf("brokertest: creating the schema: %v", err)
+	}
+
+	b := broker.New()
+	srv := transport.New("0", db, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := srv.Start(ctx); err != nil {
+		cancel()
+		_ = db.Close()
+		tb.Fatalf("brokertest: starting the broker: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		cancel()
+		_ = srv.Stop()
+		b.Stop()
+		_ = db.Close()
+	})
+	return &Server{tb: tb, srv: srv, db: db}
+}
+
+// Addr returns the host:port clients connect to
+func (s *Server) Addr() string {
+	port := s.srv.Addr().(*net.TCPAddr).Port
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// AddUser lets clients connect as username with password
+func (s *Server) AddUser(username, password string) {
+	s.tb.Helper()
+	secret, err := hash.HashPasswd(password)
+	if err != nil {
+		s.tb.Fatalf("brokertest: hashing the password of %q: %v", username, err)
+	}
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO users (username, secret) VALUES (?, ?)", username, secret); err != nil {
+		s.tb.Fatalf("brokertest: adding user %q: %v", username, err)
+	}
+}
+
+// Connect opens a clean session for clientID, failing the test if the
+// broker refuses it
+func (s *Server) Connect(clientID string) *Client {
+	s.tb.Helper()
+	return s.ConnectWith(ConnectOptions{ClientID: clientID, CleanSession: true})
+}
+
+// ConnectOptions describes the CONNECT a client sends
+type ConnectOptions struct {
+	ClientID     string
+	CleanSession bool
+	KeepAlive    time.Duration // 0 disables keep alive
+	Username     string        // Sent, with Password, when not empty
+	Password     string
+	Will         *Message // Will message and its QoS and retain flag
+}
+
+// ConnectWith opens a session described by opts, failing the test if the
+// broker refuses it
+func (s *Server) ConnectWith(opts ConnectOptions) *Client {
+	s.tb.Helper()
+	c, code, err := s.Dial(opts)
+	if err != nil {
+		s.tb.Fatalf("brokertest: connecting %q: %v", opts.ClientID, err)
+	}
+	if code != pkt.ConnectionAccepted {
+		_ = c.conn.Close()
+		s.tb.Fatalf("brokertest: connecting %q: refused with return code %#x", opts.ClientID, code)
+	}
+	return c
+}
+
+// Dial sends a CONNECT and returns the CONNACK return code, for tests that
+// expect the broker to refuse a connection. The client is closed when the
+// test ends.
+func (s *Server) Dial(opts ConnectOptions) (*Client, byte, error) {
+	conn, err := net.DialTimeout("tcp", s.Addr(), DefaultTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	c := &Client{
+		tb:      s.tb,
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		Timeout: DefaultTimeout,
+	}
+	s.tb.Cleanup(func() { _ = conn.Close() })
+
+	if err := c.write(connectFrame(opts)); err != nil {
+		return nil, 0, err
+	}
+	header, body, err := c.read(c.Timeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("waiting for CONNACK: %w", err)
+	}
+	if pkt.PacketType(header&0xF0) != pkt.CONNACK || len(body) != 2 {
+		return nil, 0, fmt.Errorf("got %s, want CONNACK", pkt.PacketType(header&0xF0))
+	}
+	return c, body[1], nil
+}
+
+// Message is a PUBLISH received by a client, or a will to register
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Dup     bool
+}
+
+// Client is an MQTT connection to a Server. Its methods fail the test on
+// any error and must be called from the test's goroutine.
+type Client struct {
+	tb       testing.TB
+	conn     net.Conn
+	reader   *bufio.Reader
+	nextID   uint16
+	received []Message // Publishes that arrived while waiting for an ack
+	Timeout  time.Duration
+}
+
+// Subscribe subscribes to filter and waits for the SUBACK, failing the test
+// if the broker refuses the subscription. It returns the granted QoS.
+func (c *Client) Subscribe(filter string, qos byte) byte {
+	c.tb.Helper()
+	id := c.packetID()
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, id)
+	body = appendString(body, filter)
+	body = append(body, qos)
+	c.mustWrite(appendFrame(nil, byte(pkt.SUBSCRIBE)|0x02, body))
+
+	ack := c.await(pkt.SUBACK, id)
+	if len(ack) != 3 || ack[2] == pkt.SubackFailure {
+		c.tb.Fatalf("brokertest: subscription to %q was refused", filter)
+	}
+	return ack[2]
+}
+
+// Unsubscribe unsubscribes from filter and waits for the UNSUBACK
+func (c *Client) Unsubscribe(filter string) {
+	c.tb.Helper()
+	id := c.packetID()
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, id)
+	body = appendString(body, filter)
+	c.mustWrite(appendFrame(nil, byte(pkt.UNSUBSCRIBE)|0x02, body))
+	c.await(pkt.UNSUBACK, id)
+}
+
+// Publish publishes a message, completing the QoS 1 or 2 handshake before
+// returning
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) {
+	c.tb.Helper()
+	var id uint16
+	if qos > 0 {
+		id = c.packetID()
+	}
+	c.mustWrite(publishFrame(Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain}, id))
+
+	switch qos {
+	case 1:
+		c.await(pkt.PUBACK, id)
+	case 2:
+		c.await(pkt.PUBREC, id)
+		c.mustWrite(appendAck(byte(pkt.PUBREL)|0x02, id))
+		c.await(pkt.PUBCOMP, id)
+	}
+}
+
+// Next returns the next message delivered to the client, failing the test
+// if none arrives within the client's Timeout
+func (c *Client) Next() Message {
+	c.tb.Helper()
+	if len(c.received) > 0 {
+		msg := c.received[0]
+		c.received = c.received[1:]
+		return msg
+	}
+
+	header, body, err := c.read(c.Timeout)
+	if err != nil {
+		c.tb.Fatalf("brokertest: waiting for a message: %v", err)
+	}
+	if pkt.PacketType(header&0xF0) != pkt.PUBLISH {
+		c.tb.Fatalf("brokertest: got %s while waiting for a message", pkt.PacketType(header&0xF0))
+	}
+	return c.receive(header, body)
+}
+
+// Expect fails the test unless the next message is payload on topic
+func (c *Client) Expect(topic string, payload []byte) Message {
+	c.tb.Helper()
+	msg := c.Next()
+	if msg.Topic != topic || !bytes.Equal(msg.Payload, payload) {
+		c.tb.Fatalf("brokertest: got %q on %s, want %q on %s", msg.Payload, msg.Topic, payload, topic)
+	}
+	return msg
+}
+
+// ExpectNone fails the test if a message arrives within d
+func (c *Client) ExpectNone(d time.Duration) {
+	c.tb.Helper()
+	if len(c.received) > 0 {
+		c.tb.Fatalf("brokertest: got an unexpected message on %s", c.received[0].Topic)
+	}
+	header, body, err := c.read(d)
+	var netErr net.Error
+	switch {
+	case err == nil && pkt.PacketType(header&0xF0) == pkt.PUBLISH:
+		c.tb.Fatalf("brokertest: got an unexpected message on %s", c.receive(header, body).Topic)
+	case err == nil:
+		c.tb.Fatalf("brokertest: got an unexpected %s", pkt.PacketType(header&0xF0))
+	case !errors.As(err, &netErr) || !netErr.Timeout():
+		c.tb.Fatalf("brokertest: %v", err)
+	}
+}
+
+// Disconnect sends DISCONNECT and closes the connection, so the broker
+// discards the will
+func (c *Client) Disconnect() {
+	_ = c.write([]byte{byte(pkt.DISCONNECT), 0})
+	_ = c.conn.Close()
+}
+
+// Close drops the connection without a DISCONNECT, so the broker publishes
+// the will
+func (c *Client) Close() {
+	_ = c.conn.Close()
+}
+
+// await reads until the ack of type want for packet ID id, keeping any
+// publishes that arrive first for Next
+func (c *Client) await(want pkt.PacketType, id uint16) []byte {
+	c.tb.Helper()
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		header, body, err := c.read(time.Until(deadline))
+		if err != nil {
+			c.tb.Fatalf("brokertest: waiting for %s: %v", want, err)
+		}
+		got := pkt.PacketType(header & 0xF0)
+		switch {
+		case got == pkt.PUBLISH:
+			c.received = append(c.received, c.receive(header, body))
+		case got != want:
+			c.tb.Fatalf("brokertest: got %s, want %s", got, want)
+		case len(body) < 2 || binary.BigEndian.Uint16(body) != id:
+			c.tb.Fatalf("brokertest: got %s for another packet ID, want %d", got, id)
+		default:
+			return body
+		}
+	}
+}
+
+// receive decodes a PUBLISH and acknowledges it. For QoS 2 the PUBREL is
+// awaited, so the exchange is complete when receive returns.
+func (c *Client) receive(header byte, body []byte) Message {
+	c.tb.Helper()
+	var p pkt.PublishPacket
+	if err := p.Parse(appendFrame(nil, header, body)); err != nil {
+		c.tb.Fatalf("brokertest: malformed PUBLISH: %v", err)
+	}
+	msg := Message{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		QoS:     byte(p.QoS),
+		Retain:  p.Retain,
+		Dup:     p.DUP,
+	}
+
+	switch p.QoS {
+	case pkt.QoSAtLeastOnce:
+		c.mustWrite(appendAck(byte(pkt.PUBACK), *p.PacketID))
+	case pkt.QoSExactlyOnce:
+		c.mustWrite(appendAck(byte(pkt.PUBREC), *p.PacketID))
+		c.await(pkt.PUBREL, *p.PacketID)
+		c.mustWrite(appendAck(byte(pkt.PUBCOMP), *p.PacketID))
+	}
+	return msg
+}
+
+// packetID returns the next packet ID, skipping 0
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (c *Client) mustWrite(frame []byte) {
+	c.tb.Helper()
+	if err := c.write(frame); err != nil {
+		c.tb.Fatalf("brokertest: writing to the broker: %v", err)
+	}
+}
+
+func (c *Client) write(frame []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// read reads one packet, returning its first byte and body
+func (c *Client) read(timeout time.Duration) (byte, []byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var lengthBytes []byte
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		lengthBytes = append(lengthBytes, b)
+		if b&0x80 == 0 || len(lengthBytes) == 4 {
+			break
+		}
+	}
+	length, _, err := utils.ParseRemainingLength(lengthBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func connectFrame(o ConnectOptions) []byte {
+	var flags byte
+	if o.CleanSession {
+		flags |= 0x02
+	}
+	if o.Will != nil {
+		flags |= 0x04 | o.Will.QoS<<3
+		if o.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if o.Username != "" {
+		flags |= 0x80 | 0x40
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4, flags) // Protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(o.KeepAlive/time.Second))
+	body = appendString(body, o.ClientID)
+	if o.Will != nil {
+		body = appendString(body, o.Will.Topic)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(o.Will.Payload)))
+		body = append(body, o.Will.Payload...)
+	}
+	if o.Username != "" {
+		body = appendString(body, o.Username)
+		body = appendString(body, o.Password)
+	}
+	return appendFrame(nil, byte(pkt.CONNECT), body)
+}
+
+func publishFrame(msg Message, packetID uint16) []byte {
+	header := byte(pkt.PUBLISH) | msg.QoS<<1
+	if msg.Retain {
+		header |= 0x01
+	}
+	var body []byte
+	body = appendString(body, msg.Topic)
+	if msg.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	return appendFrame(nil, header, append(body, msg.Payload...))
+}
+
+func appendAck(header byte, packetID uint16) []byte {
+	return binary.BigEndian.AppendUint16([]byte{header, 2}, packetID)
+}
+
+func appendFrame(dst []byte, header byte, body []byte) []byte {
+	dst = append(dst, header)
+	dst = utils.AppendRemainingLength(dst, len(body))
+	return append(dst, body...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
@@ -20,6 +20,9 @@ var (
 	ErrClientIDLengthExceed           = errors.New("client id exceeds 23 bytes")
 	ErrInvalidCharsClientID           = errors.New("client id contains invalid characters")
 	ErrUnsupportedProtocolLevel       = errors.New("protocol level is not supported")
+	ErrMQTT5NotSupported              = errors.New("mqtt 5 is not supported")
+	ErrMalformedProperties            = errors.New("mqtt 5 properties are malformed")
+	ErrDuplicateProperty              = errors.New("mqtt 5 property appears more than once")
 	ErrUnsupportedProtocolName        = errors.New("protocol name is not supported")
 	ErrInvalidWillQos                 = errors.New("willqos level is invalid")
 	ErrPasswordWithoutUsername        = errors.New("password flag set without username flag")
@@ -35,6 +38,8 @@ var (
 	ErrMissingPacketID                = errors.New("packet ID required for QoS > 0")
 	ErrInvalidPacketID                = errors.New("packet ID cannot be 0")
 	ErrInvalidReservedFlag            = errors.New("reserved flag bit must be 0")
+	ErrInvalidFixedHeaderFlags        = errors.New("fixed header flags must be 0000")
+	ErrInvalidPubrelFlags             = errors.New("pubrel fixed header flags must be 0010")
 	ErrInvalidPacketLength            = errors.New("packet length mismatch")
 	ErrInvalidDUPFlag                 = errors.New("DUP flag cannot be set for QoS 0")
 	ErrEmptyTopic                     = errors.New("topic cannot be empty")
@@ -66,9 +71,33 @@ var (
 	ErrInvalidPingrespLength          = errors.New("pingresp remaining length must be 0")
 	ErrRemainingLengthExceeded        = errors.New("remaining length exceeds maximum of 4 bytes")
 	ErrInvalidUTF8String              = errors.New("string must be valid UTF-8")
+	ErrNullCharacterInString          = errors.New("null character not allowed in string")
 	ErrEmptyTopicLevel                = errors.New("empty topic level not allowed")
 	ErrInvalidSingleLevelWildcard     = errors.New("single-level wildcard + must be alone in its level")
 	ErrInvalidMultiLevelWildcard      = errors.New("multi-level wildcard # must be alone in its level")
+	ErrBrokerOverloaded               = errors.New("broker is over its resource limits")
+	ErrInvalidWillFlags               = errors.New("will qos and will retain must be 0 when the will flag is 0")
+	ErrInvalidWillTopic               = errors.New("will topic is not a valid topic name")
+	ErrWillNotAllowed                 = errors.New("will qos or retain is not allowed by the broker")
+	ErrReservedTopic                  = errors.New("publishing to $ topics is not authorized")
+	ErrQoSNotSupported                = errors.New("qos is above the broker maximum")
+	ErrRetainNotSupported             = errors.New("retained messages are not available")
+	ErrInvalidDiscoveryConfig         = errors.New("invalid discovery config")
+	ErrMessageDropped                 = errors.New("message dropped by an interceptor")
+	ErrInvalidTransform               = errors.New("invalid transform")
+	ErrCorruptLogRecord               = errors.New("corrupt commit log record")
+	ErrInvalidTLSConfig               = errors.New("invalid tls config")
+	ErrCertificateMismatch            = errors.New("client certificate does not match the username")
+	ErrRateLimited                    = errors.New("publish rate limit exceeded")
+	ErrRateLimitsDisabled             = errors.New("rate limiting is not enabled")
+	ErrOfflineQueueDisabled           = errors.New("offline queue is not enabled")
+	ErrInflightWindowDisabled         = errors.New("in-flight window is not enabled")
+	ErrBridgeRefused                  = errors.New("upstream broker refused the bridge connection")
+	ErrBridgeProtocol                 = errors.New("unexpected packet from the upstream broker")
+	ErrInvalidEnvelope                = errors.New("invalid bridge envelope")
+	ErrWildcardsNotAvailable          = errors.New("wildcard subscriptions are not available")
+	ErrFilterDenied                   = errors.New("subscribing to the topic filter is not allowed")
+	ErrCorruptSpoolRecord             = errors.New("corrupt bridge spool record")
 )
 
 func (e *Err) Error() string {
@@ -8,3 +8,8 @@ func VerifyPasswd(hash, passwd string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd))
 	return err == nil
 }
+
+func HashPasswd(passwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+	return string(hash), err
+}